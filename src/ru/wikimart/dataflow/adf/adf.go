@@ -0,0 +1,315 @@
+// Package adf renders Atlassian Document Format documents, the rich text fields
+// of Jira Cloud such as the descriptions and the comments, as plain text,
+// slack mrkdwn or markdown (e.g. for Microsoft Teams).
+package adf
+
+import "fmt"
+import "strings"
+import "unicode/utf8"
+
+// Node is a node of a document, the document itself is the node of the doc type.
+type Node struct {
+	Type string `json:"type"`
+	Text string `json:"text,omitempty"`
+	Attrs map[string]interface{} `json:"attrs,omitempty"`
+	Marks []Mark `json:"marks,omitempty"`
+	Content []Node `json:"content,omitempty"`
+}
+
+// Mark is a text formatting, e.g. strong or link.
+type Mark struct {
+	Type string `json:"type"`
+	Attrs map[string]interface{} `json:"attrs,omitempty"`
+}
+
+func (n *Node) Attr(name string) string {
+	switch value := n.Attrs[name].(type) {
+	case string:
+		return value
+	case float64:
+		return fmt.Sprint(value)
+	}
+	return ""
+}
+
+func (m *Mark) Attr(name string) string {
+	value, _ := m.Attrs[name].(string)
+	return value
+}
+
+// dialect of the markup the document is rendered to
+type dialect struct {
+	escape func(text string) string
+	// slack needs its control characters escaped in the code too, markdown shows the code as is
+	escapeCode func(text string) string
+	strong string
+	em string
+	strike string
+	code string
+	link func(url string, text string) string
+	// markup of the headings, around the text
+	heading string
+	quote string
+}
+
+func verbatim(text string) string {
+	return text
+}
+
+var plain = &dialect {
+	escape: verbatim,
+	escapeCode: verbatim,
+	link: func(url string, text string) string {
+		if text == "" || text == url {
+			return url
+		}
+		return text + " (" + url + ")"
+	},
+}
+
+var slackEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+
+var slack = &dialect {
+	escape: slackEscaper.Replace,
+	escapeCode: slackEscaper.Replace,
+	strong: "*",
+	em: "_",
+	strike: "~",
+	code: "`",
+	link: func(url string, text string) string {
+		url = strings.NewReplacer("<", "%3C", ">", "%3E", "|", "%7C").Replace(url)
+		if text == "" {
+			return "<" + url + ">"
+		}
+		return "<" + url + "|" + text + ">"
+	},
+	heading: "*",
+	quote: ">",
+}
+
+var markdownEscaper = strings.NewReplacer("\\", "\\\\", "*", "\\*", "_", "\\_", "`", "\\`", "[", "\\[", "]", "\\]", "<", "&lt;", ">", "&gt;")
+
+var markdown = &dialect {
+	escape: markdownEscaper.Replace,
+	escapeCode: verbatim,
+	strong: "**",
+	em: "_",
+	strike: "~~",
+	code: "`",
+	link: func(url string, text string) string {
+		if text == "" {
+			text = url
+		}
+		return "[" + text + "](" + url + ")"
+	},
+	heading: "**",
+	quote: "> ",
+}
+
+type renderer struct {
+	dialect *dialect
+	builder strings.Builder
+}
+
+func (r *renderer) text(n *Node) {
+	text := n.Text
+	var link string
+	code := false
+	for _, mark := range n.Marks {
+		switch mark.Type {
+		case "code":
+			code = true
+		case "link":
+			link = mark.Attr("href")
+		}
+	}
+	if code {
+		text = r.dialect.escapeCode(text)
+	} else {
+		text = r.dialect.escape(text)
+	}
+
+	for _, mark := range n.Marks {
+		var wrap string
+		switch mark.Type {
+		case "strong":
+			wrap = r.dialect.strong
+		case "em":
+			wrap = r.dialect.em
+		case "strike":
+			wrap = r.dialect.strike
+		case "code":
+			wrap = r.dialect.code
+		}
+		// the markup does not work around spaces
+		if wrap != "" && strings.TrimSpace(text) == text && text != "" {
+			text = wrap + text + wrap
+		}
+	}
+
+	if link != "" {
+		text = r.dialect.link(link, text)
+	}
+	r.builder.WriteString(text)
+}
+
+func (r *renderer) inline(nodes []Node) string {
+	inner := &renderer { dialect: r.dialect }
+	for i := range nodes {
+		inner.node(&nodes[i], "")
+	}
+	return inner.builder.String()
+}
+
+// prefixes every line of the text, e.g. with the quote markup or the list indent
+func prefixLines(text string, first string, rest string) string {
+	lines := strings.Split(strings.TrimRight(text, "\n"), "\n")
+	for i := range lines {
+		if i == 0 {
+			lines[i] = first + lines[i]
+		} else {
+			lines[i] = rest + lines[i]
+		}
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+func (r *renderer) node(n *Node, indent string) {
+	switch n.Type {
+	case "text":
+		r.text(n)
+	case "hardBreak":
+		r.builder.WriteString("\n")
+	case "mention":
+		r.builder.WriteString(r.dialect.escape(n.Attr("text")))
+	case "emoji":
+		r.builder.WriteString(n.Attr("shortName"))
+	case "inlineCard", "blockCard", "embedCard":
+		r.builder.WriteString(r.dialect.link(n.Attr("url"), ""))
+	case "status":
+		r.builder.WriteString(r.dialect.escape("[" + n.Attr("text") + "]"))
+	case "date":
+		r.builder.WriteString(n.Attr("timestamp"))
+	case "paragraph":
+		r.builder.WriteString(r.inline(n.Content) + "\n")
+	case "heading":
+		text := r.inline(n.Content)
+		if r.dialect.heading != "" && text != "" {
+			text = r.dialect.heading + text + r.dialect.heading
+		}
+		r.builder.WriteString(text + "\n")
+	case "codeBlock":
+		var code strings.Builder
+		for _, child := range n.Content {
+			code.WriteString(r.dialect.escapeCode(child.Text))
+		}
+		if r.dialect.code == "" {
+			r.builder.WriteString(code.String() + "\n")
+		} else {
+			r.builder.WriteString("```\n" + strings.TrimRight(code.String(), "\n") + "\n```\n")
+		}
+	case "blockquote", "panel":
+		inner := &renderer { dialect: r.dialect }
+		for i := range n.Content {
+			inner.node(&n.Content[i], "")
+		}
+		r.builder.WriteString(prefixLines(inner.builder.String(), r.dialect.quote, r.dialect.quote))
+	case "bulletList", "orderedList":
+		order := 1
+		if start := n.Attr("order"); start != "" {
+			fmt.Sscan(start, &order)
+		}
+		for i := range n.Content {
+			bullet := "• "
+			if r.dialect == markdown {
+				bullet = "- "
+			}
+			if n.Type == "orderedList" {
+				bullet = fmt.Sprintf("%d. ", order + i)
+			}
+			inner := &renderer { dialect: r.dialect }
+			for j := range n.Content[i].Content {
+				inner.node(&n.Content[i].Content[j], indent + "  ")
+			}
+			r.builder.WriteString(prefixLines(inner.builder.String(), indent + bullet, indent + strings.Repeat(" ", utf8.RuneCountInString(bullet))))
+		}
+	case "rule":
+		r.builder.WriteString("———\n")
+	case "tableRow":
+		cells := make([]string, 0, len(n.Content))
+		for i := range n.Content {
+			cells = append(cells, strings.TrimSpace(r.inline(n.Content[i].Content)))
+		}
+		r.builder.WriteString(strings.Join(cells, " | ") + "\n")
+	default:
+		// doc, table, mediaSingle, the unknown nodes
+		for i := range n.Content {
+			r.node(&n.Content[i], indent)
+		}
+	}
+}
+
+func render(document *Node, d *dialect) string {
+	if document == nil {
+		return ""
+	}
+	r := &renderer { dialect: d }
+	r.node(document, "")
+	return strings.TrimSpace(r.builder.String())
+}
+
+// Plain renders the document as plain text.
+func Plain(document *Node) string {
+	return render(document, plain)
+}
+
+// Slack renders the document as slack mrkdwn.
+func Slack(document *Node) string {
+	return render(document, slack)
+}
+
+// Markdown renders the document as markdown, as understood by e.g. Microsoft Teams.
+func Markdown(document *Node) string {
+	return render(document, markdown)
+}
+
+// Truncate returns a copy of the document with at most the given number of text characters,
+// the cut text ends with an ellipsis. The markup of the rest stays valid.
+func Truncate(document *Node, limit int) *Node {
+	if document == nil {
+		return nil
+	}
+	budget := limit
+	truncated, _ := truncate(document, &budget)
+	return truncated
+}
+
+// the copy of the node within the budget, false once the budget is exhausted
+func truncate(n *Node, budget *int) (*Node, bool) {
+	copied := *n
+	copied.Content = nil
+
+	if n.Type == "text" {
+		length := utf8.RuneCountInString(n.Text)
+		if length <= *budget {
+			*budget -= length
+			return &copied, true
+		}
+		runes := []rune(n.Text)
+		copied.Text = strings.TrimRight(string(runes[:*budget]), " ") + "…"
+		*budget = 0
+		return &copied, false
+	}
+
+	for i := range n.Content {
+		if *budget <= 0 {
+			return &copied, false
+		}
+		child, more := truncate(&n.Content[i], budget)
+		copied.Content = append(copied.Content, *child)
+		if !more {
+			return &copied, false
+		}
+	}
+	return &copied, true
+}
@@ -0,0 +1,310 @@
+// end-to-end check of jiratohook: runs the binary against a fake jira and a fake slack,
+// posts the recorded payloads from the fixtures directory and compares the delivered messages
+package main
+
+import "bytes"
+import "encoding/json"
+import "flag"
+import "fmt"
+import "io"
+import "log"
+import "net"
+import "net/http"
+import "net/http/httptest"
+import "os"
+import "os/exec"
+import "path/filepath"
+import "strings"
+import "sync"
+import "time"
+
+// one scripted slack response
+type fakeResponse struct {
+	Status int
+	RetryAfter string
+}
+
+type slackMessage struct {
+	Text string `json:"text"`
+}
+
+// slack incoming webhook answering with the scripted responses, then with 200
+type fakeSlack struct {
+	mutex sync.Mutex
+	responses []fakeResponse
+	received []slackMessage
+	attempts int
+}
+
+func (s *fakeSlack) Script(responses ...fakeResponse) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.responses = responses
+	s.received = nil
+	s.attempts = 0
+}
+
+func (s *fakeSlack) ServeHTTP(response http.ResponseWriter, request *http.Request) {
+	body, _ := io.ReadAll(request.Body)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.attempts++
+
+	if len(s.responses) > 0 {
+		scripted := s.responses[0]
+		s.responses = s.responses[1:]
+		if scripted.RetryAfter != "" {
+			response.Header().Set("Retry-After", scripted.RetryAfter)
+		}
+		response.WriteHeader(scripted.Status)
+		fmt.Fprint(response, http.StatusText(scripted.Status))
+		return
+	}
+
+	var message slackMessage
+	if err := json.Unmarshal(body, &message); err != nil {
+		response.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(response, "invalid_payload")
+		return
+	}
+	s.received = append(s.received, message)
+	fmt.Fprint(response, "ok")
+}
+
+func (s *fakeSlack) State() ([]slackMessage, int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]slackMessage(nil), s.received...), s.attempts
+}
+
+// jira answering the webhook listing of the self-check
+func fakeJira(publicUrl *string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/rest/webhooks/1.0/webhook", func(response http.ResponseWriter, request *http.Request) {
+		response.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(response).Encode([]map[string]interface{} {
+			{
+				"name": "jiratohook",
+				"url": *publicUrl,
+				"events": []string { "jira:issue_updated" },
+				"enabled": true,
+			},
+		})
+	})
+	return mux
+}
+
+type testCase struct {
+	Name string
+	// payload file in the fixtures directory
+	Payload string
+	// file with the expected slack text, {jira} is replaced with the fake jira address;
+	// nothing must be delivered if empty
+	Expected string
+	Responses []fakeResponse
+	// attempts the delivery takes
+	Attempts int
+	Timeout time.Duration
+}
+
+var testCases = []testCase {
+	{
+		Name: "release is delivered after a rate limit",
+		Payload: "release.json",
+		Expected: "release.txt",
+		Responses: []fakeResponse { { Status: http.StatusTooManyRequests, RetryAfter: "1" } },
+		Attempts: 2,
+		Timeout: 10 * time.Second,
+	},
+	{
+		Name: "deploy is retried after a server error",
+		Payload: "deploy.json",
+		Expected: "deploy.txt",
+		Responses: []fakeResponse { { Status: http.StatusInternalServerError } },
+		Attempts: 2,
+		Timeout: 15 * time.Second,
+	},
+	{
+		Name: "long scope is truncated",
+		Payload: "scope.json",
+		Expected: "scope.txt",
+		Attempts: 1,
+		Timeout: 5 * time.Second,
+	},
+	{
+		Name: "sparse payload with a multiline summary is announced",
+		Payload: "sparse.json",
+		Expected: "sparse.txt",
+		Attempts: 1,
+		Timeout: 5 * time.Second,
+	},
+	{
+		Name: "rejected message is not retried",
+		Payload: "rollback.json",
+		Responses: []fakeResponse { { Status: http.StatusBadRequest } },
+		Attempts: 1,
+		Timeout: 3 * time.Second,
+	},
+	{
+		Name: "issue update without a transition is not announced",
+		Payload: "updated.json",
+		Attempts: 0,
+		Timeout: 2 * time.Second,
+	},
+}
+
+// free local address for the service
+// output of the service, written by the process while the checks read it
+type serviceOutput struct {
+	mutex sync.Mutex
+	buffer bytes.Buffer
+}
+
+func (o *serviceOutput) Write(data []byte) (int, error) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	return o.buffer.Write(data)
+}
+
+func (o *serviceOutput) String() string {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	return o.buffer.String()
+}
+
+func freeAddress() (string, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	defer listener.Close()
+	return listener.Addr().String(), nil
+}
+
+func waitReady(address string) error {
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		response, err := http.Get("http://" + address + "/schema")
+		if err == nil {
+			response.Body.Close()
+			return nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return fmt.Errorf("service at %s is not ready", address)
+}
+
+// with update the delivered text is written as the expected one
+func run(c testCase, fixtures string, address string, jiraUrl string, slack *fakeSlack, update bool) error {
+	payload, err := os.ReadFile(filepath.Join(fixtures, c.Payload))
+	if err != nil {
+		return err
+	}
+	expected := ""
+	if c.Expected != "" && !update {
+		data, err := os.ReadFile(filepath.Join(fixtures, c.Expected))
+		if err != nil {
+			return err
+		}
+		expected = strings.Replace(strings.TrimRight(string(data), "\n"), "{jira}", jiraUrl, -1)
+	}
+
+	slack.Script(c.Responses...)
+
+	response, err := http.Post("http://" + address + "/", "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("payload is answered with %s", response.Status)
+	}
+
+	deadline := time.Now().Add(c.Timeout)
+	for {
+		received, attempts := slack.State()
+		if update && c.Expected != "" && len(received) > 0 {
+			text := strings.Replace(received[0].Text, jiraUrl, "{jira}", -1)
+			return os.WriteFile(filepath.Join(fixtures, c.Expected), []byte(text + "\n"), 0644)
+		}
+		if expected != "" && len(received) > 0 {
+			if attempts != c.Attempts {
+				return fmt.Errorf("delivered in %d attempts instead of %d", attempts, c.Attempts)
+			}
+			if received[0].Text != expected {
+				return fmt.Errorf("unexpected text:\n%s\nexpected:\n%s", received[0].Text, expected)
+			}
+			return nil
+		}
+		if time.Now().After(deadline) {
+			if expected != "" || (update && c.Expected != "") {
+				return fmt.Errorf("nothing delivered in %s, %d attempts", c.Timeout, attempts)
+			}
+			if len(received) > 0 || attempts != c.Attempts {
+				return fmt.Errorf("%d messages delivered in %d attempts, expected %d attempts", len(received), attempts, c.Attempts)
+			}
+			return nil
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func main() {
+	binary := flag.String("binary", filepath.Join(os.Getenv("GOPATH"), "bin", "jiratohook"), "jiratohook binary to check")
+	fixtures := flag.String("fixtures", "fixtures", "directory with the payloads and the expected texts")
+	verbose := flag.Bool("v", false, "print the service log")
+	update := flag.Bool("update", false, "write the delivered texts as the expected ones")
+	flag.Parse()
+
+	address, err := freeAddress()
+	if err != nil {
+		log.Fatalf("error when choosing an address: %s\n", err)
+	}
+	publicUrl := "http://" + address
+
+	slack := &fakeSlack{}
+	slackServer := httptest.NewServer(slack)
+	defer slackServer.Close()
+	jiraServer := httptest.NewServer(fakeJira(&publicUrl))
+	defer jiraServer.Close()
+
+	serviceLog := &serviceOutput{}
+	service := exec.Command(*binary, "-self-check", "-public-url", publicUrl, jiraServer.URL, address, slackServer.URL + "/hook")
+	service.Stdout = serviceLog
+	service.Stderr = serviceLog
+	if err := service.Start(); err != nil {
+		log.Fatalf("error when starting %s: %s\n", *binary, err)
+	}
+	defer service.Process.Kill()
+
+	failed := 0
+	if err := waitReady(address); err != nil {
+		log.Printf("FAIL startup: %s\n", err)
+		failed++
+	} else {
+		for _, c := range testCases {
+			if err := run(c, *fixtures, address, jiraServer.URL, slack, *update); err != nil {
+				log.Printf("FAIL %s: %s\n", c.Name, err)
+				failed++
+			} else {
+				log.Printf("ok   %s\n", c.Name)
+			}
+		}
+
+		if !strings.Contains(serviceLog.String(), "self-check default: webhook \"jiratohook\" is registered") {
+			log.Printf("FAIL self-check against the fake jira\n")
+			failed++
+		} else {
+			log.Printf("ok   self-check against the fake jira\n")
+		}
+	}
+
+	if *verbose || failed > 0 {
+		os.Stderr.WriteString(serviceLog.String())
+	}
+	if failed > 0 {
+		service.Process.Kill()
+		log.Fatalf("%d check(s) failed\n", failed)
+	}
+}
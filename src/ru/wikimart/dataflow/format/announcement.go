@@ -0,0 +1,284 @@
+// Package format describes the announcements of the Jira transitions
+// and renders them as slack markup, html or plain text.
+// All the functions are pure: the output depends on the arguments only.
+package format
+
+import "fmt"
+import "sort"
+import "strings"
+import "time"
+import "unicode/utf8"
+
+import "ru/wikimart/dataflow/adf"
+
+// it we have more non-md issues, than this const, cut the rest of them and put a short summary as the last issue
+const MAX_NON_MD_ISSUES = 10
+
+type Issue struct {
+	Key string
+	Summary string
+	Url string
+	Priority string
+	PriorityRank int
+	// header of the group the issue is listed under, if the rule groups the issues
+	Group string
+}
+
+// number of the scope issues of one project
+type Project struct {
+	Project string
+	Count int
+	Url string
+}
+
+// short summary line put after the listed issues, e.g. "...and other 5 issue(s): 3 SHOP, 2 PAY"
+type More struct {
+	Lead string
+	Text string
+	Url string
+	Projects []Project
+	// the issue search of the jira instance, the links of the rules with their own scope jql point there
+	SearchUrl string
+}
+
+// Attachment is a file added to the issue.
+type Attachment struct {
+	Name string
+	Url string
+	// bytes, zero if unknown
+	Size int64
+}
+
+// Mentions of the escalated announcements: the members of the channel who are online, or all of them.
+const (
+	MENTION_HERE = "here"
+	MENTION_CHANNEL = "channel"
+)
+
+// Field is a labelled value shown under the first line of the message, the rule picks them.
+type Field struct {
+	Label string
+	Value string
+}
+
+// Build is a ci build or deployment of the announced issues.
+type Build struct {
+	Name string
+	Url string
+	// set for the deployments
+	Environment string
+}
+
+// Announcement is a destination-independent description of a message,
+// every destination renders it in its own format.
+type Announcement struct {
+	// webhook event of the announcements other than transitions, e.g. attachment_created
+	Event string
+	Transition string
+	Status string
+	Instance string
+	Project string
+	// request type of the jira service management requests, e.g. "Get IT help"
+	RequestType string
+	Emoji string
+	Action string
+	Issue Issue
+	Issues []Issue
+	More *More
+	// plain text description of the announced issue, or the comment of the transition
+	Description string
+	// the same as a document, for the rich text from Jira Cloud
+	Document *adf.Node
+	// part of the description shown, set by the rule, and the same in slack mrkdwn if rich
+	Excerpt string
+	ExcerptSlack string
+	// files added to the issue
+	Attachments []Attachment
+	// total time logged on the issue, e.g. 12h 30m
+	TimeSpent string
+	// who made the transition, and their slack user id if they are mapped
+	Actor string
+	ActorMention string
+	// when the event happened, formatted in the configured zone
+	Time string
+	// how late the delivery is, set for the deliveries delayed by the queue backlog only
+	Late time.Duration
+	// transitions coalesced into this announcement, the last one is the announced one
+	Coalesced []string
+	// identical messages collapsed into this one by the destination, counted if more than one
+	Repeats int
+	// when the webhook was received, for the delivery latency
+	Received time.Time
+	// deployment metadata from the issue properties
+	Metadata map[string]string
+	// e.g. staging or prod
+	Environment string
+	// display name of the assignee of the announced issue and its fix version names
+	Assignee string
+	FixVersions []string
+	// labels, creator name, account id, email and display name of the announced issue,
+	// for the rules skipping some of the issues
+	Labels []string
+	Creator []string
+	// the issues and the summary line listed without the links of the given types, for the rules skipping
+	// some of the link types; nil if the issues are not listed from the links
+	Relist func(excludedLinkTypes []string) ([]Issue, *More) `json:"-"`
+	// fields shown under the first line in the order of the rule, on one line if inline
+	Fields []Field
+	FieldsInline bool
+	// ci builds of the issue and of the listed issues, the latest first
+	Builds []Build
+	// who is on call for the project of the rollback, and their slack user id if they are mapped
+	OnCall string
+	OnCallMention string
+	// ids of the announced payloads in the outbox of the service
+	OutboxIds []string
+	// MENTION_HERE or MENTION_CHANNEL put before the message, set by the escalation of the rule
+	Mention string
+	// emoji to react with to the earlier message about the issue instead of a new one, set by the rule
+	Reaction string
+	// overrides of the slack incoming webhook settings, set by the rule
+	Channel string
+	Username string
+	IconUrl string
+}
+
+// Action gives the emoji and the action text for the transition.
+func Action(transition string, toStatus string) (string, string) {
+	switch transition {
+	case "Release":
+		return ":slinky:", "issue released"
+	case "Deploy":
+		return ":+1::skin-tone-6:", "issue deployed"
+	case "Rollback":
+		return ":slinky2:", "issue rollbacked"
+	}
+	return ":arrow_right:", fmt.Sprintf("issue moved to %s", toStatus)
+}
+
+// IssueProject gives the project key of the issue, e.g. QA for QA-123.
+func IssueProject(key string) string {
+	if i := strings.Index(key, "-"); i >= 0 {
+		return key[:i]
+	}
+	return key
+}
+
+// IsMd tells the migration (MD project) issues, which are always listed.
+func IsMd(key string) bool {
+	return strings.HasPrefix(key, "MD-")
+}
+
+// CountProjects counts the issues by project, the largest projects go first.
+// projectUrl gives the link to the scope issues of a project.
+func CountProjects(issues []Issue, projectUrl func(project string) string) []Project {
+	counts := map[string]int{}
+	for _, issue := range issues {
+		counts[IssueProject(issue.Key)]++
+	}
+
+	projects := make([]Project, 0, len(counts))
+	for project, count := range counts {
+		projects = append(projects, Project {
+			Project: project,
+			Count: count,
+			Url: projectUrl(project),
+		})
+	}
+	sort.Slice(projects, func(i, j int) bool {
+		if projects[i].Count != projects[j].Count {
+			return projects[i].Count > projects[j].Count
+		}
+		return projects[i].Project < projects[j].Project
+	})
+	return projects
+}
+
+// ListIssues chooses the linked issues to list and the summary line after them.
+// If there are MD issues, only they are listed and the rest of the scope is summarized,
+// otherwise the scope is listed up to MAX_NON_MD_ISSUES.
+func ListIssues(mdIssues []Issue, nonMdIssues []Issue, scopeUrl string, projectUrl func(project string) string) ([]Issue, *More) {
+	if len(mdIssues) > 0 {
+		if len(nonMdIssues) == 0 {
+			return mdIssues, nil
+		}
+		return mdIssues, &More {
+			Lead: "with",
+			Text: fmt.Sprintf("%d issue(s) in scope", len(nonMdIssues)),
+			Url: scopeUrl,
+			Projects: CountProjects(nonMdIssues, projectUrl),
+		}
+	}
+
+	// if there's just one more issue, just print it as well
+	if len(nonMdIssues) <= MAX_NON_MD_ISSUES + 1 {
+		return nonMdIssues, nil
+	}
+
+	return nonMdIssues[:MAX_NON_MD_ISSUES], &More {
+		Lead: "and",
+		Text: fmt.Sprintf("other %d issue(s)", len(nonMdIssues) - MAX_NON_MD_ISSUES),
+		Url: scopeUrl,
+		Projects: CountProjects(nonMdIssues[MAX_NON_MD_ISSUES:], projectUrl),
+	}
+}
+
+// TruncateRunes shortens the text to the given number of runes with an ellipsis, zero means no limit.
+func TruncateRunes(text string, limit int) string {
+	if limit <= 0 || utf8.RuneCountInString(text) <= limit {
+		return text
+	}
+
+	runes := []rune(text)
+	return strings.TrimRight(string(runes[:limit - 1]), " ") + "…"
+}
+
+// TruncateSummaries shortens the summaries of the announced issues.
+func (a *Announcement) TruncateSummaries(limit int) {
+	a.Issue.Summary = TruncateRunes(a.Issue.Summary, limit)
+	for i := range a.Issues {
+		a.Issues[i].Summary = TruncateRunes(a.Issues[i].Summary, limit)
+	}
+}
+
+// Metadata renders the metadata as "build: 42, environment: prod", sorted by name.
+func Metadata(values map[string]string) string {
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	parts := make([]string, 0, len(names))
+	for _, name := range names {
+		parts = append(parts, name + ": " + values[name])
+	}
+	return strings.Join(parts, ", ")
+}
+
+// FileSize formats a file size, e.g. 12.3 KB.
+func FileSize(size int64) string {
+	if size < 1024 {
+		return fmt.Sprintf("%d B", size)
+	}
+	value := float64(size) / 1024
+	for _, unit := range []string { "KB", "MB", "GB" } {
+		if value < 1024 || unit == "GB" {
+			return fmt.Sprintf("%.1f %s", value, unit)
+		}
+		value = value / 1024
+	}
+	return ""
+}
+
+// Hours formats seconds as hours and minutes, e.g. 12h 30m; the days are not used, their length depends on the Jira settings.
+func Hours(seconds int64) string {
+	minutes := seconds / 60
+	switch {
+	case minutes < 60:
+		return fmt.Sprintf("%dm", minutes)
+	case minutes % 60 == 0:
+		return fmt.Sprintf("%dh", minutes / 60)
+	}
+	return fmt.Sprintf("%dh %dm", minutes / 60, minutes % 60)
+}
@@ -0,0 +1,498 @@
+package format
+
+import "fmt"
+import "html"
+import "strings"
+import "unicode"
+import "unicode/utf8"
+
+// payload texts may carry line breaks and invalid utf-8, which would break the message layout
+func clean(text string) string {
+	if isClean(text) {
+		// most of the texts are, and they are not copied then
+		return text
+	}
+	text = strings.ToValidUTF8(text, "\uFFFD")
+	return strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return ' '
+		}
+		return r
+	}, text)
+}
+
+func isClean(text string) bool {
+	for _, r := range text {
+		if r == utf8.RuneError || unicode.IsControl(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// escapes the slack control characters in a text
+var slackEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+
+// a url must not break the <url|text> markup
+var slackUrlEscaper = strings.NewReplacer("&", "&amp;", "<", "%3C", ">", "%3E", "|", "%7C")
+
+// SlackEscape escapes the slack control characters in a text.
+func SlackEscape(text string) string {
+	return slackEscaper.Replace(clean(text))
+}
+
+// SlackLink renders a <url|text> link.
+func SlackLink(url string, text string) string {
+	var link strings.Builder
+	writeSlackLink(&link, url, text)
+	return link.String()
+}
+
+func writeSlackLink(link *strings.Builder, url string, text string) {
+	link.WriteString("<")
+	slackUrlEscaper.WriteString(link, clean(url))
+	link.WriteString("|")
+	slackEscaper.WriteString(link, clean(text))
+	link.WriteString(">")
+}
+
+// the word joiner after the @ keeps a mention reading the same, and notifying nobody
+const mentionBreak = "\u2060"
+
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_'
+}
+
+// DisarmMentions breaks the mentions of everyone written in the payload texts, e.g. "@all" for rocket.chat
+// or "@room" for matrix, which are plain text to the other formats; a mention within a word, e.g. of an email, is kept.
+func DisarmMentions(text string, mentions ...string) string {
+	for _, mention := range mentions {
+		if !strings.Contains(text, mention) {
+			continue
+		}
+		var disarmed strings.Builder
+		start := 0
+		for offset := 0; ; {
+			i := strings.Index(text[offset:], mention)
+			if i < 0 {
+				break
+			}
+			i += offset
+			end := i + len(mention)
+			before, _ := utf8.DecodeLastRuneInString(text[:i])
+			after, _ := utf8.DecodeRuneInString(text[end:])
+			// the dots and the dashes belong to the names and the emails before the @, end a sentence after it
+			if !isWordRune(before) && before != '.' && before != '-' && !isWordRune(after) {
+				disarmed.WriteString(text[start:i + 1])
+				disarmed.WriteString(mentionBreak)
+				start = i + 1
+			}
+			offset = end
+		}
+		disarmed.WriteString(text[start:])
+		text = disarmed.String()
+	}
+	return text
+}
+
+func htmlEscape(text string) string {
+	return html.EscapeString(clean(text))
+}
+
+func htmlLink(url string, text string) string {
+	var link strings.Builder
+	writeHtmlLink(&link, url, text)
+	return link.String()
+}
+
+func writeHtmlLink(link *strings.Builder, url string, text string) {
+	link.WriteString("<a href=\"")
+	link.WriteString(htmlEscape(url))
+	link.WriteString("\">")
+	link.WriteString(htmlEscape(text))
+	link.WriteString("</a>")
+}
+
+func plainLink(url string, text string) string {
+	return clean(text)
+}
+
+// escapes the markdown control characters in a text
+var markdownEscaper = strings.NewReplacer("\\", "\\\\", "*", "\\*", "_", "\\_", "`", "\\`", "[", "\\[", "]", "\\]", "#", "\\#", "~", "\\~")
+
+// a url must not break the [text](url) markup
+var markdownUrlEscaper = strings.NewReplacer("(", "%28", ")", "%29", " ", "%20")
+
+func markdownEscape(text string) string {
+	return markdownEscaper.Replace(clean(text))
+}
+
+func markdownLink(url string, text string) string {
+	var link strings.Builder
+	writeMarkdownLink(&link, url, text)
+	return link.String()
+}
+
+func writeMarkdownLink(link *strings.Builder, url string, text string) {
+	link.WriteString("[")
+	markdownEscaper.WriteString(link, clean(text))
+	link.WriteString("](")
+	markdownUrlEscaper.WriteString(link, clean(url))
+	link.WriteString(")")
+}
+
+// writes the summary between the given markup, nothing for the issues without one, e.g. hidden by the field configuration
+func writeSummary(text *strings.Builder, summary string, before string, after string, escape func(text string) string) {
+	if strings.TrimSpace(summary) == "" {
+		return
+	}
+	text.WriteString(before)
+	text.WriteString(escape(summary))
+	text.WriteString(after)
+}
+
+// room for the header and the listed issues, so that the builder does not grow again and again
+func (a *Announcement) sizeHint() int {
+	return 256 + len(a.Excerpt) + len(a.Issues) * 128
+}
+
+// "8 SHOP, 4 PAY" with the given link markup
+func (m *More) projectsText(link func(url string, text string) string) string {
+	parts := make([]string, 0, len(m.Projects))
+	for _, project := range m.Projects {
+		parts = append(parts, link(project.Url, fmt.Sprintf("%d %s", project.Count, project.Project)))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// " (12.3 KB)", nothing if the size is unknown
+func attachmentSize(attachment Attachment) string {
+	if attachment.Size <= 0 {
+		return ""
+	}
+	return fmt.Sprintf(" (%s)", FileSize(attachment.Size))
+}
+
+// the fields, a line each or all of them on one line, the labels between open and close
+func (a *Announcement) fieldLines(open string, close string, escape func(string) string) []string {
+	lines := make([]string, 0, len(a.Fields))
+	for _, field := range a.Fields {
+		if field.Label == "" {
+			lines = append(lines, escape(field.Value))
+		} else {
+			lines = append(lines, open + escape(field.Label) + close + escape(field.Value))
+		}
+	}
+	if a.FieldsInline && len(lines) > 0 {
+		return []string { strings.Join(lines, " · ") }
+	}
+	return lines
+}
+
+// " (staging)", nothing for the builds other than deployments
+func buildEnvironment(build Build) string {
+	if build.Environment == "" {
+		return ""
+	}
+	return fmt.Sprintf(" (%s)", build.Environment)
+}
+
+// prefixes every line of a multiline text with the quote markup
+func quote(text string, prefix string) string {
+	return prefix + strings.Replace(text, "\n", "\n" + prefix, -1)
+}
+
+// SlackText renders the announcement with slack markup.
+func (a *Announcement) SlackText() string {
+	var text strings.Builder
+	text.Grow(a.sizeHint())
+
+	if a.Mention != "" {
+		fmt.Fprintf(&text, "<!%s> ", a.Mention)
+	}
+	// base text about the root issue
+	fmt.Fprintf(&text, "%s %s: *%s*", a.Emoji, SlackEscape(a.Action), SlackLink(a.Issue.Url, a.Issue.Key))
+	writeSummary(&text, a.Issue.Summary, " (_", "_)", SlackEscape)
+	if a.ActorMention != "" {
+		fmt.Fprintf(&text, " by <@%s>", a.ActorMention)
+	} else if a.Actor != "" {
+		fmt.Fprintf(&text, " by %s", SlackEscape(a.Actor))
+	}
+	if a.Time != "" {
+		fmt.Fprintf(&text, " at %s", SlackEscape(a.Time))
+	}
+	if a.Late > 0 {
+		fmt.Fprintf(&text, " :warning: _delivered %s late_", a.Late)
+	}
+	if len(a.Coalesced) > 0 {
+		fmt.Fprintf(&text, " after %s", SlackEscape(strings.Join(a.Coalesced, " → ")))
+	}
+	if a.Repeats > 1 {
+		fmt.Fprintf(&text, " (×%d)", a.Repeats)
+	}
+	for _, line := range a.fieldLines("*", ":* ", SlackEscape) {
+		text.WriteString("\n" + line)
+	}
+	if a.TimeSpent != "" {
+		fmt.Fprintf(&text, "\n:stopwatch: _%s spent in total_", SlackEscape(a.TimeSpent))
+	}
+	for _, attachment := range a.Attachments {
+		fmt.Fprintf(&text, "\n:paperclip: %s%s", SlackLink(attachment.Url, attachment.Name), attachmentSize(attachment))
+	}
+	if a.ExcerptSlack != "" {
+		text.WriteString("\n" + quote(a.ExcerptSlack, ">"))
+	} else if a.Excerpt != "" {
+		// the lines are escaped one by one, the escaping would join them
+		lines := strings.Split(a.Excerpt, "\n")
+		for i := range lines {
+			lines[i] = SlackEscape(lines[i])
+		}
+		text.WriteString("\n" + quote(strings.Join(lines, "\n"), ">"))
+	}
+	if len(a.Metadata) > 0 {
+		fmt.Fprintf(&text, "\n_%s_", SlackEscape(Metadata(a.Metadata)))
+	}
+	for _, build := range a.Builds {
+		fmt.Fprintf(&text, "\n:hammer_and_wrench: %s%s", SlackLink(build.Url, build.Name), SlackEscape(buildEnvironment(build)))
+	}
+	if a.OnCallMention != "" {
+		fmt.Fprintf(&text, "\n:pager: on call: <@%s>", a.OnCallMention)
+	} else if a.OnCall != "" {
+		fmt.Fprintf(&text, "\n:pager: on call: %s", SlackEscape(a.OnCall))
+	}
+
+	group := ""
+	for _, issue := range a.Issues {
+		if issue.Group != group {
+			group = issue.Group
+			text.WriteString("\n*" + SlackEscape(group) + "*")
+		}
+		text.WriteString("\n- *")
+		writeSlackLink(&text, issue.Url, issue.Key)
+		text.WriteString("*")
+		writeSummary(&text, issue.Summary, " (_", "_)", SlackEscape)
+	}
+
+	if a.More != nil {
+		fmt.Fprintf(&text, "\n- ...%s %s", a.More.Lead, SlackLink(a.More.Url, a.More.Text))
+		if len(a.More.Projects) > 0 {
+			text.WriteString(": " + a.More.projectsText(SlackLink))
+		}
+	}
+
+	return text.String()
+}
+
+// MarkdownText renders the announcement with markdown, e.g. for zulip or webex.
+func (a *Announcement) MarkdownText() string {
+	var text strings.Builder
+	text.Grow(a.sizeHint())
+
+	fmt.Fprintf(&text, "%s %s: **%s**", a.Emoji, markdownEscape(a.Action), markdownLink(a.Issue.Url, a.Issue.Key))
+	writeSummary(&text, a.Issue.Summary, " (*", "*)", markdownEscape)
+	if a.Actor != "" {
+		fmt.Fprintf(&text, " by %s", markdownEscape(a.Actor))
+	}
+	if a.Time != "" {
+		fmt.Fprintf(&text, " at %s", markdownEscape(a.Time))
+	}
+	if a.Late > 0 {
+		fmt.Fprintf(&text, " :warning: *delivered %s late*", a.Late)
+	}
+	if len(a.Coalesced) > 0 {
+		fmt.Fprintf(&text, " after %s", markdownEscape(strings.Join(a.Coalesced, " → ")))
+	}
+	if a.Repeats > 1 {
+		fmt.Fprintf(&text, " (×%d)", a.Repeats)
+	}
+	for _, line := range a.fieldLines("**", ":** ", markdownEscape) {
+		text.WriteString("\n\n" + line)
+	}
+	if a.TimeSpent != "" {
+		fmt.Fprintf(&text, "\n\n:stopwatch: *%s spent in total*", markdownEscape(a.TimeSpent))
+	}
+	for _, attachment := range a.Attachments {
+		fmt.Fprintf(&text, "\n\n:paperclip: %s%s", markdownLink(attachment.Url, attachment.Name), attachmentSize(attachment))
+	}
+	if a.Excerpt != "" {
+		lines := strings.Split(a.Excerpt, "\n")
+		for i := range lines {
+			lines[i] = markdownEscape(lines[i])
+		}
+		text.WriteString("\n\n" + quote(strings.Join(lines, "\n"), "> "))
+	}
+	if len(a.Metadata) > 0 {
+		fmt.Fprintf(&text, "\n\n*%s*", markdownEscape(Metadata(a.Metadata)))
+	}
+	for _, build := range a.Builds {
+		fmt.Fprintf(&text, "\n\n:hammer_and_wrench: %s%s", markdownLink(build.Url, build.Name), markdownEscape(buildEnvironment(build)))
+	}
+	if a.OnCall != "" {
+		fmt.Fprintf(&text, "\n\n:pager: on call: %s", markdownEscape(a.OnCall))
+	}
+
+	if len(a.Issues) > 0 || a.More != nil {
+		text.WriteString("\n")
+	}
+	group := ""
+	for _, issue := range a.Issues {
+		if issue.Group != group {
+			group = issue.Group
+			text.WriteString("\n\n**" + markdownEscape(group) + "**\n")
+		}
+		text.WriteString("\n- **")
+		writeMarkdownLink(&text, issue.Url, issue.Key)
+		text.WriteString("**")
+		writeSummary(&text, issue.Summary, " (*", "*)", markdownEscape)
+	}
+
+	if a.More != nil {
+		fmt.Fprintf(&text, "\n- ...%s %s", markdownEscape(a.More.Lead), markdownLink(a.More.Url, a.More.Text))
+		if len(a.More.Projects) > 0 {
+			text.WriteString(": " + a.More.projectsText(markdownLink))
+		}
+	}
+
+	return text.String()
+}
+
+// HtmlText renders the announcement as an html fragment, emoji are omitted.
+func (a *Announcement) HtmlText() string {
+	var text strings.Builder
+	text.Grow(a.sizeHint())
+
+	fmt.Fprintf(&text, "<p>%s: <strong>%s</strong>", htmlEscape(a.Action), htmlLink(a.Issue.Url, a.Issue.Key))
+	writeSummary(&text, a.Issue.Summary, " (<em>", "</em>)", htmlEscape)
+	if a.Actor != "" {
+		fmt.Fprintf(&text, " by %s", htmlEscape(a.Actor))
+	}
+	if a.Time != "" {
+		fmt.Fprintf(&text, " at %s", htmlEscape(a.Time))
+	}
+	if a.Late > 0 {
+		fmt.Fprintf(&text, " <strong>delivered %s late</strong>", a.Late)
+	}
+	if len(a.Coalesced) > 0 {
+		fmt.Fprintf(&text, " after %s", htmlEscape(strings.Join(a.Coalesced, " → ")))
+	}
+	if a.Repeats > 1 {
+		fmt.Fprintf(&text, " (×%d)", a.Repeats)
+	}
+	text.WriteString("</p>")
+	for _, line := range a.fieldLines("<strong>", ":</strong> ", htmlEscape) {
+		text.WriteString("<p>" + line + "</p>")
+	}
+	if a.TimeSpent != "" {
+		fmt.Fprintf(&text, "<p><em>%s spent in total</em></p>", htmlEscape(a.TimeSpent))
+	}
+	for _, attachment := range a.Attachments {
+		fmt.Fprintf(&text, "<p>%s%s</p>", htmlLink(attachment.Url, attachment.Name), htmlEscape(attachmentSize(attachment)))
+	}
+	if a.Excerpt != "" {
+		fmt.Fprintf(&text, "<blockquote>%s</blockquote>", htmlEscape(a.Excerpt))
+	}
+	if len(a.Metadata) > 0 {
+		fmt.Fprintf(&text, "<p><em>%s</em></p>", htmlEscape(Metadata(a.Metadata)))
+	}
+	for _, build := range a.Builds {
+		fmt.Fprintf(&text, "<p>%s%s</p>", htmlLink(build.Url, build.Name), htmlEscape(buildEnvironment(build)))
+	}
+	if a.OnCall != "" {
+		fmt.Fprintf(&text, "<p>on call: %s</p>", htmlEscape(a.OnCall))
+	}
+
+	if len(a.Issues) > 0 || a.More != nil {
+		text.WriteString("<ul>")
+		group := ""
+		for _, issue := range a.Issues {
+			if issue.Group != group {
+				group = issue.Group
+				text.WriteString("<li><strong>" + htmlEscape(group) + "</strong></li>")
+			}
+			text.WriteString("<li><strong>")
+			writeHtmlLink(&text, issue.Url, issue.Key)
+			text.WriteString("</strong>")
+			writeSummary(&text, issue.Summary, " (<em>", "</em>)", htmlEscape)
+			text.WriteString("</li>")
+		}
+		if a.More != nil {
+			fmt.Fprintf(&text, "<li>...%s %s", htmlEscape(a.More.Lead), htmlLink(a.More.Url, a.More.Text))
+			if len(a.More.Projects) > 0 {
+				text.WriteString(": " + a.More.projectsText(htmlLink))
+			}
+			text.WriteString("</li>")
+		}
+		text.WriteString("</ul>")
+	}
+
+	return text.String()
+}
+
+// PlainText renders the announcement as plain text without any markup.
+func (a *Announcement) PlainText() string {
+	var text strings.Builder
+	text.Grow(a.sizeHint())
+
+	fmt.Fprintf(&text, "%s: %s", clean(a.Action), clean(a.Issue.Key))
+	writeSummary(&text, a.Issue.Summary, " (", ")", clean)
+	if a.Actor != "" {
+		fmt.Fprintf(&text, " by %s", clean(a.Actor))
+	}
+	if a.Time != "" {
+		fmt.Fprintf(&text, " at %s", clean(a.Time))
+	}
+	if a.Late > 0 {
+		fmt.Fprintf(&text, " (delivered %s late)", a.Late)
+	}
+	if len(a.Coalesced) > 0 {
+		fmt.Fprintf(&text, " after %s", clean(strings.Join(a.Coalesced, " → ")))
+	}
+	if a.Repeats > 1 {
+		fmt.Fprintf(&text, " (×%d)", a.Repeats)
+	}
+	for _, line := range a.fieldLines("", ": ", clean) {
+		text.WriteString("\n" + line)
+	}
+	if a.TimeSpent != "" {
+		fmt.Fprintf(&text, "\n%s spent in total", clean(a.TimeSpent))
+	}
+	for _, attachment := range a.Attachments {
+		fmt.Fprintf(&text, "\n%s%s %s", clean(attachment.Name), attachmentSize(attachment), clean(attachment.Url))
+	}
+	if a.Excerpt != "" {
+		lines := strings.Split(a.Excerpt, "\n")
+		for i := range lines {
+			lines[i] = clean(lines[i])
+		}
+		text.WriteString("\n" + quote(strings.Join(lines, "\n"), "> "))
+	}
+	if len(a.Metadata) > 0 {
+		text.WriteString("\n" + clean(Metadata(a.Metadata)))
+	}
+	for _, build := range a.Builds {
+		fmt.Fprintf(&text, "\n%s%s %s", clean(build.Name), clean(buildEnvironment(build)), clean(build.Url))
+	}
+	if a.OnCall != "" {
+		text.WriteString("\non call: " + clean(a.OnCall))
+	}
+
+	group := ""
+	for _, issue := range a.Issues {
+		if issue.Group != group {
+			group = issue.Group
+			text.WriteString("\n" + clean(group) + ":")
+		}
+		text.WriteString("\n- ")
+		text.WriteString(clean(issue.Key))
+		writeSummary(&text, issue.Summary, " (", ")", clean)
+	}
+
+	if a.More != nil {
+		fmt.Fprintf(&text, "\n- ...%s %s", clean(a.More.Lead), clean(a.More.Text))
+		if len(a.More.Projects) > 0 {
+			text.WriteString(": " + a.More.projectsText(plainLink))
+		}
+	}
+
+	return text.String()
+}
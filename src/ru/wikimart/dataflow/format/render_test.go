@@ -0,0 +1,275 @@
+package format
+
+import "flag"
+import "fmt"
+import "os"
+import "path/filepath"
+import "strings"
+import "testing"
+import "unicode/utf8"
+
+// go test ru/wikimart/dataflow/format -update rewrites the golden files with the current output
+var update = flag.Bool("update", false, "rewrite the golden files of testdata")
+
+func projectUrl(project string) string {
+	return "https://jira.example.com/issues/?jql=project%20%3D%20" + project
+}
+
+func issues(project string, count int, group string) []Issue {
+	list := make([]Issue, 0, count)
+	for i := 1; i <= count; i++ {
+		key := fmt.Sprintf("%s-%d", project, i)
+		list = append(list, Issue {
+			Key: key,
+			Summary: fmt.Sprintf("summary of %s", key),
+			Url: "https://jira.example.com/browse/" + key,
+			Group: group,
+		})
+	}
+	return list
+}
+
+func release(transition string, status string) *Announcement {
+	emoji, action := Action(transition, status)
+	return &Announcement {
+		Transition: transition,
+		Emoji: emoji,
+		Action: action,
+		Issue: Issue { Key: "REL-7", Summary: "Release 2.4", Url: "https://jira.example.com/browse/REL-7" },
+	}
+}
+
+// the md issues are listed, grouped, and the rest of the scope is summarized by project
+func mdGrouping() *Announcement {
+	a := release("Release", "Released")
+	md := issues("MD", 3, "Migrations")
+	md[2].Group = "Rollbacks"
+	nonMd := append(append(issues("SHOP", 3, ""), issues("PAY", 2, "")...), issues("CRM", 3, "")...)
+	a.Issues, a.More = ListIssues(md, nonMd, "https://jira.example.com/issues/?jql=fixVersion%20%3D%202.4", projectUrl)
+	return a
+}
+
+// the scope over MAX_NON_MD_ISSUES is cut, the long summaries are shortened
+func truncation() *Announcement {
+	a := release("Deploy", "Deployed")
+	a.Issue.Summary = "A release of the checkout, the payments and the delivery estimates for the new regions"
+	scope := append(issues("SHOP", 9, ""), issues("PAY", 4, "")...)
+	scope[0].Summary = "Checkout fails for the carts with more than a hundred items in them"
+	a.Issues, a.More = ListIssues(nil, scope, "https://jira.example.com/issues/?jql=fixVersion%20%3D%202.4", projectUrl)
+	a.TruncateSummaries(40)
+	return a
+}
+
+// the emoji of the transitions, the wide characters of the summaries and the mentions
+func emoji() *Announcement {
+	a := release("Rollback", "Rolled back")
+	a.Issue.Summary = "Откат 🚀 релиза «2.4»"
+	a.ActorMention, a.Actor = "U024BE7LH", "Jane Doe"
+	a.Time = "12:30 MSK"
+	a.Coalesced = []string { "Deploy", "Rollback" }
+	a.Repeats = 3
+	a.TimeSpent = "12h 30m"
+	a.Mention = MENTION_HERE
+	a.OnCall, a.OnCallMention = "John Roe", "U0G9QF9C6"
+	a.Issues = []Issue { { Key: "SHOP-1", Summary: "Корзина ✨ пустеет", Url: "https://jira.example.com/browse/SHOP-1" } }
+	return a
+}
+
+// the markup characters, the control characters and the invalid utf-8 of the payloads
+func escaping() *Announcement {
+	a := release("Review", "In <Review> & *QA*")
+	a.Issue.Summary = "Fix <script> & `code`_in_ [brackets] #1 ~x~ a|b"
+	a.Issue.Url = "https://jira.example.com/browse/REL-7?a=1&b=<2>|(3)"
+	a.Actor = "O'Brien <ob@example.com>"
+	a.Excerpt = "first *line* <b>\nsecond _line_ & more\n\tthird\x00line \xff"
+	a.Fields = []Field { { Label: "Fix <version>", Value: "2.4 & 2.5" }, { Value: "no *label*" } }
+	a.Attachments = []Attachment { { Name: "log [1].txt", Url: "https://files.example.com/log (1).txt", Size: 12345 } }
+	a.Metadata = map[string]string { "build": "42", "environment": "prod_eu" }
+	a.Builds = []Build { { Name: "deploy #42", Url: "https://ci.example.com/42", Environment: "prod" } }
+	a.Issues = []Issue { { Key: "SHOP-1", Summary: "line\nbreak\rand\x07bell", Url: "https://jira.example.com/browse/SHOP-1", Group: "<b>Group</b> *1*" } }
+	return a
+}
+
+var goldenCases = []struct {
+	name string
+	announcement func() *Announcement
+}{
+	{ "md-grouping", mdGrouping },
+	{ "truncation", truncation },
+	{ "emoji", emoji },
+	{ "escaping", escaping },
+}
+
+var goldenFormats = []struct {
+	extension string
+	render func(a *Announcement) string
+}{
+	{ "slack", (*Announcement).SlackText },
+	{ "md", (*Announcement).MarkdownText },
+	{ "html", (*Announcement).HtmlText },
+	{ "txt", (*Announcement).PlainText },
+}
+
+func TestGolden(t *testing.T) {
+	for _, c := range goldenCases {
+		for _, f := range goldenFormats {
+			path := filepath.Join("testdata", c.name + "." + f.extension + ".golden")
+			t.Run(c.name + "/" + f.extension, func(t *testing.T) {
+				rendered := f.render(c.announcement())
+				if *update {
+					if err := os.WriteFile(path, []byte(rendered), 0644); err != nil {
+						t.Fatal(err)
+					}
+					return
+				}
+				golden, err := os.ReadFile(path)
+				if err != nil {
+					t.Fatalf("%s, run with -update to create it", err)
+				}
+				if rendered != string(golden) {
+					t.Errorf("%s differs, run with -update if the change is intended\n--- got\n%s\n--- want\n%s", path, rendered, golden)
+				}
+			})
+		}
+	}
+}
+
+func TestListIssuesCutsTheScope(t *testing.T) {
+	scope := issues("SHOP", MAX_NON_MD_ISSUES + 1, "")
+	if listed, more := ListIssues(nil, scope, "", projectUrl); len(listed) != MAX_NON_MD_ISSUES + 1 || more != nil {
+		t.Errorf("one issue over the limit should be listed too, listed %d, more %v", len(listed), more)
+	}
+	scope = issues("SHOP", MAX_NON_MD_ISSUES + 2, "")
+	listed, more := ListIssues(nil, scope, "", projectUrl)
+	if len(listed) != MAX_NON_MD_ISSUES || more == nil || more.Text != "other 2 issue(s)" {
+		t.Errorf("the scope should be cut at %d, listed %d, more %v", MAX_NON_MD_ISSUES, len(listed), more)
+	}
+}
+
+func TestTruncateRunes(t *testing.T) {
+	for _, c := range []struct {
+		text string
+		limit int
+		want string
+	}{
+		{ "short", 10, "short" },
+		{ "no limit at all", 0, "no limit at all" },
+		{ "exactly ten", 11, "exactly ten" },
+		{ "cut after the space", 8, "cut aft…" },
+		{ "no trailing space", 4, "no…" },
+		{ "Откат релиза", 6, "Откат…" },
+		{ "🚀🚀🚀🚀", 3, "🚀🚀…" },
+	} {
+		if got := TruncateRunes(c.text, c.limit); got != c.want {
+			t.Errorf("TruncateRunes(%q, %d) = %q, want %q", c.text, c.limit, got, c.want)
+		}
+	}
+}
+
+func TestDisarmMentions(t *testing.T) {
+	for _, c := range []struct {
+		text string
+		want string
+	}{
+		{ "release @all", "release @\u2060all" },
+		{ "@here and @all.", "@\u2060here and @\u2060all." },
+		{ "(@all)", "(@\u2060all)" },
+		// not mentions
+		{ "@allison", "@allison" },
+		{ "ops@here.example.com", "ops@here.example.com" },
+		{ "@room", "@room" },
+		{ "", "" },
+	} {
+		if got := DisarmMentions(c.text, "@all", "@here"); got != c.want {
+			t.Errorf("DisarmMentions(%q) = %q, want %q", c.text, got, c.want)
+		}
+	}
+}
+
+// the payload texts must not change the layout of the messages: no extra lines, no slack markup
+func FuzzRender(f *testing.F) {
+	f.Add("Release 2.4", "Jane Doe", "https://jira.example.com/browse/REL-7", "first line\nsecond line")
+	f.Add("<!channel> *bold*", "<@U024BE7LH>", "https://x/<a|b>", "> quoted")
+	f.Add("line\nbreak\r\x00\xff", " ", "javascript:alert(1)", "")
+	f.Add("[text](url) `code` \\", "_", "a b(c)", "\n\n")
+
+	f.Fuzz(func(t *testing.T, summary string, actor string, url string, excerpt string) {
+		announcement := func(summary string, actor string, url string) *Announcement {
+			a := release("Release", "Released")
+			a.Issue.Summary, a.Actor, a.Issue.Url, a.Excerpt = summary, actor, url, excerpt
+			a.Issues = []Issue { { Key: "SHOP-1", Summary: summary, Url: url, Group: actor } }
+			a.Fields = []Field { { Label: actor, Value: summary } }
+			return a
+		}
+		fuzzed := announcement(summary, actor, url)
+		// an empty actor leaves the issue ungrouped, without the group line
+		plainActor := "actor"
+		if actor == "" {
+			plainActor = ""
+		}
+		plain := announcement("summary", plainActor, "https://jira.example.com/browse/REL-7")
+
+		slack, plainSlack := fuzzed.SlackText(), plain.SlackText()
+		markdown, plainMarkdown := fuzzed.MarkdownText(), plain.MarkdownText()
+		text, plainText := fuzzed.PlainText(), plain.PlainText()
+		for _, rendered := range []string { slack, markdown, text } {
+			if !utf8.ValidString(rendered) {
+				t.Fatalf("invalid utf-8 in %q", rendered)
+			}
+		}
+		if strings.Count(slack, "\n") != strings.Count(plainSlack, "\n") {
+			t.Errorf("the slack text has other lines:\n%s\n---\n%s", slack, plainSlack)
+		}
+		if strings.Count(markdown, "\n") != strings.Count(plainMarkdown, "\n") {
+			t.Errorf("the markdown has other lines:\n%s\n---\n%s", markdown, plainMarkdown)
+		}
+		if strings.Count(text, "\n") != strings.Count(plainText, "\n") {
+			t.Errorf("the plain text has other lines:\n%s\n---\n%s", text, plainText)
+		}
+		// every < and > of the slack text is markup, the texts and the urls are escaped
+		if strings.Count(slack, "<") != strings.Count(plainSlack, "<") || strings.Count(slack, ">") != strings.Count(plainSlack, ">") {
+			t.Errorf("the slack text has other markup:\n%s\n---\n%s", slack, plainSlack)
+		}
+	})
+}
+
+// a release with every part of the message set and a long scope, as the rendering is done for every destination
+func benchmarkAnnouncement() *Announcement {
+	a := escaping()
+	md := issues("MD", 5, "Migrations")
+	scope := append(issues("SHOP", 40, ""), issues("PAY", 20, "")...)
+	a.Issues, a.More = ListIssues(md, scope, "https://jira.example.com/issues/?jql=fixVersion%20%3D%202.4", projectUrl)
+	return a
+}
+
+func BenchmarkSlackText(b *testing.B) {
+	a := benchmarkAnnouncement()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		a.SlackText()
+	}
+}
+
+func BenchmarkMarkdown(b *testing.B) {
+	a := benchmarkAnnouncement()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		a.MarkdownText()
+	}
+}
+
+func BenchmarkHtmlText(b *testing.B) {
+	a := benchmarkAnnouncement()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		a.HtmlText()
+	}
+}
+
+func BenchmarkPlainText(b *testing.B) {
+	a := benchmarkAnnouncement()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		a.PlainText()
+	}
+}
@@ -0,0 +1,78 @@
+package jiraevent
+
+import "encoding/json"
+import "regexp"
+import "strings"
+
+import "ru/wikimart/dataflow/adf"
+
+// Description is the issue description, wiki markup from Jira Server
+// or an Atlassian Document Format document from Jira Cloud.
+type Description struct {
+	Raw json.RawMessage
+}
+
+func (d *Description) UnmarshalJSON(data []byte) error {
+	d.Raw = append(json.RawMessage(nil), data...)
+	return nil
+}
+
+func (d Description) MarshalJSON() ([]byte, error) {
+	if len(d.Raw) == 0 {
+		return []byte("null"), nil
+	}
+	return d.Raw, nil
+}
+
+var (
+	// {code:java}, {noformat}, {color:red}, {panel:title=x} and their closing tags
+	wikiMacro = regexp.MustCompile(`\{[a-zA-Z]+(:[^}]*)?\}`)
+	// h1. to h6. headings, bq. quotes
+	wikiHeading = regexp.MustCompile(`(?m)^(h[1-6]|bq)\.\s+`)
+	// [text|http://link] links
+	wikiLink = regexp.MustCompile(`\[([^|\]]+)\|[^\]]+\]`)
+	// [~user] mentions and [http://link] links
+	wikiBracket = regexp.MustCompile(`\[~?([^\]]+)\]`)
+	// list bullets
+	wikiBullet = regexp.MustCompile(`(?m)^[*#-]+\s+`)
+	blankLines = regexp.MustCompile(`\n{3,}`)
+)
+
+// wikiText removes the common wiki markup, the emphasis is kept as is
+func wikiText(text string) string {
+	text = wikiMacro.ReplaceAllString(text, "")
+	text = wikiHeading.ReplaceAllString(text, "")
+	text = wikiLink.ReplaceAllString(text, "$1")
+	text = wikiBracket.ReplaceAllString(text, "$1")
+	text = wikiBullet.ReplaceAllString(text, "- ")
+	return text
+}
+
+// Document returns the Atlassian Document Format document, nil for wiki markup or no description.
+func (d *Description) Document() *adf.Node {
+	if d == nil || len(d.Raw) == 0 {
+		return nil
+	}
+
+	var document adf.Node
+	if err := json.Unmarshal(d.Raw, &document); err != nil || document.Type == "" {
+		return nil
+	}
+	return &document
+}
+
+// Text converts the description to plain text, empty if there is none.
+func (d *Description) Text() string {
+	if d == nil || len(d.Raw) == 0 {
+		return ""
+	}
+
+	var text string
+	if err := json.Unmarshal(d.Raw, &text); err == nil {
+		text = wikiText(strings.Replace(text, "\r\n", "\n", -1))
+	} else if document := d.Document(); document != nil {
+		text = adf.Plain(document)
+	}
+
+	return strings.TrimSpace(blankLines.ReplaceAllString(text, "\n\n"))
+}
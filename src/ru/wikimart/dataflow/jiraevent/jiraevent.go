@@ -0,0 +1,211 @@
+// Package jiraevent is the model of the Jira webhook payloads, as sent by the
+// Jira Server "Trigger a Webhook" workflow post function and the Jira Cloud webhooks.
+package jiraevent
+
+import "bytes"
+import "encoding/json"
+import "fmt"
+import "io"
+import "mime"
+import "net/url"
+
+// Transition is set for the workflow post function webhooks only.
+type Transition struct {
+	FromStatus string `json:"from_status"`
+	ToStatus string `json:"to_status"`
+	Name string `json:"transitionName"`
+}
+
+// Priority of an issue, the lower id is the higher priority for the default priority scheme.
+type Priority struct {
+	Id string `json:"id"`
+	Name string `json:"name"`
+}
+
+// Version is a release of a project, e.g. a fix version of an issue.
+type Version struct {
+	Id string `json:"id"`
+	Name string `json:"name"`
+}
+
+// IssueFields holds the fields the model knows about, the rest of them are in All.
+type IssueFields struct {
+	Summary string `json:"summary"`
+	Description *Description `json:"description"`
+	Priority *Priority `json:"priority"`
+	// nil for the unassigned issues
+	Assignee *User `json:"assignee"`
+	FixVersions []Version `json:"fixVersions"`
+	Labels []string `json:"labels"`
+	Creator *User `json:"creator"`
+	IssueLinks []IssueLink `json:"issuelinks"`
+	// every field by its id, for the custom fields
+	All map[string]interface{} `json:"-"`
+}
+
+func (f *IssueFields) UnmarshalJSON(data []byte) error {
+	type plain IssueFields
+	if err := json.Unmarshal(data, (*plain)(f)); err != nil {
+		return err
+	}
+	return json.Unmarshal(data, &f.All)
+}
+
+// IssueBase is the part common for the issue of the event and the linked issues.
+type IssueBase struct {
+	Key string `json:"key"`
+	// rest api link of the issue, e.g. https://jira.example.com/rest/api/2/issue/10001
+	Self string `json:"self"`
+	Fields *IssueFields `json:"fields"`
+}
+
+type LinkType struct {
+	Name string `json:"name"`
+}
+
+// IssueLink has either the outward or the inward issue set.
+type IssueLink struct {
+	Type *LinkType `json:"type"`
+	OutwardIssue *IssueBase `json:"outwardIssue"`
+	InwardIssue *IssueBase `json:"inwardIssue"`
+}
+
+// Issue gives the linked issue, whichever side of the link it is on.
+func (l *IssueLink) Issue() *IssueBase {
+	if l.OutwardIssue != nil {
+		return l.OutwardIssue
+	}
+	return l.InwardIssue
+}
+
+// Direction tells the side of the link the linked issue is on, "outward" or "inward".
+func (l *IssueLink) Direction() string {
+	if l.OutwardIssue != nil {
+		return "outward"
+	}
+	return "inward"
+}
+
+// TypeName gives the name of the link type, e.g. "Blocks", empty if the type is missing.
+func (l *IssueLink) TypeName() string {
+	if l.Type == nil {
+		return ""
+	}
+	return l.Type.Name
+}
+
+// Issue is the issue the event is about.
+type Issue struct {
+	IssueBase
+}
+
+// User is a Jira user, Jira Server sends the name and the key, Jira Cloud the account id.
+type User struct {
+	Name string `json:"name"`
+	Key string `json:"key"`
+	AccountId string `json:"accountId"`
+	EmailAddress string `json:"emailAddress"`
+	DisplayName string `json:"displayName"`
+}
+
+// Property is set for the issue_property_set and issue_property_deleted events.
+type Property struct {
+	Key string `json:"key"`
+	Value json.RawMessage `json:"value"`
+}
+
+// Comment is set for the comment events and for the transitions with a comment.
+type Comment struct {
+	Id string `json:"id"`
+	Author *User `json:"author"`
+	Body *Description `json:"body"`
+}
+
+// Attachment is set for the attachment_created and attachment_deleted events of Jira Cloud.
+type Attachment struct {
+	Id json.Number `json:"id"`
+	Filename string `json:"filename"`
+	Author *User `json:"author"`
+	// bytes
+	Size int64 `json:"size"`
+	MimeType string `json:"mimeType"`
+	// download link of the file
+	Content string `json:"content"`
+}
+
+// Worklog is set for the worklog events, they tell the issue id only.
+type Worklog struct {
+	Id json.Number `json:"id"`
+	IssueId json.Number `json:"issueId"`
+	Author *User `json:"author"`
+	// e.g. 1h 30m
+	TimeSpent string `json:"timeSpent"`
+	TimeSpentSeconds int64 `json:"timeSpentSeconds"`
+}
+
+// ChangelogItem is a changed field, the values are ids and their display strings.
+type ChangelogItem struct {
+	Field string `json:"field"`
+	From string `json:"from"`
+	FromString string `json:"fromString"`
+	To string `json:"to"`
+	ToString string `json:"toString"`
+}
+
+// Changelog is set for the jira:issue_updated events.
+type Changelog struct {
+	Id string `json:"id"`
+	Items []ChangelogItem `json:"items"`
+}
+
+// Event is a webhook payload.
+type Event struct {
+	// e.g. jira:issue_updated or issue_property_set
+	WebhookEvent string `json:"webhookEvent"`
+	// milliseconds since epoch
+	Timestamp int64 `json:"timestamp"`
+	// the user who caused the event
+	User *User `json:"user"`
+	Transition *Transition `json:"transition"`
+	Issue *Issue `json:"issue"`
+	Property *Property `json:"property"`
+	Comment *Comment `json:"comment"`
+	Attachment *Attachment `json:"attachment"`
+	Changelog *Changelog `json:"changelog"`
+	Worklog *Worklog `json:"worklog"`
+}
+
+// Normalize gives the json of a payload in either encoding: json, or a form with the json in the
+// payload field, as some legacy Jira servers and gateways send it.
+func Normalize(contentType string, data []byte) ([]byte, error) {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	// json labelled as a form is json still, curl and some gateways do that
+	if mediaType != "application/x-www-form-urlencoded" || bytes.HasPrefix(bytes.TrimSpace(data), []byte("{")) {
+		return data, nil
+	}
+
+	form, err := url.ParseQuery(string(data))
+	if err != nil {
+		return nil, err
+	}
+	payload := form.Get("payload")
+	if payload == "" {
+		return nil, fmt.Errorf("form has no payload field")
+	}
+	return []byte(payload), nil
+}
+
+// Parse decodes a webhook payload. The event is returned with the error too, holding the fields decoded:
+// a field of a wrong type is skipped, nothing is decoded from malformed json.
+func Parse(data []byte) (*Event, error) {
+	var event Event
+	err := json.Unmarshal(data, &event)
+	return &event, err
+}
+
+// Decode reads and decodes a webhook payload, the event is returned with the error as by Parse.
+func Decode(reader io.Reader) (*Event, error) {
+	var event Event
+	err := json.NewDecoder(reader).Decode(&event)
+	return &event, err
+}
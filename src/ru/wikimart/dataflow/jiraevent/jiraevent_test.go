@@ -0,0 +1,82 @@
+package jiraevent
+
+import "bytes"
+import "encoding/json"
+import "os"
+import "path/filepath"
+import "testing"
+
+func FuzzParse(f *testing.F) {
+	// the payloads of the e2e harness, and the shapes the parser has to survive
+	fixtures, _ := filepath.Glob(filepath.Join("..", "e2e", "fixtures", "*.json"))
+	for _, fixture := range fixtures {
+		if data, err := os.ReadFile(fixture); err == nil {
+			f.Add(data)
+		}
+	}
+	f.Add([]byte(`{"webhookEvent":"jira:issue_updated","issue":{"key":"QA-1","fields":{"description":{"type":"doc","content":[{"type":"paragraph","content":[{"type":"text","text":"x"}]}]}}}}`))
+	f.Add([]byte(`{"issue":{"fields":{"description":"h1. *wiki* {code}x{code}","issuelinks":[{},{"type":null}]}}}`))
+	f.Add([]byte(`{"issue":{"fields":null},"transition":{}}`))
+	f.Add([]byte(`null`))
+	f.Add([]byte(`{"issue":{"fields":{"summary":"\u0000\ud800"}}}`))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		event, err := Parse(data)
+		if err != nil {
+			return
+		}
+		if event == nil {
+			t.Fatal("no error and no event")
+		}
+		if decoded, err := Decode(bytes.NewReader(data)); err != nil || decoded == nil {
+			t.Fatalf("parsed but not decoded: %v", err)
+		}
+		// the event encodes and parses back to itself, e.g. for the journal
+		encoded, err := json.Marshal(event)
+		if err != nil {
+			t.Fatalf("parsed but not encoded: %s", err)
+		}
+		again, err := Parse(encoded)
+		if err != nil {
+			t.Fatalf("encoded event not parsed: %s", err)
+		}
+		if reencoded, _ := json.Marshal(again); !bytes.Equal(encoded, reencoded) {
+			t.Fatalf("the event changed when parsed back:\n%s\n%s", encoded, reencoded)
+		}
+		// what the service reads of any payload
+		if event.Issue == nil || event.Issue.Fields == nil {
+			return
+		}
+		fields := event.Issue.Fields
+		if fields.Description != nil {
+			fields.Description.Text()
+			fields.Description.Document()
+		}
+		for i := range fields.IssueLinks {
+			link := &fields.IssueLinks[i]
+			link.Issue()
+			link.Direction()
+			link.TypeName()
+		}
+	})
+}
+
+func TestNormalize(t *testing.T) {
+	for _, c := range []struct {
+		contentType string
+		data string
+		want string
+	}{
+		{ "application/json", `{"a":1}`, `{"a":1}` },
+		{ "application/x-www-form-urlencoded", ` {"a":1}`, ` {"a":1}` },
+		{ "application/x-www-form-urlencoded; charset=utf-8", `payload=%7B%22a%22%3A1%7D`, `{"a":1}` },
+	} {
+		got, err := Normalize(c.contentType, []byte(c.data))
+		if err != nil || string(got) != c.want {
+			t.Errorf("Normalize(%q, %q) = %q, %v, want %q", c.contentType, c.data, got, err, c.want)
+		}
+	}
+	if _, err := Normalize("application/x-www-form-urlencoded", []byte("other=1")); err == nil {
+		t.Errorf("a form without the payload field should be an error")
+	}
+}
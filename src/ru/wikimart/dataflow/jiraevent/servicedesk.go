@@ -0,0 +1,128 @@
+package jiraevent
+
+import "encoding/json"
+import "sort"
+
+// SlaCycle is a cycle of an SLA, the ongoing one or a completed one.
+type SlaCycle struct {
+	Breached bool `json:"breached"`
+	RemainingTime *struct {
+		// e.g. "-2h 10m", negative when breached
+		Friendly string `json:"friendly"`
+	} `json:"remainingTime"`
+}
+
+// Sla is a Jira Service Management SLA field, e.g. "Time to resolution".
+type Sla struct {
+	// id of the custom field
+	Field string `json:"-"`
+	Name string `json:"name"`
+	OngoingCycle *SlaCycle `json:"ongoingCycle"`
+	CompletedCycles []SlaCycle `json:"completedCycles"`
+}
+
+// Breached tells whether the ongoing cycle or the last completed one is breached.
+func (s *Sla) Breached() bool {
+	if s.OngoingCycle != nil {
+		return s.OngoingCycle.Breached
+	}
+	return len(s.CompletedCycles) > 0 && s.CompletedCycles[len(s.CompletedCycles) - 1].Breached
+}
+
+// Approver is a decision of an approver of an approval.
+type Approver struct {
+	Approver *User `json:"approver"`
+	// "approved", "declined" or "pending"
+	ApproverDecision string `json:"approverDecision"`
+}
+
+// Approval is a Jira Service Management approval of a request.
+type Approval struct {
+	Id json.Number `json:"id"`
+	Name string `json:"name"`
+	// "approved" or "declined", empty while pending
+	FinalDecision string `json:"finalDecision"`
+	Approvers []Approver `json:"approvers"`
+}
+
+// ServiceRequest holds the Jira Service Management fields of an issue.
+type ServiceRequest struct {
+	// e.g. "Get IT help"
+	RequestType string
+	// ordered by the field id
+	Slas []Sla
+	Approvals []Approval
+}
+
+// decodes a field value from the generic map into the given type
+func decodeField(value interface{}, result interface{}) bool {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return false
+	}
+	return json.Unmarshal(data, result) == nil
+}
+
+// ServiceRequest finds the Jira Service Management fields among the custom fields by their shape,
+// their ids differ between the instances; nil if the issue is not a service request.
+func (f *IssueFields) ServiceRequest() *ServiceRequest {
+	if f == nil {
+		return nil
+	}
+
+	ids := make([]string, 0, len(f.All))
+	for id := range f.All {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	request := &ServiceRequest{}
+	found := false
+	for _, id := range ids {
+		switch value := f.All[id].(type) {
+		case map[string]interface{}:
+			if _, ok := value["requestType"]; ok {
+				var requestType struct {
+					RequestType struct {
+						Name string `json:"name"`
+					} `json:"requestType"`
+				}
+				if decodeField(value, &requestType) {
+					request.RequestType = requestType.RequestType.Name
+					found = true
+				}
+			}
+			_, ongoing := value["ongoingCycle"]
+			_, completed := value["completedCycles"]
+			if ongoing || completed {
+				var sla Sla
+				if decodeField(value, &sla) {
+					sla.Field = id
+					request.Slas = append(request.Slas, sla)
+					found = true
+				}
+			}
+		case []interface{}:
+			if len(value) == 0 {
+				continue
+			}
+			first, ok := value[0].(map[string]interface{})
+			if !ok {
+				continue
+			}
+			if _, ok := first["approvers"]; !ok {
+				continue
+			}
+			var approvals []Approval
+			if decodeField(value, &approvals) {
+				request.Approvals = append(request.Approvals, approvals...)
+				found = true
+			}
+		}
+	}
+
+	if !found {
+		return nil
+	}
+	return request
+}
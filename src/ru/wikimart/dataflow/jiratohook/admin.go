@@ -0,0 +1,189 @@
+package main
+
+import "crypto/subtle"
+import "encoding/json"
+import "expvar"
+import "fmt"
+import "net/http/pprof"
+import "io"
+import "log"
+import "net/http"
+import "strconv"
+import "strings"
+
+// authenticated admin endpoints, disabled without a token
+type AdminHandler struct {
+	// full access
+	Token string
+	// scoped tokens, see the tokens command
+	Tokens *AdminTokens
+	Queue *DeliveryQueue
+	Capture *Capture
+	Snoozes *Snoozes
+	Correlations *Correlations
+	// the history endpoint is disabled without it
+	Journal *Journal
+	// the rules are reloaded from here, the reload endpoint is disabled without it
+	ConfigPath string
+	Jira *JiraHandler
+}
+
+type AdminStatus struct {
+	Paused bool `json:"paused"`
+	Queued int `json:"queued"`
+}
+
+// whether the request has the admin token or a token with the scope
+func (a *AdminHandler) Authorized(request *http.Request, scope string) bool {
+	token := strings.TrimPrefix(request.Header.Get("Authorization"), "Bearer ")
+	if a.Token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(a.Token)) == 1 {
+		return true
+	}
+	if stored := a.Tokens.Find(token); stored != nil {
+		return stored.Allows(scope)
+	}
+	return false
+}
+
+func (a *AdminHandler) writeUnauthorized(response http.ResponseWriter, request *http.Request, scope string) {
+	WriteProblem(response, request, http.StatusUnauthorized, PROBLEM_UNAUTHORIZED, "admin token is missing, wrong or has no " + scope + " scope")
+}
+
+// wraps an admin endpoint with the authentication
+func (a *AdminHandler) Authenticated(scope string, endpoint http.Handler) http.HandlerFunc {
+	return func(response http.ResponseWriter, request *http.Request) {
+		if !a.Authorized(request, scope) {
+			a.writeUnauthorized(response, request, scope)
+			return
+		}
+		endpoint.ServeHTTP(response, request)
+	}
+}
+
+// wraps an admin endpoint with the authentication and the method check
+func (a *AdminHandler) Endpoint(method string, scope string, endpoint http.HandlerFunc) http.HandlerFunc {
+	return func(response http.ResponseWriter, request *http.Request) {
+		if !a.Authorized(request, scope) {
+			a.writeUnauthorized(response, request, scope)
+			return
+		}
+		if request.Method != method {
+			WriteProblem(response, request, http.StatusMethodNotAllowed, PROBLEM_METHOD_NOT_ALLOWED, method + " expected")
+			return
+		}
+		endpoint(response, request)
+	}
+}
+
+// writes a json response with the secrets redacted
+func writeJson(response http.ResponseWriter, value interface{}) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		WriteProblem(response, nil, http.StatusInternalServerError, PROBLEM_INTERNAL, err.Error())
+		return
+	}
+
+	response.Header().Set("Content-Type", "application/json")
+	io.WriteString(response, redactor.Redact(string(data)) + "\n")
+}
+
+type redactingResponseWriter struct {
+	http.ResponseWriter
+}
+
+func (w redactingResponseWriter) Write(data []byte) (int, error) {
+	if _, err := io.WriteString(w.ResponseWriter, redactor.Redact(string(data))); err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
+
+// redacts the secrets in the endpoint output, e.g. the command line with the webhook url
+func redacted(endpoint http.Handler) http.Handler {
+	return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		endpoint.ServeHTTP(redactingResponseWriter { response }, request)
+	})
+}
+
+func (a *AdminHandler) writeStatus(response http.ResponseWriter) {
+	writeJson(response, &AdminStatus {
+		Paused: a.Queue.Paused(),
+		Queued: a.Queue.Len(),
+	})
+}
+
+// holds the outbound deliveries, the webhooks are still accepted and journaled
+func (a *AdminHandler) Pause(response http.ResponseWriter, request *http.Request) {
+	log.Printf("deliveries paused\n")
+	a.Queue.Pause()
+	a.writeStatus(response)
+}
+
+// releases the held deliveries
+func (a *AdminHandler) Resume(response http.ResponseWriter, request *http.Request) {
+	log.Printf("deliveries resumed, %d queued\n", a.Queue.Len())
+	a.Queue.Resume()
+	a.writeStatus(response)
+}
+
+func (a *AdminHandler) Status(response http.ResponseWriter, request *http.Request) {
+	a.writeStatus(response)
+}
+
+// the last journaled payloads, GET /admin/history?n=20
+func (a *AdminHandler) History(response http.ResponseWriter, request *http.Request) {
+	count := 20
+	if n := request.URL.Query().Get("n"); n != "" {
+		var err error
+		if count, err = strconv.Atoi(n); err != nil || count < 1 || count > MAX_HISTORY {
+			WriteProblem(response, request, http.StatusBadRequest, PROBLEM_INVALID_PARAMETER, fmt.Sprintf("n should be a number from 1 to %d", MAX_HISTORY))
+			return
+		}
+	}
+
+	entries, err := a.Journal.Tail(count)
+	if err != nil {
+		WriteProblem(response, request, http.StatusInternalServerError, PROBLEM_INTERNAL, err.Error())
+		return
+	}
+	writeJson(response, entries)
+}
+
+// reloads the rules from the config now, not waiting for -watch-config
+func (a *AdminHandler) Reload(response http.ResponseWriter, request *http.Request) {
+	if err := a.Jira.ReloadConfig(a.ConfigPath); err != nil {
+		WriteProblem(response, request, http.StatusUnprocessableEntity, PROBLEM_INVALID_CONFIG, err.Error())
+		return
+	}
+	writeJson(response, map[string]int { "rules": len(a.Jira.CurrentRules()) })
+}
+
+func (a *AdminHandler) Register(mux *http.ServeMux) {
+	mux.HandleFunc("/admin/pause", a.Endpoint("POST", SCOPE_PAUSE, a.Pause))
+	mux.HandleFunc("/admin/resume", a.Endpoint("POST", SCOPE_PAUSE, a.Resume))
+	mux.HandleFunc("/admin/status", a.Endpoint("GET", SCOPE_HISTORY, a.Status))
+	mux.HandleFunc("/admin/capture", a.Endpoint("POST", SCOPE_CAPTURE, a.StartCapture))
+	if a.Snoozes != nil {
+		mux.HandleFunc("/admin/snoozes", a.Authenticated(SCOPE_SNOOZE, http.HandlerFunc(a.ServeSnoozes)))
+	}
+	if a.Correlations != nil {
+		mux.HandleFunc("/admin/correlations", a.Authenticated(SCOPE_CORRELATE, http.HandlerFunc(a.ServeCorrelations)))
+	}
+	if a.Journal != nil {
+		mux.HandleFunc("/admin/history", a.Endpoint("GET", SCOPE_HISTORY, a.History))
+	}
+	if a.ConfigPath != "" {
+		mux.HandleFunc("/admin/reload", a.Endpoint("POST", SCOPE_RELOAD, a.Reload))
+	}
+
+	// runtime debugging, fetch the profiles with curl -H "Authorization: Bearer ..." and open them with go tool pprof
+	mux.HandleFunc("/debug/pprof/", a.Authenticated(SCOPE_DEBUG, http.HandlerFunc(pprof.Index)))
+	mux.HandleFunc("/debug/pprof/cmdline", a.Authenticated(SCOPE_DEBUG, redacted(http.HandlerFunc(pprof.Cmdline))))
+	mux.HandleFunc("/debug/pprof/profile", a.Authenticated(SCOPE_DEBUG, http.HandlerFunc(pprof.Profile)))
+	mux.HandleFunc("/debug/pprof/symbol", a.Authenticated(SCOPE_DEBUG, http.HandlerFunc(pprof.Symbol)))
+	mux.HandleFunc("/debug/pprof/trace", a.Authenticated(SCOPE_DEBUG, http.HandlerFunc(pprof.Trace)))
+	mux.HandleFunc("/debug/vars", a.Authenticated(SCOPE_DEBUG, redacted(expvar.Handler())))
+
+	expvar.Publish("queued", expvar.Func(func() interface{} { return a.Queue.Len() }))
+	expvar.Publish("paused", expvar.Func(func() interface{} { return a.Queue.Paused() }))
+}
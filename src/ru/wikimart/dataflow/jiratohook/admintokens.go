@@ -0,0 +1,210 @@
+package main
+
+import "crypto/rand"
+import "crypto/sha256"
+import "crypto/subtle"
+import "encoding/hex"
+import "encoding/json"
+import "flag"
+import "fmt"
+import "log"
+import "os"
+import "sort"
+import "strings"
+import "sync"
+import "time"
+
+// what an admin token may do, the -admin-token may do everything
+const (
+	SCOPE_ALL = "*"
+	// the journaled payloads and the queue status
+	SCOPE_HISTORY = "history"
+	SCOPE_RELOAD = "reload"
+	// pause and resume the deliveries
+	SCOPE_PAUSE = "pause"
+	SCOPE_CAPTURE = "capture"
+	SCOPE_SNOOZE = "snooze"
+	// the ci builds of the issues, e.g. for the pipelines reporting them
+	SCOPE_CORRELATE = "correlate"
+	// pprof and expvar
+	SCOPE_DEBUG = "debug"
+)
+
+var adminScopes = map[string]bool {
+	SCOPE_ALL: true,
+	SCOPE_HISTORY: true,
+	SCOPE_RELOAD: true,
+	SCOPE_PAUSE: true,
+	SCOPE_CAPTURE: true,
+	SCOPE_SNOOZE: true,
+	SCOPE_CORRELATE: true,
+	SCOPE_DEBUG: true,
+}
+
+// admin api token, only the sha256 of the token is stored
+type AdminToken struct {
+	Id string `json:"id"`
+	Name string `json:"name"`
+	Hash string `json:"hash"`
+	Scopes []string `json:"scopes"`
+	Created time.Time `json:"created"`
+}
+
+func (t *AdminToken) Allows(scope string) bool {
+	return containsString(t.Scopes, SCOPE_ALL) || containsString(t.Scopes, scope)
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// admin tokens kept in a json file, the file is read again when it changes,
+// so the tokens created and revoked with the tokens command apply without a restart
+type AdminTokens struct {
+	path string
+	mutex sync.Mutex
+	modified time.Time
+	tokens []*AdminToken
+}
+
+func NewAdminTokens(path string) *AdminTokens {
+	return &AdminTokens { path: path }
+}
+
+func (a *AdminTokens) load() error {
+	info, err := os.Stat(a.path)
+	if os.IsNotExist(err) {
+		a.tokens = nil
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.ModTime().Equal(a.modified) {
+		return nil
+	}
+
+	data, err := os.ReadFile(a.path)
+	if err != nil {
+		return err
+	}
+	var tokens []*AdminToken
+	if err := json.Unmarshal(data, &tokens); err != nil {
+		return err
+	}
+	a.tokens = tokens
+	a.modified = info.ModTime()
+	return nil
+}
+
+// the token with the given value, nil if there is none
+func (a *AdminTokens) Find(token string) *AdminToken {
+	if a == nil || token == "" {
+		return nil
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if err := a.load(); err != nil {
+		// the tokens read before are used meanwhile
+		log.Printf("admin tokens %s: %s\n", a.path, err)
+	}
+
+	hash := hashToken(token)
+	for _, stored := range a.tokens {
+		if subtle.ConstantTimeCompare([]byte(stored.Hash), []byte(hash)) == 1 {
+			return stored
+		}
+	}
+	return nil
+}
+
+func (a *AdminTokens) save() error {
+	data, err := json.MarshalIndent(a.tokens, "", "  ")
+	if err != nil {
+		return err
+	}
+	temporary := a.path + ".tmp"
+	if err := os.WriteFile(temporary, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(temporary, a.path)
+}
+
+// jiratohook tokens -file tokens.json create -name ci -scopes history,pause | revoke -id id | list
+func TokensCommand(arguments []string) {
+	flags := flag.NewFlagSet("tokens", flag.ExitOnError)
+	path := flags.String("file", "admin-tokens.json", "token file, the same as the -admin-tokens of the service")
+	flags.Parse(arguments)
+	if flags.NArg() == 0 {
+		log.Fatalf("./jiratohook tokens [-file admin-tokens.json] create -name ci -scopes history,pause | revoke -id id | list\n")
+	}
+
+	command := flag.NewFlagSet(flags.Arg(0), flag.ExitOnError)
+	name := command.String("name", "", "who the token is for")
+	scopes := command.String("scopes", "", "comma-separated: history, reload, pause, capture, snooze, correlate, debug, or * for all")
+	id := command.String("id", "", "id of the token to revoke")
+	command.Parse(flags.Args()[1:])
+
+	tokens := NewAdminTokens(*path)
+	if err := tokens.load(); err != nil {
+		log.Fatalf("error when reading %s: %s\n", *path, err)
+	}
+
+	switch flags.Arg(0) {
+	case "create":
+		token := &AdminToken { Name: *name, Created: time.Now().UTC() }
+		for _, scope := range strings.Split(*scopes, ",") {
+			if scope = strings.TrimSpace(scope); scope == "" {
+				continue
+			}
+			if !adminScopes[scope] {
+				log.Fatalf("unknown scope %q\n", scope)
+			}
+			token.Scopes = append(token.Scopes, scope)
+		}
+		if len(token.Scopes) == 0 {
+			log.Fatalf("-scopes is required\n")
+		}
+
+		// the id is listed and logged, so it is random on its own rather than a part of the secret
+		secret, tokenId := make([]byte, 24), make([]byte, 4)
+		if _, err := rand.Read(secret); err != nil {
+			log.Fatalf("%s\n", err)
+		}
+		if _, err := rand.Read(tokenId); err != nil {
+			log.Fatalf("%s\n", err)
+		}
+		value := "jth_" + hex.EncodeToString(secret)
+		token.Id = hex.EncodeToString(tokenId)
+		token.Hash = hashToken(value)
+		tokens.tokens = append(tokens.tokens, token)
+		if err := tokens.save(); err != nil {
+			log.Fatalf("error when writing %s: %s\n", *path, err)
+		}
+		// shown once, only the hash is kept
+		fmt.Printf("%s\n", value)
+	case "revoke":
+		kept := tokens.tokens[:0]
+		for _, token := range tokens.tokens {
+			if token.Id != *id {
+				kept = append(kept, token)
+			}
+		}
+		if len(kept) == len(tokens.tokens) {
+			log.Fatalf("no token %q\n", *id)
+		}
+		tokens.tokens = kept
+		if err := tokens.save(); err != nil {
+			log.Fatalf("error when writing %s: %s\n", *path, err)
+		}
+	case "list":
+		sort.Slice(tokens.tokens, func(i, j int) bool { return tokens.tokens[i].Created.Before(tokens.tokens[j].Created) })
+		for _, token := range tokens.tokens {
+			fmt.Printf("%s\t%s\t%s\t%s\n", token.Id, token.Name, strings.Join(token.Scopes, ","), token.Created.Format(time.RFC3339))
+		}
+	default:
+		log.Fatalf("unknown tokens command %q, create, revoke or list expected\n", flags.Arg(0))
+	}
+}
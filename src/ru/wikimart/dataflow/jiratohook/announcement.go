@@ -0,0 +1,206 @@
+package main
+
+import "encoding/json"
+import "fmt"
+import "regexp"
+import "sort"
+import "strings"
+import "time"
+import "ru/wikimart/dataflow/format"
+import "ru/wikimart/dataflow/jiraevent"
+
+func NewAnnouncementIssue(instance *JiraInstance, issue *jiraevent.IssueBase) format.Issue {
+	announcementIssue := format.Issue {
+		Key: issue.Key,
+		Url: instance.IssueUrl(issue.Key),
+		PriorityRank: priorityRank(nil),
+	}
+
+	if issue.Fields != nil {
+		announcementIssue.Summary = issue.Fields.Summary
+		if issue.Fields.Priority != nil {
+			announcementIssue.Priority = issue.Fields.Priority.Name
+			announcementIssue.PriorityRank = priorityRank(issue.Fields.Priority)
+		}
+	}
+
+	return announcementIssue
+}
+
+var issueKeyPattern = regexp.MustCompile(`\b[A-Z]+-\d+\b`)
+
+// the issues referenced in the summary and the description, other than the issue itself and the listed ones
+func mentionedIssues(key string, fields *jiraevent.IssueFields, listed []format.Issue) []*jiraevent.IssueBase {
+	seen := map[string]bool { key: true }
+	for _, issue := range listed {
+		seen[issue.Key] = true
+	}
+
+	var issues []*jiraevent.IssueBase
+	for _, text := range []string { fields.Summary, fields.Description.Text() } {
+		for _, mentioned := range issueKeyPattern.FindAllString(text, -1) {
+			if seen[mentioned] {
+				continue
+			}
+			seen[mentioned] = true
+			issues = append(issues, &jiraevent.IssueBase { Key: mentioned })
+		}
+	}
+	return issues
+}
+
+// builds an announcement for the transition event, returns nil if the event is not a transition
+func (h *JiraHandler) BuildAnnouncement(event *jiraevent.Event, instance *JiraInstance) *format.Announcement {
+	if event.Transition == nil || event.Issue == nil {
+		return nil
+	}
+
+	announcement := &format.Announcement {
+		Received: time.Now(),
+		Transition: event.Transition.Name,
+		Status: event.Transition.ToStatus,
+		Instance: instance.Name,
+	}
+	announcement.Emoji, announcement.Action = format.Action(event.Transition.Name, event.Transition.ToStatus)
+
+	if event.User != nil {
+		announcement.Actor = event.User.DisplayName
+		if announcement.Actor == "" {
+			announcement.Actor = event.User.Name
+		}
+		announcement.ActorMention = h.Users.Lookup(event.User)
+	}
+
+	announcement.Issue = NewAnnouncementIssue(instance, &event.Issue.IssueBase)
+	announcement.Project = format.IssueProject(event.Issue.Key)
+	if request := event.Issue.Fields.ServiceRequest(); request != nil {
+		announcement.RequestType = request.RequestType
+	}
+	if fields := event.Issue.Fields; fields != nil {
+		if fields.Assignee != nil {
+			announcement.Assignee = fields.Assignee.DisplayName
+			if announcement.Assignee == "" {
+				announcement.Assignee = fields.Assignee.Name
+			}
+		}
+		for _, version := range fields.FixVersions {
+			announcement.FixVersions = append(announcement.FixVersions, version.Name)
+		}
+	}
+	// the comment left on the transition screen tells more than the description
+	if event.Comment != nil && event.Comment.Body.Text() != "" {
+		announcement.Description = event.Comment.Body.Text()
+		announcement.Document = event.Comment.Body.Document()
+	} else if event.Issue.Fields != nil {
+		announcement.Description = event.Issue.Fields.Description.Text()
+		announcement.Document = event.Issue.Fields.Description.Document()
+	}
+
+	// the listed issues with the type of the link they are listed by, none for the mentioned ones
+	type listedIssue struct {
+		issue format.Issue
+		linkType string
+	}
+	var listed []listedIssue
+	var listedIssues []format.Issue
+
+	if event.Issue.Fields != nil {
+		for i := range event.Issue.Fields.IssueLinks {
+			link := &event.Issue.Fields.IssueLinks[i]
+			issue := link.Issue()
+			if issue == nil {
+				continue
+			}
+
+			if format.IsMd(issue.Key) || h.InScope(link) {
+				listed = append(listed, listedIssue { NewAnnouncementIssue(instance, issue), link.TypeName() })
+				listedIssues = append(listedIssues, listed[len(listed) - 1].issue)
+			}
+		}
+	}
+
+	// the keys mentioned in the text, the scope links find them with the linked ones
+	var mentioned []string
+	if h.ScanKeys && event.Issue.Fields != nil {
+		for _, issue := range mentionedIssues(event.Issue.Key, event.Issue.Fields, listedIssues) {
+			mentioned = append(mentioned, issue.Key)
+			listed = append(listed, listedIssue { issue: NewAnnouncementIssue(instance, issue) })
+		}
+	}
+
+	// if there are MD entries, non-MD entries are skipped
+	announcement.Relist = func(excludedLinkTypes []string) ([]format.Issue, *format.More) {
+		var mdIssues []format.Issue
+		var nonMdIssues []format.Issue
+		for _, issue := range listed {
+			if issue.linkType != "" && containsString(excludedLinkTypes, issue.linkType) {
+				continue
+			}
+			if format.IsMd(issue.issue.Key) {
+				mdIssues = append(mdIssues, issue.issue)
+			} else {
+				nonMdIssues = append(nonMdIssues, issue.issue)
+			}
+		}
+
+		// the scope links find the issues of the listed link types only
+		var linkTypes []string
+		for _, linkType := range h.scopedLinkTypes() {
+			if !containsString(excludedLinkTypes, linkType) {
+				linkTypes = append(linkTypes, linkType)
+			}
+		}
+		projectUrl := func(project string) string {
+			return instance.GetScopeForProject(event.Issue.Key, linkTypes, mentioned, project)
+		}
+		issues, more := format.ListIssues(mdIssues, nonMdIssues, instance.GetScopeExceptMD(event.Issue.Key, linkTypes, mentioned), projectUrl)
+		if more != nil {
+			more.SearchUrl = instance.SearchUrl()
+		}
+		return issues, more
+	}
+	announcement.Issues, announcement.More = announcement.Relist(nil)
+
+	return announcement
+}
+
+// announcement of an event no rule matched, the raw event is summarized in the metadata
+func (h *JiraHandler) BuildUnmatched(event *jiraevent.Event, body []byte, instance *JiraInstance) *format.Announcement {
+	announcement := &format.Announcement {
+		Received: time.Now(),
+		Instance: instance.Name,
+		Emoji: ":grey_question:",
+		Action: fmt.Sprintf("unmatched %s event", event.WebhookEvent),
+		Metadata: map[string]string{},
+	}
+
+	if event.Issue != nil {
+		announcement.Issue = NewAnnouncementIssue(instance, &event.Issue.IssueBase)
+		announcement.Project = format.IssueProject(event.Issue.Key)
+	} else {
+		announcement.Issue = format.Issue { Key: "no issue", Url: instance.Url }
+	}
+	AddExclusionFields(announcement, event)
+
+	if event.Transition != nil {
+		announcement.Transition = event.Transition.Name
+		announcement.Status = event.Transition.ToStatus
+		announcement.Metadata["transition"] = fmt.Sprintf("%s → %s (%s)", event.Transition.FromStatus, event.Transition.ToStatus, event.Transition.Name)
+	}
+	if event.User != nil {
+		announcement.Metadata["user"] = event.User.DisplayName
+	}
+
+	// the top level fields tell the unknown events apart
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(body, &raw); err == nil {
+		fields := make([]string, 0, len(raw))
+		for name := range raw {
+			fields = append(fields, name)
+		}
+		sort.Strings(fields)
+		announcement.Metadata["payload"] = strings.Join(fields, " ")
+	}
+
+	return announcement
+}
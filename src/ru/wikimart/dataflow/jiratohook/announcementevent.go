@@ -0,0 +1,62 @@
+package main
+
+import "time"
+import "ru/wikimart/dataflow/format"
+
+// the announcement as the event buses and the queues get it, the field names are kept for the consumers
+type AnnouncementEvent struct {
+	Event string `json:"event,omitempty"`
+	Transition string `json:"transition,omitempty"`
+	Status string `json:"status,omitempty"`
+	Instance string `json:"instance"`
+	Project string `json:"project"`
+	Issue AnnouncementEventIssue `json:"issue"`
+	Issues []AnnouncementEventIssue `json:"issues,omitempty"`
+	RequestType string `json:"requestType,omitempty"`
+	Actor string `json:"actor,omitempty"`
+	Time string `json:"time,omitempty"`
+	Environment string `json:"environment,omitempty"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+	Builds []AnnouncementEventBuild `json:"builds,omitempty"`
+	OnCall string `json:"onCall,omitempty"`
+	Received time.Time `json:"received"`
+	Text string `json:"text"`
+}
+
+type AnnouncementEventIssue struct {
+	Key string `json:"key"`
+	Summary string `json:"summary,omitempty"`
+	Url string `json:"url"`
+}
+
+type AnnouncementEventBuild struct {
+	Name string `json:"name"`
+	Url string `json:"url"`
+	Environment string `json:"environment,omitempty"`
+}
+
+func NewAnnouncementEvent(announcement *format.Announcement) *AnnouncementEvent {
+	event := &AnnouncementEvent {
+		Event: announcement.Event,
+		Transition: announcement.Transition,
+		Status: announcement.Status,
+		Instance: announcement.Instance,
+		Project: announcement.Project,
+		Issue: AnnouncementEventIssue { Key: announcement.Issue.Key, Summary: announcement.Issue.Summary, Url: announcement.Issue.Url },
+		RequestType: announcement.RequestType,
+		Actor: announcement.Actor,
+		Time: announcement.Time,
+		Environment: announcement.Environment,
+		Metadata: announcement.Metadata,
+		OnCall: announcement.OnCall,
+		Received: announcement.Received,
+		Text: announcement.PlainText(),
+	}
+	for _, issue := range announcement.Issues {
+		event.Issues = append(event.Issues, AnnouncementEventIssue { Key: issue.Key, Summary: issue.Summary, Url: issue.Url })
+	}
+	for _, build := range announcement.Builds {
+		event.Builds = append(event.Builds, AnnouncementEventBuild { Name: build.Name, Url: build.Url, Environment: build.Environment })
+	}
+	return event
+}
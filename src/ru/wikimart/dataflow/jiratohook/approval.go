@@ -0,0 +1,251 @@
+package main
+
+import "crypto/hmac"
+import "crypto/sha256"
+import "encoding/hex"
+import "encoding/json"
+import "fmt"
+import "io"
+import "log"
+import "net/http"
+import "net/url"
+import "strconv"
+import "sync"
+import "time"
+import "ru/wikimart/dataflow/format"
+
+// the slack requests older than this are rejected, as slack recommends
+const SLACK_REQUEST_MAX_AGE = 5 * time.Minute
+
+// slack app the announcements of the approval rules are approved with,
+// its interactivity request url is https://this.service/slack/interactions
+type ApprovalConfig struct {
+	// bot token with chat:write
+	Token string `json:"token"`
+	// signing secret of the slack app, the interactions are verified with it
+	SigningSecret string `json:"signingSecret"`
+	// channel id of the approvers
+	Channel string `json:"channel"`
+	// https://slack.com/api by default
+	ApiUrl string `json:"apiUrl"`
+	// how long an announcement waits for the approvers before it is dropped, e.g. "8h"; a day by default
+	Expire string `json:"expire"`
+}
+
+type pendingApproval struct {
+	rule *Rule
+	announcement *format.Announcement
+	channel string
+	ts string
+	// drops the announcement once the approval expires
+	expiry *time.Timer
+}
+
+// announcements waiting for the approvers, sent on once approved or dropped once expired;
+// the outbox keeps their payloads, after a restart the approval is asked again
+type Approvals struct {
+	config *ApprovalConfig
+	slack *SlackApi
+	send func(rule *Rule, announcement *format.Announcement)
+	expire time.Duration
+	// keeps the payloads of the pending announcements if set
+	Outbox *Outbox
+	// the approval requests are posted through it, retried as the deliveries are; its destinations are
+	// not configured ones, so it is not shared and not spilled
+	Queue *DeliveryQueue
+
+	mutex sync.Mutex
+	sequence int
+	pending map[string]*pendingApproval
+}
+
+func NewApprovals(config *ApprovalConfig, send func(rule *Rule, announcement *format.Announcement)) (*Approvals, error) {
+	if config.Token == "" || config.SigningSecret == "" || config.Channel == "" {
+		return nil, fmt.Errorf("approval: token, signingSecret and channel are required")
+	}
+	expire := 24 * time.Hour
+	if config.Expire != "" {
+		var err error
+		if expire, err = time.ParseDuration(config.Expire); err != nil || expire <= 0 {
+			return nil, fmt.Errorf("approval: expire should be a positive duration, e.g. 8h")
+		}
+	}
+	return &Approvals {
+		config: config,
+		slack: &SlackApi { Token: config.Token, Url: config.ApiUrl },
+		send: send,
+		expire: expire,
+		Queue: NewDeliveryQueue(),
+		pending: map[string]*pendingApproval{},
+	}, nil
+}
+
+type slackBlock map[string]interface{}
+
+func approvalBlocks(text string, id string) []slackBlock {
+	button := func(action string, label string, style string) slackBlock {
+		return slackBlock {
+			"type": "button",
+			"action_id": action,
+			"value": id,
+			"style": style,
+			"text": slackBlock { "type": "plain_text", "text": label },
+		}
+	}
+	return []slackBlock {
+		{ "type": "section", "text": slackBlock { "type": "mrkdwn", "text": text } },
+		{ "type": "actions", "elements": []slackBlock { button("approve", "Approve", "primary"), button("reject", "Reject", "danger") } },
+	}
+}
+
+// the approval request of an announcement, delivered through the queue of the approvals
+type approvalPost struct {
+	DestinationBase
+	approvals *Approvals
+	rule *Rule
+	id string
+}
+
+// posts the announcement to the approvers and waits for them
+func (p *approvalPost) Send(announcement *format.Announcement) error {
+	a := p.approvals
+	text := announcement.SlackText()
+	response, err := a.slack.PostMessage(&SlackPostMessage {
+		Channel: a.config.Channel,
+		Text: fmt.Sprintf("approval requested by rule %s: %s", p.rule.Name, text),
+		Blocks: approvalBlocks(fmt.Sprintf("*rule %s asks for approval:*\n%s", format.SlackEscape(p.rule.Name), text), p.id),
+	})
+	if err != nil {
+		return err
+	}
+
+	a.Outbox.Hold(announcement.OutboxIds)
+	expire := func() {
+		a.finish(p.id, false, "expired", fmt.Sprintf(":hourglass: expired after %s, not sent", a.expire))
+	}
+	a.mutex.Lock()
+	a.pending[p.id] = &pendingApproval { rule: p.rule, announcement: announcement, channel: response.Channel, ts: response.Ts, expiry: time.AfterFunc(a.expire, expire) }
+	a.mutex.Unlock()
+	log.Printf("rule %s: %s is waiting for the approval %s\n", p.rule.Name, announcement.Issue.Key, p.id)
+	return nil
+}
+
+// posts the announcement to the approvers, it is sent on when they approve it
+func (a *Approvals) Request(rule *Rule, announcement *format.Announcement) {
+	a.mutex.Lock()
+	a.sequence++
+	id := fmt.Sprintf("%d-%06d", time.Now().UnixNano(), a.sequence)
+	a.mutex.Unlock()
+
+	a.Outbox.Hold(announcement.OutboxIds)
+	a.Queue.Push(&Delivery {
+		Destination: &approvalPost { DestinationBase: DestinationBase { DestinationName: "approval" }, approvals: a, rule: rule, id: id },
+		Announcement: announcement,
+	})
+}
+
+// checks the X-Slack-Signature of the request
+func (a *Approvals) verify(request *http.Request, body []byte) bool {
+	timestamp := request.Header.Get("X-Slack-Request-Timestamp")
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return false
+	}
+	if age := time.Since(time.Unix(seconds, 0)); age > SLACK_REQUEST_MAX_AGE || age < -SLACK_REQUEST_MAX_AGE {
+		return false
+	}
+
+	mac := hmac.New(sha256.New, []byte(a.config.SigningSecret))
+	mac.Write([]byte("v0:" + timestamp + ":"))
+	mac.Write(body)
+	expected := "v0=" + hex.EncodeToString(mac.Sum(nil))
+	return hmac.Equal([]byte(request.Header.Get("X-Slack-Signature")), []byte(expected))
+}
+
+type slackInteraction struct {
+	Type string `json:"type"`
+	User struct {
+		Id string `json:"id"`
+		Username string `json:"username"`
+	} `json:"user"`
+	Actions []struct {
+		ActionId string `json:"action_id"`
+		Value string `json:"value"`
+	} `json:"actions"`
+}
+
+// receives the button clicks of the approvers
+func (a *Approvals) ServeInteractions(response http.ResponseWriter, request *http.Request) {
+	if request.Method != "POST" {
+		WriteProblem(response, request, http.StatusMethodNotAllowed, PROBLEM_METHOD_NOT_ALLOWED, "POST expected")
+		return
+	}
+	body, err := io.ReadAll(request.Body)
+	if err != nil {
+		WriteProblem(response, request, http.StatusBadRequest, PROBLEM_READ_FAILED, "error when reading a request")
+		return
+	}
+	if !a.verify(request, body) {
+		WriteProblem(response, request, http.StatusUnauthorized, PROBLEM_SIGNATURE_MISMATCH, "slack signature is missing or wrong")
+		return
+	}
+
+	// slack posts the payload as a form field
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		WriteProblem(response, request, http.StatusBadRequest, PROBLEM_INVALID_PAYLOAD, "error when decoding a payload")
+		return
+	}
+	var interaction slackInteraction
+	if err := json.Unmarshal([]byte(form.Get("payload")), &interaction); err != nil {
+		WriteProblem(response, request, http.StatusBadRequest, PROBLEM_INVALID_PAYLOAD, "error when decoding a payload")
+		return
+	}
+
+	// slack wants the answer within 3 seconds, the decisions are carried out meanwhile
+	for _, action := range interaction.Actions {
+		if action.ActionId != "approve" && action.ActionId != "reject" {
+			continue
+		}
+		go a.decide(action.Value, action.ActionId == "approve", interaction.User.Id)
+	}
+	response.WriteHeader(http.StatusOK)
+}
+
+func (a *Approvals) decide(id string, approved bool, user string) {
+	emoji, verb := ":no_entry:", "rejected"
+	if approved {
+		emoji, verb = ":white_check_mark:", "approved"
+	}
+	a.finish(id, approved, fmt.Sprintf("%s by %s", verb, user), fmt.Sprintf("%s %s by <@%s>", emoji, verb, user))
+}
+
+// sends the pending announcement on if approved, drops it otherwise, and tells the approvers the decision
+func (a *Approvals) finish(id string, approved bool, outcome string, decision string) {
+	a.mutex.Lock()
+	pending, ok := a.pending[id]
+	delete(a.pending, id)
+	a.mutex.Unlock()
+	if !ok {
+		log.Printf("approval %s is not pending, decided already, expired or lost on a restart\n", id)
+		return
+	}
+	pending.expiry.Stop()
+	defer a.Outbox.Release(pending.announcement.OutboxIds)
+
+	if approved {
+		a.send(pending.rule, pending.announcement)
+	}
+	log.Printf("rule %s: %s %s\n", pending.rule.Name, pending.announcement.Issue.Key, outcome)
+
+	text := fmt.Sprintf("*rule %s:*\n%s\n%s", format.SlackEscape(pending.rule.Name), pending.announcement.SlackText(), decision)
+	update := map[string]interface{} {
+		"channel": pending.channel,
+		"ts": pending.ts,
+		"text": text,
+		"blocks": []slackBlock { { "type": "section", "text": slackBlock { "type": "mrkdwn", "text": text } } },
+	}
+	if err := a.slack.Call("chat.update", update, nil); err != nil {
+		log.Printf("error when updating the approval %s: %s\n", id, err)
+	}
+}
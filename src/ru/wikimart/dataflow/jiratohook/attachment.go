@@ -0,0 +1,75 @@
+package main
+
+import "fmt"
+import "time"
+import "ru/wikimart/dataflow/format"
+import "ru/wikimart/dataflow/jiraevent"
+
+const ATTACHMENT_EVENT = "attachment_created"
+
+// files added by the event: Jira Cloud sends attachment_created,
+// Jira Server sends jira:issue_updated with the attachment in the changelog
+func addedAttachments(event *jiraevent.Event, instance *JiraInstance) ([]format.Attachment, *jiraevent.User) {
+	if event.WebhookEvent == ATTACHMENT_EVENT && event.Attachment != nil {
+		attachment := format.Attachment {
+			Name: event.Attachment.Filename,
+			Url: event.Attachment.Content,
+			Size: event.Attachment.Size,
+		}
+		return []format.Attachment { attachment }, event.Attachment.Author
+	}
+
+	if event.WebhookEvent != "jira:issue_updated" || event.Changelog == nil {
+		return nil, nil
+	}
+	var attachments []format.Attachment
+	for _, item := range event.Changelog.Items {
+		// the removed attachments have the from values set instead
+		if item.Field != "Attachment" || item.To == "" {
+			continue
+		}
+		attachments = append(attachments, format.Attachment {
+			Name: item.ToString,
+			Url: joinUrl(instance.Url, "secure", "attachment", item.To, item.ToString),
+		})
+	}
+	return attachments, event.User
+}
+
+// builds an announcement for the added attachments, returns nil if the event adds none
+func (h *JiraHandler) BuildAttachment(event *jiraevent.Event, instance *JiraInstance) *format.Announcement {
+	attachments, author := addedAttachments(event, instance)
+	if len(attachments) == 0 {
+		return nil
+	}
+
+	announcement := &format.Announcement {
+		Event: ATTACHMENT_EVENT,
+		Received: time.Now(),
+		Instance: instance.Name,
+		Emoji: ":paperclip:",
+		Action: "attachment added",
+		Attachments: attachments,
+	}
+	if len(attachments) > 1 {
+		announcement.Action = fmt.Sprintf("%d attachments added", len(attachments))
+	}
+
+	if author != nil {
+		announcement.Actor = author.DisplayName
+		if announcement.Actor == "" {
+			announcement.Actor = author.Name
+		}
+		announcement.ActorMention = h.Users.Lookup(author)
+	}
+
+	// Jira Cloud does not tell the issue of the attachment
+	if event.Issue != nil {
+		announcement.Issue = NewAnnouncementIssue(instance, &event.Issue.IssueBase)
+		announcement.Project = format.IssueProject(event.Issue.Key)
+	} else {
+		announcement.Issue = format.Issue { Key: "no issue", Url: instance.Url }
+	}
+
+	return announcement
+}
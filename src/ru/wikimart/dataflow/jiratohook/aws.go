@@ -0,0 +1,143 @@
+package main
+
+import "encoding/json"
+import "encoding/xml"
+import "fmt"
+import "log"
+import "net/http"
+import "net/url"
+import "strings"
+import "time"
+import "ru/wikimart/dataflow/format"
+
+// sns topic or sqs queue, for the serverless consumers; the message is the announcement as json,
+// or its plain text
+type AwsDestination struct {
+	DestinationBase
+	// "sns" or "sqs"
+	Service string `json:"service"`
+	Region string `json:"region"`
+	AwsCredentials
+	// sns
+	TopicArn string `json:"topicArn"`
+	// sqs, e.g. https://sqs.eu-west-1.amazonaws.com/123456789012/releases
+	QueueUrl string `json:"queueUrl"`
+	// "event" (default) or "text"
+	Message string `json:"message"`
+	// the api address instead of the regional one, e.g. of localstack
+	Endpoint string `json:"endpoint"`
+}
+
+func init() {
+	RegisterDestination("aws", func() Destination { return &AwsDestination{} })
+}
+
+type awsErrorResponse struct {
+	Code string `xml:"Error>Code"`
+	Message string `xml:"Error>Message"`
+}
+
+func (d *AwsDestination) Init() error {
+	switch d.Service {
+	case "sns":
+		if d.TopicArn == "" {
+			return fmt.Errorf("topicArn is required")
+		}
+	case "sqs":
+		if d.QueueUrl == "" {
+			return fmt.Errorf("queueUrl is required")
+		}
+	default:
+		return fmt.Errorf("service should be sns or sqs, not %q", d.Service)
+	}
+	if d.Message == "" {
+		d.Message = "event"
+	}
+	if d.Message != "event" && d.Message != "text" {
+		return fmt.Errorf("message should be event or text, not %q", d.Message)
+	}
+	if d.Region == "" {
+		// the region is in the arn and in the queue url
+		if parts := strings.Split(d.TopicArn, ":"); d.Service == "sns" && len(parts) > 3 {
+			d.Region = parts[3]
+		} else if host := strings.Split(strings.TrimPrefix(strings.TrimPrefix(d.QueueUrl, "https://"), "http://"), "."); d.Service == "sqs" && len(host) > 2 {
+			d.Region = host[1]
+		}
+	}
+	if d.Region == "" {
+		return fmt.Errorf("region is required")
+	}
+
+	d.fromEnvironment()
+	if d.AccessKeyId == "" || d.SecretAccessKey == "" {
+		return fmt.Errorf("accessKeyId and secretAccessKey, or AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY, are required")
+	}
+	redactor.Add(d.SecretAccessKey)
+	redactor.Add(d.SessionToken)
+	return nil
+}
+
+func (d *AwsDestination) Send(announcement *format.Announcement) error {
+	message := announcement.PlainText()
+	if d.Message == "event" {
+		data, err := json.Marshal(NewAnnouncementEvent(announcement))
+		if err != nil {
+			return err
+		}
+		message = string(data)
+	}
+
+	var address string
+	form := url.Values{}
+	if d.Service == "sns" {
+		address = "https://sns." + d.Region + ".amazonaws.com/"
+		form.Set("Action", "Publish")
+		form.Set("Version", "2010-03-31")
+		form.Set("TopicArn", d.TopicArn)
+		form.Set("Message", message)
+		// the email subscribers see it, at most 100 characters
+		form.Set("Subject", format.TruncateRunes(announcement.Action + ": " + announcement.Issue.Key, 100))
+	} else {
+		address = d.QueueUrl
+		form.Set("Action", "SendMessage")
+		form.Set("Version", "2012-11-05")
+		form.Set("MessageBody", message)
+	}
+	if d.Endpoint != "" {
+		parsed, err := url.Parse(address)
+		if err != nil {
+			return err
+		}
+		address = strings.TrimRight(d.Endpoint, "/") + parsed.Path
+	}
+
+	body := []byte(form.Encode())
+	request, err := http.NewRequest("POST", address, strings.NewReader(string(body)))
+	if err != nil {
+		return err
+	}
+	for name, value := range d.WithHeaders(map[string]string { "Content-Type": "application/x-www-form-urlencoded; charset=utf-8" }) {
+		request.Header.Set(name, value)
+	}
+	SignAws(request, body, d.Service, d.Region, &d.AwsCredentials, time.Now())
+
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if err := CheckResponse(response); err != nil {
+		// the aws errors are xml, their code is more telling than the body
+		if delivery, ok := err.(*DeliveryError); ok {
+			var awsError awsErrorResponse
+			if xml.Unmarshal([]byte(delivery.Body), &awsError) == nil && awsError.Code != "" {
+				delivery.Body = awsError.Code + ": " + awsError.Message
+				delivery.Retryable = delivery.Retryable || awsError.Code == "Throttling" || awsError.Code == "ThrottlingException"
+			}
+		}
+		return err
+	}
+
+	log.Printf("published %s to %s %s\n", announcement.Issue.Key, d.Service, d.TopicArn + d.QueueUrl)
+	return nil
+}
@@ -0,0 +1,105 @@
+package main
+
+import "crypto/hmac"
+import "crypto/sha256"
+import "encoding/base64"
+import "fmt"
+import "log"
+import "net/url"
+import "strconv"
+import "strings"
+import "time"
+import "ru/wikimart/dataflow/format"
+
+// how long the service bus tokens are valid
+const AZURE_SAS_TTL = 10 * time.Minute
+
+// azure event grid topic or service bus queue, the announcement event is published
+type AzureDestination struct {
+	DestinationBase
+	// "eventgrid" or "servicebus"
+	Service string `json:"service"`
+	// event grid topic endpoint, e.g. https://releases.westeurope-1.eventgrid.azure.net/api/events,
+	// or the service bus queue or topic, e.g. https://shop.servicebus.windows.net/releases
+	Url string `json:"url"`
+	// the access key of the event grid topic, or the shared access key of the service bus policy
+	Key string `json:"key"`
+	// name of the service bus shared access policy, e.g. RootManageSharedAccessKey
+	KeyName string `json:"keyName"`
+	// event grid event type prefix, "Jira" by default: Jira.Release, Jira.attachment_created
+	EventTypePrefix string `json:"eventTypePrefix"`
+}
+
+func init() {
+	RegisterDestination("azure", func() Destination { return &AzureDestination{} })
+}
+
+type EventGridEvent struct {
+	Id string `json:"id"`
+	EventType string `json:"eventType"`
+	Subject string `json:"subject"`
+	EventTime time.Time `json:"eventTime"`
+	Data *AnnouncementEvent `json:"data"`
+	DataVersion string `json:"dataVersion"`
+}
+
+func (d *AzureDestination) Init() error {
+	if d.Url == "" || d.Key == "" {
+		return fmt.Errorf("url and key are required")
+	}
+	switch d.Service {
+	case "eventgrid":
+	case "servicebus":
+		if d.KeyName == "" {
+			return fmt.Errorf("keyName is required")
+		}
+	default:
+		return fmt.Errorf("service should be eventgrid or servicebus, not %q", d.Service)
+	}
+	if d.EventTypePrefix == "" {
+		d.EventTypePrefix = "Jira"
+	}
+	redactor.Add(d.Key)
+	return nil
+}
+
+// shared access signature of the service bus resource
+func (d *AzureDestination) sasToken(now time.Time) string {
+	resource := strings.ToLower(url.QueryEscape(strings.TrimRight(d.Url, "/")))
+	expiry := strconv.FormatInt(now.Add(AZURE_SAS_TTL).Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(d.Key))
+	mac.Write([]byte(resource + "\n" + expiry))
+	signature := base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	return fmt.Sprintf("SharedAccessSignature sr=%s&sig=%s&se=%s&skn=%s", resource, url.QueryEscape(signature), expiry, url.QueryEscape(d.KeyName))
+}
+
+func (d *AzureDestination) Send(announcement *format.Announcement) error {
+	event := NewAnnouncementEvent(announcement)
+
+	if d.Service == "servicebus" {
+		headers := d.WithHeaders(map[string]string { "Authorization": d.sasToken(time.Now()) })
+		if err := JsonRequest("POST", strings.TrimRight(d.Url, "/") + "/messages", headers, event, nil); err != nil {
+			return err
+		}
+		log.Printf("published %s to service bus\n", announcement.Issue.Key)
+		return nil
+	}
+
+	eventType := announcement.Transition
+	if announcement.Event != "" {
+		eventType = announcement.Event
+	}
+	gridEvent := &EventGridEvent {
+		Id: fmt.Sprintf("%s-%d", announcement.Issue.Key, announcement.Received.UnixNano()),
+		EventType: d.EventTypePrefix + "." + eventType,
+		Subject: announcement.Instance + "/" + announcement.Project + "/" + announcement.Issue.Key,
+		EventTime: announcement.Received,
+		Data: event,
+		DataVersion: "1",
+	}
+	if err := JsonRequest("POST", d.Url, d.WithHeaders(map[string]string { "aeg-sas-key": d.Key }), []*EventGridEvent { gridEvent }, nil); err != nil {
+		return err
+	}
+	log.Printf("published %s to event grid as %s\n", announcement.Issue.Key, gridEvent.EventType)
+	return nil
+}
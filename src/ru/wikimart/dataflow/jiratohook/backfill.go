@@ -0,0 +1,200 @@
+package main
+
+import "bytes"
+import "crypto/hmac"
+import "crypto/sha256"
+import "encoding/hex"
+import "encoding/json"
+import "flag"
+import "fmt"
+import "log"
+import "net/http"
+import "net/url"
+import "sort"
+import "strings"
+import "time"
+import "ru/wikimart/dataflow/jiraevent"
+
+// how jira formats the changelog times
+const JIRA_TIME_LAYOUT = "2006-01-02T15:04:05.000-0700"
+
+type backfillHistory struct {
+	Author *jiraevent.User `json:"author"`
+	Created string `json:"created"`
+	Items []jiraevent.ChangelogItem `json:"items"`
+}
+
+type backfillIssue struct {
+	Key string `json:"key"`
+	Self string `json:"self"`
+	// kept as is, so the custom fields reach the service too
+	Fields json.RawMessage `json:"fields"`
+	Changelog struct {
+		Histories []backfillHistory `json:"histories"`
+	} `json:"changelog"`
+}
+
+type backfillSearch struct {
+	Total int `json:"total"`
+	Issues []backfillIssue `json:"issues"`
+}
+
+// status change found in the history, as the workflow post function would have sent it
+type backfillTransition struct {
+	time time.Time
+	payload map[string]interface{}
+}
+
+// the status changes of the issues found by the jql since the given time, oldest first
+func findTransitions(instance *JiraInstance, jql string, since time.Time, names map[string]string) ([]backfillTransition, error) {
+	var transitions []backfillTransition
+	for startAt := 0; ; {
+		var search backfillSearch
+		query := url.Values {
+			"jql": []string { jql },
+			"expand": []string { "changelog" },
+			"startAt": []string { fmt.Sprint(startAt) },
+			"maxResults": []string { "50" },
+		}
+		if err := instance.Request("GET", "/rest/api/2/search?" + query.Encode(), nil, &search); err != nil {
+			return nil, err
+		}
+
+		for _, issue := range search.Issues {
+			for _, history := range issue.Changelog.Histories {
+				created, err := time.Parse(JIRA_TIME_LAYOUT, history.Created)
+				if err != nil || created.Before(since) {
+					continue
+				}
+				for _, item := range history.Items {
+					if item.Field != "status" {
+						continue
+					}
+					// the changelog tells the statuses only, the transition is named by its target status unless mapped
+					name := names[item.ToString]
+					if name == "" {
+						name = item.ToString
+					}
+					transitions = append(transitions, backfillTransition {
+						time: created,
+						payload: map[string]interface{} {
+							"webhookEvent": "jira:issue_updated",
+							"timestamp": created.UnixNano() / int64(time.Millisecond),
+							"user": history.Author,
+							"transition": &jiraevent.Transition { FromStatus: item.FromString, ToStatus: item.ToString, Name: name },
+							"issue": map[string]interface{} { "key": issue.Key, "self": issue.Self, "fields": issue.Fields },
+						},
+					})
+				}
+			}
+		}
+
+		startAt += len(search.Issues)
+		if len(search.Issues) == 0 || startAt >= search.Total {
+			break
+		}
+	}
+
+	sort.SliceStable(transitions, func(i, j int) bool { return transitions[i].time.Before(transitions[j].time) })
+	return transitions, nil
+}
+
+// posts the payload to the running service like jira would, signed with the instance secret
+func postBackfill(target string, instance *JiraInstance, payload map[string]interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	request, err := http.NewRequest("POST", target, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("X-Jira-Instance", instance.Name)
+	if instance.Secret != "" {
+		mac := hmac.New(sha256.New, []byte(instance.Secret))
+		mac.Write(body)
+		request.Header.Set("X-Hub-Signature", "sha256=" + hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	return CheckResponse(response)
+}
+
+// jiratohook backfill -jql '...' -target http://jiratohook:8080/ [-since 24h] [-config config.json -instance name | -user u -token t http://jira.address]
+func BackfillCommand(arguments []string) {
+	flags := flag.NewFlagSet("backfill", flag.ExitOnError)
+	jql := flags.String("jql", "", "issues to look for the transitions in, e.g. 'project = QA AND status changed to Released after -1d'")
+	since := flags.Duration("since", 24 * time.Hour, "transitions older than this are skipped")
+	target := flags.String("target", "", "address of the running jiratohook the transitions are posted to, as jira would")
+	configPath := flags.String("config", "", "json config with the jira instances")
+	instanceName := flags.String("instance", "", "instance of the config to read the history of, the service gets its name in X-Jira-Instance")
+	user := flags.String("user", "", "jira user for the instance given as an argument")
+	token := flags.String("token", "", "jira password or token, can be a file:, env: or vault: reference")
+	transitionNames := flags.String("transitions", "", "transition names by target status, e.g. 'Released=Release,Deployed=Deploy'; the status is the name if not given")
+	dryRun := flags.Bool("dry-run", false, "print the transitions found instead of posting them")
+	flags.Parse(arguments)
+
+	if *jql == "" || (*target == "" && !*dryRun) {
+		log.Fatalf("backfill needs -jql and -target\n")
+	}
+
+	var instance *JiraInstance
+	if flags.NArg() > 0 {
+		resolvedToken, err := ResolveSecret(*token)
+		if err != nil {
+			log.Fatalf("error when resolving the token: %s\n", err)
+		}
+		instance = &JiraInstance { Name: "default", Url: flags.Arg(0), User: *user, Token: resolvedToken }
+	} else if *configPath != "" {
+		config, err := LoadConfig(*configPath)
+		if err != nil {
+			log.Fatalf("error when loading config %s: %s\n", *configPath, err)
+		}
+		for _, configured := range config.Instances {
+			if configured.Name == *instanceName {
+				instance = configured
+			}
+		}
+		if instance == nil {
+			log.Fatalf("no instance %q in config %s\n", *instanceName, *configPath)
+		}
+	} else {
+		log.Fatalf("backfill needs the jira address or -config with -instance\n")
+	}
+
+	names := map[string]string{}
+	for _, pair := range strings.Split(*transitionNames, ",") {
+		if status, name, ok := strings.Cut(pair, "="); ok {
+			names[strings.TrimSpace(status)] = strings.TrimSpace(name)
+		}
+	}
+
+	transitions, err := findTransitions(instance, *jql, time.Now().Add(-*since), names)
+	if err != nil {
+		log.Fatalf("error when searching %s: %s\n", instance.Name, err)
+	}
+	log.Printf("%d transition(s) found\n", len(transitions))
+
+	failed := 0
+	for _, transition := range transitions {
+		issue := transition.payload["issue"].(map[string]interface{})["key"]
+		change := transition.payload["transition"].(*jiraevent.Transition)
+		log.Printf("%s %s: %s → %s (%s)\n", transition.time.Format(time.RFC3339), issue, change.FromStatus, change.ToStatus, change.Name)
+		if *dryRun {
+			continue
+		}
+		if err := postBackfill(*target, instance, transition.payload); err != nil {
+			log.Printf("error when posting %s: %s\n", issue, err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		log.Fatalf("%d of %d transition(s) not posted\n", failed, len(transitions))
+	}
+}
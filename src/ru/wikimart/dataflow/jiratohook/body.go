@@ -0,0 +1,94 @@
+package main
+
+import "bufio"
+import "compress/flate"
+import "compress/gzip"
+import "compress/zlib"
+import "fmt"
+import "io"
+import "net/http"
+import "strings"
+
+// the body is larger than allowed once decompressed
+type BodyTooLargeError struct {
+	Limit int64
+}
+
+func (e *BodyTooLargeError) Error() string {
+	return fmt.Sprintf("body is larger than %d bytes", e.Limit)
+}
+
+// the body is compressed in a way the service does not know
+type UnsupportedEncodingError struct {
+	Encoding string
+}
+
+func (e *UnsupportedEncodingError) Error() string {
+	return fmt.Sprintf("unsupported content encoding %q", e.Encoding)
+}
+
+// whether the stream starts with a zlib header: the deflate method and the check bits
+func isZlib(reader *bufio.Reader) bool {
+	header, err := reader.Peek(2)
+	if err != nil {
+		return false
+	}
+	return header[0] & 0x0f == 8 && (uint16(header[0]) << 8 | uint16(header[1])) % 31 == 0
+}
+
+// reads the request body, decompressed if a gateway compressed it, up to the limit, no limit if zero
+func ReadBody(request *http.Request, limit int64) ([]byte, error) {
+	var reader io.Reader = request.Body
+	switch encoding := strings.ToLower(strings.TrimSpace(request.Header.Get("Content-Encoding"))); encoding {
+	case "", "identity":
+	case "gzip", "x-gzip":
+		decompressor, err := gzip.NewReader(request.Body)
+		if err != nil {
+			return nil, err
+		}
+		defer decompressor.Close()
+		reader = decompressor
+	case "deflate":
+		// deflate is zlib by the http spec, some senders send the raw deflate stream though
+		buffered := bufio.NewReader(request.Body)
+		if isZlib(buffered) {
+			decompressor, err := zlib.NewReader(buffered)
+			if err != nil {
+				return nil, err
+			}
+			defer decompressor.Close()
+			reader = decompressor
+		} else {
+			decompressor := flate.NewReader(buffered)
+			defer decompressor.Close()
+			reader = decompressor
+		}
+	default:
+		return nil, &UnsupportedEncodingError { Encoding: encoding }
+	}
+
+	if limit <= 0 {
+		return io.ReadAll(reader)
+	}
+	// one byte more tells the bodies over the limit
+	body, err := io.ReadAll(io.LimitReader(reader, limit + 1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(body)) > limit {
+		return nil, &BodyTooLargeError { Limit: limit }
+	}
+	return body, nil
+}
+
+// answers the error of ReadBody
+func WriteBodyProblem(response http.ResponseWriter, request *http.Request, err error) {
+	switch err.(type) {
+	case *BodyTooLargeError:
+		WriteProblem(response, request, http.StatusRequestEntityTooLarge, PROBLEM_TOO_LARGE, err.Error())
+	case *UnsupportedEncodingError:
+		WriteProblem(response, request, http.StatusUnsupportedMediaType, PROBLEM_UNSUPPORTED_ENCODING, err.Error())
+	default:
+		WriteProblem(response, request, http.StatusBadRequest, PROBLEM_READ_FAILED, "error when reading a request")
+	}
+}
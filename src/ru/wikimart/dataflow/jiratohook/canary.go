@@ -0,0 +1,61 @@
+package main
+
+import "fmt"
+import "time"
+
+// sends the output of a new rule to a shadow channel until the given time, the rule it replaces
+// serves the real channels meanwhile; afterwards the new rule takes over and the replaced one stops
+type RuleCanary struct {
+	// shadow destination names
+	Destinations []string `json:"destinations"`
+	// RFC 3339 time the canary period ends, e.g. "2026-11-01T00:00:00Z"
+	Until string `json:"until"`
+	// name of the rule retired when the period ends, none if empty
+	Replaces string `json:"replaces"`
+
+	destinations []Destination
+	until time.Time
+}
+
+func (c *RuleCanary) Init(destinations []Destination) error {
+	if len(c.Destinations) == 0 {
+		return fmt.Errorf("destinations are required")
+	}
+	var err error
+	if c.destinations, err = findDestinations(c.Destinations, destinations); err != nil {
+		return err
+	}
+	if c.until, err = time.Parse(time.RFC3339, c.Until); err != nil {
+		return fmt.Errorf("until: %s", err.Error())
+	}
+	return nil
+}
+
+// whether the rule still sends to the shadow destinations
+func (r *Rule) InCanary() bool {
+	return r.Canary != nil && time.Now().Before(r.Canary.until)
+}
+
+// whether a canary rule took over the rule
+func (r *Rule) Retired() bool {
+	return r.replacedBy != nil && !r.replacedBy.InCanary()
+}
+
+// links the replaced rules to their canaries
+func linkCanaries(rules []*Rule) error {
+	byName := map[string]*Rule{}
+	for _, rule := range rules {
+		byName[rule.Name] = rule
+	}
+	for _, rule := range rules {
+		if rule.Canary == nil || rule.Canary.Replaces == "" {
+			continue
+		}
+		replaced, ok := byName[rule.Canary.Replaces]
+		if !ok || replaced == rule {
+			return fmt.Errorf("rule %s: canary: unknown rule %q to replace", rule.Name, rule.Canary.Replaces)
+		}
+		replaced.replacedBy = rule
+	}
+	return nil
+}
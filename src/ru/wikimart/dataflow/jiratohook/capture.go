@@ -0,0 +1,136 @@
+package main
+
+import "encoding/json"
+import "fmt"
+import "log"
+import "net/http"
+import "os"
+import "path/filepath"
+import "strconv"
+import "strings"
+import "sync"
+import "time"
+
+// most payloads captured with one request
+const MAX_CAPTURE = 100
+
+// stores the next incoming payloads as fixtures, e.g. for the e2e harness or template development
+type Capture struct {
+	Dir string
+
+	mutex sync.Mutex
+	remaining int
+}
+
+// whether the next payloads are captured
+func (c *Capture) Active() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.remaining > 0
+}
+
+type CaptureStatus struct {
+	Remaining int `json:"remaining"`
+	Dir string `json:"dir"`
+}
+
+// personal data replaced in the captured payloads
+var capturedPersonalFields = map[string]string {
+	"emailaddress": "user@example.com",
+	"displayname": "Jira User",
+}
+
+// replaces the secrets and the personal data, drops the avatars
+func sanitizePayload(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for name, field := range v {
+			lower := strings.ToLower(name)
+			if lower == "avatarurls" {
+				delete(v, name)
+			} else if replacement, ok := capturedPersonalFields[lower]; ok {
+				if _, isString := field.(string); isString {
+					v[name] = replacement
+				}
+			} else if isSecretField(name) {
+				v[name] = "[redacted]"
+			} else {
+				v[name] = sanitizePayload(field)
+			}
+		}
+	case []interface{}:
+		for i, item := range v {
+			v[i] = sanitizePayload(item)
+		}
+	}
+	return value
+}
+
+func (c *Capture) Start(count int) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.remaining = count
+}
+
+func (c *Capture) Status() *CaptureStatus {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return &CaptureStatus { Remaining: c.remaining, Dir: c.Dir }
+}
+
+// writes the payload if the capture is on, the invalid json payloads are skipped
+func (c *Capture) Take(event string, issue string, payload []byte) {
+	c.mutex.Lock()
+	if c.remaining == 0 {
+		c.mutex.Unlock()
+		return
+	}
+	c.remaining--
+	c.mutex.Unlock()
+
+	var value interface{}
+	if err := json.Unmarshal(payload, &value); err != nil {
+		log.Printf("capture: skipping a payload: %s\n", err)
+		return
+	}
+	data, err := json.MarshalIndent(sanitizePayload(value), "", "\t")
+	if err != nil {
+		log.Printf("capture: %s\n", err)
+		return
+	}
+
+	name := time.Now().Format("20060102-150405.000")
+	for _, part := range []string { event, issue } {
+		if part != "" {
+			name = name + "-" + part
+		}
+	}
+	name = strings.NewReplacer(":", "_", "/", "_", "\\", "_").Replace(name) + ".json"
+
+	if err := os.MkdirAll(c.Dir, 0700); err != nil {
+		log.Printf("capture: %s\n", err)
+		return
+	}
+	path := filepath.Join(c.Dir, name)
+	if err := os.WriteFile(path, []byte(redactor.Redact(string(data)) + "\n"), 0600); err != nil {
+		log.Printf("capture: %s\n", err)
+		return
+	}
+	log.Printf("captured %s\n", path)
+}
+
+// starts capturing the next n payloads, POST /admin/capture?n=5
+func (a *AdminHandler) StartCapture(response http.ResponseWriter, request *http.Request) {
+	count := 1
+	if n := request.URL.Query().Get("n"); n != "" {
+		var err error
+		if count, err = strconv.Atoi(n); err != nil || count < 0 || count > MAX_CAPTURE {
+			WriteProblem(response, request, http.StatusBadRequest, PROBLEM_INVALID_PARAMETER, fmt.Sprintf("n should be a number from 0 to %d", MAX_CAPTURE))
+			return
+		}
+	}
+
+	log.Printf("capturing %d payload(s) to %s\n", count, a.Capture.Dir)
+	a.Capture.Start(count)
+	writeJson(response, a.Capture.Status())
+}
@@ -0,0 +1,68 @@
+package main
+
+import "fmt"
+import "io"
+import "log"
+import "math/rand"
+import "net/http"
+import "strings"
+import "time"
+
+// fails and delays the outbound posts, for testing the retries and the queue in staging, see -chaos-failures
+type chaosTransport struct {
+	http.RoundTripper
+	// share of the posts failed, 0 to 1
+	failures float64
+	// the rest of the posts are delayed by up to this
+	delay time.Duration
+}
+
+// the reads, e.g. of the jira rest api, are passed through
+func (t *chaosTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	if request.Method == "GET" || request.Method == "HEAD" {
+		return t.RoundTripper.RoundTrip(request)
+	}
+
+	if rand.Float64() < t.failures {
+		if request.Body != nil {
+			request.Body.Close()
+		}
+		// every kind of failure the deliveries handle differently
+		switch rand.Intn(3) {
+		case 0:
+			log.Printf("chaos: failing %s %s with 503\n", request.Method, request.URL.Host)
+			return chaosResponse(request, http.StatusServiceUnavailable, nil), nil
+		case 1:
+			log.Printf("chaos: failing %s %s with 429\n", request.Method, request.URL.Host)
+			return chaosResponse(request, http.StatusTooManyRequests, http.Header { "Retry-After": []string { "1" } }), nil
+		default:
+			log.Printf("chaos: failing %s %s with a connection error\n", request.Method, request.URL.Host)
+			return nil, fmt.Errorf("chaos: connection refused")
+		}
+	}
+
+	if t.delay > 0 {
+		delay := time.Duration(rand.Int63n(int64(t.delay)))
+		log.Printf("chaos: delaying %s %s by %s\n", request.Method, request.URL.Host, delay)
+		time.Sleep(delay)
+	}
+	return t.RoundTripper.RoundTrip(request)
+}
+
+func chaosResponse(request *http.Request, status int, header http.Header) *http.Response {
+	if header == nil {
+		header = http.Header{}
+	}
+	body := "chaos: injected failure"
+	return &http.Response {
+		Status: fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		StatusCode: status,
+		Proto: "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header: header,
+		Body: io.NopCloser(strings.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request: request,
+	}
+}
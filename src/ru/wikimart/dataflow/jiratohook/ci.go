@@ -0,0 +1,336 @@
+package main
+
+import "crypto/hmac"
+import "crypto/sha256"
+import "encoding/hex"
+import "encoding/json"
+import "fmt"
+import "log"
+import "net/http"
+import "strings"
+import "time"
+import "ru/wikimart/dataflow/format"
+
+// deployments reported by the ci, announced by the rules having it in their events
+const CI_DEPLOYMENT_EVENT = "ci_deployment"
+
+// github actions and bitbucket pipelines webhooks at /ci/github and /ci/bitbucket
+type CiConfig struct {
+	// the secret of the webhooks, required: anybody reaching /ci/ could announce deployments otherwise
+	Secret string `json:"secret"`
+	// the jira instance the issue keys belong to, the first one if empty
+	Instance string `json:"instance"`
+}
+
+func (c *CiConfig) Init() error {
+	if c.Secret == "" {
+		return fmt.Errorf("ci: secret is required")
+	}
+	return nil
+}
+
+// a build or a deployment, whichever ci reported it
+type CiEvent struct {
+	Provider string
+	// unique per provider, the build the issues are correlated with
+	Id string
+	// e.g. "CI #42"
+	Name string
+	Url string
+	// success, failure, in_progress, ...
+	State string
+	// set for the deployments
+	Environment string
+	Commit string
+	// the branch or the tag, the issue keys are looked for in it and in the message
+	Ref string
+	Message string
+}
+
+func (e *CiEvent) IssueKeys() []string {
+	seen := map[string]bool{}
+	var keys []string
+	for _, key := range issueKeyPattern.FindAllString(e.Ref + "\n" + e.Message, -1) {
+		if !seen[key] {
+			seen[key] = true
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// the values merged into the metadata of the issues, shown in their following announcements
+func (e *CiEvent) Metadata() map[string]string {
+	values := map[string]string {
+		"build": e.Name,
+		"build_status": e.State,
+	}
+	if e.Url != "" {
+		values["build_url"] = e.Url
+	}
+	if commit := e.Commit; commit != "" {
+		if len(commit) > 12 {
+			commit = commit[:12]
+		}
+		values["commit"] = commit
+	}
+	if e.Environment != "" {
+		values["environment"] = e.Environment
+	}
+	return values
+}
+
+type githubPayload struct {
+	WorkflowRun *struct {
+		Id int64 `json:"id"`
+		Name string `json:"name"`
+		RunNumber int `json:"run_number"`
+		HtmlUrl string `json:"html_url"`
+		Status string `json:"status"`
+		Conclusion string `json:"conclusion"`
+		HeadBranch string `json:"head_branch"`
+		HeadSha string `json:"head_sha"`
+		HeadCommit *struct {
+			Message string `json:"message"`
+		} `json:"head_commit"`
+	} `json:"workflow_run"`
+	Deployment *struct {
+		Id int64 `json:"id"`
+		Ref string `json:"ref"`
+		Sha string `json:"sha"`
+		Environment string `json:"environment"`
+		Description string `json:"description"`
+	} `json:"deployment"`
+	DeploymentStatus *struct {
+		State string `json:"state"`
+		Environment string `json:"environment"`
+		TargetUrl string `json:"target_url"`
+		LogUrl string `json:"log_url"`
+		Description string `json:"description"`
+	} `json:"deployment_status"`
+	Repository *struct {
+		FullName string `json:"full_name"`
+	} `json:"repository"`
+}
+
+// workflow_run and deployment_status events, nil for the rest of them
+func parseGithubEvent(event string, body []byte) (*CiEvent, error) {
+	var payload githubPayload
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil, err
+	}
+	repository := ""
+	if payload.Repository != nil {
+		repository = payload.Repository.FullName + " "
+	}
+
+	switch {
+	case event == "workflow_run" && payload.WorkflowRun != nil:
+		run := payload.WorkflowRun
+		ci := &CiEvent {
+			Provider: "github",
+			Id: fmt.Sprintf("github:%d", run.Id),
+			Name: fmt.Sprintf("%s%s #%d", repository, run.Name, run.RunNumber),
+			Url: run.HtmlUrl,
+			State: run.Status,
+			Commit: run.HeadSha,
+			Ref: run.HeadBranch,
+		}
+		if run.Conclusion != "" {
+			ci.State = run.Conclusion
+		}
+		if run.HeadCommit != nil {
+			ci.Message = run.HeadCommit.Message
+		}
+		return ci, nil
+	case event == "deployment_status" && payload.Deployment != nil && payload.DeploymentStatus != nil:
+		status := payload.DeploymentStatus
+		ci := &CiEvent {
+			Provider: "github",
+			Id: fmt.Sprintf("github:deployment:%d", payload.Deployment.Id),
+			Name: repository + "deployment",
+			Url: status.TargetUrl,
+			State: status.State,
+			Environment: status.Environment,
+			Commit: payload.Deployment.Sha,
+			Ref: payload.Deployment.Ref,
+			Message: payload.Deployment.Description + "\n" + status.Description,
+		}
+		if status.LogUrl != "" {
+			ci.Url = status.LogUrl
+		}
+		if ci.Environment == "" {
+			ci.Environment = payload.Deployment.Environment
+		}
+		return ci, nil
+	}
+	return nil, nil
+}
+
+type bitbucketPayload struct {
+	CommitStatus *struct {
+		Name string `json:"name"`
+		Key string `json:"key"`
+		State string `json:"state"`
+		Url string `json:"url"`
+		RefName string `json:"refname"`
+		Commit *struct {
+			Hash string `json:"hash"`
+			Message string `json:"message"`
+		} `json:"commit"`
+	} `json:"commit_status"`
+	Repository *struct {
+		FullName string `json:"full_name"`
+	} `json:"repository"`
+}
+
+// the pipelines report the builds and the deployment steps as commit statuses,
+// the deployments are recognized by the "deploy to <environment>" step names
+func parseBitbucketEvent(event string, body []byte) (*CiEvent, error) {
+	if event != "repo:commit_status_created" && event != "repo:commit_status_updated" {
+		return nil, nil
+	}
+	var payload bitbucketPayload
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil, err
+	}
+	if payload.CommitStatus == nil {
+		return nil, nil
+	}
+
+	status := payload.CommitStatus
+	ci := &CiEvent {
+		Provider: "bitbucket",
+		Name: status.Name,
+		Url: status.Url,
+		State: map[string]string { "SUCCESSFUL": "success", "FAILED": "failure", "INPROGRESS": "in_progress", "STOPPED": "cancelled" }[status.State],
+		Ref: status.RefName,
+	}
+	if payload.Repository != nil {
+		ci.Name = payload.Repository.FullName + " " + ci.Name
+	}
+	if status.Commit != nil {
+		ci.Commit = status.Commit.Hash
+		ci.Message = status.Commit.Message
+	}
+	// a status is unique by its key per commit, the pipelines reuse the keys of the steps
+	ci.Id = "bitbucket:" + status.Key + "@" + ci.Commit
+	if payload.Repository != nil {
+		ci.Id = "bitbucket:" + payload.Repository.FullName + "/" + status.Key + "@" + ci.Commit
+	}
+	if lower := strings.ToLower(status.Name); strings.Contains(lower, "deploy to ") {
+		ci.Environment = strings.TrimSpace(status.Name[strings.Index(lower, "deploy to ") + len("deploy to "):])
+	}
+	return ci, nil
+}
+
+// github sends X-Hub-Signature-256, bitbucket X-Hub-Signature, both sha256=<hmac of the body>
+func verifyCiSignature(request *http.Request, body []byte, secret string) bool {
+	signature := request.Header.Get("X-Hub-Signature-256")
+	if signature == "" {
+		signature = request.Header.Get("X-Hub-Signature")
+	}
+	expected, err := hex.DecodeString(strings.TrimPrefix(signature, "sha256="))
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hmac.Equal(mac.Sum(nil), expected)
+}
+
+func (h *JiraHandler) ciInstance() *JiraInstance {
+	for _, instance := range h.Instances {
+		if h.Ci != nil && instance.Name == h.Ci.Instance {
+			return instance
+		}
+	}
+	return h.Instances[0]
+}
+
+// the announcement of a successful deployment of the issue
+func (h *JiraHandler) BuildCiDeployment(ci *CiEvent, key string, instance *JiraInstance) *format.Announcement {
+	announcement := &format.Announcement {
+		Event: CI_DEPLOYMENT_EVENT,
+		Received: time.Now(),
+		Instance: instance.Name,
+		Project: format.IssueProject(key),
+		Issue: format.Issue { Key: key, Url: instance.IssueUrl(key), PriorityRank: priorityRank(nil) },
+		Emoji: ":rocket:",
+		Action: "issue deployed to " + ci.Environment,
+		Environment: ci.Environment,
+		Metadata: h.Metadata.Get(key),
+	}
+	h.AddBuilds(announcement)
+	return announcement
+}
+
+// ci webhooks: the builds and the deployments are remembered as the metadata of the issues
+// found in the branch and the commit message, the successful deployments are announced
+func (h *JiraHandler) ServeCi(response http.ResponseWriter, request *http.Request) {
+	if request.Method != "POST" {
+		WriteProblem(response, request, http.StatusMethodNotAllowed, PROBLEM_METHOD_NOT_ALLOWED, "POST expected")
+		return
+	}
+	body, err := ReadBody(request, h.MaxBody)
+	if err != nil {
+		WriteBodyProblem(response, request, err)
+		return
+	}
+	if !verifyCiSignature(request, body, h.Ci.Secret) {
+		WriteProblem(response, request, http.StatusUnauthorized, PROBLEM_SIGNATURE_MISMATCH, "signature mismatch")
+		return
+	}
+
+	var ci *CiEvent
+	switch request.URL.Path {
+	case "/ci/github":
+		ci, err = parseGithubEvent(request.Header.Get("X-GitHub-Event"), body)
+	case "/ci/bitbucket":
+		ci, err = parseBitbucketEvent(request.Header.Get("X-Event-Key"), body)
+	default:
+		WriteProblem(response, request, http.StatusNotFound, PROBLEM_INVALID_PARAMETER, "unknown ci, /ci/github or /ci/bitbucket expected")
+		return
+	}
+	if err != nil {
+		WriteProblem(response, request, http.StatusBadRequest, PROBLEM_INVALID_PAYLOAD, "error when decoding a payload")
+		return
+	}
+	// the other events, e.g. the pings, are accepted and ignored
+	if ci == nil {
+		return
+	}
+
+	keys := ci.IssueKeys()
+	log.Printf("ci %s: %s %s, issues %s\n", ci.Provider, ci.Name, ci.State, strings.Join(keys, ", "))
+	if h.Correlations != nil && len(keys) > 0 {
+		build := &Correlation { Build: ci.Id, Name: ci.Name, Url: ci.Url, Environment: ci.Environment, Keys: keys }
+		if _, err := h.Correlations.Record(build); err != nil {
+			log.Printf("error when saving the correlations: %s\n", err)
+		}
+	}
+	instance := h.ciInstance()
+	snoozed := map[string]*Snooze{}
+	if ci.Environment != "" && ci.State == "success" {
+		snoozed = h.Snoozes.FindAll(instance, keys)
+	}
+	for _, key := range keys {
+		h.Metadata.SetValues(key, ci.Metadata())
+		if ci.Environment == "" || ci.State != "success" {
+			continue
+		}
+
+		announcement := h.BuildCiDeployment(ci, key, instance)
+		if snooze := snoozed[key]; snooze != nil {
+			log.Printf("%s is snoozed until %s by %s, not announced\n", key, snooze.Until.Format(time.RFC3339), snooze.Id)
+			continue
+		}
+		for _, rule := range h.MatchingRules(announcement) {
+			if !h.StartCooldown(rule, announcement) {
+				log.Printf("rule %s: %s %s is cooling down, not announced\n", rule.Name, key, announcement.Event)
+				continue
+			}
+			h.Route(rule, announcement)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import "log"
+import "sync"
+import "time"
+import "ru/wikimart/dataflow/format"
+
+type pendingAnnouncement struct {
+	announcement *format.Announcement
+	// transitions seen within the window, in order
+	transitions []string
+	// outbox ids of all of them
+	outboxIds []string
+	timer *time.Timer
+}
+
+// holds back announcements of the same issue for a rule's window,
+// so a Deploy → Rollback → Deploy bounce gives one message with the final state
+type Coalescer struct {
+	mutex sync.Mutex
+	pending map[string]*pendingAnnouncement
+}
+
+func NewCoalescer() *Coalescer {
+	return &Coalescer {
+		pending: map[string]*pendingAnnouncement{},
+	}
+}
+
+// delays the announcement until no other transition of the issue comes within the window,
+// then passes the latest one to flush
+func (c *Coalescer) Add(rule *Rule, announcement *format.Announcement, flush func(rule *Rule, announcement *format.Announcement)) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	key := rule.Name + "/" + announcement.Issue.Key
+	pending, ok := c.pending[key]
+	if ok {
+		pending.timer.Stop()
+		log.Printf("coalescing %s %s with %d earlier transition(s)\n", announcement.Issue.Key, announcement.Transition, len(pending.transitions))
+	} else {
+		pending = &pendingAnnouncement{}
+		c.pending[key] = pending
+	}
+
+	pending.announcement = announcement
+	pending.transitions = append(pending.transitions, announcement.Transition)
+	pending.outboxIds = append(pending.outboxIds, announcement.OutboxIds...)
+	pending.timer = time.AfterFunc(rule.coalesceWindow, func() {
+		c.mutex.Lock()
+		// a newer transition may have replaced this one meanwhile
+		if c.pending[key] != pending {
+			c.mutex.Unlock()
+			return
+		}
+		delete(c.pending, key)
+		c.mutex.Unlock()
+
+		final := *pending.announcement
+		final.OutboxIds = pending.outboxIds
+		if len(pending.transitions) > 1 {
+			final.Coalesced = pending.transitions
+		}
+		flush(rule, &final)
+	})
+}
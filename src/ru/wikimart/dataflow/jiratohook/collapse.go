@@ -0,0 +1,63 @@
+package main
+
+import "log"
+import "sync"
+import "time"
+
+type pendingDelivery struct {
+	delivery *Delivery
+	repeats int
+	// outbox ids of all the collapsed announcements
+	outboxIds []string
+}
+
+// holds back the deliveries for a destination's collapse window,
+// so a bulk transition posting the same message again and again gives one message with a counter
+type Collapser struct {
+	mutex sync.Mutex
+	pending map[string]*pendingDelivery
+}
+
+func NewCollapser() *Collapser {
+	return &Collapser {
+		pending: map[string]*pendingDelivery{},
+	}
+}
+
+// counts the delivery if the same message to the same destination is already waiting,
+// otherwise waits the window of the destination and passes it to flush
+func (c *Collapser) Add(delivery *Delivery, flush func(delivery *Delivery)) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	// the slack text tells the messages apart well enough for all the destinations
+	key := delivery.Destination.Name() + "/" + delivery.Announcement.SlackText()
+	if pending, ok := c.pending[key]; ok {
+		pending.repeats++
+		pending.outboxIds = append(pending.outboxIds, delivery.Announcement.OutboxIds...)
+		log.Printf("destination %s: collapsing %s, %d identical message(s)\n", delivery.Destination.Name(), delivery.Announcement.Issue.Key, pending.repeats)
+		return
+	}
+
+	pending := &pendingDelivery {
+		delivery: delivery,
+		repeats: 1,
+		outboxIds: append([]string(nil), delivery.Announcement.OutboxIds...),
+	}
+	c.pending[key] = pending
+	time.AfterFunc(delivery.Destination.Base().CollapseWindow, func() {
+		c.mutex.Lock()
+		delete(c.pending, key)
+		c.mutex.Unlock()
+
+		if pending.repeats > 1 {
+			// the announcement is shared between the destinations
+			collapsed := *pending.delivery.Announcement
+			collapsed.Repeats = pending.repeats
+			collapsed.OutboxIds = pending.outboxIds
+			pending.delivery.Announcement = &collapsed
+		}
+		flush(pending.delivery)
+	})
+}
+
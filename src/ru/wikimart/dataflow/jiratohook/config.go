@@ -0,0 +1,142 @@
+package main
+
+import "bytes"
+import "encoding/json"
+import "fmt"
+import "strings"
+
+// optional json config, given with -config
+type Config struct {
+	Instances []*JiraInstance `json:"instances"`
+	Destinations []DestinationConfig `json:"destinations"`
+	// slack user ids by jira user name, account id or email
+	Users map[string]string `json:"users"`
+	// the default rule is used if there are none
+	Rules []*Rule `json:"rules"`
+	// "all" to send the announcement by every matching rule, or "first" to stop at the first one; all by default.
+	// The rules are evaluated by their priority, a matching final rule stops the evaluation either way
+	RuleMatching string `json:"ruleMatching"`
+	// "high", "normal" or "low" by transition name
+	Priorities map[string]string `json:"priorities"`
+	// "outward", "inward", "both" or "none" by link type name, which linked issues are listed
+	// in the announcements and found by the scope links; the issues of a "Release link" are listed whichever
+	// side they are on, the link types missing here are not listed
+	LinkScopes map[string]string `json:"linkScopes"`
+	// the issue keys mentioned in the summary and the description are listed like the linked issues,
+	// for the teams listing the released issues in the text instead of the links
+	ScanKeys bool `json:"scanKeys"`
+	// issue summaries longer than this number of characters are truncated
+	MaxSummaryLength int `json:"maxSummaryLength"`
+	// deploy environments, see also the rule environments
+	Environment *EnvironmentConfig `json:"environment"`
+	// event time display and late delivery flagging
+	Time *TimeConfig `json:"time"`
+	// dedup cache, rate limits and delivery queue shared by the replicas
+	Shared *SharedConfig `json:"shared"`
+	// delivery latency and failure rate alerting
+	Slo *SloConfig `json:"slo"`
+	// channel the given up deliveries and the failed config reloads are reported to
+	Ops *OpsConfig `json:"ops"`
+	// connection reuse of the outbound requests
+	Transport *TransportConfig `json:"transport"`
+	// slack app asking the approvers before the announcements of the approval rules are sent
+	Approval *ApprovalConfig `json:"approval"`
+	// github and bitbucket webhooks adding the build and deploy metadata to the issues
+	Ci *CiConfig `json:"ci"`
+	// pagerduty or opsgenie schedules the on-call named in the rollbacks is looked up in
+	OnCall *OnCallConfig `json:"onCall"`
+	// the users mapped by their email to the slack users, synced from the workspace
+	UserSync *UserSyncConfig `json:"userSync"`
+}
+
+// the config with its includes, see CONFIG_INCLUDE_KEY
+func LoadConfig(path string) (*Config, error) {
+	data, err := RenderConfig(path)
+	if err != nil {
+		return nil, err
+	}
+
+	// file:, env: and vault: references in the credential fields keep the secrets out of the config
+	data, err = ResolveSecretsJson(data)
+	if err != nil {
+		return nil, err
+	}
+
+	return decodeConfig(data)
+}
+
+// the fields of Config are the schema of the config, a misspelt field is an error instead of a setting
+// silently ignored; the fields of the destinations are checked by their types
+func decodeConfig(data []byte) (*Config, error) {
+	var config Config
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&config); err != nil {
+		if typeError, ok := err.(*json.UnmarshalTypeError); ok && typeError.Field != "" {
+			return nil, fmt.Errorf("field %s: %s expected, not a json %s", typeError.Field, typeError.Type, typeError.Value)
+		}
+		return nil, fmt.Errorf("%s", strings.TrimPrefix(err.Error(), "json: "))
+	}
+	return &config, nil
+}
+
+// the handler of the instance from the arguments and of the config with the parts the routing and the formatting
+// depend on, the service and diff-rules build it alike; nothing is started, the destinations and the rules
+// are left to the caller; config is nil without -config
+func NewRoutingHandler(defaultInstance *JiraInstance, config *Config) (*JiraHandler, error) {
+	h := &JiraHandler {
+		Instances: []*JiraInstance { defaultInstance },
+		Metadata: NewMetadataStore(),
+		Users: NewUserMap(nil),
+		Priorities: map[string]string{},
+		LinkScopes: map[string]string{},
+	}
+	for transition, priority := range DefaultTransitionPriorities {
+		h.Priorities[transition] = priority
+	}
+	for linkType, scope := range DefaultLinkScopes {
+		h.LinkScopes[linkType] = scope
+	}
+	if config == nil {
+		return h, nil
+	}
+
+	for transition, priority := range config.Priorities {
+		if _, ok := priorityNames[priority]; !ok {
+			return nil, fmt.Errorf("unknown priority %q for %s", priority, transition)
+		}
+		h.Priorities[transition] = priority
+	}
+	for linkType, scope := range config.LinkScopes {
+		if err := validLinkScope(scope); err != nil {
+			return nil, fmt.Errorf("linkScopes: %s: %s", linkType, err)
+		}
+		h.LinkScopes[linkType] = scope
+	}
+	h.ScanKeys = config.ScanKeys
+
+	// the instance from the arguments stays the fallback one
+	h.Instances = append(h.Instances, config.Instances...)
+	for _, instance := range config.Instances {
+		if err := instance.Init(); err != nil {
+			return nil, err
+		}
+	}
+	h.Users = NewUserMap(config.Users)
+
+	var err error
+	h.Rules = config.Rules
+	if h.FirstMatch, err = firstMatch(config.RuleMatching); err != nil {
+		return nil, err
+	}
+	h.Environment = config.Environment
+	h.MaxSummaryLength = config.MaxSummaryLength
+
+	if config.Time != nil {
+		if err := config.Time.Init(); err != nil {
+			return nil, err
+		}
+		h.Time = config.Time
+	}
+	return h, nil
+}
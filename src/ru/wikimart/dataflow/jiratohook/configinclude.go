@@ -0,0 +1,288 @@
+package main
+
+import "bytes"
+import "encoding/json"
+import "flag"
+import "fmt"
+import "log"
+import "os"
+import "path/filepath"
+import "strings"
+
+// the configs are json, the service has no dependencies to read yaml with.
+// The config files may include others: {"include": ["base.json", "rules/*.json"], ...}, the paths relative to
+// the including file. An environment overlay is a file including the base one, e.g. prod.json including base.json.
+// Precedence, the later wins:
+//   - the includes in their order, the files of a glob sorted by name, then the including file itself
+//   - objects are merged key by key, a null removes the key
+//   - lists of named objects, e.g. the rules, the destinations and the instances, are merged by name,
+//     the new names are appended; the other lists and the values are replaced
+const CONFIG_INCLUDE_KEY = "include"
+
+// the config with its includes merged in, indented; the file:, env: and vault: references are not resolved
+func RenderConfig(path string) ([]byte, error) {
+	tree, err := readConfigTree(path, map[string]bool{})
+	if err != nil {
+		return nil, err
+	}
+	return json.MarshalIndent(tree, "", "  ")
+}
+
+func readConfigTree(path string, including map[string]bool) (map[string]interface{}, error) {
+	absolute, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	if including[absolute] {
+		return nil, fmt.Errorf("%s: include loop", path)
+	}
+	including[absolute] = true
+	defer delete(including, absolute)
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var tree map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	// the numbers are kept as they are written
+	decoder.UseNumber()
+	if err := decoder.Decode(&tree); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err.Error())
+	}
+
+	raw, ok := tree[CONFIG_INCLUDE_KEY]
+	if !ok {
+		return tree, nil
+	}
+	delete(tree, CONFIG_INCLUDE_KEY)
+	var includes []string
+	if list, ok := raw.([]interface{}); ok {
+		for _, item := range list {
+			if include, ok := item.(string); ok {
+				includes = append(includes, include)
+			} else {
+				return nil, fmt.Errorf("%s: include should be a list of paths", path)
+			}
+		}
+	} else {
+		return nil, fmt.Errorf("%s: include should be a list of paths", path)
+	}
+
+	merged := map[string]interface{}{}
+	for _, include := range includes {
+		if !filepath.IsAbs(include) {
+			include = filepath.Join(filepath.Dir(path), include)
+		}
+		files := []string { include }
+		// a glob may match nothing, a plain path has to exist
+		if strings.ContainsAny(include, "*?[") {
+			if files, err = filepath.Glob(include); err != nil {
+				return nil, fmt.Errorf("%s: include %s: %s", path, include, err.Error())
+			}
+		}
+		for _, file := range files {
+			included, err := readConfigTree(file, including)
+			if err != nil {
+				return nil, err
+			}
+			merged = mergeConfig(merged, included).(map[string]interface{})
+		}
+	}
+	return mergeConfig(merged, tree).(map[string]interface{}), nil
+}
+
+// the name of every item if the list is of named objects
+func configNames(list []interface{}) ([]string, bool) {
+	names := make([]string, len(list))
+	for i, item := range list {
+		object, ok := item.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if names[i], ok = object["name"].(string); !ok || names[i] == "" {
+			return nil, false
+		}
+	}
+	return names, true
+}
+
+// the overlay merged into the base, see CONFIG_INCLUDE_KEY for the precedence
+func mergeConfig(base interface{}, overlay interface{}) interface{} {
+	switch overlayValue := overlay.(type) {
+	case map[string]interface{}:
+		baseValue, ok := base.(map[string]interface{})
+		if !ok {
+			return overlay
+		}
+		merged := make(map[string]interface{}, len(baseValue) + len(overlayValue))
+		for key, value := range baseValue {
+			merged[key] = value
+		}
+		for key, value := range overlayValue {
+			if value == nil {
+				delete(merged, key)
+			} else {
+				merged[key] = mergeConfig(merged[key], value)
+			}
+		}
+		return merged
+	case []interface{}:
+		baseValue, ok := base.([]interface{})
+		if !ok {
+			return overlay
+		}
+		baseNames, baseNamed := configNames(baseValue)
+		overlayNames, overlayNamed := configNames(overlayValue)
+		if !baseNamed || !overlayNamed {
+			return overlay
+		}
+		merged := append([]interface{}{}, baseValue...)
+		for i, item := range overlayValue {
+			found := false
+			for j, name := range baseNames {
+				if name == overlayNames[i] {
+					merged[j], found = mergeConfig(merged[j], item), true
+					break
+				}
+			}
+			if !found {
+				merged = append(merged, item)
+			}
+		}
+		return merged
+	}
+	return overlay
+}
+
+// the config fields holding credentials besides the ones redacted from the logs by name
+var maskedConfigFields = map[string]bool {
+	"key": true,
+	"accesskeyid": true,
+	"secretaccesskey": true,
+	"credentials": true,
+	"redis": true,
+	"headers": true,
+}
+
+// a secret or a url with credentials in it, the file:, env: and vault: references are not secrets themselves
+func maskConfigValue(text string, url bool) string {
+	for _, prefix := range []string { "file:", "env:", "vault:" } {
+		if strings.HasPrefix(text, prefix) {
+			return text
+		}
+	}
+	if url {
+		// the same as in the logs, the webhook urls are credentials
+		masked := &Redactor{}
+		masked.AddUrl(text)
+		return masked.Redact(text)
+	}
+	return "[redacted]"
+}
+
+// replaces the secrets of a rendered config, as the redaction of the logs does
+func maskConfig(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for name, field := range v {
+			lower := strings.ToLower(name)
+			switch {
+			case lower == "headers":
+				if headers, ok := field.(map[string]interface{}); ok {
+					for header, headerValue := range headers {
+						if text, ok := headerValue.(string); ok {
+							headers[header] = maskConfigValue(text, false)
+						}
+					}
+				}
+			case isSecretField(name) || maskedConfigFields[lower] || isUrlField(name):
+				if text, ok := field.(string); ok {
+					v[name] = maskConfigValue(text, isUrlField(name) || lower == "redis")
+				} else {
+					v[name] = maskConfig(field)
+				}
+			default:
+				v[name] = maskConfig(field)
+			}
+		}
+	case []interface{}:
+		for i, item := range v {
+			v[i] = maskConfig(item)
+		}
+	}
+	return value
+}
+
+// the settings the service defaults when the config does not set them, the defaults of the config
+// applied under it; the destinations and the rest of the sections have their defaults in their own code
+func withConfigDefaults(tree map[string]interface{}) {
+	if _, ok := tree["ruleMatching"]; !ok {
+		tree["ruleMatching"] = "all"
+	}
+	if rules, _ := tree["rules"].([]interface{}); len(rules) == 0 {
+		rule := DefaultRule()
+		tree["rules"] = []interface{} {
+			map[string]interface{} { "name": rule.Name, "projects": rule.Projects, "transitions": rule.Transitions },
+		}
+	}
+
+	priorities := map[string]interface{}{}
+	for transition, priority := range DefaultTransitionPriorities {
+		priorities[transition] = priority
+	}
+	if set, ok := tree["priorities"]; ok {
+		tree["priorities"] = mergeConfig(priorities, set)
+	} else {
+		tree["priorities"] = priorities
+	}
+	linkScopes := map[string]interface{}{}
+	for linkType, scope := range DefaultLinkScopes {
+		linkScopes[linkType] = scope
+	}
+	if set, ok := tree["linkScopes"]; ok {
+		tree["linkScopes"] = mergeConfig(linkScopes, set)
+	} else {
+		tree["linkScopes"] = linkScopes
+	}
+}
+
+// ./jiratohook config -config prod.json prints the config the service would load, the secrets masked
+func ConfigCommand(arguments []string) {
+	flags := flag.NewFlagSet("config", flag.ExitOnError)
+	path := flags.String("config", "", "json config, its includes are merged in")
+	showSecrets := flags.Bool("show-secrets", false, "print the tokens, the passwords and the webhook urls as they are")
+	defaults := flags.Bool("defaults", false, "print the defaults of the settings not set too")
+	flags.Parse(arguments)
+	if *path == "" {
+		log.Fatalf("./jiratohook config -config config.json [-show-secrets] [-defaults]\n")
+	}
+
+	rendered, err := RenderConfig(*path)
+	if err != nil {
+		log.Fatalf("error in config %s: %s\n", *path, err)
+	}
+	// the rendered config has to load too, e.g. no list replaced by an object and no unknown field
+	if _, err := decodeConfig(rendered); err != nil {
+		log.Fatalf("error in config %s: %s\n", *path, err)
+	}
+	if !*showSecrets || *defaults {
+		var tree map[string]interface{}
+		decoder := json.NewDecoder(bytes.NewReader(rendered))
+		decoder.UseNumber()
+		if err := decoder.Decode(&tree); err != nil {
+			log.Fatalf("error in config %s: %s\n", *path, err)
+		}
+		if *defaults {
+			withConfigDefaults(tree)
+		}
+		var printed interface{} = tree
+		if !*showSecrets {
+			printed = maskConfig(tree)
+		}
+		if rendered, err = json.MarshalIndent(printed, "", "  "); err != nil {
+			log.Fatalf("error in config %s: %s\n", *path, err)
+		}
+	}
+	fmt.Printf("%s\n", rendered)
+}
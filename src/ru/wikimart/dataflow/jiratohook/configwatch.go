@@ -0,0 +1,174 @@
+package main
+
+import "crypto/sha256"
+import "encoding/json"
+import "fmt"
+import "log"
+import "path/filepath"
+import "sort"
+import "time"
+
+// the default rule if there are none, every rule initialized, in the order of their priority
+func InitRules(rules []*Rule, destinations []Destination) ([]*Rule, error) {
+	if len(rules) == 0 {
+		rules = []*Rule { DefaultRule() }
+	}
+	sort.SliceStable(rules, func(i, j int) bool { return rules[i].Priority > rules[j].Priority })
+	for _, rule := range rules {
+		if err := rule.Init(destinations); err != nil {
+			return nil, err
+		}
+	}
+	if err := linkCanaries(rules); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+// whether the rule matching of the config stops at the first matching rule
+func firstMatch(ruleMatching string) (bool, error) {
+	switch ruleMatching {
+	case "", "all":
+		return false, nil
+	case "first":
+		return true, nil
+	}
+	return false, fmt.Errorf("ruleMatching should be all or first, not %q", ruleMatching)
+}
+
+func (h *JiraHandler) CurrentRules() []*Rule {
+	h.rulesMutex.RLock()
+	defer h.rulesMutex.RUnlock()
+	return h.Rules
+}
+
+// the rules with the rule matching they are evaluated by, read together as a reload replaces them together
+func (h *JiraHandler) currentMatching() ([]*Rule, bool) {
+	h.rulesMutex.RLock()
+	defer h.rulesMutex.RUnlock()
+	return h.Rules, h.FirstMatch
+}
+
+func (h *JiraHandler) ReplaceRules(rules []*Rule, firstMatch bool) {
+	h.rulesMutex.Lock()
+	defer h.rulesMutex.Unlock()
+	h.Rules = rules
+	h.FirstMatch = firstMatch
+}
+
+// the settings of a rule by their json names
+func ruleFields(rule *Rule) map[string]string {
+	data, _ := json.Marshal(rule)
+	var raw map[string]json.RawMessage
+	json.Unmarshal(data, &raw)
+
+	fields := map[string]string{}
+	for name, value := range raw {
+		fields[name] = string(value)
+	}
+	return fields
+}
+
+// logs what the reload changed, by rule name and setting
+func logRulesDiff(old []*Rule, new []*Rule) {
+	before := map[string]*Rule{}
+	for _, rule := range old {
+		before[rule.Name] = rule
+	}
+	after := map[string]bool{}
+
+	for _, rule := range new {
+		after[rule.Name] = true
+		previous, ok := before[rule.Name]
+		if !ok {
+			log.Printf("config reload: rule %s added\n", rule.Name)
+			continue
+		}
+
+		oldFields := ruleFields(previous)
+		newFields := ruleFields(rule)
+		names := make([]string, 0, len(newFields))
+		for name := range newFields {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if oldFields[name] != newFields[name] {
+				log.Printf("config reload: rule %s %s: %s -> %s\n", rule.Name, name, oldFields[name], newFields[name])
+			}
+		}
+	}
+	for _, rule := range old {
+		if !after[rule.Name] {
+			log.Printf("config reload: rule %s removed\n", rule.Name)
+		}
+	}
+}
+
+// the file the config path resolves to and the hash of its content with the includes;
+// kubernetes swaps the ..data symlink of a configmap mount, the mtime of the path does not change
+func configVersion(path string) (string, [sha256.Size]byte, error) {
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return "", [sha256.Size]byte{}, err
+	}
+	data, err := RenderConfig(resolved)
+	if err != nil {
+		return "", [sha256.Size]byte{}, err
+	}
+	return resolved, sha256.Sum256(data), nil
+}
+
+// reloads the rules and the rule matching when the config changes, the rest of the config needs a restart
+func (h *JiraHandler) WatchConfig(path string, interval time.Duration) {
+	resolved, sum, err := configVersion(path)
+	if err != nil {
+		log.Printf("config watch %s: %s\n", path, err)
+	}
+
+	for range time.Tick(interval) {
+		newResolved, newSum, err := configVersion(path)
+		if err != nil {
+			// the symlinks are swapped not quite atomically, the next check sees the new ones
+			log.Printf("config watch %s: %s\n", path, err)
+			continue
+		}
+		if newResolved == resolved && newSum == sum {
+			continue
+		}
+		if newResolved != resolved {
+			log.Printf("config reload: %s now points to %s\n", path, newResolved)
+		}
+		resolved, sum = newResolved, newSum
+
+		if err := h.ReloadConfig(path); err != nil {
+			h.Ops.Notify("reload", fmt.Sprintf("config reload of %s failed, the rules are kept: %s", path, redactor.Redact(err.Error())))
+		}
+	}
+}
+
+// replaces the rules with the ones of the config, the rules are kept if it is invalid
+func (h *JiraHandler) ReloadConfig(path string) error {
+	config, err := LoadConfig(path)
+	var first bool
+	if err == nil {
+		first, err = firstMatch(config.RuleMatching)
+	}
+	if err == nil {
+		config.Rules, err = InitRules(config.Rules, h.Destinations)
+	}
+	if err != nil {
+		log.Printf("config reload failed, the rules are kept: %s\n", err)
+		return err
+	}
+	rules := config.Rules
+	current, currentFirst := h.currentMatching()
+	if first != currentFirst {
+		log.Printf("config reload: ruleMatching is %q now\n", config.RuleMatching)
+	}
+
+	logRulesDiff(current, rules)
+	h.ReplaceRules(rules, first)
+	log.Printf("config reload: %d rule(s) loaded\n", len(rules))
+	return nil
+}
@@ -0,0 +1,144 @@
+package main
+
+import "encoding/base64"
+import "fmt"
+import "net/url"
+import "log"
+import "strings"
+import "time"
+import "ru/wikimart/dataflow/format"
+
+// confluence page, the announcements are appended to the page with the given id,
+// or to the page with the given title in the space, which is created when missing
+type ConfluenceDestination struct {
+	DestinationBase
+	Url string `json:"url"`
+	User string `json:"user"`
+	Token string `json:"token"`
+	Space string `json:"space"`
+	PageId string `json:"pageId"`
+	ParentId string `json:"parentId"`
+	// {date} and {issue} are substituted
+	Title string `json:"title"`
+}
+
+func init() {
+	RegisterDestination("confluence", func() Destination { return &ConfluenceDestination{} })
+}
+
+type ConfluenceStorage struct {
+	Value string `json:"value"`
+	Representation string `json:"representation"`
+}
+
+type ConfluenceBody struct {
+	Storage ConfluenceStorage `json:"storage"`
+}
+
+type ConfluenceVersion struct {
+	Number int `json:"number"`
+}
+
+type ConfluenceSpace struct {
+	Key string `json:"key"`
+}
+
+type ConfluenceAncestor struct {
+	Id string `json:"id"`
+}
+
+type ConfluencePage struct {
+	Id string `json:"id,omitempty"`
+	Type string `json:"type"`
+	Title string `json:"title"`
+	Space *ConfluenceSpace `json:"space,omitempty"`
+	Ancestors []ConfluenceAncestor `json:"ancestors,omitempty"`
+	Body *ConfluenceBody `json:"body,omitempty"`
+	Version *ConfluenceVersion `json:"version,omitempty"`
+}
+
+type ConfluenceSearchResult struct {
+	Results []ConfluencePage `json:"results"`
+}
+
+func (d *ConfluenceDestination) request(method string, path string, body interface{}, result interface{}) error {
+	headers := map[string]string{}
+	if d.User != "" {
+		headers["Authorization"] = "Basic " + base64.StdEncoding.EncodeToString([]byte(d.User + ":" + d.Token))
+	} else if d.Token != "" {
+		headers["Authorization"] = "Bearer " + d.Token
+	}
+
+	return JsonRequest(method, strings.TrimRight(d.Url, "/") + path, d.WithHeaders(headers), body, result)
+}
+
+// finds the page to append to, returns nil if there is no such page yet
+func (d *ConfluenceDestination) findPage(title string) (*ConfluencePage, error) {
+	if d.PageId != "" {
+		var page ConfluencePage
+		err := d.request("GET", "/rest/api/content/" + url.PathEscape(d.PageId) + "?expand=body.storage,version", nil, &page)
+		if err != nil {
+			return nil, err
+		}
+		return &page, nil
+	}
+
+	query := url.Values{}
+	query.Set("spaceKey", d.Space)
+	query.Set("title", title)
+	query.Set("expand", "body.storage,version")
+
+	var search ConfluenceSearchResult
+	if err := d.request("GET", "/rest/api/content?" + query.Encode(), nil, &search); err != nil {
+		return nil, err
+	}
+	if len(search.Results) == 0 {
+		return nil, nil
+	}
+	return &search.Results[0], nil
+}
+
+func (d *ConfluenceDestination) Send(announcement *format.Announcement) error {
+	now := time.Now()
+	title := strings.NewReplacer("{date}", now.Format("2006-01-02"), "{issue}", announcement.Issue.Key).Replace(d.Title)
+	entry := fmt.Sprintf("<h3>%s</h3>%s", now.Format("2006-01-02 15:04"), announcement.HtmlText())
+
+	page, err := d.findPage(title)
+	if err != nil {
+		return err
+	}
+
+	if page == nil {
+		page = &ConfluencePage {
+			Type: "page",
+			Title: title,
+			Space: &ConfluenceSpace { Key: d.Space },
+			Body: &ConfluenceBody { Storage: ConfluenceStorage { Value: entry, Representation: "storage" } },
+		}
+		if d.ParentId != "" {
+			page.Ancestors = []ConfluenceAncestor { { Id: d.ParentId } }
+		}
+
+		log.Printf("creating confluence page %q\n", title)
+		return d.request("POST", "/rest/api/content", page, nil)
+	}
+
+	previous := ""
+	if page.Body != nil {
+		previous = page.Body.Storage.Value
+	}
+	version := 1
+	if page.Version != nil {
+		version = page.Version.Number + 1
+	}
+
+	update := &ConfluencePage {
+		Type: "page",
+		Title: page.Title,
+		Body: &ConfluenceBody { Storage: ConfluenceStorage { Value: previous + entry, Representation: "storage" } },
+		Version: &ConfluenceVersion { Number: version },
+	}
+
+	log.Printf("appending to confluence page %s (%q)\n", page.Id, page.Title)
+	return d.request("PUT", "/rest/api/content/" + url.PathEscape(page.Id), update, nil)
+}
@@ -0,0 +1,38 @@
+package main
+
+import "sync"
+import "time"
+
+// suppresses the repeated announcements, e.g. of the jira automation loops firing the same transition
+type Cooldowns interface {
+	// starts the cooldown of the key, false if it is cooling down already
+	Start(key string, cooldown time.Duration) bool
+}
+
+// cooldowns of a single instance
+type LocalCooldowns struct {
+	mutex sync.Mutex
+	until map[string]time.Time
+}
+
+func NewLocalCooldowns() *LocalCooldowns {
+	return &LocalCooldowns { until: map[string]time.Time{} }
+}
+
+func (c *LocalCooldowns) Start(key string, cooldown time.Duration) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	now := time.Now()
+	for key, until := range c.until {
+		if now.After(until) {
+			delete(c.until, key)
+		}
+	}
+
+	if _, ok := c.until[key]; ok {
+		return false
+	}
+	c.until[key] = now.Add(cooldown)
+	return true
+}
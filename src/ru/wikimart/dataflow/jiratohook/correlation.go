@@ -0,0 +1,220 @@
+package main
+
+import "encoding/json"
+import "fmt"
+import "log"
+import "net/http"
+import "os"
+import "sort"
+import "sync"
+import "time"
+import "ru/wikimart/dataflow/format"
+
+// builds are forgotten if they are not reported for this long
+const CORRELATION_TTL = 30 * 24 * time.Hour
+
+// builds shown in an announcement at most
+const MAX_BUILDS = 3
+
+// a ci build or deployment and the issues it is made of
+type Correlation struct {
+	// unique per ci, e.g. github:123456789
+	Build string `json:"build"`
+	Name string `json:"name,omitempty"`
+	Url string `json:"url,omitempty"`
+	Environment string `json:"environment,omitempty"`
+	Keys []string `json:"keys"`
+	Updated time.Time `json:"updated"`
+}
+
+// builds by the issue keys, reported by the ci webhooks or posted to /admin/correlations,
+// kept in a json file so they survive a restart
+type Correlations struct {
+	path string
+	mutex sync.Mutex
+	builds map[string]*Correlation
+}
+
+func OpenCorrelations(path string) (*Correlations, error) {
+	c := &Correlations { path: path, builds: map[string]*Correlation{} }
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var correlations []*Correlation
+	if err := json.Unmarshal(data, &correlations); err != nil {
+		return nil, err
+	}
+	for _, correlation := range correlations {
+		c.builds[correlation.Build] = correlation
+	}
+	return c, nil
+}
+
+// the builds, the latest first, must be called with the mutex locked
+func (c *Correlations) sorted() []*Correlation {
+	correlations := make([]*Correlation, 0, len(c.builds))
+	for _, correlation := range c.builds {
+		correlations = append(correlations, correlation)
+	}
+	sort.Slice(correlations, func(i, j int) bool {
+		return correlations[i].Updated.After(correlations[j].Updated)
+	})
+	return correlations
+}
+
+// drops the stale builds and writes the file aside and renames it, must be called with the mutex locked
+func (c *Correlations) save() error {
+	for build, correlation := range c.builds {
+		if time.Since(correlation.Updated) > CORRELATION_TTL {
+			delete(c.builds, build)
+		}
+	}
+	data, err := json.MarshalIndent(c.sorted(), "", "  ")
+	if err != nil {
+		return err
+	}
+	temporary := c.path + ".tmp"
+	if err := os.WriteFile(temporary, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(temporary, c.path)
+}
+
+// merges the build into the known one: the keys are added, the other fields are replaced if set
+func (c *Correlations) Record(build *Correlation) (*Correlation, error) {
+	if build.Build == "" || len(build.Keys) == 0 {
+		return nil, fmt.Errorf("build and keys are required")
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	correlation, ok := c.builds[build.Build]
+	if !ok {
+		correlation = &Correlation { Build: build.Build }
+		c.builds[build.Build] = correlation
+	}
+	if build.Name != "" {
+		correlation.Name = build.Name
+	}
+	if build.Url != "" {
+		correlation.Url = build.Url
+	}
+	if build.Environment != "" {
+		correlation.Environment = build.Environment
+	}
+	for _, key := range build.Keys {
+		if !containsString(correlation.Keys, key) {
+			correlation.Keys = append(correlation.Keys, key)
+		}
+	}
+	correlation.Updated = time.Now()
+
+	copied := *correlation
+	copied.Keys = append([]string{}, correlation.Keys...)
+	return &copied, c.save()
+}
+
+// false if there is no such build
+func (c *Correlations) Delete(build string) (bool, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if _, ok := c.builds[build]; !ok {
+		return false, nil
+	}
+	delete(c.builds, build)
+	return true, c.save()
+}
+
+// the builds of any of the issues, the latest first; all of them if no keys are given
+func (c *Correlations) Find(keys ...string) []*Correlation {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	found := []*Correlation{}
+	for _, correlation := range c.sorted() {
+		if time.Since(correlation.Updated) > CORRELATION_TTL {
+			continue
+		}
+		matches := len(keys) == 0
+		for _, key := range keys {
+			if containsString(correlation.Keys, key) {
+				matches = true
+				break
+			}
+		}
+		if matches {
+			copied := *correlation
+			copied.Keys = append([]string{}, correlation.Keys...)
+			found = append(found, &copied)
+		}
+	}
+	return found
+}
+
+// the latest builds of the announced issue and of the listed ones, the builds without a link are not shown
+func (h *JiraHandler) AddBuilds(announcement *format.Announcement) {
+	if h.Correlations == nil {
+		return
+	}
+	keys := []string { announcement.Issue.Key }
+	for _, issue := range announcement.Issues {
+		keys = append(keys, issue.Key)
+	}
+	for _, correlation := range h.Correlations.Find(keys...) {
+		if correlation.Url == "" {
+			continue
+		}
+		announcement.Builds = append(announcement.Builds, format.Build { Name: correlation.Name, Url: correlation.Url, Environment: correlation.Environment })
+		if len(announcement.Builds) == MAX_BUILDS {
+			return
+		}
+	}
+}
+
+// GET lists the builds, of an issue with ?key=; POST records one, DELETE ?build= forgets one
+func (a *AdminHandler) ServeCorrelations(response http.ResponseWriter, request *http.Request) {
+	switch request.Method {
+	case "GET":
+		var keys []string
+		if key := request.URL.Query().Get("key"); key != "" {
+			keys = append(keys, key)
+		}
+		writeJson(response, a.Correlations.Find(keys...))
+	case "POST":
+		var build Correlation
+		if err := json.NewDecoder(request.Body).Decode(&build); err != nil {
+			WriteProblem(response, request, http.StatusBadRequest, PROBLEM_INVALID_PAYLOAD, err.Error())
+			return
+		}
+		correlation, err := a.Correlations.Record(&build)
+		if correlation == nil {
+			WriteProblem(response, request, http.StatusBadRequest, PROBLEM_INVALID_PARAMETER, err.Error())
+			return
+		}
+		if err != nil {
+			log.Printf("error when saving the correlations: %s\n", err)
+		}
+		log.Printf("build %s correlated with %s\n", correlation.Build, build.Keys)
+		writeJson(response, correlation)
+	case "DELETE":
+		build := request.URL.Query().Get("build")
+		found, err := a.Correlations.Delete(build)
+		if !found {
+			WriteProblem(response, request, http.StatusNotFound, PROBLEM_INVALID_PARAMETER, fmt.Sprintf("no build %q", build))
+			return
+		}
+		if err != nil {
+			log.Printf("error when saving the correlations: %s\n", err)
+		}
+		log.Printf("build %s forgotten\n", build)
+		writeJson(response, a.Correlations.Find())
+	default:
+		WriteProblem(response, request, http.StatusMethodNotAllowed, PROBLEM_METHOD_NOT_ALLOWED, "GET, POST or DELETE expected")
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import "encoding/json"
+import "os"
+import "sync"
+import "time"
+import "ru/wikimart/dataflow/format"
+
+type DeadLetter struct {
+	Time time.Time `json:"time"`
+	Destination string `json:"destination"`
+	Attempts int `json:"attempts"`
+	Error string `json:"error"`
+	Announcement *format.Announcement `json:"announcement"`
+}
+
+// deliveries given up on, one json entry per line
+type DeadLetters struct {
+	mutex sync.Mutex
+	file *os.File
+}
+
+func OpenDeadLetters(path string) (*DeadLetters, error) {
+	file, err := os.OpenFile(path, os.O_CREATE | os.O_APPEND | os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &DeadLetters { file: file }, nil
+}
+
+func (d *DeadLetters) Append(delivery *Delivery, cause error) error {
+	line, err := json.Marshal(&DeadLetter {
+		Time: time.Now(),
+		Destination: delivery.Destination.Name(),
+		Attempts: delivery.Attempts,
+		Error: cause.Error(),
+		Announcement: delivery.Announcement,
+	})
+	if err != nil {
+		return err
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	_, err = d.file.Write(append(line, '\n'))
+	return err
+}
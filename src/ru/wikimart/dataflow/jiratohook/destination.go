@@ -0,0 +1,376 @@
+package main
+
+import "encoding/json"
+import "fmt"
+import "net/http"
+import "log"
+import "bytes"
+import "io"
+import "net"
+import "reflect"
+import "sort"
+import "strings"
+import "strconv"
+import "time"
+import "ru/wikimart/dataflow/format"
+
+// destination receives announcements and delivers them somewhere
+type Destination interface {
+	Name() string
+	Base() *DestinationBase
+	Send(announcement *format.Announcement) error
+}
+
+// common part of every destination config, the rest of the fields are type-specific
+type DestinationConfig struct {
+	Type string `json:"type"`
+	Name string `json:"name"`
+	// minimal interval between two messages, e.g. "1s"
+	MinInterval string `json:"minInterval"`
+	// maximum concurrent deliveries, unlimited if zero
+	MaxInFlight int `json:"maxInFlight"`
+	// identical messages within the window are sent once with a counter, e.g. "1m", never collapsed if empty
+	CollapseWindow string `json:"collapseWindow"`
+	// sent with every request to the destination, e.g. the api key of a gateway
+	Headers map[string]string `json:"headers"`
+	Raw json.RawMessage `json:"-"`
+}
+
+func (c *DestinationConfig) UnmarshalJSON(data []byte) error {
+	type plain DestinationConfig
+	if err := json.Unmarshal(data, (*plain)(c)); err != nil {
+		return err
+	}
+	c.Raw = append(json.RawMessage(nil), data...)
+	return nil
+}
+
+// embedded into every destination, holds the settings common for all of them
+type DestinationBase struct {
+	DestinationName string `json:"-"`
+	MinInterval time.Duration `json:"-"`
+	MaxInFlight int `json:"-"`
+	CollapseWindow time.Duration `json:"-"`
+	Headers map[string]string `json:"-"`
+}
+
+func (d *DestinationBase) Name() string {
+	return d.DestinationName
+}
+
+func (d *DestinationBase) Base() *DestinationBase {
+	return d
+}
+
+// the configured headers with the destination's own ones, e.g. the authorization, on top
+func (d *DestinationBase) WithHeaders(own map[string]string) map[string]string {
+	headers := map[string]string{}
+	for name, value := range d.Headers {
+		headers[name] = value
+	}
+	for name, value := range own {
+		headers[name] = value
+	}
+	return headers
+}
+
+// destination is rate limited, the delivery should be retried later
+type RateLimitError struct {
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("rate limited, retry after %s", e.RetryAfter)
+}
+
+// destination rejected the delivery
+type DeliveryError struct {
+	Status int
+	Body string
+	// 5xx and network errors are retried, 4xx are not
+	Retryable bool
+}
+
+func (e *DeliveryError) Error() string {
+	if e.Status == 0 {
+		return e.Body
+	}
+	return fmt.Sprintf("%d %s", e.Status, e.Body)
+}
+
+// slack webhook errors, which are worth retrying, the rest of them are permanent
+var retryableSlackErrors = map[string]bool {
+	"rollup_error": true,
+}
+
+// reads the response and classifies it, nil for successful responses
+func CheckResponse(response *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(response.Body, 1024))
+	// the rest of the body is read too, otherwise the connection is not reused
+	io.Copy(io.Discard, io.LimitReader(response.Body, 64 * 1024))
+	text := strings.TrimSpace(string(body))
+
+	if response.StatusCode == http.StatusTooManyRequests {
+		retryAfter := time.Second
+		if seconds, err := strconv.Atoi(response.Header.Get("Retry-After")); err == nil && seconds > 0 {
+			retryAfter = time.Duration(seconds) * time.Second
+		}
+		return &RateLimitError { RetryAfter: retryAfter }
+	}
+
+	if response.StatusCode < 300 {
+		return nil
+	}
+
+	return &DeliveryError {
+		Status: response.StatusCode,
+		Body: text,
+		Retryable: response.StatusCode >= 500 || retryableSlackErrors[text],
+	}
+}
+
+// whether the failed delivery is worth another attempt
+func IsRetryable(err error) bool {
+	switch e := err.(type) {
+	case *RateLimitError:
+		return true
+	case *DeliveryError:
+		return e.Retryable
+	case net.Error:
+		// transport errors, *url.Error included
+		return true
+	}
+	return false
+}
+
+// what the destinations may need besides their own config
+type DestinationContext struct {
+	Instances []*JiraInstance
+	Users *UserMap
+	// state shared by the replicas, nil if there is one
+	Shared *Shared
+}
+
+// makes an empty destination of a type, its config is decoded into it
+type DestinationFactory func() Destination
+
+// the destination factories by the type of their config
+var destinationTypes = map[string]DestinationFactory{}
+
+// adds a destination type, every destination registers itself in the init of its file
+func RegisterDestination(destinationType string, factory DestinationFactory) {
+	if _, ok := destinationTypes[destinationType]; ok {
+		panic("destination type " + destinationType + " registered twice")
+	}
+	destinationTypes[destinationType] = factory
+}
+
+// the registered destination types, sorted
+func DestinationTypes() []string {
+	types := make([]string, 0, len(destinationTypes))
+	for destinationType := range destinationTypes {
+		types = append(types, destinationType)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// the json names of the fields every destination config has
+func commonDestinationFields() map[string]bool {
+	fields := map[string]bool{}
+	configType := reflect.TypeOf(DestinationConfig{})
+	for i := 0; i < configType.NumField(); i++ {
+		if name, _, _ := strings.Cut(configType.Field(i).Tag.Get("json"), ","); name != "" && name != "-" {
+			fields[name] = true
+		}
+	}
+	return fields
+}
+
+// decodes the type-specific fields of the config into the destination, the unknown and the mistyped fields are named
+func decodeDestination(raw json.RawMessage, destination Destination) error {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		return err
+	}
+	for name := range commonDestinationFields() {
+		delete(fields, name)
+	}
+	own, err := json.Marshal(fields)
+	if err != nil {
+		return err
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(own))
+	decoder.DisallowUnknownFields()
+	err = decoder.Decode(destination)
+	if typeError, ok := err.(*json.UnmarshalTypeError); ok && typeError.Field != "" {
+		return fmt.Errorf("field %s: %s expected, not a json %s", typeError.Field, typeError.Type, typeError.Value)
+	}
+	// "json: unknown field" names the field already
+	if err != nil {
+		return fmt.Errorf("%s", strings.TrimPrefix(err.Error(), "json: "))
+	}
+	return nil
+}
+
+func NewDestination(config DestinationConfig, context *DestinationContext) (Destination, error) {
+	name := config.Name
+	if name == "" {
+		name = config.Type
+	}
+
+	factory, ok := destinationTypes[config.Type]
+	if !ok {
+		return nil, fmt.Errorf("destination %s: unknown type %q, expected %s", name, config.Type, strings.Join(DestinationTypes(), ", "))
+	}
+	destination := factory()
+	if err := decodeDestination(config.Raw, destination); err != nil {
+		return nil, fmt.Errorf("destination %s: %s", name, err.Error())
+	}
+	redactor.AddConfig(config.Raw)
+	destination.Base().DestinationName = name
+	destination.Base().MaxInFlight = config.MaxInFlight
+	destination.Base().Headers = config.Headers
+	for _, value := range config.Headers {
+		redactor.Add(value)
+	}
+
+	if config.MinInterval != "" {
+		interval, err := time.ParseDuration(config.MinInterval)
+		if err != nil {
+			return nil, fmt.Errorf("destination %s: minInterval: %s", name, err.Error())
+		}
+		destination.Base().MinInterval = interval
+	}
+
+	if config.CollapseWindow != "" {
+		window, err := time.ParseDuration(config.CollapseWindow)
+		if err != nil {
+			return nil, fmt.Errorf("destination %s: collapseWindow: %s", name, err.Error())
+		}
+		destination.Base().CollapseWindow = window
+	}
+
+	// some destinations have to prepare themselves, e.g. parse templates
+	if initializer, ok := destination.(interface{ Init() error }); ok {
+		if err := initializer.Init(); err != nil {
+			return nil, fmt.Errorf("destination %s: %s", name, err.Error())
+		}
+	}
+
+	if contextual, ok := destination.(interface{ SetContext(context *DestinationContext) }); ok {
+		contextual.SetContext(context)
+	}
+
+	return destination, nil
+}
+
+type WebHookMessage struct {
+	Text string `json:"text"`
+	IconEmoji *string `json:"icon_emoji,omitempty"`
+	Channel string `json:"channel,omitempty"`
+	Username string `json:"username,omitempty"`
+	IconUrl string `json:"icon_url,omitempty"`
+}
+
+// slack incoming webhook, or a mattermost one
+type SlackDestination struct {
+	DestinationBase
+	Url string `json:"url"`
+	// defaults for the rule overrides, the webhook settings are used if empty
+	Channel string `json:"channel"`
+	Username string `json:"username"`
+	IconUrl string `json:"iconUrl"`
+}
+
+func init() {
+	RegisterDestination("slack", func() Destination { return &SlackDestination{} })
+}
+
+// the rule setting if it is set, the destination one otherwise
+func override(rule string, destination string) string {
+	if rule != "" {
+		return rule
+	}
+	return destination
+}
+
+func (d *SlackDestination) Send(announcement *format.Announcement) error {
+	releaseEmoji := ":slinky:"
+	message := WebHookMessage {
+		Text: announcement.SlackText(),
+		Channel: override(announcement.Channel, d.Channel),
+		Username: override(announcement.Username, d.Username),
+		IconUrl: override(announcement.IconUrl, d.IconUrl),
+	}
+	// the icon url replaces the emoji
+	if message.IconUrl == "" {
+		message.IconEmoji = &releaseEmoji
+	}
+
+	postString, err := json.Marshal(message)
+	if err != nil {
+		return fmt.Errorf("error when marshalling a message: %s", err.Error())
+	}
+
+	request, err := http.NewRequest("POST", d.Url, bytes.NewReader(postString))
+	if err != nil {
+		return err
+	}
+	for name, value := range d.WithHeaders(map[string]string { "Content-Type": "application/json" }) {
+		request.Header.Set(name, value)
+	}
+
+	log.Printf("sending %s", postString)
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if err := CheckResponse(response); err != nil {
+		return err
+	}
+
+	log.Printf("post to webhook %s: %s", postString, response.Status)
+	return nil
+}
+
+// sends a json request and decodes a json response into result, if it is not nil
+func JsonRequest(method string, address string, headers map[string]string, body interface{}, result interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	request, err := http.NewRequest(method, address, reader)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("Accept", "application/json")
+	for name, value := range headers {
+		request.Header.Set(name, value)
+	}
+
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode >= 300 {
+		return CheckResponse(response)
+	}
+
+	if result != nil {
+		err = json.NewDecoder(response.Body).Decode(result)
+	}
+	io.Copy(io.Discard, io.LimitReader(response.Body, 64 * 1024))
+	return err
+}
@@ -0,0 +1,82 @@
+package main
+
+import "context"
+import "crypto/tls"
+import "fmt"
+import "net"
+import "net/http"
+import "time"
+
+// connects the outbound connections, of the http transport and of the destinations speaking
+// their own protocols alike; ConfigureDialer replaces it
+var dialContext = (&net.Dialer { Timeout: 30 * time.Second, KeepAlive: 30 * time.Second }).DialContext
+
+// binds the outbound connections to the source address and restricts them to an address family,
+// e.g. for the egress firewalls allowing a single source ip; family is "4", "6", or empty for both;
+// the host names are resolved through the cache if it is not nil
+func ConfigureDialer(source string, family string, cache *DnsCache) error {
+	dialer := &net.Dialer {
+		Timeout: 30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+
+	if source != "" {
+		ip := net.ParseIP(source)
+		if ip == nil {
+			return fmt.Errorf("source address %q is not an ip address", source)
+		}
+		dialer.LocalAddr = &net.TCPAddr { IP: ip }
+		// the source address decides the family of the destinations too
+		sourceFamily := "6"
+		if ip.To4() != nil {
+			sourceFamily = "4"
+		}
+		if family != "" && family != sourceFamily {
+			return fmt.Errorf("source address %s is not an ipv%s address", source, family)
+		}
+		family = sourceFamily
+	}
+
+	switch family {
+	case "", "4", "6":
+	default:
+		return fmt.Errorf("ip family should be 4 or 6, not %q", family)
+	}
+
+	transport, ok := http.DefaultTransport.(*http.Transport)
+	if !ok {
+		return fmt.Errorf("default transport is replaced")
+	}
+	dialContext = func(ctx context.Context, network string, address string) (net.Conn, error) {
+		// tcp becomes tcp4 or tcp6, and udp udp4 or udp6, only the addresses of the family are resolved then
+		if network == "tcp" || network == "udp" {
+			network = network + family
+		}
+		if cache == nil {
+			return dialer.DialContext(ctx, network, address)
+		}
+		return cache.Dial(ctx, dialer, network, address)
+	}
+	transport.DialContext = dialContext
+	return nil
+}
+
+// connects to the address within the timeout through the configured dialer, over tls if the config is set
+func DialOutbound(network string, address string, timeout time.Duration, tlsConfig *tls.Config) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	connection, err := dialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig == nil {
+		return connection, nil
+	}
+	secure := tls.Client(connection, tlsConfig)
+	if err := secure.HandshakeContext(ctx); err != nil {
+		connection.Close()
+		return nil, err
+	}
+	return secure, nil
+}
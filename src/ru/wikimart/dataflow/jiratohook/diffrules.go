@@ -0,0 +1,154 @@
+package main
+
+import "flag"
+import "fmt"
+import "log"
+import "os"
+import "sort"
+import "strings"
+import "time"
+import "ru/wikimart/dataflow/jiraevent"
+
+// the parts of the service the routing and the formatting depend on, set up from the config like the service does;
+// the destinations are stand-ins named after the configured ones, the routes need their names only, so nothing
+// is initialised, started or sent; the default instance takes its address from the payloads like "auto"
+func routingHandler(path string, jiraAddress string) (*JiraHandler, error) {
+	config, err := LoadConfig(path)
+	if err != nil {
+		return nil, err
+	}
+
+	defaultInstance := &JiraInstance { Name: "default", Url: jiraAddress }
+	if jiraAddress == "auto" {
+		defaultInstance.Url = ""
+		defaultInstance.DeriveUrl = true
+	}
+	h, err := NewRoutingHandler(defaultInstance, config)
+	if err != nil {
+		return nil, err
+	}
+
+	// stands for the webhook of the arguments, the rules may name it
+	h.Destinations = []Destination { &SlackDestination { DestinationBase: DestinationBase { DestinationName: "slack" } } }
+	for _, destinationConfig := range config.Destinations {
+		name := destinationConfig.Name
+		if name == "" {
+			name = destinationConfig.Type
+		}
+		if _, ok := destinationTypes[destinationConfig.Type]; !ok {
+			return nil, fmt.Errorf("destination %s: unknown type %q, expected %s", name, destinationConfig.Type, strings.Join(DestinationTypes(), ", "))
+		}
+		h.Destinations = append(h.Destinations, &SlackDestination { DestinationBase: DestinationBase { DestinationName: name } })
+	}
+	if h.Rules, err = InitRules(h.Rules, h.Destinations); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// "rule → destinations" and the plain text of the message, indented
+func describeMessage(prefix string, message PreviewMessage) string {
+	text := strings.Replace(message.Plain, "\n", "\n" + strings.Repeat(" ", len(prefix) + 2), -1)
+	return fmt.Sprintf("%s rule %s → %s\n%s  %s\n", prefix, message.Rule, strings.Join(message.Destinations, ", "), strings.Repeat(" ", len(prefix)), text)
+}
+
+func sameMessage(a PreviewMessage, b PreviewMessage) bool {
+	return strings.Join(a.Destinations, ",") == strings.Join(b.Destinations, ",") &&
+		a.Slack == b.Slack && a.Html == b.Html && a.Plain == b.Plain && a.Markdown == b.Markdown
+}
+
+// the differences of the messages by rule name, empty if the event is routed and formatted the same
+func diffMessages(before []PreviewMessage, after []PreviewMessage) string {
+	byRule := func(messages []PreviewMessage) map[string]PreviewMessage {
+		found := map[string]PreviewMessage{}
+		for _, message := range messages {
+			found[message.Rule] = message
+		}
+		return found
+	}
+	oldRules, newRules := byRule(before), byRule(after)
+	var names []string
+	for name := range oldRules {
+		names = append(names, name)
+	}
+	for name := range newRules {
+		if _, ok := oldRules[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	var diff strings.Builder
+	for _, name := range names {
+		oldMessage, inOld := oldRules[name]
+		newMessage, inNew := newRules[name]
+		switch {
+		case !inNew:
+			diff.WriteString(describeMessage("-", oldMessage))
+		case !inOld:
+			diff.WriteString(describeMessage("+", newMessage))
+		case !sameMessage(oldMessage, newMessage):
+			diff.WriteString(describeMessage("-", oldMessage))
+			diff.WriteString(describeMessage("+", newMessage))
+		}
+	}
+	return diff.String()
+}
+
+// jiratohook diff-rules -old config.json -new next.json -journal journal.jsonl: replays the journaled payloads
+// against both configs and prints the events routed or formatted differently; exits with 1 if there are any, like diff.
+// The journal has the payloads processed only, the events the old rules did not announce are skipped before it
+func DiffRulesCommand(arguments []string) {
+	flags := flag.NewFlagSet("diff-rules", flag.ExitOnError)
+	oldPath := flags.String("old", "", "json config in use")
+	newPath := flags.String("new", "", "json config to review")
+	journalPath := flags.String("journal", "", "journal of the service, see -journal")
+	last := flags.Int("last", 10000, "latest journal entries replayed")
+	jiraAddress := flags.String("jira", "auto", "address of the default jira instance, taken from the payloads if auto")
+	strict := flags.Bool("strict", false, "skip the payloads that do not decode, as the service does with -strict")
+	flags.Parse(arguments)
+	if *oldPath == "" || *newPath == "" || *journalPath == "" {
+		log.Fatalf("./jiratohook diff-rules -old config.json -new next.json -journal journal.jsonl [-last 10000]\n")
+	}
+
+	oldHandler, err := routingHandler(*oldPath, *jiraAddress)
+	if err != nil {
+		log.Fatalf("error in config %s: %s\n", *oldPath, err)
+	}
+	newHandler, err := routingHandler(*newPath, *jiraAddress)
+	if err != nil {
+		log.Fatalf("error in config %s: %s\n", *newPath, err)
+	}
+	entries, err := (&Journal { path: *journalPath }).Tail(*last)
+	if err != nil {
+		log.Fatalf("error when reading %s: %s\n", *journalPath, err)
+	}
+
+	changed := 0
+	for _, entry := range entries {
+		// the fields decoded are replayed unless strict, as the service processed them
+		event, err := jiraevent.Parse(entry.Payload)
+		if err != nil && *strict {
+			continue
+		}
+		oldInstance := FindInstance(oldHandler.Instances, entry.Instance).ForEvent(event)
+		newInstance := FindInstance(newHandler.Instances, entry.Instance).ForEvent(event)
+		diff := diffMessages(oldHandler.PreviewMessages(event, entry.Payload, oldInstance), newHandler.PreviewMessages(event, entry.Payload, newInstance))
+		if diff == "" {
+			continue
+		}
+		changed++
+		key := "no issue"
+		if event.Issue != nil {
+			key = event.Issue.Key
+		}
+		fmt.Printf("%s %s %s %s\n%s\n", entry.Time.Format(time.RFC3339), entry.Instance, event.WebhookEvent, key, diff)
+	}
+
+	fmt.Printf("%d of %d event(s) routed or formatted differently\n", changed, len(entries))
+	// the service journals the payloads it processes only
+	fmt.Printf("the events skipped as no rule announced them or by the filter of the webhook url are not journaled, a new rule announcing them is not seen here\n")
+	if changed > 0 {
+		os.Exit(1)
+	}
+}
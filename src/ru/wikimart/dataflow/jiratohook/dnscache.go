@@ -0,0 +1,93 @@
+package main
+
+import "context"
+import "fmt"
+import "log"
+import "net"
+import "strings"
+import "sync"
+import "time"
+
+type dnsEntry struct {
+	ips []net.IP
+	expires time.Time
+}
+
+// resolved addresses of the destination hosts; the system resolver does not tell the record ttls,
+// so the entries are kept for the configured ttl, and for longer while the lookups fail
+type DnsCache struct {
+	ttl time.Duration
+	mutex sync.Mutex
+	entries map[string]*dnsEntry
+}
+
+func NewDnsCache(ttl time.Duration) *DnsCache {
+	return &DnsCache {
+		ttl: ttl,
+		entries: map[string]*dnsEntry{},
+	}
+}
+
+// the addresses of the host, the stale ones if the lookup fails
+func (c *DnsCache) Lookup(ctx context.Context, host string) ([]net.IP, error) {
+	c.mutex.Lock()
+	entry, ok := c.entries[host]
+	c.mutex.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		return entry.ips, nil
+	}
+
+	addresses, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil || len(addresses) == 0 {
+		if ok {
+			log.Printf("dns: %s: %s, using the stale addresses\n", host, err)
+			return entry.ips, nil
+		}
+		if err == nil {
+			err = fmt.Errorf("no addresses for %s", host)
+		}
+		return nil, err
+	}
+
+	ips := make([]net.IP, len(addresses))
+	for i, address := range addresses {
+		ips[i] = address.IP
+	}
+	c.mutex.Lock()
+	c.entries[host] = &dnsEntry { ips: ips, expires: time.Now().Add(c.ttl) }
+	c.mutex.Unlock()
+	return ips, nil
+}
+
+// connects to the addresses of the host one by one until one of them answers
+func (c *DnsCache) Dial(ctx context.Context, dialer *net.Dialer, network string, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil || net.ParseIP(host) != nil {
+		return dialer.DialContext(ctx, network, address)
+	}
+
+	ips, err := c.Lookup(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	var lastErr error
+	for _, ip := range ips {
+		// tcp4, udp4, tcp6 and udp6 take the addresses of their family only
+		if (strings.HasSuffix(network, "4") && ip.To4() == nil) || (strings.HasSuffix(network, "6") && ip.To4() != nil) {
+			continue
+		}
+		connection, err := dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return connection, nil
+		}
+		lastErr = err
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	if lastErr == nil {
+		lastErr = fmt.Errorf("no %s addresses for %s", network, host)
+	}
+	return nil, lastErr
+}
@@ -0,0 +1,74 @@
+package main
+
+import "fmt"
+import "ru/wikimart/dataflow/format"
+import "ru/wikimart/dataflow/jiraevent"
+
+// where the environment of a deploy is taken from and how it is announced
+type EnvironmentConfig struct {
+	// issue field, e.g. customfield_10100
+	Field string `json:"field"`
+	// name from the issue property metadata, e.g. environment, used if the field is empty
+	Property string `json:"property"`
+	// by environment name
+	Formats map[string]*EnvironmentFormat `json:"formats"`
+}
+
+type EnvironmentFormat struct {
+	// replaces the transition emoji
+	Emoji string `json:"emoji"`
+	// shown after the action, e.g. "issue deployed to production", the environment name by default
+	Label string `json:"label"`
+}
+
+// plain value of a custom field: select lists give their value, user pickers their name, arrays the first item
+func FieldString(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case float64, bool:
+		return fmt.Sprint(v)
+	case map[string]interface{}:
+		for _, key := range []string { "value", "name", "displayName" } {
+			if text, ok := v[key].(string); ok {
+				return text
+			}
+		}
+	case []interface{}:
+		if len(v) > 0 {
+			return FieldString(v[0])
+		}
+	}
+	return ""
+}
+
+func (c *EnvironmentConfig) Environment(event *jiraevent.Event, metadata map[string]string) string {
+	if c.Field != "" && event.Issue != nil && event.Issue.Fields != nil {
+		if environment := FieldString(event.Issue.Fields.All[c.Field]); environment != "" {
+			return environment
+		}
+	}
+	if c.Property != "" {
+		return metadata[c.Property]
+	}
+	return ""
+}
+
+// sets the announcement environment and applies its format
+func (c *EnvironmentConfig) Apply(event *jiraevent.Event, announcement *format.Announcement) {
+	announcement.Environment = c.Environment(event, announcement.Metadata)
+	if announcement.Environment == "" {
+		return
+	}
+
+	label := announcement.Environment
+	if format, ok := c.Formats[announcement.Environment]; ok {
+		if format.Emoji != "" {
+			announcement.Emoji = format.Emoji
+		}
+		if format.Label != "" {
+			label = format.Label
+		}
+	}
+	announcement.Action = announcement.Action + " to " + label
+}
@@ -0,0 +1,86 @@
+package main
+
+import "fmt"
+import "log"
+import "regexp"
+import "strings"
+import "time"
+import "ru/wikimart/dataflow/format"
+
+// how often a rule may mention everyone if its escalation does not say
+const DEFAULT_ESCALATION_INTERVAL = 15 * time.Minute
+
+// an @here or @channel mention put before the message, e.g. for the rollbacks of the blockers
+type Escalation struct {
+	// "here" or "channel"
+	Mention string `json:"mention"`
+	// transitions as in the rule, priority names and environments the mention is for, any if empty
+	Transitions []string `json:"transitions"`
+	Priorities []string `json:"priorities"`
+	Environments []string `json:"environments"`
+	// the rule mentions everyone once per interval at most, the rest of the messages go without it; "15m" by default
+	Interval string `json:"interval"`
+
+	transitions []*regexp.Regexp
+	interval time.Duration
+}
+
+func (e *Escalation) Init() error {
+	if e.Mention != format.MENTION_HERE && e.Mention != format.MENTION_CHANNEL {
+		return fmt.Errorf("mention should be here or channel, not %q", e.Mention)
+	}
+	transitions, err := compileTransitions(e.Transitions)
+	if err != nil {
+		return fmt.Errorf("transitions: %s", err.Error())
+	}
+	e.transitions = transitions
+
+	e.interval = DEFAULT_ESCALATION_INTERVAL
+	if e.Interval != "" {
+		if e.interval, err = time.ParseDuration(e.Interval); err != nil {
+			return fmt.Errorf("interval: %s", err.Error())
+		}
+	}
+	return nil
+}
+
+func (e *Escalation) Matches(announcement *format.Announcement) bool {
+	if len(e.transitions) > 0 && !matchesAny(e.transitions, announcement.Transition) {
+		return false
+	}
+	if len(e.Priorities) > 0 && !containsString(e.Priorities, announcement.Issue.Priority) {
+		return false
+	}
+	if len(e.Environments) > 0 && !containsString(e.Environments, announcement.Environment) {
+		return false
+	}
+	return true
+}
+
+// the mention of everyone in the syntax of the destination, followed by a space, if the announcement is escalated;
+// the chats without the online-only mention notify everyone for both
+func mentionText(announcement *format.Announcement, everyone string) string {
+	if announcement.Mention == "" {
+		return ""
+	}
+	return everyone + " "
+}
+
+// the announcement with the mention of the first matching escalation of the rule,
+// unless the rule has mentioned everyone within the interval
+func (h *JiraHandler) Escalate(rule *Rule, announcement *format.Announcement) *format.Announcement {
+	for i, escalation := range rule.Escalations {
+		if !escalation.Matches(announcement) {
+			continue
+		}
+		key := strings.Join([]string { "escalation", rule.Name, fmt.Sprint(i) }, "/")
+		if !h.Cooldowns.Start(key, escalation.interval) {
+			log.Printf("rule %s: @%s was mentioned within %s, %s goes without it\n", rule.Name, escalation.Mention, escalation.interval, announcement.Issue.Key)
+			return announcement
+		}
+		escalated := *announcement
+		escalated.Mention = escalation.Mention
+		return &escalated
+	}
+	return announcement
+}
@@ -0,0 +1,48 @@
+package main
+
+import "fmt"
+import "time"
+
+// shows when the event happened and flags the late deliveries
+type TimeConfig struct {
+	// iana zone name, e.g. Europe/Moscow, the local zone if empty
+	Zone string `json:"zone"`
+	// go time layout, "2006-01-02 15:04 MST" by default
+	Layout string `json:"layout"`
+	// deliveries later than this after the webhook are flagged, e.g. "5m", never if empty
+	LateAfter string `json:"lateAfter"`
+
+	location *time.Location
+	lateAfter time.Duration
+}
+
+func (c *TimeConfig) Init() error {
+	c.location = time.Local
+	if c.Zone != "" {
+		location, err := time.LoadLocation(c.Zone)
+		if err != nil {
+			return fmt.Errorf("time: zone: %s", err.Error())
+		}
+		c.location = location
+	}
+	if c.Layout == "" {
+		c.Layout = "2006-01-02 15:04 MST"
+	}
+	if c.LateAfter != "" {
+		lateAfter, err := time.ParseDuration(c.LateAfter)
+		if err != nil {
+			return fmt.Errorf("time: lateAfter: %s", err.Error())
+		}
+		c.lateAfter = lateAfter
+	}
+	return nil
+}
+
+// the event timestamp in milliseconds, the receipt time for the payloads without one
+func (c *TimeConfig) Format(timestamp int64, received time.Time) string {
+	at := received
+	if timestamp > 0 {
+		at = time.Unix(0, timestamp * int64(time.Millisecond))
+	}
+	return at.In(c.location).Format(c.Layout)
+}
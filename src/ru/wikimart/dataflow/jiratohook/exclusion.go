@@ -0,0 +1,61 @@
+package main
+
+import "fmt"
+import "regexp"
+import "ru/wikimart/dataflow/format"
+import "ru/wikimart/dataflow/jiraevent"
+
+// the announcements a rule skips although it matches them, any of the conditions is enough;
+// the link types narrow the listed issues down instead
+type RuleExclusion struct {
+	// e.g. ["no-announce"]
+	Labels []string `json:"labels"`
+	// the issues created by these jira users, by name, account id, email or display name, e.g. the automation bots
+	Creators []string `json:"creators"`
+	// the links of these types are not listed and not found by the scope links, e.g. ["Duplicate"];
+	// the announcement is sent with the rest of the issues
+	LinkTypes []string `json:"linkTypes"`
+	// project keys and transitions as in the rule, e.g. all the projects but one
+	Projects []string `json:"projects"`
+	Transitions []string `json:"transitions"`
+
+	transitions []*regexp.Regexp
+}
+
+func (e *RuleExclusion) Init() error {
+	transitions, err := compileTransitions(e.Transitions)
+	if err != nil {
+		return fmt.Errorf("transitions: %s", err.Error())
+	}
+	e.transitions = transitions
+	return nil
+}
+
+func containsAny(list []string, values []string) bool {
+	for _, value := range values {
+		if value != "" && containsString(list, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// whether the announcement is skipped
+func (e *RuleExclusion) Matches(announcement *format.Announcement) bool {
+	return containsAny(e.Labels, announcement.Labels) ||
+		containsAny(e.Creators, announcement.Creator) ||
+		containsString(e.Projects, announcement.Project) ||
+		matchesAny(e.transitions, announcement.Transition)
+}
+
+// the labels and the creator of the issue of the event, for the exclusions of the rules
+func AddExclusionFields(announcement *format.Announcement, event *jiraevent.Event) {
+	if event.Issue == nil || event.Issue.Fields == nil {
+		return
+	}
+	fields := event.Issue.Fields
+	announcement.Labels = fields.Labels
+	if creator := fields.Creator; creator != nil {
+		announcement.Creator = []string { creator.Name, creator.AccountId, creator.EmailAddress, creator.DisplayName }
+	}
+}
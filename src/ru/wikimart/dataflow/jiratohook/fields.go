@@ -0,0 +1,76 @@
+package main
+
+import "fmt"
+import "strings"
+import "ru/wikimart/dataflow/format"
+
+// a field shown under the first line of the message, see Fields of the rule
+type MessageField struct {
+	// status, transition, assignee, priority, fixVersions, environment, project or requestType
+	Field string `json:"field"`
+	// shown before the value, the name of the field by default, "-" for none
+	Label string `json:"label"`
+	// printf format of the value, of each of them for the fix versions, e.g. "v%s" or "%s (planned)"
+	Format string `json:"format"`
+}
+
+type messageField struct {
+	label string
+	values func(announcement *format.Announcement) []string
+}
+
+func fieldValue(value string) []string {
+	if value == "" {
+		return nil
+	}
+	return []string { value }
+}
+
+var messageFields = map[string]messageField {
+	"status": { "Status", func(a *format.Announcement) []string { return fieldValue(a.Status) } },
+	"transition": { "Transition", func(a *format.Announcement) []string { return fieldValue(a.Transition) } },
+	"assignee": { "Assignee", func(a *format.Announcement) []string { return fieldValue(a.Assignee) } },
+	"priority": { "Priority", func(a *format.Announcement) []string { return fieldValue(a.Issue.Priority) } },
+	"fixVersions": { "Fix versions", func(a *format.Announcement) []string { return a.FixVersions } },
+	"environment": { "Environment", func(a *format.Announcement) []string { return fieldValue(a.Environment) } },
+	"project": { "Project", func(a *format.Announcement) []string { return fieldValue(a.Project) } },
+	"requestType": { "Request type", func(a *format.Announcement) []string { return fieldValue(a.RequestType) } },
+}
+
+func (f *MessageField) Init() error {
+	if _, ok := messageFields[f.Field]; !ok {
+		return fmt.Errorf("unknown field %q, expected status, transition, assignee, priority, fixVersions, environment, project or requestType", f.Field)
+	}
+	if f.Format != "" && strings.Count(f.Format, "%s") != 1 {
+		return fmt.Errorf("field %s: format should have one %%s, not %q", f.Field, f.Format)
+	}
+	return nil
+}
+
+// the fields of the announcement in the order of the rule, the empty ones are left out
+func announcementFields(fields []*MessageField, announcement *format.Announcement) []format.Field {
+	var shown []format.Field
+	for _, field := range fields {
+		known := messageFields[field.Field]
+		values := known.values(announcement)
+		if len(values) == 0 {
+			continue
+		}
+		if field.Format != "" {
+			formatted := make([]string, len(values))
+			for i, value := range values {
+				formatted[i] = fmt.Sprintf(field.Format, value)
+			}
+			values = formatted
+		}
+		label := field.Label
+		switch label {
+		case "":
+			label = known.label
+		case "-":
+			label = ""
+		}
+		shown = append(shown, format.Field { Label: label, Value: strings.Join(values, ", ") })
+	}
+	return shown
+}
@@ -0,0 +1,123 @@
+package main
+
+import "html"
+import "log"
+import "strings"
+import "ru/wikimart/dataflow/format"
+
+// google chat space incoming webhook, the announcement is a card with the buttons to the issue and to the scope search
+type GoogleChatDestination struct {
+	DestinationBase
+	// the webhook url of the space, with its key and token
+	Url string `json:"url"`
+	// the messages about one issue go to one thread
+	ThreadByIssue bool `json:"threadByIssue"`
+}
+
+func init() {
+	RegisterDestination("googlechat", func() Destination { return &GoogleChatDestination{} })
+}
+
+type GoogleChatOpenLink struct {
+	Url string `json:"url"`
+}
+
+type GoogleChatOnClick struct {
+	OpenLink GoogleChatOpenLink `json:"openLink"`
+}
+
+type GoogleChatButton struct {
+	Text string `json:"text"`
+	OnClick GoogleChatOnClick `json:"onClick"`
+}
+
+type GoogleChatButtonList struct {
+	Buttons []GoogleChatButton `json:"buttons"`
+}
+
+type GoogleChatTextParagraph struct {
+	Text string `json:"text"`
+}
+
+// one of the fields is set
+type GoogleChatWidget struct {
+	TextParagraph *GoogleChatTextParagraph `json:"textParagraph,omitempty"`
+	ButtonList *GoogleChatButtonList `json:"buttonList,omitempty"`
+}
+
+type GoogleChatSection struct {
+	Widgets []GoogleChatWidget `json:"widgets"`
+}
+
+type GoogleChatCardHeader struct {
+	Title string `json:"title"`
+	Subtitle string `json:"subtitle,omitempty"`
+}
+
+type GoogleChatCard struct {
+	Header GoogleChatCardHeader `json:"header"`
+	Sections []GoogleChatSection `json:"sections"`
+}
+
+type GoogleChatCardWithId struct {
+	CardId string `json:"cardId"`
+	Card GoogleChatCard `json:"card"`
+}
+
+type GoogleChatThread struct {
+	ThreadKey string `json:"threadKey"`
+}
+
+type GoogleChatMessage struct {
+	// the mentions go here, the cards cannot have them
+	Text string `json:"text,omitempty"`
+	CardsV2 []GoogleChatCardWithId `json:"cardsV2"`
+	Thread *GoogleChatThread `json:"thread,omitempty"`
+}
+
+func googleChatButton(text string, url string) GoogleChatButton {
+	return GoogleChatButton { Text: text, OnClick: GoogleChatOnClick { OpenLink: GoogleChatOpenLink { Url: url } } }
+}
+
+func (d *GoogleChatDestination) Send(announcement *format.Announcement) error {
+	title := announcement.Action + ": " + announcement.Issue.Key
+	// the text paragraphs take a little html, the line breaks included
+	text := strings.Replace(html.EscapeString(announcement.PlainText()), "\n", "<br>", -1)
+
+	buttons := []GoogleChatButton { googleChatButton("Open " + announcement.Issue.Key, announcement.Issue.Url) }
+	if announcement.More != nil && announcement.More.Url != "" {
+		buttons = append(buttons, googleChatButton("Scope", announcement.More.Url))
+	}
+
+	message := &GoogleChatMessage {
+		Text: mentionText(announcement, "<users/all>"),
+		CardsV2: []GoogleChatCardWithId { {
+			CardId: "announcement",
+			Card: GoogleChatCard {
+				Header: GoogleChatCardHeader { Title: title, Subtitle: announcement.Issue.Summary },
+				Sections: []GoogleChatSection { {
+					Widgets: []GoogleChatWidget {
+						{ TextParagraph: &GoogleChatTextParagraph { Text: text } },
+						{ ButtonList: &GoogleChatButtonList { Buttons: buttons } },
+					},
+				} },
+			},
+		} },
+	}
+
+	address := d.Url
+	if d.ThreadByIssue {
+		message.Thread = &GoogleChatThread { ThreadKey: announcement.Issue.Key }
+		separator := "?"
+		if strings.Contains(address, "?") {
+			separator = "&"
+		}
+		address = address + separator + "messageReplyOption=REPLY_MESSAGE_FALLBACK_TO_NEW_THREAD"
+	}
+
+	if err := JsonRequest("POST", address, d.WithHeaders(nil), message, nil); err != nil {
+		return err
+	}
+	log.Printf("posted %s to google chat\n", announcement.Issue.Key)
+	return nil
+}
@@ -0,0 +1,60 @@
+package main
+
+import "log"
+import "strings"
+import "time"
+import "ru/wikimart/dataflow/format"
+
+// grafana annotation, so dashboards show deploy markers
+type GrafanaDestination struct {
+	DestinationBase
+	Url string `json:"url"`
+	Token string `json:"token"`
+	// the annotation is global (organization-wide) when dashboard is not set
+	DashboardUid string `json:"dashboardUid"`
+	PanelId int `json:"panelId"`
+	// added to project, issue key and transition tags
+	Tags []string `json:"tags"`
+}
+
+func init() {
+	RegisterDestination("grafana", func() Destination { return &GrafanaDestination{} })
+}
+
+type GrafanaAnnotation struct {
+	DashboardUid string `json:"dashboardUID,omitempty"`
+	PanelId int `json:"panelId,omitempty"`
+	Time int64 `json:"time"`
+	Tags []string `json:"tags"`
+	Text string `json:"text"`
+}
+
+type GrafanaAnnotationResponse struct {
+	Id int64 `json:"id"`
+}
+
+func (d *GrafanaDestination) Send(announcement *format.Announcement) error {
+	tags := []string { announcement.Project, announcement.Issue.Key, strings.ToLower(announcement.Transition) }
+	tags = append(tags, d.Tags...)
+
+	annotation := &GrafanaAnnotation {
+		DashboardUid: d.DashboardUid,
+		PanelId: d.PanelId,
+		Time: time.Now().UnixNano() / int64(time.Millisecond),
+		Tags: tags,
+		Text: announcement.PlainText() + "\n" + announcement.Issue.Url,
+	}
+
+	headers := map[string]string{}
+	if d.Token != "" {
+		headers["Authorization"] = "Bearer " + d.Token
+	}
+
+	var created GrafanaAnnotationResponse
+	if err := JsonRequest("POST", strings.TrimRight(d.Url, "/") + "/api/annotations", d.WithHeaders(headers), annotation, &created); err != nil {
+		return err
+	}
+
+	log.Printf("created grafana annotation %d for %s\n", created.Id, announcement.Issue.Key)
+	return nil
+}
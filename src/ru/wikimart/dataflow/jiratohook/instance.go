@@ -0,0 +1,252 @@
+package main
+
+import "crypto/hmac"
+import "crypto/sha256"
+import "encoding/base64"
+import "encoding/hex"
+import "fmt"
+import "net/http"
+import "net/url"
+import "strings"
+import "time"
+import "ru/wikimart/dataflow/jiraevent"
+
+// jira instance sending webhooks to us
+type JiraInstance struct {
+	Name string `json:"name"`
+	Url string `json:"url"`
+	// credentials for the rest api
+	User string `json:"user"`
+	Token string `json:"token"`
+	// webhook secret, payloads are rejected if their X-Hub-Signature does not match
+	Secret string `json:"secret"`
+	// with the secret, the payloads sent longer ago than this, e.g. "5m", are rejected,
+	// and so are the signatures seen within this time, against replayed captures;
+	// it should be longer than the jira retries of the failed deliveries take
+	MaxSkew string `json:"maxSkew"`
+	// header with the delivery time set e.g. by a signing proxy, the signed payload timestamp is used if empty;
+	// the signature covers the header then, it is the hmac of "<header value>.<body>"
+	TimestampHeader string `json:"timestampHeader"`
+	// take the base url for links from the issue self link instead of url,
+	// for instances accessible under several hostnames
+	DeriveUrl bool `json:"deriveUrl"`
+	// events and jql filter the webhook registered in jira is expected to have, see -self-check
+	WebhookEvents []string `json:"webhookEvents"`
+	WebhookJql string `json:"webhookJql"`
+
+	maxSkew time.Duration
+}
+
+// calls the jira rest api with the instance credentials, the path is e.g. /rest/api/2/issue/QA-1
+func (i *JiraInstance) Request(method string, path string, body interface{}, result interface{}) error {
+	headers := map[string]string{}
+	if i.User != "" {
+		headers["Authorization"] = "Basic " + base64.StdEncoding.EncodeToString([]byte(i.User + ":" + i.Token))
+	} else if i.Token != "" {
+		headers["Authorization"] = "Bearer " + i.Token
+	}
+
+	return JsonRequest(method, strings.TrimRight(i.Url, "/") + path, headers, body, result)
+}
+
+// the instance with the given name, the first one if there is no such instance
+func FindInstance(instances []*JiraInstance, name string) *JiraInstance {
+	for _, instance := range instances {
+		if instance.Name == name {
+			return instance
+		}
+	}
+	return instances[0]
+}
+
+// base url from a rest api link, e.g. https://jira/rest/api/2/issue/1 gives https://jira
+func BaseUrlFromSelf(self string) string {
+	if i := strings.Index(self, "/rest/api/"); i > 0 {
+		return self[:i]
+	}
+	return ""
+}
+
+// the instance to use for the event links, with the url derived from the payload if configured
+func (i *JiraInstance) ForEvent(event *jiraevent.Event) *JiraInstance {
+	if !i.DeriveUrl || event.Issue == nil {
+		return i
+	}
+
+	baseUrl := BaseUrlFromSelf(event.Issue.Self)
+	if baseUrl == "" {
+		return i
+	}
+
+	derived := *i
+	derived.Url = baseUrl
+	return &derived
+}
+
+// the base url with the path segments appended, each of them escaped, e.g. a key with a slash stays one segment;
+// the path of the base is kept and the trailing slash of it dropped, https://host/jira/ gives https://host/jira/browse/QA-1
+func joinUrl(base string, segments ...string) string {
+	escaped := make([]string, len(segments))
+	for i, segment := range segments {
+		escaped[i] = url.PathEscape(segment)
+	}
+	address, err := url.Parse(strings.TrimRight(base, "/"))
+	if err != nil {
+		return strings.TrimRight(base, "/") + "/" + strings.Join(escaped, "/")
+	}
+
+	rawPath := address.EscapedPath()
+	for i, segment := range segments {
+		address.Path += "/" + segment
+		rawPath += "/" + escaped[i]
+	}
+	address.RawPath = rawPath
+	return address.String()
+}
+
+func (i *JiraInstance) IssueUrl(key string) string {
+	return joinUrl(i.Url, "browse", key)
+}
+
+// the issue search the scope links point to
+func (i *JiraInstance) SearchUrl() string {
+	return joinUrl(i.Url, "issues") + "/"
+}
+
+// the issues the jql finds in the issue search, the query of the search url is kept
+func jqlUrl(searchUrl string, jql string) string {
+	address, err := url.Parse(searchUrl)
+	if err != nil {
+		return searchUrl + "?" + url.Values { "jql": []string { jql } }.Encode()
+	}
+	query := address.Query()
+	query.Set("jql", jql)
+	address.RawQuery = query.Encode()
+	return address.String()
+}
+
+var jqlStringEscaper = strings.NewReplacer("\\", "\\\\", "\"", "\\\"")
+
+// the text as a quoted jql string
+func jqlString(text string) string {
+	return "\"" + jqlStringEscaper.Replace(text) + "\""
+}
+
+func (i *JiraInstance) GetScopeExceptMD(baseIssue string, linkTypes []string, mentioned []string) string {
+	return jqlUrl(i.SearchUrl(), scopeJql(baseIssue, linkTypes, mentioned) + " AND project != MD")
+}
+
+// linked issues of the base issue in the project
+func (i *JiraInstance) GetScopeForProject(baseIssue string, linkTypes []string, mentioned []string, project string) string {
+	return jqlUrl(i.SearchUrl(), fmt.Sprintf("%s AND project = %s", scopeJql(baseIssue, linkTypes, mentioned), project))
+}
+
+// the issues linked with the given link types and the ones mentioned in the text of the base issue;
+// with no link types and nothing mentioned no issue is listed, the scope links are not shown then
+func scopeJql(baseIssue string, linkTypes []string, mentioned []string) string {
+	args := []string { jqlString(baseIssue) }
+	for _, linkType := range linkTypes {
+		args = append(args, jqlString(linkType))
+	}
+	linked := fmt.Sprintf("issue in linkedIssues(%s)", strings.Join(args, ", "))
+	switch {
+	case len(mentioned) == 0:
+		return linked
+	case len(linkTypes) == 0:
+		return fmt.Sprintf("key in (%s)", strings.Join(mentioned, ", "))
+	}
+	return fmt.Sprintf("(%s OR key in (%s))", linked, strings.Join(mentioned, ", "))
+}
+
+// checks the X-Hub-Signature header sent by jira for webhooks with a secret,
+// with the timestamp header signed too if the instance reads the delivery time from it
+func (i *JiraInstance) VerifySignature(request *http.Request, body []byte) bool {
+	if i.Secret == "" {
+		return true
+	}
+
+	signature := strings.TrimPrefix(request.Header.Get("X-Hub-Signature"), "sha256=")
+	expected, err := hex.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+
+	mac := hmac.New(sha256.New, []byte(i.Secret))
+	// otherwise a captured body would be replayed with a fresh timestamp
+	if i.TimestampHeader != "" {
+		mac.Write([]byte(request.Header.Get(i.TimestampHeader) + "."))
+	}
+	mac.Write(body)
+	return hmac.Equal(mac.Sum(nil), expected)
+}
+
+func sameHost(a string, b string) bool {
+	aUrl, err := url.Parse(a)
+	if err != nil {
+		return false
+	}
+	bUrl, err := url.Parse(b)
+	if err != nil {
+		return false
+	}
+	return aUrl.Host != "" && strings.EqualFold(aUrl.Host, bUrl.Host)
+}
+
+// whether any instance verifies the signatures of its webhooks
+func (h *JiraHandler) anySecret() bool {
+	for _, instance := range h.Instances {
+		if instance.Secret != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// the instances without a secret while another one has it, DetectInstance never detects them
+func (h *JiraHandler) unsignedInstances() []string {
+	var names []string
+	if !h.anySecret() {
+		return names
+	}
+	for _, instance := range h.Instances {
+		if instance.Secret == "" {
+			names = append(names, instance.Name)
+		}
+	}
+	return names
+}
+
+// detects the instance which sent the event: by the last path segment, e.g. /hook/cloud,
+// by the X-Jira-Instance header or by the issue self link, the first instance is the default one.
+// Once an instance has a secret, the instances without one are never detected and there is no default,
+// nil is returned: otherwise an unsigned request naming no instance or the default one would skip the signature check
+func (h *JiraHandler) DetectInstance(request *http.Request, event *jiraevent.Event) *JiraInstance {
+	segment := request.URL.Path[strings.LastIndex(request.URL.Path, "/") + 1:]
+	header := request.Header.Get("X-Jira-Instance")
+	signed := h.anySecret()
+	detected := func(instance *JiraInstance) *JiraInstance {
+		if signed && instance.Secret == "" {
+			return nil
+		}
+		return instance
+	}
+
+	for _, instance := range h.Instances {
+		if instance.Name != "" && (instance.Name == segment || instance.Name == header) {
+			return detected(instance)
+		}
+	}
+
+	if event.Issue != nil && event.Issue.Self != "" {
+		for _, instance := range h.Instances {
+			if sameHost(instance.Url, event.Issue.Self) {
+				return detected(instance)
+			}
+		}
+	}
+
+	if signed {
+		return nil
+	}
+	return h.Instances[0]
+}
@@ -0,0 +1,75 @@
+package main
+
+import "testing"
+
+func TestJoinUrl(t *testing.T) {
+	for _, c := range []struct {
+		base string
+		segments []string
+		want string
+	}{
+		{ "https://jira.example.com", []string { "browse", "QA-1" }, "https://jira.example.com/browse/QA-1" },
+		{ "https://jira.example.com/", []string { "browse", "QA-1" }, "https://jira.example.com/browse/QA-1" },
+		// jira behind a context path
+		{ "https://example.com/jira", []string { "browse", "QA-1" }, "https://example.com/jira/browse/QA-1" },
+		{ "https://example.com/jira/", []string { "browse", "QA-1" }, "https://example.com/jira/browse/QA-1" },
+		{ "https://example.com/jira//", []string { "issues" }, "https://example.com/jira/issues" },
+		{ "https://example.com/my%20jira/", []string { "browse", "QA-1" }, "https://example.com/my%20jira/browse/QA-1" },
+		// the segments stay one segment each
+		{ "https://jira.example.com", []string { "browse", "QA/1" }, "https://jira.example.com/browse/QA%2F1" },
+		{ "https://jira.example.com", []string { "browse", "QA 1?#" }, "https://jira.example.com/browse/QA%201%3F%23" },
+		{ "https://jira.example.com", []string { "browse", "../admin" }, "https://jira.example.com/browse/..%2Fadmin" },
+	} {
+		if got := joinUrl(c.base, c.segments...); got != c.want {
+			t.Errorf("joinUrl(%q, %q) = %q, want %q", c.base, c.segments, got, c.want)
+		}
+	}
+}
+
+func TestInstanceUrls(t *testing.T) {
+	instance := &JiraInstance { Url: "https://example.com/jira/" }
+	if got, want := instance.IssueUrl("QA-1"), "https://example.com/jira/browse/QA-1"; got != want {
+		t.Errorf("IssueUrl = %q, want %q", got, want)
+	}
+	if got, want := instance.SearchUrl(), "https://example.com/jira/issues/"; got != want {
+		t.Errorf("SearchUrl = %q, want %q", got, want)
+	}
+}
+
+func TestJqlUrl(t *testing.T) {
+	for _, c := range []struct {
+		searchUrl string
+		jql string
+		want string
+	}{
+		{ "https://jira.example.com/issues/", "project = QA", "https://jira.example.com/issues/?jql=project+%3D+QA" },
+		{ "https://example.com/jira/issues/", `issue in linkedIssues("QA-1")`, "https://example.com/jira/issues/?jql=issue+in+linkedIssues%28%22QA-1%22%29" },
+		// the query of the search url is kept, its jql is replaced
+		{ "https://jira.example.com/issues/?filter=10000", "project = QA", "https://jira.example.com/issues/?filter=10000&jql=project+%3D+QA" },
+		{ "https://jira.example.com/issues/?jql=old&filter=10000", "project = QA", "https://jira.example.com/issues/?filter=10000&jql=project+%3D+QA" },
+		{ "https://jira.example.com/issues/?", "a & b", "https://jira.example.com/issues/?jql=a+%26+b" },
+	} {
+		if got := jqlUrl(c.searchUrl, c.jql); got != c.want {
+			t.Errorf("jqlUrl(%q, %q) = %q, want %q", c.searchUrl, c.jql, got, c.want)
+		}
+	}
+}
+
+func TestJqlString(t *testing.T) {
+	for _, c := range []struct {
+		text string
+		want string
+	}{
+		{ "", `""` },
+		{ "QA-1", `"QA-1"` },
+		{ `say "hi"`, `"say \"hi\""` },
+		{ `back\slash`, `"back\\slash"` },
+		// an escaped quote of the text does not close the string
+		{ `\"`, `"\\\""` },
+		{ `QA-1") OR project = ("X`, `"QA-1\") OR project = (\"X"` },
+	} {
+		if got := jqlString(c.text); got != c.want {
+			t.Errorf("jqlString(%q) = %s, want %s", c.text, got, c.want)
+		}
+	}
+}
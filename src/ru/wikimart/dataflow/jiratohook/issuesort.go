@@ -0,0 +1,104 @@
+package main
+
+import "fmt"
+import "sort"
+import "strconv"
+import "strings"
+import "ru/wikimart/dataflow/format"
+import "ru/wikimart/dataflow/jiraevent"
+
+// jira sends the priorities with their ids, the lower id is the higher priority
+func priorityRank(priority *jiraevent.Priority) int {
+	if priority == nil {
+		return 1 << 30
+	}
+	if rank, err := strconv.Atoi(priority.Id); err == nil {
+		return rank
+	}
+	return 1 << 30
+}
+
+// value of the issue the issues are sorted or grouped by: "key", "project" or "priority"
+func issueAttribute(issue *format.Issue, by string) string {
+	switch by {
+	case "project":
+		return format.IssueProject(issue.Key)
+	case "priority":
+		if issue.Priority == "" {
+			return "No priority"
+		}
+		return issue.Priority
+	}
+	return issue.Key
+}
+
+func compareIssues(a *format.Issue, b *format.Issue, by string) int {
+	switch by {
+	case "priority":
+		if a.PriorityRank != b.PriorityRank {
+			if a.PriorityRank < b.PriorityRank {
+				return -1
+			}
+			return 1
+		}
+	case "project":
+		if projectA, projectB := format.IssueProject(a.Key), format.IssueProject(b.Key); projectA != projectB {
+			if projectA < projectB {
+				return -1
+			}
+			return 1
+		}
+	}
+
+	// keys are compared with their numbers, QA-9 goes before QA-10
+	projectA, projectB := format.IssueProject(a.Key), format.IssueProject(b.Key)
+	if projectA != projectB {
+		if projectA < projectB {
+			return -1
+		}
+		return 1
+	}
+	return issueNumber(a.Key) - issueNumber(b.Key)
+}
+
+// 123 for QA-123
+func issueNumber(key string) int {
+	number, _ := strconv.Atoi(strings.TrimPrefix(key, format.IssueProject(key) + "-"))
+	return number
+}
+
+func validIssueOrder(by string) error {
+	switch by {
+	case "", "key", "project", "priority":
+		return nil
+	}
+	return fmt.Errorf("unknown order %q, expected key, project or priority", by)
+}
+
+// every issue has a key of its own, so the issues are grouped by "project" or "priority" only
+func validIssueGroup(by string) error {
+	switch by {
+	case "", "project", "priority":
+		return nil
+	}
+	return fmt.Errorf("unknown group %q, expected project or priority", by)
+}
+
+// sorts the issues and sets their group headers, the issues are grouped in the group order first
+func SortIssues(issues []format.Issue, sortBy string, groupBy string) {
+	sort.SliceStable(issues, func(i, j int) bool {
+		if groupBy != "" && issueAttribute(&issues[i], groupBy) != issueAttribute(&issues[j], groupBy) {
+			return compareIssues(&issues[i], &issues[j], groupBy) < 0
+		}
+		if sortBy == "" {
+			return false
+		}
+		return compareIssues(&issues[i], &issues[j], sortBy) < 0
+	})
+
+	if groupBy != "" {
+		for i := range issues {
+			issues[i].Group = issueAttribute(&issues[i], groupBy)
+		}
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+import "fmt"
+import "log"
+import "strings"
+import "sync"
+import "time"
+import "ru/wikimart/dataflow/format"
+
+// jira cloud takes at most this many issue keys per deployment
+const MAX_DEPLOYMENT_KEYS = 500
+
+// jira software cloud deployments panel, the deployed issues show "deployed to production" natively;
+// route the Deploy and Rollback transitions to it. Needs the oauth credentials of the deployments integration
+// (jira settings, apps, oauth credentials)
+type JiraDeploymentsDestination struct {
+	DestinationBase
+	// e.g. https://shop.atlassian.net, its cloud id is asked for unless cloudId is set
+	Site string `json:"site"`
+	CloudId string `json:"cloudId"`
+	ClientId string `json:"clientId"`
+	ClientSecret string `json:"clientSecret"`
+	// the environment of the announcements without one, production by default
+	Environment string `json:"environment"`
+	// development, testing, staging, production or unmapped by environment name,
+	// guessed from the name for the rest of them
+	EnvironmentTypes map[string]string `json:"environmentTypes"`
+	// the pipeline of the deployments without a ci build, "jiratohook" by default
+	Pipeline string `json:"pipeline"`
+	// the api address, e.g. of a proxy
+	Endpoint string `json:"endpoint"`
+
+	mutex sync.Mutex
+	token string
+	expires time.Time
+}
+
+func init() {
+	RegisterDestination("jira-deployments", func() Destination { return &JiraDeploymentsDestination{} })
+}
+
+type JiraDeploymentAssociation struct {
+	AssociationType string `json:"associationType"`
+	Values []string `json:"values"`
+}
+
+type JiraDeploymentPipeline struct {
+	Id string `json:"id"`
+	DisplayName string `json:"displayName"`
+	Url string `json:"url"`
+}
+
+type JiraDeploymentEnvironment struct {
+	Id string `json:"id"`
+	DisplayName string `json:"displayName"`
+	Type string `json:"type"`
+}
+
+type JiraDeployment struct {
+	DeploymentSequenceNumber int64 `json:"deploymentSequenceNumber"`
+	UpdateSequenceNumber int64 `json:"updateSequenceNumber"`
+	Associations []JiraDeploymentAssociation `json:"associations"`
+	DisplayName string `json:"displayName"`
+	Url string `json:"url"`
+	Description string `json:"description"`
+	LastUpdated time.Time `json:"lastUpdated"`
+	State string `json:"state"`
+	Pipeline JiraDeploymentPipeline `json:"pipeline"`
+	Environment JiraDeploymentEnvironment `json:"environment"`
+}
+
+type JiraDeploymentsRequest struct {
+	Deployments []*JiraDeployment `json:"deployments"`
+}
+
+type JiraDeploymentsResponse struct {
+	RejectedDeployments []struct {
+		Errors []struct {
+			Message string `json:"message"`
+		} `json:"errors"`
+	} `json:"rejectedDeployments"`
+	UnknownIssueKeys []string `json:"unknownIssueKeys"`
+}
+
+var jiraEnvironmentTypes = map[string]bool {
+	"development": true,
+	"testing": true,
+	"staging": true,
+	"production": true,
+	"unmapped": true,
+}
+
+func (d *JiraDeploymentsDestination) Init() error {
+	if d.ClientId == "" || d.ClientSecret == "" {
+		return fmt.Errorf("clientId and clientSecret are required")
+	}
+	if d.Site == "" && d.CloudId == "" {
+		return fmt.Errorf("site or cloudId is required")
+	}
+	for environment, environmentType := range d.EnvironmentTypes {
+		if !jiraEnvironmentTypes[environmentType] {
+			return fmt.Errorf("environment %s: unknown type %q", environment, environmentType)
+		}
+	}
+	if d.Environment == "" {
+		d.Environment = "production"
+	}
+	if d.Pipeline == "" {
+		d.Pipeline = "jiratohook"
+	}
+	if d.Endpoint == "" {
+		d.Endpoint = "https://api.atlassian.com"
+	}
+	return nil
+}
+
+// the type of the environment as jira groups them, e.g. prod-eu is production
+func (d *JiraDeploymentsDestination) environmentType(environment string) string {
+	if environmentType, ok := d.EnvironmentTypes[environment]; ok {
+		return environmentType
+	}
+	name := strings.ToLower(environment)
+	switch {
+	case strings.HasPrefix(name, "prod") || strings.HasPrefix(name, "live"):
+		return "production"
+	case strings.HasPrefix(name, "stag") || strings.HasPrefix(name, "preprod"):
+		return "staging"
+	case strings.HasPrefix(name, "test") || strings.HasPrefix(name, "qa") || strings.HasPrefix(name, "uat"):
+		return "testing"
+	case strings.HasPrefix(name, "dev"):
+		return "development"
+	}
+	return "unmapped"
+}
+
+type atlassianToken struct {
+	AccessToken string `json:"access_token"`
+	ExpiresIn int `json:"expires_in"`
+}
+
+// the token of the oauth credentials and the cloud id of the site, both asked for once and kept
+func (d *JiraDeploymentsDestination) credentials() (string, string, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.CloudId == "" {
+		var tenant struct {
+			CloudId string `json:"cloudId"`
+		}
+		if err := JsonRequest("GET", strings.TrimRight(d.Site, "/") + "/_edge/tenant_info", nil, nil, &tenant); err != nil {
+			return "", "", fmt.Errorf("cloud id of %s: %s", d.Site, err.Error())
+		}
+		d.CloudId = tenant.CloudId
+	}
+
+	now := time.Now()
+	if d.token == "" || now.Add(5 * time.Minute).After(d.expires) {
+		var fetched atlassianToken
+		body := map[string]string {
+			"audience": "api.atlassian.com",
+			"grant_type": "client_credentials",
+			"client_id": d.ClientId,
+			"client_secret": d.ClientSecret,
+		}
+		if err := JsonRequest("POST", d.Endpoint + "/oauth/token", nil, body, &fetched); err != nil {
+			return "", "", fmt.Errorf("oauth token: %s", err.Error())
+		}
+		d.token, d.expires = fetched.AccessToken, now.Add(time.Duration(fetched.ExpiresIn) * time.Second)
+	}
+	return d.token, d.CloudId, nil
+}
+
+func (d *JiraDeploymentsDestination) deployment(announcement *format.Announcement) *JiraDeployment {
+	keys := []string { announcement.Issue.Key }
+	for _, issue := range announcement.Issues {
+		if len(keys) < MAX_DEPLOYMENT_KEYS && !containsString(keys, issue.Key) {
+			keys = append(keys, issue.Key)
+		}
+	}
+
+	environment := announcement.Environment
+	if environment == "" {
+		environment = d.Environment
+	}
+	state := "successful"
+	if announcement.Transition == "Rollback" {
+		state = "rolled_back"
+	}
+	pipeline := JiraDeploymentPipeline { Id: d.Pipeline, DisplayName: d.Pipeline, Url: announcement.Issue.Url }
+	url := announcement.Issue.Url
+	if len(announcement.Builds) > 0 {
+		build := announcement.Builds[0]
+		pipeline = JiraDeploymentPipeline { Id: build.Name, DisplayName: build.Name, Url: build.Url }
+		url = build.Url
+	}
+
+	// the sequence numbers only have to grow, the later deployments win
+	sequence := announcement.Received.UnixNano() / int64(time.Millisecond)
+	return &JiraDeployment {
+		DeploymentSequenceNumber: sequence,
+		UpdateSequenceNumber: sequence,
+		Associations: []JiraDeploymentAssociation { { AssociationType: "issueIdOrKeys", Values: keys } },
+		DisplayName: format.TruncateRunes(strings.TrimSpace(announcement.Issue.Key + " " + announcement.Issue.Summary), 255),
+		Url: url,
+		Description: format.TruncateRunes(announcement.PlainText(), 255),
+		LastUpdated: announcement.Received,
+		State: state,
+		Pipeline: pipeline,
+		Environment: JiraDeploymentEnvironment { Id: environment, DisplayName: environment, Type: d.environmentType(environment) },
+	}
+}
+
+func (d *JiraDeploymentsDestination) Send(announcement *format.Announcement) error {
+	token, cloudId, err := d.credentials()
+	if err != nil {
+		return err
+	}
+
+	deployment := d.deployment(announcement)
+	var accepted JiraDeploymentsResponse
+	address := fmt.Sprintf("%s/jira/deployments/0.1/cloud/%s/bulk", d.Endpoint, cloudId)
+	if err := JsonRequest("POST", address, d.WithHeaders(map[string]string { "Authorization": "Bearer " + token }), &JiraDeploymentsRequest { Deployments: []*JiraDeployment { deployment } }, &accepted); err != nil {
+		return err
+	}
+	if len(accepted.RejectedDeployments) > 0 {
+		var messages []string
+		for _, rejected := range accepted.RejectedDeployments {
+			for _, rejectedError := range rejected.Errors {
+				messages = append(messages, rejectedError.Message)
+			}
+		}
+		return &DeliveryError { Body: "deployment rejected: " + strings.Join(messages, "; ") }
+	}
+	if len(accepted.UnknownIssueKeys) > 0 {
+		log.Printf("jira does not know %s of the %s deployment\n", strings.Join(accepted.UnknownIssueKeys, ", "), announcement.Issue.Key)
+	}
+
+	log.Printf("sent %s deployment to %s to jira\n", announcement.Issue.Key, deployment.Environment.Id)
+	return nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import "bufio"
+import "encoding/json"
+import "io"
+import "os"
+import "sync"
+import "time"
+
+type JournalEntry struct {
+	Time time.Time `json:"time"`
+	Instance string `json:"instance"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+// append-only log of the incoming payloads, one json entry per line
+type Journal struct {
+	mutex sync.Mutex
+	file *os.File
+	path string
+}
+
+// most entries /admin/history returns
+const MAX_HISTORY = 1000
+
+func OpenJournal(path string) (*Journal, error) {
+	file, err := os.OpenFile(path, os.O_CREATE | os.O_APPEND | os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &Journal { file: file, path: path }, nil
+}
+
+func (j *Journal) Append(instance string, payload []byte) error {
+	entry := JournalEntry {
+		Time: time.Now(),
+		Instance: instance,
+		Payload: payload,
+	}
+	// payloads which are not valid json are stored as strings
+	if !json.Valid(payload) {
+		entry.Payload, _ = json.Marshal(string(payload))
+	}
+
+	line, err := json.Marshal(&entry)
+	if err != nil {
+		return err
+	}
+
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	_, err = j.file.Write(append(line, '\n'))
+	return err
+}
+
+// the last entries, the oldest first
+func (j *Journal) Tail(count int) ([]*JournalEntry, error) {
+	file, err := os.Open(j.path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var lines [][]byte
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		// a line being appended is not complete yet
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		lines = append(lines, line)
+		if len(lines) > count {
+			lines = lines[1:]
+		}
+	}
+
+	entries := []*JournalEntry{}
+	for _, line := range lines {
+		entry := &JournalEntry{}
+		if err := json.Unmarshal(line, entry); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import "fmt"
+import "log"
+import "math/rand"
+import "os"
+import "strconv"
+import "sync"
+import "time"
+
+// the leader is replaced if it does not renew its lease within this time
+const LEADER_TTL = 30 * time.Second
+
+// extends the lease only if this replica still holds it
+const renewLeaseScript = `if redis.call("get", KEYS[1]) == ARGV[1] then return redis.call("pexpire", KEYS[1], ARGV[2]) else return 0 end`
+
+// chooses one of the replicas sharing the redis to run the periodic jobs, e.g. the slo alerts
+type Leadership struct {
+	shared *Shared
+	id string
+
+	mutex sync.Mutex
+	leader bool
+	// when the lease was last taken or extended, the lease may have expired in redis a LEADER_TTL later
+	renewed time.Time
+}
+
+func NewLeadership(shared *Shared) *Leadership {
+	host, _ := os.Hostname()
+	return &Leadership {
+		shared: shared,
+		id: fmt.Sprintf("%s-%d-%d", host, os.Getpid(), rand.Int63()),
+	}
+}
+
+// a single replica without the shared state is always the leader
+func (l *Leadership) IsLeader() bool {
+	if l == nil {
+		return true
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.leader
+}
+
+func (l *Leadership) campaign() bool {
+	key := l.shared.prefix + "leader"
+	ttl := strconv.FormatInt(int64(LEADER_TTL / time.Millisecond), 10)
+
+	// the lease runs from before the request, the reply may come late
+	now := time.Now()
+	if l.IsLeader() {
+		reply, err := l.shared.redis.Do("EVAL", renewLeaseScript, "1", key, l.id, ttl)
+		// the lease is kept until it expires if redis is not reachable, another replica may take it then
+		if err != nil {
+			log.Printf("leader lease: %s\n", err)
+			return time.Since(l.renewed) < LEADER_TTL
+		}
+		if reply != int64(1) {
+			return false
+		}
+		l.renewed = now
+		return true
+	}
+
+	reply, err := l.shared.redis.Do("SET", key, l.id, "NX", "PX", ttl)
+	if err != nil {
+		log.Printf("leader lease: %s\n", err)
+		return false
+	}
+	if reply != "OK" {
+		return false
+	}
+	l.renewed = now
+	return true
+}
+
+// keeps the lease until the process exits
+func (l *Leadership) Run() {
+	for {
+		leader := l.campaign()
+
+		l.mutex.Lock()
+		if leader != l.leader {
+			if leader {
+				log.Printf("this replica (%s) runs the periodic jobs now\n", l.id)
+			} else {
+				log.Printf("this replica (%s) no longer runs the periodic jobs\n", l.id)
+			}
+		}
+		l.leader = leader
+		l.mutex.Unlock()
+
+		time.Sleep(LEADER_TTL / 3)
+	}
+}
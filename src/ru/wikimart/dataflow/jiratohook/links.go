@@ -0,0 +1,50 @@
+package main
+
+import "fmt"
+import "log"
+import "sort"
+import "ru/wikimart/dataflow/jiraevent"
+
+// which of the linked issues are listed in the announcement, by the side of the link they are on
+const (
+	LINK_OUTWARD = "outward"
+	LINK_INWARD = "inward"
+	LINK_BOTH = "both"
+	LINK_NONE = "none"
+)
+
+// the issues linked with a release link are listed whichever side they are on
+var DefaultLinkScopes = map[string]string {
+	"Release link": LINK_BOTH,
+}
+
+func validLinkScope(scope string) error {
+	switch scope {
+	case LINK_OUTWARD, LINK_INWARD, LINK_BOTH, LINK_NONE:
+		return nil
+	}
+	return fmt.Errorf("unknown link scope %q, expected outward, inward, both or none", scope)
+}
+
+// whether the linked issue is listed, the migration issues are listed whatever the link is;
+// the link types missing in linkScopes are not listed, and logged so a misspelt type is noticed
+func (h *JiraHandler) InScope(link *jiraevent.IssueLink) bool {
+	scope, ok := h.LinkScopes[link.TypeName()]
+	if !ok {
+		log.Printf("link type %q is not in linkScopes, its issues are not listed\n", link.TypeName())
+		return false
+	}
+	return scope == LINK_BOTH || scope == link.Direction()
+}
+
+// the link types whose issues are listed on some side, sorted, for the scope jql
+func (h *JiraHandler) scopedLinkTypes() []string {
+	var linkTypes []string
+	for linkType, scope := range h.LinkScopes {
+		if scope != LINK_NONE {
+			linkTypes = append(linkTypes, linkType)
+		}
+	}
+	sort.Strings(linkTypes)
+	return linkTypes
+}
@@ -0,0 +1,84 @@
+package main
+
+import "reflect"
+import "testing"
+import "ru/wikimart/dataflow/jiraevent"
+
+func link(linkType string, direction string) *jiraevent.IssueLink {
+	link := &jiraevent.IssueLink {}
+	if linkType != "" {
+		link.Type = &jiraevent.LinkType { Name: linkType }
+	}
+	if direction == LINK_OUTWARD {
+		link.OutwardIssue = &jiraevent.IssueBase { Key: "SHOP-1" }
+	} else {
+		link.InwardIssue = &jiraevent.IssueBase { Key: "SHOP-1" }
+	}
+	return link
+}
+
+func TestInScope(t *testing.T) {
+	h := &JiraHandler {
+		LinkScopes: map[string]string {
+			"Release link": LINK_BOTH,
+			"Blocks": LINK_INWARD,
+			"Clones": LINK_OUTWARD,
+			"Relates": LINK_NONE,
+		},
+	}
+	for _, c := range []struct {
+		linkType string
+		direction string
+		want bool
+	}{
+		{ "Release link", LINK_OUTWARD, true },
+		{ "Release link", LINK_INWARD, true },
+		{ "Blocks", LINK_INWARD, true },
+		{ "Blocks", LINK_OUTWARD, false },
+		{ "Clones", LINK_OUTWARD, true },
+		{ "Clones", LINK_INWARD, false },
+		{ "Relates", LINK_OUTWARD, false },
+		{ "Relates", LINK_INWARD, false },
+		// not configured
+		{ "Duplicate", LINK_OUTWARD, false },
+		{ "release link", LINK_INWARD, false },
+		// no type in the payload
+		{ "", LINK_OUTWARD, false },
+	} {
+		if got := h.InScope(link(c.linkType, c.direction)); got != c.want {
+			t.Errorf("InScope(%q, %s) = %v, want %v", c.linkType, c.direction, got, c.want)
+		}
+	}
+}
+
+func TestScopedLinkTypes(t *testing.T) {
+	h := &JiraHandler {
+		LinkScopes: map[string]string {
+			"Release link": LINK_BOTH,
+			"Blocks": LINK_INWARD,
+			"Relates": LINK_NONE,
+		},
+	}
+	if got, want := h.scopedLinkTypes(), []string { "Blocks", "Release link" }; !reflect.DeepEqual(got, want) {
+		t.Errorf("scopedLinkTypes() = %q, want %q", got, want)
+	}
+}
+
+func TestScopeJql(t *testing.T) {
+	for _, c := range []struct {
+		linkTypes []string
+		mentioned []string
+		want string
+	}{
+		{ nil, nil, `issue in linkedIssues("REL-7")` },
+		{ []string { "Release link" }, nil, `issue in linkedIssues("REL-7", "Release link")` },
+		{ []string { "Blocks", "Release link" }, nil, `issue in linkedIssues("REL-7", "Blocks", "Release link")` },
+		{ []string { "Release link" }, []string { "SHOP-1", "PAY-2" }, `(issue in linkedIssues("REL-7", "Release link") OR key in (SHOP-1, PAY-2))` },
+		{ nil, []string { "SHOP-1" }, `key in (SHOP-1)` },
+		{ []string { `say "hi"` }, nil, `issue in linkedIssues("REL-7", "say \"hi\"")` },
+	} {
+		if got := scopeJql("REL-7", c.linkTypes, c.mentioned); got != c.want {
+			t.Errorf("scopeJql(%q, %q) = %s, want %s", c.linkTypes, c.mentioned, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,26 @@
+package main
+
+import "crypto/tls"
+import "crypto/x509"
+import "fmt"
+import "os"
+
+// tls of the listener, the clients have to present a certificate signed by the client ca if it is set
+func ServerTls(clientCa string) (*tls.Config, error) {
+	config := &tls.Config { MinVersion: tls.VersionTLS12 }
+	if clientCa == "" {
+		return config, nil
+	}
+
+	data, err := os.ReadFile(clientCa)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates in %s", clientCa)
+	}
+	config.ClientCAs = pool
+	config.ClientAuth = tls.RequireAndVerifyClientCert
+	return config, nil
+}
@@ -1,209 +1,775 @@
 package main
 
-import "encoding/json"
 import "net/http"
 import "log"
+import "flag"
+import "fmt"
+import "expvar"
 import "os"
 import "strings"
-import "bytes"
-import "fmt"
+import "sync"
+import "time"
+import "ru/wikimart/dataflow/format"
+import "ru/wikimart/dataflow/jiraevent"
 
 type JiraHandler struct {
-	DestinationHook string
-	JiraBaseUrl string
+	Instances []*JiraInstance
+	Destinations []Destination
+	// replaced on the config reload, read with CurrentRules
+	Rules []*Rule
+	rulesMutex sync.RWMutex
+	// only the first matching rule is used, see RuleMatching in the config; replaced with the rules on reload
+	FirstMatch bool
+	Queue *DeliveryQueue
+	Coalescer *Coalescer
+	Collapser *Collapser
+	Metadata *MetadataStore
+	Environment *EnvironmentConfig
+	// summaries are truncated to this number of characters, unlimited if zero
+	MaxSummaryLength int
+	// the payloads larger than this once decompressed are refused, unlimited if zero
+	MaxBody int64
+	// incoming payloads are journaled if set
+	Journal *Journal
+	Capture *Capture
+	// slack mentions of the transition actors
+	Users *UserMap
+	// event time display, not shown if nil
+	Time *TimeConfig
+	// accepted payloads kept until delivered, see -outbox
+	Outbox *Outbox
+	// the payloads jira sends again are announced once
+	Dedup Deduplicator
+	Cooldowns Cooldowns
+	// priority names by transition names
+	Priorities map[string]string
+	// which linked issues are listed by link type, see LinkScopes in the config
+	LinkScopes map[string]string
+	// the issue keys in the summary and the description are listed too, see ScanKeys in the config
+	ScanKeys bool
+	// reject payloads not matching the schema instead of just logging the diagnostics
+	Strict bool
+	// the failed config reloads are reported here if set
+	Ops *OpsNotifier
+	// issues not announced for a while, see /admin/snoozes
+	Snoozes *Snoozes
+	// announcements of the approval rules waiting for the approvers
+	Approvals *Approvals
+	// the ci webhooks are accepted if set
+	Ci *CiConfig
+	// the ci builds of the issues, see /admin/correlations
+	Correlations *Correlations
+	// the on-call of the project is named in the rollbacks if set
+	OnCall *OnCall
 }
 
-type JiraIssueLogEntryTransition struct {
-	FromStatus string `json:"from_status"`
-	ToStatus string `json:"to_status"`
-	Name string `json:"transitionName"`
+func (h *JiraHandler) LogEvent(event *jiraevent.Event) {
+	log.Printf("event %s\n", event.WebhookEvent)
+	if event.Issue != nil {
+		log.Printf("issue %s\n", event.Issue.Key)
+	}
+
+	if event.Transition != nil {
+		log.Printf("%s → %s (%s)\n", event.Transition.FromStatus, event.Transition.ToStatus, event.Transition.Name)
+		if event.Issue != nil && event.Issue.Fields != nil && len(event.Issue.Fields.IssueLinks) > 0 {
+			for _, link := range event.Issue.Fields.IssueLinks {
+				issue := link.Issue()
+				if issue == nil {
+					continue
+				}
+				summary := ""
+				if issue.Fields != nil {
+					summary = issue.Fields.Summary
+				}
+				log.Printf("issue link: %s %s %s (%s)\n", link.TypeName(), link.Direction(), issue.Key, summary)
+			}
+		} else { log.Printf("no issue links\n") }
+	}
 }
 
-type JiraIssueLogIssueFields struct {
-	Summary string `json:"summary"`
-	IssueLinks []JiraIssueLogIssueLink `json:"issuelinks"`
+func (h *JiraHandler) Priority(transition string) int {
+	if priority, ok := priorityNames[h.Priorities[transition]]; ok {
+		return priority
+	}
+	return PRIORITY_LOW
 }
 
-type JiraIssueLogIssueBase struct {
-        Key string `json:"key"`
-        Fields *JiraIssueLogIssueFields `json:"fields"`
+// false if the rule announced the same transition of the issue within its cooldown
+func (h *JiraHandler) StartCooldown(rule *Rule, announcement *format.Announcement) bool {
+	if rule.cooldown <= 0 {
+		return true
+	}
+	what := announcement.Transition
+	if announcement.Event != "" {
+		what = announcement.Event
+	}
+	return h.Cooldowns.Start(strings.Join([]string { rule.Name, announcement.Instance, announcement.Issue.Key, what }, "/"), rule.cooldown)
 }
 
-type JiraIssueLogIssueLinkType struct {
-	Name string `json:"name"`
+// applies the rule and dispatches the announcement, now or after the coalesce window
+func (h *JiraHandler) Route(rule *Rule, announcement *format.Announcement) {
+	ruleAnnouncement := rule.Apply(announcement)
+	// only the transitions are coalesced, the other events would replace them
+	if rule.coalesceWindow > 0 && ruleAnnouncement.Event == "" {
+		// the outbox keeps the payload while it waits
+		h.Outbox.Hold(ruleAnnouncement.OutboxIds)
+		h.Coalescer.Add(rule, ruleAnnouncement, func(rule *Rule, announcement *format.Announcement) {
+			h.Dispatch(rule, announcement)
+			h.Outbox.Release(announcement.OutboxIds)
+		})
+	} else {
+		h.Dispatch(rule, ruleAnnouncement)
+	}
+}
+
+// queues the announcement for the rule destinations, the approval rules ask the approvers first
+func (h *JiraHandler) Dispatch(rule *Rule, announcement *format.Announcement) {
+	if !rule.Approval {
+		h.Enqueue(rule, announcement)
+	} else if h.Approvals != nil {
+		h.Approvals.Request(rule, announcement)
+	} else {
+		log.Printf("rule %s: approval is not configured, %s is not sent\n", rule.Name, announcement.Issue.Key)
+	}
+}
+
+// queues the announcement for the rule destinations
+func (h *JiraHandler) Enqueue(rule *Rule, announcement *format.Announcement) {
+	announcement = h.Escalate(rule, announcement)
+	priority := h.Priority(announcement.Transition)
+	for _, destination := range rule.destinationsFor(announcement) {
+		h.Outbox.Hold(announcement.OutboxIds)
+		delivery := &Delivery {
+			Destination: destination,
+			Announcement: announcement,
+			Priority: priority,
+		}
+		if destination.Base().CollapseWindow > 0 {
+			h.Collapser.Add(delivery, h.Queue.Push)
+		} else {
+			h.Queue.Push(delivery)
+		}
+	}
 }
 
-type JiraIssueLogIssueLink struct {
-	Type *JiraIssueLogIssueLinkType `json:"type"`
-	OutwardIssue *JiraIssueLogIssueBase `json:"outwardIssue"`
-	InwardIssue *JiraIssueLogIssueBase `json:"inwardIssue"`
+func (h *JiraHandler) ServeHTTP(response http.ResponseWriter, request *http.Request) {
+	raw, err := ReadBody(request, h.MaxBody)
+	if err != nil {
+		log.Printf("error when reading a request: %s\n", err)
+		WriteBodyProblem(response, request, err)
+		return
+	}
+	// the form-encoded payloads are kept as json, the signature is of the body as it was sent
+	body, err := jiraevent.Normalize(request.Header.Get("Content-Type"), raw)
+	if err != nil {
+		log.Printf("error when decoding a form payload: %s\n", err)
+		WriteProblem(response, request, http.StatusBadRequest, PROBLEM_INVALID_PAYLOAD, "error when decoding a form payload")
+		return
+	}
+
+	if h.Queue.Overloaded() {
+		log.Printf("delivery queue is full, refusing a payload\n")
+		response.Header().Set("Retry-After", "30")
+		WriteProblem(response, request, http.StatusServiceUnavailable, PROBLEM_QUEUE_FULL, "delivery queue is full, retry later")
+		return
+	}
+
+	// the events no rule announces are dropped before they are decoded,
+	// jira may be configured to send everything
+	if event, ok := peekWebhookEvent(body); ok && !h.Wanted(event) {
+		log.Printf("event %s is not announced by any rule, skipped\n", event)
+		return
+	}
+
+	// validate event
+	diagnostics := ValidatePayload(body)
+	for _, diagnostic := range diagnostics {
+		log.Printf("payload %s %s: %s\n", diagnostic.Problem, diagnostic.Path, diagnostic.Message)
+	}
+	if h.Strict && HasSchemaErrors(diagnostics) {
+		problem := NewProblem(request, http.StatusBadRequest, PROBLEM_SCHEMA_VIOLATION, "payload does not match the schema served at /schema")
+		problem.Diagnostics = diagnostics
+		problem.Write(response)
+		return
+	}
+
+	// decode event
+	logEntry, err := jiraevent.Parse(body)
+	if err != nil {
+		log.Printf("error when decoding a payload: %s\n", err)
+		// the fields decoded are processed unless strict, as they always were
+		if h.Strict {
+			WriteProblem(response, request, http.StatusBadRequest, PROBLEM_INVALID_PAYLOAD, "error when decoding a payload")
+			return
+		}
+	}
+
+	instance := h.DetectInstance(request, logEntry)
+	if instance == nil {
+		log.Printf("no instance with a secret detected for the payload, rejected\n")
+		WriteProblem(response, request, http.StatusUnauthorized, PROBLEM_UNKNOWN_INSTANCE, "the instance is not named in the path or in X-Jira-Instance")
+		return
+	}
+	if !instance.VerifySignature(request, raw) {
+		log.Printf("signature mismatch for instance %s\n", instance.Name)
+		WriteProblem(response, request, http.StatusUnauthorized, PROBLEM_SIGNATURE_MISMATCH, "signature mismatch")
+		return
+	}
+	if err := instance.CheckSkew(request, logEntry); err != nil {
+		log.Printf("stale delivery for instance %s: %s\n", instance.Name, err)
+		WriteProblem(response, request, http.StatusUnauthorized, PROBLEM_STALE_DELIVERY, err.Error())
+		return
+	}
+	instance = instance.ForEvent(logEntry)
+
+	// the webhook url may narrow the events down on the jira side
+	filter, err := ParseUrlFilter(request.URL.Query())
+	if err != nil {
+		WriteProblem(response, request, http.StatusBadRequest, PROBLEM_INVALID_PARAMETER, err.Error())
+		return
+	}
+	if !filter.Matches(logEntry) {
+		log.Printf("event %s does not pass the filter of the webhook url %s, skipped\n", logEntry.WebhookEvent, request.URL.RawQuery)
+		return
+	}
+
+	// from now on the payload survives a restart
+	outboxId, err := h.Outbox.Add(instance.Name, body)
+	if err != nil {
+		log.Printf("error when storing a payload in the outbox: %s\n", err)
+		WriteProblem(response, request, http.StatusServiceUnavailable, PROBLEM_OUTBOX_UNAVAILABLE, "error when storing a payload")
+		return
+	}
+	// the signature is remembered once the payload is stored, the retries of the deliveries failed before are accepted
+	if !h.FirstDelivery(instance, request) {
+		h.Outbox.Release([]string { outboxId })
+		log.Printf("replayed signature for instance %s\n", instance.Name)
+		WriteProblem(response, request, http.StatusUnauthorized, PROBLEM_REPLAYED, "the signature was accepted already")
+		return
+	}
+	// and so is the payload marked as seen
+	if h.Dedup != nil && h.Dedup.Seen(body) {
+		h.Outbox.Release([]string { outboxId })
+		log.Printf("duplicate payload for instance %s, already accepted\n", instance.Name)
+		return
+	}
+
+	if h.Journal != nil {
+		if err := h.Journal.Append(instance.Name, body); err != nil {
+			log.Printf("error when journaling a payload: %s\n", err)
+		}
+	}
+
+	issueKey := ""
+	if logEntry.Issue != nil {
+		issueKey = logEntry.Issue.Key
+	}
+	h.Capture.Take(logEntry.WebhookEvent, issueKey, body)
+
+	h.Process(outboxId, logEntry, body, instance)
 }
 
-type JiraIssueLogIssue struct {
-	JiraIssueLogIssueBase
+// builds the announcement of the event with everything the rules need, nil if the event is not announced
+func (h *JiraHandler) Announce(event *jiraevent.Event, instance *JiraInstance) *format.Announcement {
+	announcement := h.BuildAnnouncement(event, instance)
+	if announcement == nil {
+		announcement = h.BuildAttachment(event, instance)
+	}
+	if announcement == nil {
+		announcement = h.BuildWorklog(event, instance)
+	}
+	if announcement == nil {
+		announcement = h.BuildServiceEvent(event, instance)
+	}
+	if announcement == nil {
+		return nil
+	}
+
+	announcement.TruncateSummaries(h.MaxSummaryLength)
+	AddExclusionFields(announcement, event)
+	announcement.Metadata = h.Metadata.Get(announcement.Issue.Key)
+	if h.Environment != nil {
+		h.Environment.Apply(event, announcement)
+	}
+	if h.Time != nil {
+		announcement.Time = h.Time.Format(event.Timestamp, announcement.Received)
+	}
+	h.AddTimeSpent(announcement, instance)
+	h.AddBuilds(announcement)
+	h.AddOnCall(announcement)
+	return announcement
 }
 
-type JiraIssueLogEntry struct {
-	WebhookEvent string `json:"webhookEvent"`
-	Transition *JiraIssueLogEntryTransition `json:"transition"`
-	Issue *JiraIssueLogIssue `json:"issue"`
+// the rules of the kind the announcement matches, up to the first one in the first-match mode or up to a final one;
+// the rules in canary do not stop the evaluation, the rules they replace still get the announcements
+func (h *JiraHandler) matchRules(announcement *format.Announcement, catchAll bool) []*Rule {
+	var rules []*Rule
+	current, firstMatch := h.currentMatching()
+	for _, rule := range current {
+		if rule.CatchAll != catchAll || !rule.Matches(announcement) {
+			continue
+		}
+		rules = append(rules, rule)
+		if (firstMatch || rule.Final) && !rule.InCanary() {
+			break
+		}
+	}
+	return rules
 }
 
-type WebHookMessage struct {
-	Text string `json:"text"`
-	IconEmoji *string `json:"icon_emoji,omitempty"`
+// the rules the announcement matches, the catch-all ones excluded
+func (h *JiraHandler) MatchingRules(announcement *format.Announcement) []*Rule {
+	return h.matchRules(announcement, false)
 }
 
-func (h *JiraHandler) GetScopeExceptMD(baseIssue string) string {
-	return fmt.Sprintf("%s/issues/?jql=issue%%20in%%20linkedIssues(%%22%s%%22)%%20AND%%20project%%20!%%3D%%20MD", h.JiraBaseUrl, baseIssue)
+// the catch-all rules for the announcement no other rule matched
+func (h *JiraHandler) CatchAllRules(announcement *format.Announcement) []*Rule {
+	return h.matchRules(announcement, true)
 }
 
-func (h *JiraHandler) LogEvent(event *JiraIssueLogEntry) {
-	log.Printf("event %s\n", event.WebhookEvent)
-	if event.Issue != nil {
-		log.Printf("issue %s\n", event.Issue.Key)
+// announces the event, the outbox id is released when done
+func (h *JiraHandler) Process(outboxId string, logEntry *jiraevent.Event, body []byte, instance *JiraInstance) {
+	var outboxIds []string
+	if outboxId != "" {
+		outboxIds = []string { outboxId }
 	}
+	defer h.Outbox.Release(outboxIds)
 
-	if event.Transition != nil {
-		log.Printf("%s → %s (%s)\n", event.Transition.FromStatus, event.Transition.ToStatus, event.Transition.Name)
-		if len(event.Issue.Fields.IssueLinks) > 0 {
-			for _, link := range event.Issue.Fields.IssueLinks {
-				if link.OutwardIssue != nil {
-					log.Printf("issue link: %s (%s)\n", link.OutwardIssue.Key, link.OutwardIssue.Fields.Summary)
-				}
+	// write log entry
+	log.Printf("instance %s\n", instance.Name)
+	h.LogEvent(logEntry)
+
+	// remember the deployment metadata for the next transitions
+	if logEntry.WebhookEvent == "issue_property_set" && logEntry.Property != nil && logEntry.Issue != nil {
+		log.Printf("property %s of %s: %s\n", logEntry.Property.Key, logEntry.Issue.Key, logEntry.Property.Value)
+		h.Metadata.Set(logEntry.Issue.Key, logEntry.Property)
+	}
+
+	// do transition processing
+	matched := false
+	announcement := h.Announce(logEntry, instance)
+	if announcement != nil {
+		if snooze := h.Snoozes.Find(instance, announcement.Issue.Key); snooze != nil {
+			log.Printf("%s is snoozed until %s by %s, not announced\n", announcement.Issue.Key, snooze.Until.Format(time.RFC3339), snooze.Id)
+			log.Printf("\n")
+			return
+		}
+		announcement.OutboxIds = outboxIds
+		for _, rule := range h.MatchingRules(announcement) {
+			matched = true
+			if !h.StartCooldown(rule, announcement) {
+				log.Printf("rule %s: %s %s is cooling down, not announced\n", rule.Name, announcement.Issue.Key, announcement.Transition)
+				continue
 			}
-		} else { log.Printf("no issue links\n") }
+			h.Route(rule, announcement)
+		}
 	}
+
+	// the rest of the events go to the catch-all rules, if there are any
+	if !matched && logEntry.WebhookEvent != "issue_property_set" {
+		if announcement == nil {
+			announcement = h.BuildUnmatched(logEntry, body, instance)
+			announcement.OutboxIds = outboxIds
+		}
+		for _, rule := range h.CatchAllRules(announcement) {
+			h.Route(rule, announcement)
+		}
+	}
+
+	log.Printf("\n")
 }
 
-func (h *JiraHandler) ServeHTTP(response http.ResponseWriter, request *http.Request) {
-	// decode event
-	dec := json.NewDecoder(request.Body)
+func main() {
+	log.SetOutput(redactor)
+	http.DefaultClient.Transport = userAgentTransport { http.DefaultTransport }
+	if len(os.Args) > 1 && os.Args[1] == "register" {
+		RegisterCommand(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "snooze" {
+		SnoozeCommand(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "tokens" {
+		TokensCommand(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "backfill" {
+		BackfillCommand(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "config" {
+		ConfigCommand(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "diff-rules" {
+		DiffRulesCommand(os.Args[2:])
+		return
+	}
 
-	var logEntry JiraIssueLogEntry
-	dec.Decode(&logEntry)
+	configPath := flag.String("config", "", "json config with additional destinations, its includes are merged in")
+	workers := flag.Int("workers", 4, "number of concurrent deliveries")
+	journalPath := flag.String("journal", "", "file to journal the incoming payloads to")
+	jiraSecret := flag.String("jira-secret", "", "secret of the webhook of the jira from the arguments, needed once the config instances have secrets")
+	adminToken := flag.String("admin-token", "", "bearer token for the /admin endpoints with full access, they are disabled without it or -admin-tokens")
+	adminTokens := flag.String("admin-tokens", "", "file of the scoped admin tokens, see ./jiratohook tokens")
+	maxAttempts := flag.Int("max-attempts", 5, "delivery attempts for retryable errors, the rate limited ones are not counted")
+	rateLimitDeadline := flag.Duration("rate-limit-deadline", time.Hour, "how long a rate limited delivery is retried for before it is given up; never given up if 0")
+	deadLetterPath := flag.String("dead-letter", "", "file to write the undelivered announcements to")
+	redact := flag.Bool("redact", true, "redact destination urls and tokens in the logs and the admin endpoints")
+	publicUrl := flag.String("public-url", "", "address jira sends the webhooks to, e.g. https://jiratohook.example.com")
+	selfCheck := flag.Bool("self-check", false, "check the webhook registration in jira on startup, needs -public-url and the instance credentials")
+	autoRegister := flag.Bool("auto-register", false, "create or update the webhook in jira on startup, needs -public-url and the instance admin credentials")
+	captureDir := flag.String("capture-dir", "captured", "directory /admin/capture writes the payloads to")
+	outboxDir := flag.String("outbox", "", "directory to keep the accepted payloads in until they are delivered, they are resumed on restart")
+	showVersion := flag.Bool("version", false, "print the version and exit")
+	agent := flag.String("user-agent", userAgent, "user agent of the outbound requests")
+	strict := flag.Bool("strict", false, "reject payloads not matching the schema served at /schema")
+	snoozesPath := flag.String("snoozes", "snoozes.json", "file the snoozed issues are kept in, see /admin/snoozes")
+	correlationsPath := flag.String("correlations", "correlations.json", "file the ci builds of the issues are kept in, see /admin/correlations")
+	watchConfig := flag.Duration("watch-config", 10 * time.Second, "interval the rules are reloaded from -config at if it changes, also through the kubernetes configmap symlinks; 0 disables")
+	tlsCert := flag.String("tls-cert", "", "certificate file to serve https with, plain http without it")
+	tlsKey := flag.String("tls-key", "", "key file of -tls-cert")
+	clientCa := flag.String("client-ca", "", "ca file the client certificates are verified against, e.g. of jira data center; needs -tls-cert")
+	maxBody := flag.String("max-body", "10MB", "largest payload accepted, once decompressed if a gateway compresses them")
+	queueMemory := flag.String("queue-memory", "", "memory the queued deliveries may take, e.g. 64MB, the rest of them are spilled to -spill-dir; unlimited if empty")
+	spillDir := flag.String("spill-dir", "", "directory the deliveries over -queue-memory wait in, new payloads are answered with 503 instead if empty")
+	spillMax := flag.String("spill-max", "1GB", "disk the spilled deliveries may take before new payloads are answered with 503")
+	sourceAddress := flag.String("source-address", "", "local ip address of the outbound connections, e.g. the one the egress firewall allows")
+	ipFamily := flag.String("ip-family", "", "4 or 6 to connect over ipv4 or ipv6 only, both if empty")
+	dnsCache := flag.Duration("dns-cache", 0, "how long the resolved addresses of the outbound hosts are kept, and reused while the lookups fail; every address is tried before a connection fails; not cached if zero")
+	chaosFailures := flag.Float64("chaos-failures", 0, "testing only: share of the outbound posts failed on purpose, 0 to 1")
+	chaosDelay := flag.Duration("chaos-delay", 0, "testing only: the outbound posts not failed are delayed by up to this")
+	flag.Parse()
+
+	if *showVersion {
+		fmt.Println(CurrentVersion())
+		return
+	}
 
-	// write log entry
-	h.LogEvent(&logEntry)
+	userAgent = *agent
 
-	// do transition processing
-	if logEntry.Transition != nil {
-		// process just these transitions
-		isRelease := logEntry.Transition.Name == "Release"
-		isDeploy := logEntry.Transition.Name == "Deploy"
-		isRollback := logEntry.Transition.Name == "Rollback"
-
-		// process just QA-issues
-		if (isRelease || isDeploy || isRollback) && strings.HasPrefix(logEntry.Issue.Key, "QA-") {
-			prefixText := "issue ???"
-			if isRelease {
-				prefixText = ":slinky: issue released"
-			} else if isDeploy {
-				prefixText = ":+1::skin-tone-6: issue deployed"
-			} else if isRollback {
-				prefixText = ":slinky2: issue rollbacked"
+	if *sourceAddress != "" || *ipFamily != "" || *dnsCache > 0 {
+		var cache *DnsCache
+		if *dnsCache > 0 {
+			cache = NewDnsCache(*dnsCache)
+		}
+		if err := ConfigureDialer(*sourceAddress, *ipFamily, cache); err != nil {
+			log.Fatalf("%s\n", err)
+		}
+	}
+
+	if *chaosFailures > 0 || *chaosDelay > 0 {
+		log.Printf("chaos mode: failing %.0f%% of the outbound posts, delaying the rest by up to %s\n", *chaosFailures * 100, *chaosDelay)
+		http.DefaultClient.Transport = &chaosTransport { RoundTripper: http.DefaultClient.Transport, failures: *chaosFailures, delay: *chaosDelay }
+	}
+
+	// the resolved secrets are never logged
+	redactor.Disabled = !*redact
+
+	args := flag.Args()
+	if len(args) < 3 {
+		log.Fatalf("not enough arguments\n./jiratohook [-config config.json] http://jira.address|auto localhost:8080 http://destinationwebhook\n./jiratohook register -public-url https://this.service [-config config.json] [-user admin -token secret] [http://jira.address]\n./jiratohook backfill -jql 'project = QA AND status changed after -1d' -target http://this.service [-user u -token t http://jira.address | -config config.json -instance name]\n./jiratohook snooze -url http://this.service -admin-token t (-key QA-1 | -jql 'project = QA') -for 2h [-reason why] | -list | -delete id\n./jiratohook tokens [-file admin-tokens.json] create -name ci -scopes history,correlate | revoke -id id | list\n./jiratohook config -config prod.json\n./jiratohook diff-rules -old config.json -new next.json -journal journal.jsonl")
+		return
+	}
+
+	jiraBaseUrl := args[0]
+	bindAddress := args[1]
+
+	// the webhook, the jira secret and the admin token can be given as file:, env: or vault: references, so they are not seen in ps
+	hook, err := ResolveSecret(args[2])
+	if err != nil {
+		log.Fatalf("error when resolving the webhook: %s\n", err)
+	}
+	if *jiraSecret, err = ResolveSecret(*jiraSecret); err != nil {
+		log.Fatalf("error when resolving the jira secret: %s\n", err)
+	}
+	if *adminToken, err = ResolveSecret(*adminToken); err != nil {
+		log.Fatalf("error when resolving the admin token: %s\n", err)
+	}
+	redactor.AddUrl(hook)
+	redactor.Add(*jiraSecret)
+	redactor.Add(*adminToken)
+
+	// "auto" takes the jira address from the payloads
+	defaultInstance := &JiraInstance { Name: "default", Url: jiraBaseUrl, Secret: *jiraSecret }
+	if jiraBaseUrl == "auto" {
+		defaultInstance.Url = ""
+		defaultInstance.DeriveUrl = true
+	}
+
+	var config *Config
+	if *configPath != "" {
+		if config, err = LoadConfig(*configPath); err != nil {
+			log.Fatalf("error when loading config %s: %s\n", *configPath, err)
+		}
+	}
+	jiraHandler, err := NewRoutingHandler(defaultInstance, config)
+	if err != nil {
+		log.Fatalf("error in config %s: %s\n", *configPath, err)
+	}
+	jiraHandler.Strict = *strict
+	jiraHandler.Queue = NewDeliveryQueue()
+	jiraHandler.Coalescer = NewCoalescer()
+	jiraHandler.Collapser = NewCollapser()
+	jiraHandler.Capture = &Capture { Dir: *captureDir }
+	jiraHandler.Dedup = NewLocalDedup()
+	jiraHandler.Cooldowns = NewLocalCooldowns()
+	jiraHandler.Destinations = []Destination { &SlackDestination { DestinationBase: DestinationBase { DestinationName: "slack" }, Url: hook } }
+
+	// runs the periodic jobs when replicated
+	var leader *Leadership
+
+	if config != nil {
+		for _, instance := range config.Instances {
+			redactor.Add(instance.Token)
+			redactor.Add(instance.Secret)
+		}
+
+		var shared *Shared
+		if config.Shared != nil {
+			redactor.AddUrl(config.Shared.Redis)
+			shared = NewShared(config.Shared)
+		}
+
+		context := &DestinationContext {
+			Instances: jiraHandler.Instances,
+			Users: jiraHandler.Users,
+			Shared: shared,
+		}
+		for _, destinationConfig := range config.Destinations {
+			destination, err := NewDestination(destinationConfig, context)
+			if err != nil {
+				log.Fatalf("error in config %s: %s\n", *configPath, err)
 			}
+			jiraHandler.Destinations = append(jiraHandler.Destinations, destination)
+		}
 
-			// base text about the root issue
-			messageText := fmt.Sprintf("%s: *<%s/browse/%s|%s>* (_%s_)", prefixText, h.JiraBaseUrl, logEntry.Issue.Key, logEntry.Issue.Key, logEntry.Issue.Fields.Summary)
+		if config.Time != nil {
+			jiraHandler.Queue.LateAfter = config.Time.lateAfter
+		}
 
-			// accumulated text for md and non-md entries
-			// if there are MD entries, non-MD entries are skipped
-			mdText := ""
-			nonMdText := ""
+		if shared != nil {
+			jiraHandler.Dedup = shared
+			jiraHandler.Cooldowns = shared
+			jiraHandler.Queue.Shared = shared
+			leader = NewLeadership(shared)
+			go leader.Run()
+		}
 
-			const MAX_NON_MD_ISSUES = 10 // it we have more non-md issues, than this const, cut the rest of them and put a short summary as the last issue
-			lastNonMdIssueText := "" // if we have MAX_NON_MD_ISSUES + 1, still write the last one
-			countNonMdIssues := 0
+		if config.Slo != nil {
+			tracker, err := NewSloTracker(config.Slo)
+			if err != nil {
+				log.Fatalf("error in config %s: %s\n", *configPath, err)
+			}
+			redactor.AddUrl(config.Slo.AlertUrl)
+			tracker.Leader = leader
+			jiraHandler.Queue.Slo = tracker
+			expvar.Publish("slo", expvar.Func(func() interface{} { return tracker.Stats() }))
+			go tracker.Watch()
+		}
 
-			for _, link := range logEntry.Issue.Fields.IssueLinks {
-				// choose the issue, we do not care, whether is is inward or outward
-				issue := link.OutwardIssue
-				if issue == nil {
-					issue = link.InwardIssue
-				}
+		if config.Ops != nil {
+			redactor.AddUrl(config.Ops.Url)
+			ops := NewOpsNotifier(config.Ops)
+			jiraHandler.Ops = ops
+			jiraHandler.Queue.Ops = ops
+		}
 
-				if issue != nil {
-					issueText := fmt.Sprintf("- *<%s/browse/%s|%s>* (_%s_)", h.JiraBaseUrl, issue.Key, issue.Key, issue.Fields.Summary)
-
-					if strings.HasPrefix(issue.Key, "MD-") {
-						mdText = mdText + "\n" + issueText
-						//messageText = messageText + "\n" + issueText
-					} else if link.Type != nil && link.Type.Name == "Release link" {
-						countNonMdIssues++
-						lastNonMdIssueText = issueText
-						if countNonMdIssues < MAX_NON_MD_ISSUES {
-							nonMdText = nonMdText + "\n" + issueText
-						}
-					}
-				}
+		if config.Transport != nil {
+			if err := config.Transport.Apply(); err != nil {
+				log.Fatalf("error in config %s: transport: %s\n", *configPath, err)
 			}
+		}
 
-			if mdText != "" {
-				messageText = messageText + mdText
-				if countNonMdIssues > 0 {
-					messageText = messageText + "\n" + fmt.Sprintf("- ...with <%s|%d issue(s) in scope>", h.GetScopeExceptMD(logEntry.Issue.Key), countNonMdIssues)
-				}
-			} else if nonMdText != "" {
-				messageText = messageText + nonMdText
-				if countNonMdIssues > MAX_NON_MD_ISSUES {
-					if MAX_NON_MD_ISSUES - countNonMdIssues == 1 { // if there's just one more issue, just print it as well
-						messageText = messageText + lastNonMdIssueText
-					} else {
-						messageText = messageText + "\n" + fmt.Sprintf("- ...and <%s|other %d issue(s)>", h.GetScopeExceptMD(logEntry.Issue.Key), MAX_NON_MD_ISSUES - countNonMdIssues)
-					}
-				}
+		if config.Approval != nil {
+			redactor.Add(config.Approval.Token)
+			redactor.Add(config.Approval.SigningSecret)
+			approvals, err := NewApprovals(config.Approval, jiraHandler.Enqueue)
+			if err != nil {
+				log.Fatalf("error in config %s: %s\n", *configPath, err)
 			}
+			approvals.Queue.Ops = jiraHandler.Ops
+			jiraHandler.Approvals = approvals
+		}
 
-			releaseEmoji := ":slinky:"
-			message := WebHookMessage {
-				Text: messageText,
-				IconEmoji: &releaseEmoji,
+		if config.Ci != nil {
+			if err := config.Ci.Init(); err != nil {
+				log.Fatalf("error in config %s: %s\n", *configPath, err)
 			}
+			redactor.Add(config.Ci.Secret)
+			jiraHandler.Ci = config.Ci
+		}
 
-			postString, err := json.Marshal(message)
-			
+		if config.OnCall != nil {
+			redactor.Add(config.OnCall.Token)
+			onCall, err := NewOnCall(config.OnCall)
 			if err != nil {
-				log.Printf("error when marshalling a message: %s", err.Error())
-				return
+				log.Fatalf("error in config %s: %s\n", *configPath, err)
+			}
+			jiraHandler.OnCall = onCall
+		}
+
+		if config.UserSync != nil {
+			redactor.Add(config.UserSync.Token)
+			if err := config.UserSync.Init(); err != nil {
+				log.Fatalf("error in config %s: %s\n", *configPath, err)
 			}
+			go config.UserSync.Watch(jiraHandler.Users)
+		}
+	}
 
-			log.Printf("sending %s", postString)
-			_, err = http.Post(h.DestinationHook, "application/json", bytes.NewReader(postString))
+	if jiraHandler.Rules, err = InitRules(jiraHandler.Rules, jiraHandler.Destinations); err != nil {
+		log.Fatalf("error in config %s: %s\n", *configPath, err)
+	}
+	if *configPath != "" && *watchConfig > 0 {
+		go jiraHandler.WatchConfig(*configPath, *watchConfig)
+	}
+
+	if *journalPath != "" {
+		journal, err := OpenJournal(*journalPath)
+		if err != nil {
+			log.Fatalf("error when opening journal %s: %s\n", *journalPath, err)
+		}
+		jiraHandler.Journal = journal
+	}
+
+	jiraHandler.Queue.MaxAttempts = *maxAttempts
+	jiraHandler.Queue.RateLimitDeadline = *rateLimitDeadline
+	if jiraHandler.Approvals != nil {
+		jiraHandler.Approvals.Queue.MaxAttempts = *maxAttempts
+		jiraHandler.Approvals.Queue.RateLimitDeadline = *rateLimitDeadline
+	}
+	if jiraHandler.MaxBody, err = ParseByteSize(*maxBody); err != nil {
+		log.Fatalf("-max-body: %s\n", err)
+	}
+	if *queueMemory != "" {
+		limit, err := ParseByteSize(*queueMemory)
+		if err != nil {
+			log.Fatalf("-queue-memory: %s\n", err)
+		}
+		jiraHandler.Queue.MemoryLimit = limit
+		if *spillDir != "" {
+			maxBytes, err := ParseByteSize(*spillMax)
 			if err != nil {
-				log.Printf("error when posting to webhook: %s\n", err)
-				return
-			} else {
-				log.Printf("post to webhook %s", postString)
+				log.Fatalf("-spill-max: %s\n", err)
 			}
+			spill, err := OpenSpill(*spillDir, maxBytes, jiraHandler.Destinations)
+			if err != nil {
+				log.Fatalf("error when opening spill %s: %s\n", *spillDir, err)
+			}
+			jiraHandler.Queue.Spill = spill
 		}
 	}
+	if *outboxDir != "" {
+		outbox, err := OpenOutbox(*outboxDir)
+		if err != nil {
+			log.Fatalf("error when opening outbox %s: %s\n", *outboxDir, err)
+		}
+		jiraHandler.Outbox = outbox
+		jiraHandler.Queue.Outbox = outbox
+		if jiraHandler.Approvals != nil {
+			jiraHandler.Approvals.Outbox = outbox
+			jiraHandler.Approvals.Queue.Outbox = outbox
+		}
+		if err := jiraHandler.ResumeOutbox(); err != nil {
+			log.Fatalf("error when resuming outbox %s: %s\n", *outboxDir, err)
+		}
+	}
+	if *snoozesPath != "" {
+		snoozes, err := OpenSnoozes(*snoozesPath)
+		if err != nil {
+			log.Fatalf("error when opening snoozes %s: %s\n", *snoozesPath, err)
+		}
+		jiraHandler.Snoozes = snoozes
+	}
+	if *correlationsPath != "" {
+		correlations, err := OpenCorrelations(*correlationsPath)
+		if err != nil {
+			log.Fatalf("error when opening correlations %s: %s\n", *correlationsPath, err)
+		}
+		jiraHandler.Correlations = correlations
+	}
+	if *deadLetterPath != "" {
+		deadLetters, err := OpenDeadLetters(*deadLetterPath)
+		if err != nil {
+			log.Fatalf("error when opening dead letters %s: %s\n", *deadLetterPath, err)
+		}
+		jiraHandler.Queue.DeadLetters = deadLetters
+	}
 
-	log.Printf("\n")
-}
+	// once an instance has a secret, the unsigned ones would have all their payloads rejected
+	if unsigned := jiraHandler.unsignedInstances(); len(unsigned) > 0 {
+		log.Fatalf("instances %s have no secret while the others have one, set their secrets or -jira-secret for the default one\n", strings.Join(unsigned, ", "))
+	}
 
-func main() {
-	args := os.Args[1:]
-	if len(args) < 3 {
-		log.Fatalf("not enough arguments\n./jiratohook http://jira.address localhost:8080 http://destinationwebhook")
-		return
+	if (*selfCheck || *autoRegister) && *publicUrl == "" {
+		log.Fatalf("-self-check and -auto-register need -public-url\n")
+	}
+	for _, instance := range jiraHandler.Instances {
+		if *autoRegister && instance.Url != "" {
+			if err := instance.RegisterWebhook(*publicUrl); err != nil {
+				log.Printf("register %s: %s\n", instance.Name, err)
+			}
+		}
+		if *selfCheck {
+			instance.SelfCheck(*publicUrl)
+		}
 	}
 
-	jiraBaseUrl := args[0]
-	bindAddress := args[1]
-	hook := args[2]
+	for i := 0; i < *workers; i++ {
+		go jiraHandler.Queue.Work()
+	}
+	if jiraHandler.Approvals != nil {
+		go jiraHandler.Approvals.Queue.Work()
+	}
+	if jiraHandler.Queue.Shared != nil {
+		go jiraHandler.Queue.Feed(jiraHandler.Destinations, *workers)
+	}
 
-	jiraHandler := &JiraHandler {
-		DestinationHook: hook,
-		JiraBaseUrl: jiraBaseUrl,
+	mux := http.NewServeMux()
+	mux.Handle("/", jiraHandler)
+	mux.HandleFunc("/schema", ServeSchema)
+	mux.HandleFunc("/openapi.json", ServeOpenApi)
+	mux.HandleFunc("/version", ServeVersion)
+	mux.HandleFunc("/preview", jiraHandler.ServePreview)
+	if jiraHandler.Approvals != nil {
+		mux.HandleFunc("/slack/interactions", jiraHandler.Approvals.ServeInteractions)
+	}
+	if jiraHandler.Ci != nil {
+		mux.HandleFunc("/ci/", jiraHandler.ServeCi)
 	}
 
+	admin := &AdminHandler {
+		Token: *adminToken,
+		Queue: jiraHandler.Queue,
+		Capture: jiraHandler.Capture,
+		Snoozes: jiraHandler.Snoozes,
+		Correlations: jiraHandler.Correlations,
+		Journal: jiraHandler.Journal,
+		ConfigPath: *configPath,
+		Jira: jiraHandler,
+	}
+	if *adminTokens != "" {
+		admin.Tokens = NewAdminTokens(*adminTokens)
+	}
+	admin.Register(mux)
+
 	srv := &http.Server {
 		Addr: bindAddress,
-		Handler: jiraHandler,
+		Handler: mux,
 	}
 
-	
-
+	if *clientCa != "" && *tlsCert == "" {
+		log.Fatalf("-client-ca needs -tls-cert and -tls-key\n")
+	}
+	if *tlsCert != "" {
+		tlsConfig, err := ServerTls(*clientCa)
+		if err != nil {
+			log.Fatalf("error when reading client ca %s: %s\n", *clientCa, err)
+		}
+		srv.TLSConfig = tlsConfig
+		log.Fatal(srv.ListenAndServeTLS(*tlsCert, *tlsKey))
+	}
 	log.Fatal(srv.ListenAndServe())
 }
@@ -0,0 +1,73 @@
+package main
+
+import "crypto/sha256"
+import "encoding/hex"
+import "fmt"
+import "log"
+import "net/url"
+import "strings"
+import "ru/wikimart/dataflow/format"
+
+// matrix room, e.g. for element, the message is sent by the user of the access token
+type MatrixDestination struct {
+	DestinationBase
+	// e.g. https://matrix.example.com
+	Homeserver string `json:"homeserver"`
+	AccessToken string `json:"accessToken"`
+	// e.g. !abcdef:example.com
+	RoomId string `json:"roomId"`
+	// sent as m.notice, which the bots are expected to use, m.text if false
+	Notice *bool `json:"notice"`
+}
+
+func init() {
+	RegisterDestination("matrix", func() Destination { return &MatrixDestination{} })
+}
+
+type MatrixMessage struct {
+	MsgType string `json:"msgtype"`
+	Body string `json:"body"`
+	Format string `json:"format"`
+	FormattedBody string `json:"formatted_body"`
+}
+
+type MatrixSendResponse struct {
+	EventId string `json:"event_id"`
+}
+
+func (d *MatrixDestination) Init() error {
+	if d.Homeserver == "" || d.AccessToken == "" || d.RoomId == "" {
+		return fmt.Errorf("homeserver, accessToken and roomId are required")
+	}
+	return nil
+}
+
+// the same for the retries of one delivery, so the homeserver sends the message once;
+// the text is not hashed, the late deliveries are flagged in it
+func (d *MatrixDestination) transactionId(announcement *format.Announcement) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s\n%d\n%s\n%s\n%s", d.Name(), announcement.Received.UnixNano(), announcement.Issue.Key, announcement.Event, announcement.Transition)))
+	return hex.EncodeToString(sum[:16])
+}
+
+func (d *MatrixDestination) Send(announcement *format.Announcement) error {
+	message := &MatrixMessage {
+		MsgType: "m.notice",
+		// only the rule mentions the room, not the texts of the issue
+		Body: mentionText(announcement, "@room") + format.DisarmMentions(announcement.PlainText(), "@room"),
+		Format: "org.matrix.custom.html",
+		FormattedBody: mentionText(announcement, "@room") + format.DisarmMentions(announcement.HtmlText(), "@room"),
+	}
+	if d.Notice != nil && !*d.Notice {
+		message.MsgType = "m.text"
+	}
+
+	address := fmt.Sprintf("%s/_matrix/client/v3/rooms/%s/send/m.room.message/%s",
+		strings.TrimRight(d.Homeserver, "/"), url.PathEscape(d.RoomId), d.transactionId(announcement))
+
+	var sent MatrixSendResponse
+	if err := JsonRequest("PUT", address, d.WithHeaders(map[string]string { "Authorization": "Bearer " + d.AccessToken }), message, &sent); err != nil {
+		return err
+	}
+	log.Printf("posted %s to matrix room %s as %s\n", announcement.Issue.Key, d.RoomId, sent.EventId)
+	return nil
+}
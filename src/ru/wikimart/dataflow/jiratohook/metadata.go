@@ -0,0 +1,97 @@
+package main
+
+import "encoding/json"
+import "fmt"
+import "sync"
+import "time"
+import "ru/wikimart/dataflow/jiraevent"
+
+// metadata is forgotten if the issue is not transitioned for this long
+const METADATA_TTL = 7 * 24 * time.Hour
+
+type issueMetadata struct {
+	values map[string]string
+	updated time.Time
+}
+
+// deployment metadata (environment, build number, ...) set as issue properties,
+// merged into the following announcements of the same issue
+type MetadataStore struct {
+	mutex sync.Mutex
+	issues map[string]*issueMetadata
+}
+
+func NewMetadataStore() *MetadataStore {
+	return &MetadataStore {
+		issues: map[string]*issueMetadata{},
+	}
+}
+
+// flattens a property value, objects give one value per field, e.g. {"environment": "prod"}
+func flattenProperty(key string, value json.RawMessage) map[string]string {
+	values := map[string]string{}
+
+	var object map[string]interface{}
+	if err := json.Unmarshal(value, &object); err == nil {
+		for name, field := range object {
+			switch v := field.(type) {
+			case string:
+				values[name] = v
+			case float64, bool:
+				values[name] = fmt.Sprint(v)
+			}
+		}
+		return values
+	}
+
+	var scalar interface{}
+	if err := json.Unmarshal(value, &scalar); err == nil && scalar != nil {
+		values[key] = fmt.Sprint(scalar)
+	}
+	return values
+}
+
+func (s *MetadataStore) Set(issueKey string, property *jiraevent.Property) {
+	s.SetValues(issueKey, flattenProperty(property.Key, property.Value))
+}
+
+// merges the values into the metadata of the issue, e.g. the ones reported by the ci
+func (s *MetadataStore) SetValues(issueKey string, values map[string]string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// forget the stale issues on the way
+	now := time.Now()
+	for key, metadata := range s.issues {
+		if now.Sub(metadata.updated) > METADATA_TTL {
+			delete(s.issues, key)
+		}
+	}
+
+	metadata, ok := s.issues[issueKey]
+	if !ok {
+		metadata = &issueMetadata { values: map[string]string{} }
+		s.issues[issueKey] = metadata
+	}
+	for name, value := range values {
+		metadata.values[name] = value
+	}
+	metadata.updated = now
+}
+
+// copy of the issue metadata, nil if there is none
+func (s *MetadataStore) Get(issueKey string) map[string]string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	metadata, ok := s.issues[issueKey]
+	if !ok || time.Since(metadata.updated) > METADATA_TTL {
+		return nil
+	}
+
+	values := map[string]string{}
+	for name, value := range metadata.values {
+		values[name] = value
+	}
+	return values
+}
@@ -0,0 +1,259 @@
+package main
+
+import "bufio"
+import "crypto/tls"
+import "encoding/json"
+import "fmt"
+import "io"
+import "log"
+import "net"
+import "net/url"
+import "strings"
+import "text/template"
+import "time"
+import "ru/wikimart/dataflow/format"
+
+// mqtt 3.1.1 control packet types
+const (
+	MQTT_CONNECT = 1
+	MQTT_CONNACK = 2
+	MQTT_PUBLISH = 3
+	MQTT_PUBACK = 4
+	MQTT_PUBREC = 5
+	MQTT_PUBREL = 6
+	MQTT_PUBCOMP = 7
+	MQTT_DISCONNECT = 14
+)
+
+// how long a broker may take to answer
+const MQTT_TIMEOUT = 10 * time.Second
+
+// mqtt broker, the announcement event is published to a topic of the project and the event,
+// e.g. jira/QA/Release; a connection is made for every delivery, the announcements are rare
+type MqttDestination struct {
+	DestinationBase
+	// tcp://host:1883, or tls://host:8883
+	Broker string `json:"broker"`
+	ClientId string `json:"clientId"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+	// text/template over the announcement, the + and # wildcards are replaced with _;
+	// jira/{{.Project}}/ and the transition or the event by default
+	Topic string `json:"topic"`
+	// 0, 1 (default) or 2
+	Qos *int `json:"qos"`
+	Retain bool `json:"retain"`
+
+	topic *template.Template
+	address string
+	tls bool
+	qos byte
+}
+
+func init() {
+	RegisterDestination("mqtt", func() Destination { return &MqttDestination{} })
+}
+
+func (d *MqttDestination) Init() error {
+	broker, err := url.Parse(d.Broker)
+	if err != nil {
+		return fmt.Errorf("broker: %s", err.Error())
+	}
+	switch broker.Scheme {
+	case "tcp", "mqtt":
+		d.address = withDefaultPort(broker.Host, "1883")
+	case "tls", "ssl", "mqtts":
+		d.address = withDefaultPort(broker.Host, "8883")
+		d.tls = true
+	default:
+		return fmt.Errorf("broker should be tcp://host:port or tls://host:port, not %q", d.Broker)
+	}
+
+	d.qos = 1
+	if d.Qos != nil {
+		if *d.Qos < 0 || *d.Qos > 2 {
+			return fmt.Errorf("qos should be 0, 1 or 2")
+		}
+		d.qos = byte(*d.Qos)
+	}
+	if d.ClientId == "" {
+		d.ClientId = "jiratohook-" + d.Name()
+	}
+	if d.Topic == "" {
+		d.Topic = "jira/{{.Project}}/{{if .Event}}{{.Event}}{{else}}{{.Transition}}{{end}}"
+	}
+	if d.topic, err = template.New("topic").Parse(d.Topic); err != nil {
+		return err
+	}
+	return nil
+}
+
+func withDefaultPort(host string, port string) string {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// mqtt remaining length, 7 bits per byte
+func mqttLength(length int) []byte {
+	var encoded []byte
+	for {
+		digit := byte(length % 128)
+		length /= 128
+		if length > 0 {
+			digit |= 0x80
+		}
+		encoded = append(encoded, digit)
+		if length == 0 {
+			return encoded
+		}
+	}
+}
+
+func mqttString(text string) []byte {
+	return append([]byte { byte(len(text) >> 8), byte(len(text)) }, text...)
+}
+
+func mqttPacket(header byte, body []byte) []byte {
+	packet := append([]byte { header }, mqttLength(len(body))...)
+	return append(packet, body...)
+}
+
+// reads a packet, its type and its body
+func readMqttPacket(reader *bufio.Reader) (byte, []byte, error) {
+	header, err := reader.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	length, multiplier := 0, 1
+	for i := 0; ; i++ {
+		digit, err := reader.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		length += int(digit & 0x7f) * multiplier
+		multiplier *= 128
+		if digit & 0x80 == 0 {
+			break
+		}
+		if i == 3 {
+			return 0, nil, fmt.Errorf("malformed mqtt packet length")
+		}
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(reader, body); err != nil {
+		return 0, nil, err
+	}
+	return header >> 4, body, nil
+}
+
+// waits for the acknowledgement of the packet id
+func expectMqtt(reader *bufio.Reader, packetType byte, packetId uint16) error {
+	received, body, err := readMqttPacket(reader)
+	if err != nil {
+		return err
+	}
+	if received != packetType || len(body) < 2 || uint16(body[0]) << 8 | uint16(body[1]) != packetId {
+		return fmt.Errorf("unexpected mqtt packet %d while waiting for %d", received, packetType)
+	}
+	return nil
+}
+
+func (d *MqttDestination) connect() (net.Conn, *bufio.Reader, error) {
+	var tlsConfig *tls.Config
+	if d.tls {
+		host, _, _ := net.SplitHostPort(d.address)
+		tlsConfig = &tls.Config { ServerName: host }
+	}
+	connection, err := DialOutbound("tcp", d.address, MQTT_TIMEOUT, tlsConfig)
+	if err != nil {
+		return nil, nil, err
+	}
+	connection.SetDeadline(time.Now().Add(MQTT_TIMEOUT))
+
+	// protocol level 4, clean session, no keep alive as the connection is short
+	flags := byte(0x02)
+	payload := mqttString(d.ClientId)
+	if d.Username != "" {
+		flags |= 0x80
+		payload = append(payload, mqttString(d.Username)...)
+		if d.Password != "" {
+			flags |= 0x40
+			payload = append(payload, mqttString(d.Password)...)
+		}
+	}
+	body := append(mqttString("MQTT"), 4, flags, 0, 0)
+	body = append(body, payload...)
+	if _, err := connection.Write(mqttPacket(MQTT_CONNECT << 4, body)); err != nil {
+		connection.Close()
+		return nil, nil, err
+	}
+
+	reader := bufio.NewReader(connection)
+	packetType, acknowledgement, err := readMqttPacket(reader)
+	if err == nil && (packetType != MQTT_CONNACK || len(acknowledgement) < 2) {
+		err = fmt.Errorf("unexpected mqtt packet %d while connecting", packetType)
+	}
+	if err == nil && acknowledgement[1] != 0 {
+		// 4 and 5 are bad credentials and not authorized, the rest are not worth a retry either
+		err = &DeliveryError { Body: fmt.Sprintf("mqtt connection refused with code %d", acknowledgement[1]) }
+	}
+	if err != nil {
+		connection.Close()
+		return nil, nil, err
+	}
+	return connection, reader, nil
+}
+
+var mqttWildcards = strings.NewReplacer("+", "_", "#", "_")
+
+func (d *MqttDestination) Send(announcement *format.Announcement) error {
+	topic, err := executeTemplate(d.topic, announcement)
+	if err != nil {
+		return fmt.Errorf("topic template: %s", err.Error())
+	}
+	topic = mqttWildcards.Replace(topic)
+	payload, err := json.Marshal(NewAnnouncementEvent(announcement))
+	if err != nil {
+		return err
+	}
+
+	connection, reader, err := d.connect()
+	if err != nil {
+		return err
+	}
+	defer connection.Close()
+
+	header := byte(MQTT_PUBLISH << 4) | d.qos << 1
+	if d.Retain {
+		header |= 0x01
+	}
+	body := mqttString(topic)
+	packetId := uint16(1)
+	if d.qos > 0 {
+		body = append(body, byte(packetId >> 8), byte(packetId))
+	}
+	body = append(body, payload...)
+	if _, err := connection.Write(mqttPacket(header, body)); err != nil {
+		return err
+	}
+
+	switch d.qos {
+	case 1:
+		err = expectMqtt(reader, MQTT_PUBACK, packetId)
+	case 2:
+		if err = expectMqtt(reader, MQTT_PUBREC, packetId); err == nil {
+			if _, err = connection.Write(mqttPacket(MQTT_PUBREL << 4 | 0x02, []byte { byte(packetId >> 8), byte(packetId) })); err == nil {
+				err = expectMqtt(reader, MQTT_PUBCOMP, packetId)
+			}
+		}
+	}
+	if err != nil {
+		return err
+	}
+	connection.Write(mqttPacket(MQTT_DISCONNECT << 4, nil))
+
+	log.Printf("published %s to mqtt topic %s\n", announcement.Issue.Key, topic)
+	return nil
+}
@@ -0,0 +1,191 @@
+package main
+
+import "fmt"
+import "log"
+import "net/url"
+import "regexp"
+import "strings"
+import "sync"
+import "time"
+import "ru/wikimart/dataflow/format"
+import "ru/wikimart/dataflow/jiraevent"
+
+// how long the on-call of a schedule is kept if the config does not say
+const DEFAULT_ONCALL_CACHE = 5 * time.Minute
+
+// the on-call engineer of the project mentioned in the rollbacks, from a pagerduty or opsgenie schedule
+type OnCallConfig struct {
+	// "pagerduty" or "opsgenie"
+	Provider string `json:"provider"`
+	// pagerduty rest api key, or opsgenie api key
+	Token string `json:"token"`
+	// schedule id by project key, "*" for the rest of the projects
+	Schedules map[string]string `json:"schedules"`
+	// transitions as in the rules the on-call is looked up for, Rollback by default
+	Transitions []string `json:"transitions"`
+	// how long a lookup is kept, e.g. "10m", 5m by default
+	CacheFor string `json:"cacheFor"`
+	// the api address, e.g. https://api.eu.opsgenie.com
+	Endpoint string `json:"endpoint"`
+}
+
+type onCallEntry struct {
+	name string
+	email string
+	expires time.Time
+}
+
+// looks up the current on-call of the schedules, the lookups are cached
+type OnCall struct {
+	config *OnCallConfig
+	transitions []*regexp.Regexp
+	cacheFor time.Duration
+
+	mutex sync.Mutex
+	cache map[string]*onCallEntry
+}
+
+func NewOnCall(config *OnCallConfig) (*OnCall, error) {
+	o := &OnCall { config: config, cacheFor: DEFAULT_ONCALL_CACHE, cache: map[string]*onCallEntry{} }
+	switch config.Provider {
+	case "pagerduty":
+		if config.Endpoint == "" {
+			config.Endpoint = "https://api.pagerduty.com"
+		}
+	case "opsgenie":
+		if config.Endpoint == "" {
+			config.Endpoint = "https://api.opsgenie.com"
+		}
+	default:
+		return nil, fmt.Errorf("onCall: provider should be pagerduty or opsgenie, not %q", config.Provider)
+	}
+	if config.Token == "" || len(config.Schedules) == 0 {
+		return nil, fmt.Errorf("onCall: token and schedules are required")
+	}
+
+	transitions := config.Transitions
+	if len(transitions) == 0 {
+		transitions = []string { "Rollback" }
+	}
+	var err error
+	if o.transitions, err = compileTransitions(transitions); err != nil {
+		return nil, fmt.Errorf("onCall: transitions: %s", err.Error())
+	}
+	if config.CacheFor != "" {
+		if o.cacheFor, err = time.ParseDuration(config.CacheFor); err != nil {
+			return nil, fmt.Errorf("onCall: cacheFor: %s", err.Error())
+		}
+	}
+	return o, nil
+}
+
+type pagerDutyOnCalls struct {
+	OnCalls []struct {
+		EscalationLevel int `json:"escalation_level"`
+		User struct {
+			Name string `json:"name"`
+			Summary string `json:"summary"`
+			Email string `json:"email"`
+		} `json:"user"`
+	} `json:"oncalls"`
+}
+
+type opsgenieOnCalls struct {
+	Data struct {
+		OnCallRecipients []string `json:"onCallRecipients"`
+	} `json:"data"`
+}
+
+// asks the provider who is on call now, nil if nobody is
+func (o *OnCall) fetch(schedule string) (*onCallEntry, error) {
+	endpoint := strings.TrimRight(o.config.Endpoint, "/")
+	if o.config.Provider == "opsgenie" {
+		var onCalls opsgenieOnCalls
+		address := joinUrl(endpoint, "v2", "schedules", schedule, "on-calls") + "?" + url.Values { "scheduleIdentifierType": { "id" }, "flat": { "true" } }.Encode()
+		if err := JsonRequest("GET", address, map[string]string { "Authorization": "GenieKey " + o.config.Token }, nil, &onCalls); err != nil {
+			return nil, err
+		}
+		if len(onCalls.Data.OnCallRecipients) == 0 {
+			return nil, nil
+		}
+		// the recipients are the user names, which are their emails
+		email := onCalls.Data.OnCallRecipients[0]
+		return &onCallEntry { name: email, email: email }, nil
+	}
+
+	var onCalls pagerDutyOnCalls
+	query := url.Values { "schedule_ids[]": { schedule }, "include[]": { "users" }, "earliest": { "true" } }
+	headers := map[string]string {
+		"Authorization": "Token token=" + o.config.Token,
+		"Accept": "application/vnd.pagerduty+json;version=2",
+	}
+	if err := JsonRequest("GET", endpoint + "/oncalls?" + query.Encode(), headers, nil, &onCalls); err != nil {
+		return nil, err
+	}
+	// the first level of the escalation policy is the one on call
+	var entry *onCallEntry
+	level := 0
+	for _, onCall := range onCalls.OnCalls {
+		if entry == nil || onCall.EscalationLevel < level {
+			name := onCall.User.Name
+			if name == "" {
+				name = onCall.User.Summary
+			}
+			entry, level = &onCallEntry { name: name, email: onCall.User.Email }, onCall.EscalationLevel
+		}
+	}
+	return entry, nil
+}
+
+// the on-call of the schedule of the project, nil if there is no schedule, nobody is on call or the lookup failed
+func (o *OnCall) Lookup(project string) *onCallEntry {
+	schedule, ok := o.config.Schedules[project]
+	if !ok {
+		if schedule, ok = o.config.Schedules["*"]; !ok {
+			return nil
+		}
+	}
+
+	o.mutex.Lock()
+	cached, ok := o.cache[schedule]
+	o.mutex.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		if cached.name == "" {
+			return nil
+		}
+		return cached
+	}
+
+	entry, err := o.fetch(schedule)
+	if err != nil {
+		log.Printf("error when looking up the on-call of schedule %s: %s\n", schedule, err)
+		return nil
+	}
+	// nobody on call is cached too, as an empty entry
+	cached = &onCallEntry { expires: time.Now().Add(o.cacheFor) }
+	if entry != nil {
+		cached.name, cached.email = entry.name, entry.email
+	}
+	o.mutex.Lock()
+	o.cache[schedule] = cached
+	o.mutex.Unlock()
+	if entry == nil {
+		return nil
+	}
+	return cached
+}
+
+// names the on-call of the project of the announced transition, mentions them if they are a known slack user
+func (h *JiraHandler) AddOnCall(announcement *format.Announcement) {
+	if h.OnCall == nil || announcement.Event != "" || !matchesAny(h.OnCall.transitions, announcement.Transition) {
+		return
+	}
+	onCall := h.OnCall.Lookup(announcement.Project)
+	if onCall == nil {
+		return
+	}
+	announcement.OnCall = onCall.name
+	if onCall.email != "" {
+		announcement.OnCallMention = h.Users.Lookup(&jiraevent.User { EmailAddress: onCall.email, DisplayName: onCall.name })
+	}
+}
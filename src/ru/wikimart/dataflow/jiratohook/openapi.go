@@ -0,0 +1,307 @@
+package main
+
+import "encoding/json"
+import "net/http"
+
+type apiObject = map[string]interface{}
+
+func schemaRef(name string) apiObject {
+	return apiObject { "$ref": "#/components/schemas/" + name }
+}
+
+func jsonContent(schema apiObject) apiObject {
+	return apiObject { "application/json": apiObject { "schema": schema } }
+}
+
+// the payload fields as an openapi schema
+func openApiSchema(fields []SchemaField, closed bool) apiObject {
+	properties := apiObject{}
+	required := []string{}
+	for _, field := range fields {
+		property := apiObject { "type": field.Type }
+		if field.Description != "" {
+			property["description"] = field.Description
+		}
+		if field.Type == "object" && len(field.Fields) > 0 {
+			property = openApiSchema(field.Fields, field.Closed)
+			if field.Description != "" {
+				property["description"] = field.Description
+			}
+		}
+		if field.Type == "array" {
+			property["items"] = openApiSchema(field.Fields, field.Closed)
+		}
+		properties[field.Name] = property
+		if field.Required {
+			required = append(required, field.Name)
+		}
+	}
+
+	schema := apiObject { "type": "object", "properties": properties, "additionalProperties": !closed }
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+	return schema
+}
+
+func openApiObject(properties apiObject) apiObject {
+	return apiObject { "type": "object", "properties": properties }
+}
+
+var stringSchema = apiObject { "type": "string" }
+var integerSchema = apiObject { "type": "integer" }
+var booleanSchema = apiObject { "type": "boolean" }
+var timeSchema = apiObject { "type": "string", "format": "date-time" }
+
+func arraySchema(items apiObject) apiObject {
+	return apiObject { "type": "array", "items": items }
+}
+
+func queryParameter(name string, description string, schema apiObject) apiObject {
+	return apiObject { "name": name, "in": "query", "description": description, "schema": schema }
+}
+
+func headerParameter(name string, description string) apiObject {
+	return apiObject { "name": name, "in": "header", "description": description, "schema": stringSchema }
+}
+
+// the problem+json responses of the given statuses
+func problemResponses(responses apiObject, statuses ...string) apiObject {
+	for _, status := range statuses {
+		responses[status] = apiObject {
+			"description": "see the code of the problem",
+			"content": apiObject { "application/problem+json": apiObject { "schema": schemaRef("Problem") } },
+		}
+	}
+	return responses
+}
+
+func okResponse(description string, schema apiObject) apiObject {
+	return apiObject { "description": description, "content": jsonContent(schema) }
+}
+
+// an admin operation, the scope is the one a scoped token needs
+func adminOperation(summary string, scope string, responses apiObject) apiObject {
+	return apiObject {
+		"summary": summary,
+		"tags": []string { "admin" },
+		"security": []apiObject { { "adminToken": []string { scope } } },
+		"responses": problemResponses(responses, "401", "405"),
+	}
+}
+
+// the operation with the field set
+func with(operation apiObject, name string, value interface{}) apiObject {
+	operation[name] = value
+	return operation
+}
+
+// openapi 3 description of the http endpoints, served at /openapi.json;
+// the webhook payload is described by the same fields as /schema
+func OpenApiDocument() apiObject {
+	payload := apiObject { "$ref": "#/components/schemas/Payload" }
+	payloadBody := apiObject {
+		"required": true,
+		"description": "the form-encoded payloads carry the json in the payload field; gzip and deflate bodies are accepted",
+		"content": apiObject {
+			"application/json": apiObject { "schema": payload },
+			"application/x-www-form-urlencoded": apiObject { "schema": openApiObject(apiObject { "payload": stringSchema }) },
+		},
+	}
+
+	paths := apiObject {
+		"/": apiObject {
+			"post": apiObject {
+				"summary": "jira webhook",
+				"tags": []string { "webhook" },
+				"parameters": []apiObject {
+					queryParameter("project", "announce only the issues of these projects, repeated or comma-separated", stringSchema),
+					queryParameter("transition", "announce only these transitions, patterns like the ones of the rules", stringSchema),
+					queryParameter("event", "announce only these webhook events, e.g. jira:issue_updated", stringSchema),
+					headerParameter("X-Jira-Instance", "name of the configured instance, detected from the payload if missing"),
+					headerParameter("X-Hub-Signature", "sha256= hmac of the body, required if the instance has a secret"),
+				},
+				"requestBody": payloadBody,
+				"responses": problemResponses(apiObject { "200": apiObject { "description": "accepted, or skipped as not wanted" } }, "400", "401", "413", "415", "503"),
+			},
+		},
+		"/preview": apiObject {
+			"post": apiObject {
+				"summary": "renders the messages of a payload without sending them",
+				"tags": []string { "webhook" },
+				"parameters": []apiObject { headerParameter("X-Jira-Instance", "name of the configured instance, detected from the payload if missing") },
+				"requestBody": payloadBody,
+				"responses": problemResponses(apiObject { "200": okResponse("the messages the rules would send", schemaRef("Preview")) }, "400", "405", "413", "415"),
+			},
+		},
+		"/schema": apiObject {
+			"get": apiObject {
+				"summary": "the fields of the payloads, their types and the supported jira versions",
+				"responses": apiObject { "200": okResponse("payload schema", apiObject { "type": "object" }) },
+			},
+		},
+		"/version": apiObject {
+			"get": apiObject {
+				"summary": "build information",
+				"responses": apiObject { "200": okResponse("version", schemaRef("Version")) },
+			},
+		},
+		"/admin/status": apiObject {
+			"get": adminOperation("queue status", SCOPE_HISTORY, apiObject { "200": okResponse("status", schemaRef("AdminStatus")) }),
+		},
+		"/admin/pause": apiObject {
+			"post": adminOperation("holds the outbound deliveries", SCOPE_PAUSE, apiObject { "200": okResponse("status", schemaRef("AdminStatus")) }),
+		},
+		"/admin/resume": apiObject {
+			"post": adminOperation("releases the held deliveries", SCOPE_PAUSE, apiObject { "200": okResponse("status", schemaRef("AdminStatus")) }),
+		},
+		"/admin/history": apiObject {
+			"get": with(adminOperation("the last journaled payloads, available with -journal", SCOPE_HISTORY, problemResponses(apiObject { "200": okResponse("oldest first", arraySchema(schemaRef("JournalEntry"))) }, "400")), "parameters", []apiObject { queryParameter("n", "number of entries, 1 to 1000", apiObject { "type": "integer", "default": 20 }) }),
+		},
+		"/admin/reload": apiObject {
+			"post": adminOperation("reloads the rules from the config, available with -config", SCOPE_RELOAD, problemResponses(apiObject { "200": okResponse("the number of the loaded rules", openApiObject(apiObject { "rules": integerSchema })) }, "422")),
+		},
+		"/admin/capture": apiObject {
+			"post": with(adminOperation("stores the next payloads as fixtures", SCOPE_CAPTURE, problemResponses(apiObject { "200": okResponse("capture status", schemaRef("CaptureStatus")) }, "400")), "parameters", []apiObject { queryParameter("n", "number of payloads, 0 stops the capture", apiObject { "type": "integer", "default": 1 }) }),
+		},
+		"/admin/snoozes": apiObject {
+			"get": adminOperation("the snoozed issues", SCOPE_SNOOZE, apiObject { "200": okResponse("snoozes", arraySchema(schemaRef("Snooze"))) }),
+			"post": with(adminOperation("snoozes an issue or the issues of a jql", SCOPE_SNOOZE, problemResponses(apiObject { "200": okResponse("the snooze", schemaRef("Snooze")) }, "400")), "requestBody", apiObject { "required": true, "content": jsonContent(schemaRef("SnoozeRequest")) }),
+			"delete": with(adminOperation("deletes a snooze", SCOPE_SNOOZE, problemResponses(apiObject { "200": okResponse("the remaining snoozes", arraySchema(schemaRef("Snooze"))) }, "404")), "parameters", []apiObject { queryParameter("id", "id of the snooze", stringSchema) }),
+		},
+		"/admin/correlations": apiObject {
+			"get": with(adminOperation("the ci builds, the latest first", SCOPE_CORRELATE, apiObject { "200": okResponse("builds", arraySchema(schemaRef("Correlation"))) }), "parameters", []apiObject { queryParameter("key", "issue key, all the builds if empty", stringSchema) }),
+			"post": with(adminOperation("correlates a build with the issues, merged into the known build", SCOPE_CORRELATE, problemResponses(apiObject { "200": okResponse("the build", schemaRef("Correlation")) }, "400")), "requestBody", apiObject { "required": true, "content": jsonContent(schemaRef("Correlation")) }),
+			"delete": with(adminOperation("forgets a build", SCOPE_CORRELATE, problemResponses(apiObject { "200": okResponse("the remaining builds", arraySchema(schemaRef("Correlation"))) }, "404")), "parameters", []apiObject { queryParameter("build", "id of the build", stringSchema) }),
+		},
+		"/ci/github": apiObject {
+			"post": apiObject {
+				"summary": "github workflow_run and deployment_status webhooks, available with ci in the config",
+				"tags": []string { "ci" },
+				"parameters": []apiObject {
+					headerParameter("X-GitHub-Event", "the other events are accepted and ignored"),
+					headerParameter("X-Hub-Signature-256", "sha256= hmac of the body with the secret of the ci"),
+				},
+				"requestBody": apiObject { "required": true, "content": jsonContent(apiObject { "type": "object" }) },
+				"responses": problemResponses(apiObject { "200": apiObject { "description": "accepted" } }, "400", "401", "413"),
+			},
+		},
+		"/ci/bitbucket": apiObject {
+			"post": apiObject {
+				"summary": "bitbucket commit status webhooks, available with ci in the config",
+				"tags": []string { "ci" },
+				"parameters": []apiObject {
+					headerParameter("X-Event-Key", "repo:commit_status_created or repo:commit_status_updated, the other events are ignored"),
+					headerParameter("X-Hub-Signature", "sha256= hmac of the body with the secret of the ci"),
+				},
+				"requestBody": apiObject { "required": true, "content": jsonContent(apiObject { "type": "object" }) },
+				"responses": problemResponses(apiObject { "200": apiObject { "description": "accepted" } }, "400", "401", "413"),
+			},
+		},
+		"/slack/interactions": apiObject {
+			"post": apiObject {
+				"summary": "slack interactivity requests of the approval buttons, available with approval in the config",
+				"tags": []string { "slack" },
+				"parameters": []apiObject {
+					headerParameter("X-Slack-Request-Timestamp", "unix time of the request, the older ones are refused"),
+					headerParameter("X-Slack-Signature", "v0= hmac with the signing secret"),
+				},
+				"requestBody": apiObject { "required": true, "content": apiObject { "application/x-www-form-urlencoded": apiObject { "schema": openApiObject(apiObject { "payload": stringSchema }) } } },
+				"responses": problemResponses(apiObject { "200": apiObject { "description": "handled" } }, "400", "401"),
+			},
+		},
+	}
+
+	problem := openApiObject(apiObject {
+		"type": stringSchema,
+		"title": stringSchema,
+		"status": integerSchema,
+		"detail": stringSchema,
+		"instance": stringSchema,
+		"code": stringSchema,
+		"diagnostics": arraySchema(openApiObject(apiObject {
+			"path": stringSchema,
+			"problem": stringSchema,
+			"error": booleanSchema,
+			"message": stringSchema,
+		})),
+	})
+
+	return apiObject {
+		"openapi": "3.0.3",
+		"info": apiObject {
+			"title": "jiratohook",
+			"version": Version,
+			"description": "announces jira webhooks in slack and the other destinations",
+		},
+		"paths": paths,
+		"components": apiObject {
+			"securitySchemes": apiObject {
+				"adminToken": apiObject {
+					"type": "http",
+					"scheme": "bearer",
+					"description": "the -admin-token, or a scoped token of the tokens command",
+				},
+			},
+			"schemas": apiObject {
+				"Payload": openApiSchema(PayloadSchema.Fields, false),
+				"Problem": problem,
+				"Version": openApiObject(apiObject {
+					"version": stringSchema,
+					"commit": stringSchema,
+					"buildDate": stringSchema,
+					"go": stringSchema,
+					"schema": stringSchema,
+				}),
+				"Preview": openApiObject(apiObject {
+					"event": stringSchema,
+					"instance": stringSchema,
+					"diagnostics": problem["properties"].(apiObject)["diagnostics"],
+					"messages": arraySchema(openApiObject(apiObject {
+						"rule": stringSchema,
+						"destinations": arraySchema(stringSchema),
+						"slack": stringSchema,
+						"html": stringSchema,
+						"plain": stringSchema,
+					"markdown": stringSchema,
+					})),
+				}),
+				"AdminStatus": openApiObject(apiObject { "paused": booleanSchema, "queued": integerSchema }),
+				"CaptureStatus": openApiObject(apiObject { "remaining": integerSchema, "dir": stringSchema }),
+				"JournalEntry": openApiObject(apiObject {
+					"time": timeSchema,
+					"instance": stringSchema,
+					"payload": apiObject { "description": "the payload as received, a string if it is not json" },
+				}),
+				"Snooze": openApiObject(apiObject {
+					"id": stringSchema,
+					"key": stringSchema,
+					"jql": stringSchema,
+					"instance": stringSchema,
+					"until": timeSchema,
+					"reason": stringSchema,
+				}),
+				"Correlation": openApiObject(apiObject {
+					"build": apiObject { "type": "string", "example": "github:123456789" },
+					"name": stringSchema,
+					"url": stringSchema,
+					"environment": stringSchema,
+					"keys": arraySchema(stringSchema),
+					"updated": timeSchema,
+				}),
+				"SnoozeRequest": openApiObject(apiObject {
+					"key": stringSchema,
+					"jql": stringSchema,
+					"instance": stringSchema,
+					"for": apiObject { "type": "string", "example": "2h" },
+					"reason": stringSchema,
+				}),
+			},
+		},
+	}
+}
+
+func ServeOpenApi(response http.ResponseWriter, request *http.Request) {
+	response.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(response).Encode(OpenApiDocument())
+}
@@ -0,0 +1,77 @@
+package main
+
+import "bytes"
+import "encoding/json"
+import "fmt"
+import "log"
+import "net/http"
+import "sync"
+import "time"
+
+// the same kind of notification is posted once within this time, the skipped ones are counted
+const OPS_MIN_INTERVAL = time.Minute
+
+// channel for the problems of jiratohook itself
+type OpsConfig struct {
+	// slack-compatible webhook
+	Url string `json:"url"`
+}
+
+// posts a text to a slack-compatible webhook
+func PostWebhookText(url string, text string) error {
+	data, _ := json.Marshal(&WebHookMessage { Text: text })
+	response, err := http.Post(url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	return CheckResponse(response)
+}
+
+type opsKind struct {
+	last time.Time
+	skipped int
+}
+
+// posts the operational failures to the ops channel, nil notifies nothing
+type OpsNotifier struct {
+	url string
+	mutex sync.Mutex
+	kinds map[string]*opsKind
+}
+
+func NewOpsNotifier(config *OpsConfig) *OpsNotifier {
+	return &OpsNotifier { url: config.Url, kinds: map[string]*opsKind{} }
+}
+
+// posts the text unless the same kind was posted recently; never goes through the delivery queue,
+// so the failures of the ops channel itself are only logged
+func (o *OpsNotifier) Notify(kind string, text string) {
+	if o == nil {
+		return
+	}
+
+	o.mutex.Lock()
+	state, ok := o.kinds[kind]
+	if !ok {
+		state = &opsKind{}
+		o.kinds[kind] = state
+	}
+	if time.Since(state.last) < OPS_MIN_INTERVAL {
+		state.skipped++
+		o.mutex.Unlock()
+		return
+	}
+	if state.skipped > 0 {
+		text = text + fmt.Sprintf(" (and %d more like this since %s)", state.skipped, state.last.Format("15:04:05"))
+	}
+	state.last = time.Now()
+	state.skipped = 0
+	o.mutex.Unlock()
+
+	go func() {
+		if err := PostWebhookText(o.url, ":construction: jiratohook: " + text); err != nil {
+			log.Printf("error when posting to the ops channel: %s\n", err)
+		}
+	}()
+}
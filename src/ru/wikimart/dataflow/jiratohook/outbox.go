@@ -0,0 +1,178 @@
+package main
+
+import "encoding/json"
+import "fmt"
+import "log"
+import "os"
+import "path/filepath"
+import "sort"
+import "strings"
+import "sync"
+import "time"
+import "ru/wikimart/dataflow/jiraevent"
+
+// accepted payloads are kept on disk until all their deliveries are done or given up,
+// the unfinished ones are processed again on startup, so a crash does not lose announcements
+type Outbox struct {
+	Dir string
+
+	mutex sync.Mutex
+	sequence int
+	// holds on the payloads by id: the processing, the coalescing and the queued deliveries
+	pending map[string]int
+}
+
+type OutboxEntry struct {
+	Id string `json:"id"`
+	Time time.Time `json:"time"`
+	Instance string `json:"instance"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+func OpenOutbox(dir string) (*Outbox, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &Outbox { Dir: dir, pending: map[string]int{} }, nil
+}
+
+func (o *Outbox) path(id string) string {
+	return filepath.Join(o.Dir, id + ".json")
+}
+
+// stores the payload before it is acknowledged, the returned id is held until released
+func (o *Outbox) Add(instance string, payload []byte) (string, error) {
+	if o == nil {
+		return "", nil
+	}
+
+	o.mutex.Lock()
+	o.sequence++
+	id := fmt.Sprintf("%d-%06d", time.Now().UnixNano(), o.sequence)
+	o.mutex.Unlock()
+
+	entry := OutboxEntry {
+		Id: id,
+		Time: time.Now(),
+		Instance: instance,
+		Payload: payload,
+	}
+	if !json.Valid(payload) {
+		entry.Payload, _ = json.Marshal(string(payload))
+	}
+	data, err := json.Marshal(&entry)
+	if err != nil {
+		return "", err
+	}
+
+	// written aside and renamed, so a crash leaves no partial entries
+	temporary := o.path(id) + ".tmp"
+	file, err := os.OpenFile(temporary, os.O_CREATE | os.O_TRUNC | os.O_WRONLY, 0600)
+	if err != nil {
+		return "", err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return "", err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return "", err
+	}
+	if err := file.Close(); err != nil {
+		return "", err
+	}
+	if err := os.Rename(temporary, o.path(id)); err != nil {
+		return "", err
+	}
+
+	o.Hold([]string { id })
+	return id, nil
+}
+
+func (o *Outbox) Hold(ids []string) {
+	if o == nil {
+		return
+	}
+
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	for _, id := range ids {
+		o.pending[id]++
+	}
+}
+
+// the payload is removed when its last hold is released
+func (o *Outbox) Release(ids []string) {
+	if o == nil {
+		return
+	}
+
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	for _, id := range ids {
+		o.pending[id]--
+		if o.pending[id] > 0 {
+			continue
+		}
+		delete(o.pending, id)
+		if err := os.Remove(o.path(id)); err != nil && !os.IsNotExist(err) {
+			log.Printf("outbox: %s\n", err)
+		}
+	}
+}
+
+// the unfinished payloads in the order they were accepted
+func (o *Outbox) Unfinished() ([]*OutboxEntry, error) {
+	files, err := os.ReadDir(o.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, file := range files {
+		if strings.HasSuffix(file.Name(), ".json") {
+			names = append(names, file.Name())
+		}
+	}
+	sort.Strings(names)
+
+	var entries []*OutboxEntry
+	for _, name := range names {
+		data, err := os.ReadFile(filepath.Join(o.Dir, name))
+		if err != nil {
+			return nil, err
+		}
+		var entry OutboxEntry
+		if err := json.Unmarshal(data, &entry); err != nil {
+			log.Printf("outbox: skipping %s: %s\n", name, err)
+			continue
+		}
+		entries = append(entries, &entry)
+	}
+	return entries, nil
+}
+
+// processes the payloads left unfinished by the previous run
+func (h *JiraHandler) ResumeOutbox() error {
+	entries, err := h.Outbox.Unfinished()
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		event, err := jiraevent.Parse(entry.Payload)
+		// the payloads with the decoding errors were accepted without -strict, the fields decoded are processed
+		if err != nil && h.Strict {
+			log.Printf("outbox: dropping %s: %s\n", entry.Id, err)
+			h.Outbox.Hold([]string { entry.Id })
+			h.Outbox.Release([]string { entry.Id })
+			continue
+		}
+
+		log.Printf("outbox: resuming %s received at %s\n", entry.Id, entry.Time.Format(time.RFC3339))
+		h.Outbox.Hold([]string { entry.Id })
+		h.Process(entry.Id, event, entry.Payload, FindInstance(h.Instances, entry.Instance).ForEvent(event))
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import "bytes"
+import "encoding/json"
+
+// webhook events processed whatever the rules are: the transitions, the attachments and the service requests
+// of jira server come as issue updates, the properties carry the deployment metadata
+var processedEvents = map[string]bool {
+	"": true,
+	"jira:issue_updated": true,
+	"issue_property_set": true,
+}
+
+// reads the top level webhookEvent of the payload token by token, without decoding the rest of it;
+// ok is false if the payload is not a json object, the full decoding reports it then
+func peekWebhookEvent(body []byte) (event string, ok bool) {
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	if token, err := decoder.Token(); err != nil || token != json.Delim('{') {
+		return "", false
+	}
+
+	for decoder.More() {
+		key, err := decoder.Token()
+		if err != nil {
+			return "", false
+		}
+		if key == "webhookEvent" {
+			value, err := decoder.Token()
+			event, isString := value.(string)
+			return event, err == nil && isString
+		}
+
+		// skips the value, the nested objects and arrays included
+		depth := 0
+		for {
+			token, err := decoder.Token()
+			if err != nil {
+				return "", false
+			}
+			switch token {
+			case json.Delim('{'), json.Delim('['):
+				depth++
+			case json.Delim('}'), json.Delim(']'):
+				depth--
+			}
+			if depth == 0 {
+				break
+			}
+		}
+	}
+	// no webhookEvent, e.g. the workflow post functions of the old jira servers
+	return "", true
+}
+
+// whether the current rules may announce the event
+func (h *JiraHandler) Wanted(event string) bool {
+	if processedEvents[event] || h.Capture.Active() {
+		return true
+	}
+	for _, rule := range h.CurrentRules() {
+		if rule.CatchAll || containsString(rule.Events, event) {
+			return true
+		}
+	}
+	return false
+}
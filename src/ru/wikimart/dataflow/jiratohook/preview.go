@@ -0,0 +1,97 @@
+package main
+
+import "encoding/json"
+import "net/http"
+import "ru/wikimart/dataflow/jiraevent"
+
+// message a rule would send, in every markup the destinations use
+type PreviewMessage struct {
+	Rule string `json:"rule"`
+	Destinations []string `json:"destinations"`
+	Slack string `json:"slack"`
+	Html string `json:"html"`
+	Plain string `json:"plain"`
+	Markdown string `json:"markdown"`
+}
+
+type Preview struct {
+	Event string `json:"event"`
+	Instance string `json:"instance"`
+	Diagnostics []SchemaDiagnostic `json:"diagnostics,omitempty"`
+	// empty if the event is not announced
+	Messages []PreviewMessage `json:"messages"`
+}
+
+// renders the messages of a jira payload without sending them, e.g. for a ci test of the formatting;
+// the cooldowns, the coalescing and the deployment metadata are not applied, the instance is chosen by X-Jira-Instance
+func (h *JiraHandler) ServePreview(response http.ResponseWriter, request *http.Request) {
+	if request.Method != "POST" {
+		WriteProblem(response, request, http.StatusMethodNotAllowed, PROBLEM_METHOD_NOT_ALLOWED, "POST expected")
+		return
+	}
+	body, err := ReadBody(request, h.MaxBody)
+	if err != nil {
+		WriteBodyProblem(response, request, err)
+		return
+	}
+	body, err = jiraevent.Normalize(request.Header.Get("Content-Type"), body)
+	if err != nil {
+		WriteProblem(response, request, http.StatusBadRequest, PROBLEM_INVALID_PAYLOAD, "error when decoding a form payload")
+		return
+	}
+	// the fields decoded are previewed unless strict, as the webhook processes them
+	event, err := jiraevent.Parse(body)
+	if err != nil && h.Strict {
+		WriteProblem(response, request, http.StatusBadRequest, PROBLEM_INVALID_PAYLOAD, "error when decoding a payload")
+		return
+	}
+	instance := h.DetectInstance(request, event)
+	if instance == nil {
+		WriteProblem(response, request, http.StatusBadRequest, PROBLEM_UNKNOWN_INSTANCE, "the instance is not named in X-Jira-Instance")
+		return
+	}
+	instance = instance.ForEvent(event)
+
+	preview := &Preview {
+		Event: event.WebhookEvent,
+		Instance: instance.Name,
+		Diagnostics: ValidatePayload(body),
+		Messages: h.PreviewMessages(event, body, instance),
+	}
+
+	response.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(response).Encode(preview)
+}
+
+// the messages the rules would send for the event, none if it is not announced
+func (h *JiraHandler) PreviewMessages(event *jiraevent.Event, body []byte, instance *JiraInstance) []PreviewMessage {
+	messages := []PreviewMessage{}
+	announcement := h.Announce(event, instance)
+	var rules []*Rule
+	if announcement != nil {
+		rules = h.MatchingRules(announcement)
+	}
+	if len(rules) == 0 && event.WebhookEvent != "issue_property_set" {
+		if announcement == nil {
+			announcement = h.BuildUnmatched(event, body, instance)
+		}
+		rules = h.CatchAllRules(announcement)
+	}
+
+	for _, rule := range rules {
+		applied := rule.Apply(announcement)
+		message := PreviewMessage {
+			Rule: rule.Name,
+			Destinations: []string{},
+			Slack: applied.SlackText(),
+			Html: applied.HtmlText(),
+			Plain: applied.PlainText(),
+			Markdown: applied.MarkdownText(),
+		}
+		for _, destination := range rule.destinationsFor(applied) {
+			message.Destinations = append(message.Destinations, destination.Name())
+		}
+		messages = append(messages, message)
+	}
+	return messages
+}
@@ -0,0 +1,63 @@
+package main
+
+import "encoding/json"
+import "net/http"
+
+// machine-readable causes of the error responses, the problem type is "urn:jiratohook:problem:" + code
+const (
+	PROBLEM_READ_FAILED = "read-failed"
+	PROBLEM_TOO_LARGE = "too-large"
+	PROBLEM_UNSUPPORTED_ENCODING = "unsupported-encoding"
+	PROBLEM_SCHEMA_VIOLATION = "schema-violation"
+	PROBLEM_INVALID_PAYLOAD = "invalid-payload"
+	PROBLEM_SIGNATURE_MISMATCH = "signature-mismatch"
+	PROBLEM_UNKNOWN_INSTANCE = "unknown-instance"
+	PROBLEM_STALE_DELIVERY = "stale-delivery"
+	PROBLEM_REPLAYED = "replayed"
+	PROBLEM_OUTBOX_UNAVAILABLE = "outbox-unavailable"
+	PROBLEM_QUEUE_FULL = "queue-full"
+	PROBLEM_UNAUTHORIZED = "unauthorized"
+	PROBLEM_METHOD_NOT_ALLOWED = "method-not-allowed"
+	PROBLEM_INVALID_PARAMETER = "invalid-parameter"
+	PROBLEM_INVALID_CONFIG = "invalid-config"
+	PROBLEM_INTERNAL = "internal"
+)
+
+// RFC 7807 error response body
+type Problem struct {
+	Type string `json:"type"`
+	Title string `json:"title"`
+	Status int `json:"status"`
+	Detail string `json:"detail,omitempty"`
+	// request path
+	Instance string `json:"instance,omitempty"`
+	Code string `json:"code"`
+	// the schema problems of the rejected payloads, see -strict
+	Diagnostics []SchemaDiagnostic `json:"diagnostics,omitempty"`
+}
+
+func NewProblem(request *http.Request, status int, code string, detail string) *Problem {
+	problem := &Problem {
+		Type: "urn:jiratohook:problem:" + code,
+		Title: http.StatusText(status),
+		Status: status,
+		Detail: detail,
+		Code: code,
+	}
+	if request != nil {
+		problem.Instance = request.URL.Path
+	}
+	return problem
+}
+
+func (p *Problem) Write(response http.ResponseWriter) {
+	response.Header().Set("Content-Type", "application/problem+json")
+	response.Header().Set("X-Content-Type-Options", "nosniff")
+	response.WriteHeader(p.Status)
+	json.NewEncoder(response).Encode(p)
+}
+
+// writes a problem+json error response, used instead of http.Error
+func WriteProblem(response http.ResponseWriter, request *http.Request, status int, code string, detail string) {
+	NewProblem(request, status, code, detail).Write(response)
+}
@@ -0,0 +1,193 @@
+package main
+
+import "encoding/json"
+import "fmt"
+import "log"
+import "net/http"
+import "net/url"
+import "strings"
+import "sync"
+import "time"
+import "ru/wikimart/dataflow/format"
+
+// channels are looked up again after this time, so the property changes are picked up
+const PROJECT_CHANNEL_TTL = 10 * time.Minute
+
+// announced messages are reacted to within this time, a new message is posted after it
+const ANNOUNCED_MESSAGE_TTL = 7 * 24 * time.Hour
+
+// slack channel taken from a jira project property, so the teams choose their channel in jira
+type SlackProjectChannelDestination struct {
+	DestinationBase
+	// bot token with chat:write
+	Token string `json:"token"`
+	// "slack-channel" by default, the value is "#channel", a channel id, or {"channel": "..."}
+	Property string `json:"property"`
+	// channel of the projects without the property, they are not announced if empty
+	Channel string `json:"channel"`
+	// https://slack.com/api by default
+	ApiUrl string `json:"apiUrl"`
+
+	slack *SlackApi
+	instances []*JiraInstance
+	// keeps the messages for the reactions across the restarts and the replicas if set
+	shared *Shared
+
+	mutex sync.Mutex
+	// channels by instance and project, empty for the projects without the property
+	channels map[string]projectChannel
+	// the last message of every issue by instance and issue key, for the reactions, unless shared
+	messages map[string]announcedMessage
+}
+
+func init() {
+	RegisterDestination("slack-project-channel", func() Destination { return &SlackProjectChannelDestination{} })
+}
+
+type announcedMessage struct {
+	channel string
+	ts string
+	expires time.Time
+}
+
+type projectChannel struct {
+	channel string
+	expires time.Time
+}
+
+type jiraProjectProperty struct {
+	Key string `json:"key"`
+	Value json.RawMessage `json:"value"`
+}
+
+func (d *SlackProjectChannelDestination) Init() error {
+	if d.Token == "" {
+		return fmt.Errorf("token is required")
+	}
+	if d.Property == "" {
+		d.Property = "slack-channel"
+	}
+	d.slack = &SlackApi { Token: d.Token, Url: d.ApiUrl, Headers: d.Headers }
+	d.channels = map[string]projectChannel{}
+	d.messages = map[string]announcedMessage{}
+	return nil
+}
+
+func (d *SlackProjectChannelDestination) SetContext(context *DestinationContext) {
+	d.instances = context.Instances
+	d.shared = context.Shared
+}
+
+// channel from the property value, a plain string or an object with the channel field
+func propertyChannel(value json.RawMessage) string {
+	var channel string
+	if err := json.Unmarshal(value, &channel); err == nil {
+		return strings.TrimSpace(channel)
+	}
+
+	var object struct {
+		Channel string `json:"channel"`
+	}
+	if err := json.Unmarshal(value, &object); err == nil {
+		return strings.TrimSpace(object.Channel)
+	}
+	return ""
+}
+
+// channel of the project, empty if the project has no property
+func (d *SlackProjectChannelDestination) channel(instance *JiraInstance, project string) (string, error) {
+	key := instance.Name + "/" + project
+
+	d.mutex.Lock()
+	cached, ok := d.channels[key]
+	d.mutex.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached.channel, nil
+	}
+
+	var property jiraProjectProperty
+	path := fmt.Sprintf("/rest/api/2/project/%s/properties/%s", url.PathEscape(project), url.PathEscape(d.Property))
+	err := instance.Request("GET", path, nil, &property)
+	if deliveryError, ok := err.(*DeliveryError); ok && deliveryError.Status == http.StatusNotFound {
+		err = nil
+	} else if err != nil {
+		return "", err
+	}
+
+	channel := propertyChannel(property.Value)
+	d.mutex.Lock()
+	d.channels[key] = projectChannel { channel: channel, expires: time.Now().Add(PROJECT_CHANNEL_TTL) }
+	d.mutex.Unlock()
+	return channel, nil
+}
+
+// the last message announcing the issue, if it is recent enough
+func (d *SlackProjectChannelDestination) message(key string) (announcedMessage, bool) {
+	if d.shared != nil {
+		channel, ts := d.shared.Message(d.Name(), key)
+		return announcedMessage { channel: channel, ts: ts }, ts != ""
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	message, ok := d.messages[key]
+	return message, ok && time.Now().Before(message.expires)
+}
+
+func (d *SlackProjectChannelDestination) remember(key string, message announcedMessage) {
+	if d.shared != nil {
+		d.shared.RememberMessage(d.Name(), key, message.channel, message.ts, ANNOUNCED_MESSAGE_TTL)
+		return
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	now := time.Now()
+	for key, remembered := range d.messages {
+		if now.After(remembered.expires) {
+			delete(d.messages, key)
+		}
+	}
+	message.expires = now.Add(ANNOUNCED_MESSAGE_TTL)
+	d.messages[key] = message
+}
+
+func (d *SlackProjectChannelDestination) Send(announcement *format.Announcement) error {
+	key := announcement.Instance + "/" + announcement.Issue.Key
+
+	// the rule asks to react to the earlier announcement instead of a new message
+	if announcement.Reaction != "" {
+		if message, ok := d.message(key); ok {
+			reaction := &SlackReaction { Channel: message.channel, Timestamp: message.ts, Name: strings.Trim(announcement.Reaction, ":") }
+			if err := d.slack.AddReaction(reaction); err != nil {
+				return err
+			}
+			log.Printf("reacted with %s to %s in %s\n", reaction.Name, announcement.Issue.Key, message.channel)
+			return nil
+		}
+	}
+
+	channel, err := d.channel(FindInstance(d.instances, announcement.Instance), announcement.Project)
+	if err != nil {
+		return err
+	}
+	if channel == "" {
+		channel = d.Channel
+	}
+	if channel == "" {
+		log.Printf("project %s has no %s property, %s is not announced\n", announcement.Project, d.Property, announcement.Issue.Key)
+		return nil
+	}
+
+	posted, err := d.slack.PostMessage(&SlackPostMessage { Channel: channel, Text: announcement.SlackText(), IconEmoji: announcement.Emoji })
+	if err != nil {
+		return err
+	}
+	if announcement.Reaction == "" {
+		d.remember(key, announcedMessage { channel: posted.Channel, ts: posted.Ts })
+	}
+	log.Printf("posted %s to %s\n", announcement.Issue.Key, channel)
+	return nil
+}
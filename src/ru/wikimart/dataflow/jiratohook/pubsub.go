@@ -0,0 +1,229 @@
+package main
+
+import "crypto"
+import "crypto/rand"
+import "crypto/rsa"
+import "crypto/sha256"
+import "crypto/x509"
+import "encoding/base64"
+import "encoding/json"
+import "encoding/pem"
+import "fmt"
+import "log"
+import "os"
+import "strings"
+import "sync"
+import "text/template"
+import "time"
+import "ru/wikimart/dataflow/format"
+
+// the audience of the self-signed service account tokens
+const PUBSUB_AUDIENCE = "https://pubsub.googleapis.com/"
+
+// google cloud pub/sub topic, the announcement event is published with the attributes to filter the subscriptions by
+type PubSubDestination struct {
+	DestinationBase
+	// e.g. projects/shop/topics/releases
+	Topic string `json:"topic"`
+	// service account key file, GOOGLE_APPLICATION_CREDENTIALS if empty,
+	// the token of the metadata server if neither is set, e.g. on gke
+	Credentials string `json:"credentials"`
+	// text/template over the announcement by attribute name, project, transition and issueKey by default
+	Attributes map[string]string `json:"attributes"`
+	// the messages of one issue are delivered in order, the subscription must have the ordering enabled
+	Ordered bool `json:"ordered"`
+	// the api address, e.g. of the emulator
+	Endpoint string `json:"endpoint"`
+
+	attributes map[string]*template.Template
+	account *serviceAccountKey
+
+	mutex sync.Mutex
+	token string
+	expires time.Time
+}
+
+func init() {
+	RegisterDestination("pubsub", func() Destination { return &PubSubDestination{} })
+}
+
+type serviceAccountKey struct {
+	ClientEmail string `json:"client_email"`
+	PrivateKeyId string `json:"private_key_id"`
+	PrivateKey string `json:"private_key"`
+
+	key *rsa.PrivateKey
+}
+
+type PubSubMessage struct {
+	// base64
+	Data string `json:"data"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+	OrderingKey string `json:"orderingKey,omitempty"`
+}
+
+type PubSubPublishRequest struct {
+	Messages []PubSubMessage `json:"messages"`
+}
+
+type PubSubPublishResponse struct {
+	MessageIds []string `json:"messageIds"`
+}
+
+var defaultPubSubAttributes = map[string]string {
+	"project": "{{.Project}}",
+	"transition": "{{.Transition}}",
+	"issueKey": "{{.Issue.Key}}",
+}
+
+func readServiceAccount(path string) (*serviceAccountKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	account := &serviceAccountKey{}
+	if err := json.Unmarshal(data, account); err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode([]byte(account.PrivateKey))
+	if block == nil {
+		return nil, fmt.Errorf("no private key in %s", path)
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("the private key of %s is not rsa", path)
+	}
+	account.key = key
+	return account, nil
+}
+
+func (d *PubSubDestination) Init() error {
+	if !strings.HasPrefix(d.Topic, "projects/") || !strings.Contains(d.Topic, "/topics/") {
+		return fmt.Errorf("topic should be projects/<project>/topics/<topic>, not %q", d.Topic)
+	}
+	if d.Endpoint == "" {
+		d.Endpoint = "https://pubsub.googleapis.com"
+	}
+
+	if d.Attributes == nil {
+		d.Attributes = defaultPubSubAttributes
+	}
+	d.attributes = map[string]*template.Template{}
+	for name, text := range d.Attributes {
+		parsed, err := template.New(name).Parse(text)
+		if err != nil {
+			return fmt.Errorf("attribute %s: %s", name, err.Error())
+		}
+		d.attributes[name] = parsed
+	}
+
+	path := d.Credentials
+	if path == "" {
+		path = os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
+	}
+	if path != "" {
+		account, err := readServiceAccount(path)
+		if err != nil {
+			return fmt.Errorf("credentials: %s", err.Error())
+		}
+		d.account = account
+	}
+	return nil
+}
+
+func jwtPart(value interface{}) string {
+	data, _ := json.Marshal(value)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// self-signed service account token, google accepts them without the oauth exchange
+func (a *serviceAccountKey) token(now time.Time) (string, error) {
+	header := jwtPart(map[string]string { "alg": "RS256", "typ": "JWT", "kid": a.PrivateKeyId })
+	claims := jwtPart(map[string]interface{} {
+		"iss": a.ClientEmail,
+		"sub": a.ClientEmail,
+		"aud": PUBSUB_AUDIENCE,
+		"iat": now.Unix(),
+		"exp": now.Add(time.Hour).Unix(),
+	})
+	digest := sha256.Sum256([]byte(header + "." + claims))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, a.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return header + "." + claims + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+type metadataToken struct {
+	AccessToken string `json:"access_token"`
+	ExpiresIn int `json:"expires_in"`
+}
+
+// a token valid for a few more minutes at least, renewed before it expires
+func (d *PubSubDestination) accessToken() (string, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	now := time.Now()
+	if d.token != "" && now.Add(5 * time.Minute).Before(d.expires) {
+		return d.token, nil
+	}
+
+	if d.account != nil {
+		token, err := d.account.token(now)
+		if err != nil {
+			return "", err
+		}
+		d.token, d.expires = token, now.Add(time.Hour)
+		return d.token, nil
+	}
+
+	var fetched metadataToken
+	err := JsonRequest("GET", "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token", map[string]string { "Metadata-Flavor": "Google" }, nil, &fetched)
+	if err != nil {
+		return "", fmt.Errorf("metadata server token: %s", err.Error())
+	}
+	d.token, d.expires = fetched.AccessToken, now.Add(time.Duration(fetched.ExpiresIn) * time.Second)
+	return d.token, nil
+}
+
+func (d *PubSubDestination) Send(announcement *format.Announcement) error {
+	data, err := json.Marshal(NewAnnouncementEvent(announcement))
+	if err != nil {
+		return err
+	}
+	message := PubSubMessage {
+		Data: base64.StdEncoding.EncodeToString(data),
+		Attributes: map[string]string{},
+	}
+	for name, attribute := range d.attributes {
+		value, err := executeTemplate(attribute, announcement)
+		if err != nil {
+			return fmt.Errorf("attribute %s: %s", name, err.Error())
+		}
+		// the empty attributes, e.g. the transition of the other events, are not sent
+		if value != "" {
+			message.Attributes[name] = value
+		}
+	}
+	if d.Ordered {
+		message.OrderingKey = announcement.Issue.Key
+	}
+
+	token, err := d.accessToken()
+	if err != nil {
+		return err
+	}
+	var published PubSubPublishResponse
+	address := strings.TrimRight(d.Endpoint, "/") + "/v1/" + d.Topic + ":publish"
+	if err := JsonRequest("POST", address, d.WithHeaders(map[string]string { "Authorization": "Bearer " + token }), &PubSubPublishRequest { Messages: []PubSubMessage { message } }, &published); err != nil {
+		return err
+	}
+	log.Printf("published %s to %s as %s\n", announcement.Issue.Key, d.Topic, strings.Join(published.MessageIds, ", "))
+	return nil
+}
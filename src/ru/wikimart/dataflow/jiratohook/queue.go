@@ -0,0 +1,402 @@
+package main
+
+import "fmt"
+import "log"
+import "sync"
+import "time"
+import "ru/wikimart/dataflow/format"
+
+// priority classes, urgent messages jump ahead of the queued low priority ones
+const (
+	PRIORITY_HIGH = iota
+	PRIORITY_NORMAL
+	PRIORITY_LOW
+	PRIORITY_COUNT
+)
+
+var priorityNames = map[string]int {
+	"high": PRIORITY_HIGH,
+	"normal": PRIORITY_NORMAL,
+	"low": PRIORITY_LOW,
+}
+
+// default priorities of the transitions, the rest of the events are low priority
+var DefaultTransitionPriorities = map[string]string {
+	"Rollback": "high",
+	"Release": "normal",
+	"Deploy": "normal",
+}
+
+type Delivery struct {
+	Destination Destination
+	Announcement *format.Announcement
+	Priority int
+	Attempts int
+	// of the attempts, the rate limited ones are retried until RateLimitDeadline from the first of them
+	rateLimited int
+	rateLimitedSince time.Time
+	// memory taken by the delivery, set when the queue has a memory limit
+	size int64
+}
+
+// queue of deliveries, one fifo lane per priority
+type DeliveryQueue struct {
+	mutex sync.Mutex
+	cond *sync.Cond
+	lanes [PRIORITY_COUNT][]*Delivery
+	// destinations are not available until this time, because of the rate limiting
+	blockedUntil map[string]time.Time
+	// deliveries being sent by destination, limited by the destination max in flight
+	inFlight map[string]int
+	wakeup *time.Timer
+	// nothing is delivered while paused, see /admin/pause
+	paused bool
+
+	// attempts for the retryable errors before giving up
+	MaxAttempts int
+	// how long the rate limited deliveries are retried for before giving up, never given up if zero
+	RateLimitDeadline time.Duration
+	// the given up deliveries are written here if set
+	DeadLetters *DeadLetters
+	// delivery latencies and failures are recorded here if set
+	Slo *SloTracker
+	// the deliveries go through the queue shared by the replicas if set, see Feed
+	Shared *Shared
+	// the delivered and the given up announcements are released here if set
+	Outbox *Outbox
+	// deliveries later than this are flagged in the message, never if zero
+	LateAfter time.Duration
+	// the given up deliveries are reported here if set
+	Ops *OpsNotifier
+	// memory the queued deliveries may take, roughly, unlimited if zero;
+	// the rest of them wait in the spill if set, new payloads are refused otherwise
+	MemoryLimit int64
+	Spill *Spill
+	queuedBytes int64
+}
+
+// first retry delay, doubled with every attempt
+const RETRY_DELAY = 5 * time.Second
+
+func NewDeliveryQueue() *DeliveryQueue {
+	queue := &DeliveryQueue {
+		blockedUntil: map[string]time.Time{},
+		inFlight: map[string]int{},
+		MaxAttempts: 5,
+		RateLimitDeadline: time.Hour,
+	}
+	queue.cond = sync.NewCond(&queue.mutex)
+	return queue
+}
+
+func (q *DeliveryQueue) Push(delivery *Delivery) {
+	if q.Shared != nil {
+		err := q.Shared.Push(delivery)
+		if err == nil {
+			q.Outbox.Release(delivery.Announcement.OutboxIds)
+			return
+		}
+		log.Printf("shared queue: %s, delivering locally\n", err)
+	}
+	q.pushLocal(delivery)
+}
+
+func (q *DeliveryQueue) pushLocal(delivery *Delivery) {
+	if q.MemoryLimit > 0 && delivery.size == 0 {
+		delivery.size = deliverySize(delivery)
+	}
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	// over the memory limit the deliveries wait on the disk, after the ones of their priority spilled earlier
+	if q.MemoryLimit > 0 && q.Spill != nil && (q.queuedBytes + delivery.size > q.MemoryLimit || q.Spill.LaneLen(delivery.Priority) > 0) {
+		err := q.Spill.Write(delivery)
+		if err == nil {
+			q.cond.Signal()
+			return
+		}
+		log.Printf("spill: %s, keeping the delivery in memory\n", err)
+	}
+
+	q.lanes[delivery.Priority] = append(q.lanes[delivery.Priority], delivery)
+	q.queuedBytes += delivery.size
+	q.cond.Signal()
+}
+
+// takes the spilled deliveries back while the memory allows, must be called with the mutex locked
+func (q *DeliveryQueue) refill() {
+	if q.Spill == nil || q.queuedBytes > q.MemoryLimit / 2 {
+		return
+	}
+	for q.queuedBytes < q.MemoryLimit {
+		delivery := q.Spill.Read()
+		if delivery == nil {
+			return
+		}
+		delivery.size = deliverySize(delivery)
+		q.lanes[delivery.Priority] = append(q.lanes[delivery.Priority], delivery)
+		q.queuedBytes += delivery.size
+	}
+}
+
+// whether the new payloads should be refused: the spill is full, or the memory is if there is no spill
+func (q *DeliveryQueue) Overloaded() bool {
+	if q.MemoryLimit == 0 {
+		return false
+	}
+	if q.Spill != nil {
+		return q.Spill.Full()
+	}
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return q.queuedBytes >= q.MemoryLimit
+}
+
+// puts the delivery back to the head of its lane
+func (q *DeliveryQueue) Requeue(delivery *Delivery) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	q.lanes[delivery.Priority] = append([]*Delivery { delivery }, q.lanes[delivery.Priority]...)
+	q.queuedBytes += delivery.size
+	q.cond.Signal()
+}
+
+// makes the destination unavailable until the given time
+func (q *DeliveryQueue) Block(destination string, until time.Time) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if until.After(q.blockedUntil[destination]) {
+		q.blockedUntil[destination] = until
+	}
+}
+
+func (q *DeliveryQueue) Pause() {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	q.paused = true
+}
+
+func (q *DeliveryQueue) Resume() {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	q.paused = false
+	q.cond.Broadcast()
+}
+
+func (q *DeliveryQueue) Paused() bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	return q.paused
+}
+
+// takes the most urgent delivery for an available destination, waits if there is none
+func (q *DeliveryQueue) Pop() *Delivery {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	for {
+		for q.paused {
+			q.cond.Wait()
+		}
+		q.refill()
+
+		now := time.Now()
+		var earliest time.Time
+
+		for priority := range q.lanes {
+			for i, delivery := range q.lanes[priority] {
+				// a slow destination does not occupy more workers than allowed,
+				// Done wakes us up when it finishes one
+				if limit := delivery.Destination.Base().MaxInFlight; limit > 0 && q.inFlight[delivery.Destination.Name()] >= limit {
+					continue
+				}
+
+				until := q.blockedUntil[delivery.Destination.Name()]
+				if until.After(now) {
+					if earliest.IsZero() || until.Before(earliest) {
+						earliest = until
+					}
+					continue
+				}
+
+				q.lanes[priority] = append(q.lanes[priority][:i:i], q.lanes[priority][i + 1:]...)
+				q.queuedBytes -= delivery.size
+				if interval := delivery.Destination.Base().MinInterval; interval > 0 {
+					q.blockedUntil[delivery.Destination.Name()] = now.Add(interval)
+				}
+				q.inFlight[delivery.Destination.Name()]++
+				return delivery
+			}
+		}
+
+		// everything queued is blocked, wake up when the first destination becomes available
+		if !earliest.IsZero() {
+			if q.wakeup != nil {
+				q.wakeup.Stop()
+			}
+			q.wakeup = time.AfterFunc(earliest.Sub(now), func() {
+				q.mutex.Lock()
+				q.cond.Broadcast()
+				q.mutex.Unlock()
+			})
+		}
+		q.cond.Wait()
+	}
+}
+
+// marks the popped delivery as no longer in flight
+func (q *DeliveryQueue) Done(delivery *Delivery) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	q.inFlight[delivery.Destination.Name()]--
+	q.cond.Broadcast()
+}
+
+func (q *DeliveryQueue) Len() int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	count := 0
+	for _, lane := range q.lanes {
+		count += len(lane)
+	}
+	if q.Spill != nil {
+		count += q.Spill.Len()
+	}
+	return count
+}
+
+// moves the deliveries from the shared queue to this replica while it has free workers
+func (q *DeliveryQueue) Feed(destinations []Destination, capacity int) {
+	byName := map[string]Destination{}
+	for _, destination := range destinations {
+		byName[destination.Name()] = destination
+	}
+
+	for {
+		if q.Len() >= capacity || q.Paused() {
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+
+		shared, err := q.Shared.Pop(5 * time.Second)
+		if err != nil {
+			log.Printf("shared queue: %s\n", err)
+			time.Sleep(time.Second)
+			continue
+		}
+		if shared == nil {
+			continue
+		}
+
+		destination, ok := byName[shared.Destination]
+		if !ok {
+			log.Printf("shared queue: dropping a delivery to unknown destination %s\n", shared.Destination)
+			continue
+		}
+		q.pushLocal(&Delivery {
+			Destination: destination,
+			Announcement: shared.Announcement,
+			Priority: shared.Priority,
+			Attempts: shared.Attempts,
+		})
+	}
+}
+
+// how long the other replicas keep the destination busy, by their rate limit or min interval
+func (q *DeliveryQueue) sharedWait(destination Destination) time.Duration {
+	if q.Shared == nil {
+		return 0
+	}
+	if until := q.Shared.BlockedUntil(destination.Name()); until.After(time.Now()) {
+		return time.Until(until)
+	}
+	if interval := destination.Base().MinInterval; interval > 0 {
+		if ok, wait := q.Shared.TakeInterval(destination.Name(), interval); !ok {
+			return wait
+		}
+	}
+	return 0
+}
+
+// delivers the queued announcements until the process exits
+func (q *DeliveryQueue) Work() {
+	for {
+		delivery := q.Pop()
+		destination := delivery.Destination
+
+		if wait := q.sharedWait(destination); wait > 0 {
+			q.Done(delivery)
+			q.Block(destination.Name(), time.Now().Add(wait))
+			q.Requeue(delivery)
+			continue
+		}
+		delivery.Attempts++
+
+		announcement := delivery.Announcement
+		if late := time.Since(announcement.Received); q.LateAfter > 0 && late > q.LateAfter {
+			// the announcement is shared between the destinations
+			flagged := *announcement
+			flagged.Late = late.Round(time.Second)
+			announcement = &flagged
+		}
+
+		err := destination.Send(announcement)
+		q.Done(delivery)
+
+		// the rate limited attempts are not failures, they have a deadline of their own instead of counting in the attempts
+		if rateLimit, ok := err.(*RateLimitError); ok {
+			delivery.rateLimited++
+			if delivery.rateLimitedSince.IsZero() {
+				delivery.rateLimitedSince = time.Now()
+			}
+			log.Printf("destination %s: attempt %d: %s\n", destination.Name(), delivery.Attempts, err)
+			q.Block(destination.Name(), time.Now().Add(rateLimit.RetryAfter))
+			if q.Shared != nil {
+				q.Shared.Block(destination.Name(), time.Now().Add(rateLimit.RetryAfter))
+			}
+			if q.RateLimitDeadline <= 0 || time.Since(delivery.rateLimitedSince) < q.RateLimitDeadline {
+				q.Requeue(delivery)
+				continue
+			}
+			err = fmt.Errorf("still rate limited %s after the first rate limited attempt", q.RateLimitDeadline)
+		}
+
+		if err == nil {
+			if q.Slo != nil {
+				q.Slo.Record(time.Since(delivery.Announcement.Received), true)
+			}
+			q.Outbox.Release(delivery.Announcement.OutboxIds)
+			continue
+		}
+
+		if failed := delivery.Attempts - delivery.rateLimited; IsRetryable(err) && failed < q.MaxAttempts {
+			delay := RETRY_DELAY << uint(failed - 1)
+			log.Printf("destination %s: attempt %d failed, retrying in %s: %s\n", destination.Name(), delivery.Attempts, delay, err)
+			time.AfterFunc(delay, func() {
+				q.Push(delivery)
+			})
+			continue
+		}
+
+		log.Printf("destination %s: giving up after %d attempt(s): %s\n", destination.Name(), delivery.Attempts, err)
+		q.Ops.Notify("delivery/" + destination.Name(), fmt.Sprintf("gave up delivering %s to %s after %d attempt(s): %s", delivery.Announcement.Issue.Key, destination.Name(), delivery.Attempts, redactor.Redact(err.Error())))
+		if q.Slo != nil {
+			q.Slo.Record(time.Since(delivery.Announcement.Received), false)
+		}
+		if q.DeadLetters != nil {
+			if err := q.DeadLetters.Append(delivery, err); err != nil {
+				log.Printf("error when writing a dead letter: %s\n", err)
+			}
+		}
+		q.Outbox.Release(delivery.Announcement.OutboxIds)
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import "bufio"
+import "fmt"
+import "io"
+import "net"
+import "net/url"
+import "strconv"
+import "strings"
+import "sync"
+import "time"
+
+// minimal redis client speaking resp2, enough for the shared state of the replicas
+type RedisClient struct {
+	// e.g. redis://:password@redis:6379/0
+	Url string
+
+	mutex sync.Mutex
+	conn net.Conn
+	reader *bufio.Reader
+}
+
+// error reply of the server
+type RedisError string
+
+func (e RedisError) Error() string {
+	return "redis: " + string(e)
+}
+
+func (c *RedisClient) connect() error {
+	address, err := url.Parse(c.Url)
+	if err != nil {
+		return err
+	}
+	if address.Scheme != "redis" {
+		return fmt.Errorf("redis: unsupported scheme %q", address.Scheme)
+	}
+	host := address.Host
+	if address.Port() == "" {
+		host = net.JoinHostPort(address.Hostname(), "6379")
+	}
+
+	conn, err := DialOutbound("tcp", host, 5 * time.Second, nil)
+	if err != nil {
+		return err
+	}
+	c.conn = conn
+	c.reader = bufio.NewReader(conn)
+
+	if password, ok := address.User.Password(); ok {
+		args := []string { "AUTH", password }
+		if user := address.User.Username(); user != "" {
+			args = []string { "AUTH", user, password }
+		}
+		if _, err := c.roundTrip(args, 0); err != nil {
+			c.close()
+			return err
+		}
+	}
+	if db := strings.Trim(address.Path, "/"); db != "" && db != "0" {
+		if _, err := c.roundTrip([]string { "SELECT", db }, 0); err != nil {
+			c.close()
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *RedisClient) close() {
+	if c.conn != nil {
+		c.conn.Close()
+	}
+	c.conn = nil
+	c.reader = nil
+}
+
+func (c *RedisClient) roundTrip(args []string, timeout time.Duration) (interface{}, error) {
+	// the values may be whole payloads, they are not copied once per argument
+	var command strings.Builder
+	command.WriteString("*" + strconv.Itoa(len(args)) + "\r\n")
+	for _, arg := range args {
+		command.WriteString("$" + strconv.Itoa(len(arg)) + "\r\n")
+		command.WriteString(arg)
+		command.WriteString("\r\n")
+	}
+
+	c.conn.SetDeadline(time.Now().Add(5 * time.Second + timeout))
+	if _, err := io.WriteString(c.conn, command.String()); err != nil {
+		return nil, err
+	}
+	return c.readReply()
+}
+
+func (c *RedisClient) readLine() (string, error) {
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// strings for the simple and the bulk strings, int64 for the integers,
+// []interface{} for the arrays and nil for the null replies
+func (c *RedisClient) readReply() (interface{}, error) {
+	line, err := c.readLine()
+	if err != nil {
+		return nil, err
+	}
+	if line == "" {
+		return nil, fmt.Errorf("redis: empty reply")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, RedisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		length, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if length < 0 {
+			return nil, nil
+		}
+		data := make([]byte, length + 2)
+		if _, err := io.ReadFull(c.reader, data); err != nil {
+			return nil, err
+		}
+		return string(data[:length]), nil
+	case '*':
+		count, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if count < 0 {
+			return nil, nil
+		}
+		items := make([]interface{}, count)
+		for i := range items {
+			if items[i], err = c.readReply(); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("redis: unexpected reply %q", line)
+}
+
+// runs a command, reconnecting if needed
+func (c *RedisClient) Do(args ...string) (interface{}, error) {
+	return c.DoBlocking(0, args...)
+}
+
+// runs a command, which may block on the server for up to the timeout, e.g. BLPOP
+func (c *RedisClient) DoBlocking(timeout time.Duration, args ...string) (interface{}, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.conn == nil {
+		if err := c.connect(); err != nil {
+			return nil, err
+		}
+	}
+
+	reply, err := c.roundTrip(args, timeout)
+	if _, ok := err.(RedisError); err != nil && !ok {
+		// the connection is in an unknown state after a transport error
+		c.close()
+	}
+	return reply, err
+}
@@ -0,0 +1,100 @@
+package main
+
+import "flag"
+import "log"
+import "strings"
+
+// events the webhook is registered for when the instance does not configure them
+var DefaultWebhookEvents = []string { "jira:issue_updated" }
+
+// url jira should call for the instance, the named instances are told apart by the last path segment
+func (i *JiraInstance) WebhookUrl(publicUrl string) string {
+	if i.Name == "" || i.Name == "default" {
+		return strings.TrimRight(publicUrl, "/")
+	}
+	return joinUrl(publicUrl, i.Name)
+}
+
+// creates the webhook pointing to the service in jira, or updates the existing one
+func (i *JiraInstance) RegisterWebhook(publicUrl string) error {
+	events := i.WebhookEvents
+	if len(events) == 0 {
+		events = DefaultWebhookEvents
+	}
+
+	webhook := &JiraWebhook {
+		Name: "jiratohook",
+		Url: i.WebhookUrl(publicUrl),
+		Events: events,
+		Filters: map[string]string { "issue-related-events-section": i.WebhookJql },
+		Enabled: true,
+	}
+
+	existing, err := i.FindWebhooks(webhook.Url)
+	if err != nil {
+		return err
+	}
+
+	for _, found := range existing {
+		if found.Url != webhook.Url || found.Self == "" {
+			continue
+		}
+
+		log.Printf("register %s: updating webhook %q\n", i.Name, found.Name)
+		webhook.Name = found.Name
+		path := found.Self
+		if j := strings.Index(path, "/rest/"); j >= 0 {
+			path = path[j:]
+		}
+		return i.Request("PUT", path, webhook, nil)
+	}
+
+	log.Printf("register %s: creating webhook %s\n", i.Name, webhook.Url)
+	return i.Request("POST", "/rest/webhooks/1.0/webhook", webhook, nil)
+}
+
+// jiratohook register [-config config.json] [-user admin -token secret] -public-url https://... [http://jira.address]
+func RegisterCommand(arguments []string) {
+	flags := flag.NewFlagSet("register", flag.ExitOnError)
+	configPath := flags.String("config", "", "json config with the jira instances")
+	publicUrl := flags.String("public-url", "", "address jira sends the webhooks to")
+	user := flags.String("user", "", "jira admin user for the instance given as an argument")
+	token := flags.String("token", "", "jira admin password or token, can be a file:, env: or vault: reference")
+	flags.Parse(arguments)
+
+	if *publicUrl == "" {
+		log.Fatalf("register needs -public-url\n")
+	}
+
+	var instances []*JiraInstance
+	if flags.NArg() > 0 {
+		resolvedToken, err := ResolveSecret(*token)
+		if err != nil {
+			log.Fatalf("error when resolving the token: %s\n", err)
+		}
+		instances = append(instances, &JiraInstance { Name: "default", Url: flags.Arg(0), User: *user, Token: resolvedToken })
+	}
+
+	if *configPath != "" {
+		config, err := LoadConfig(*configPath)
+		if err != nil {
+			log.Fatalf("error when loading config %s: %s\n", *configPath, err)
+		}
+		instances = append(instances, config.Instances...)
+	}
+
+	if len(instances) == 0 {
+		log.Fatalf("no jira instances to register the webhook in\n")
+	}
+
+	failed := false
+	for _, instance := range instances {
+		if err := instance.RegisterWebhook(*publicUrl); err != nil {
+			log.Printf("register %s: %s\n", instance.Name, err)
+			failed = true
+		}
+	}
+	if failed {
+		log.Fatalf("registration failed\n")
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import "fmt"
+import "net/http"
+import "strconv"
+import "strings"
+import "time"
+import "ru/wikimart/dataflow/jiraevent"
+
+// parses the max skew of the instance
+func (i *JiraInstance) Init() error {
+	if i.MaxSkew == "" {
+		return nil
+	}
+	skew, err := time.ParseDuration(i.MaxSkew)
+	if err != nil {
+		return fmt.Errorf("instance %s: maxSkew: %s", i.Name, err.Error())
+	}
+	i.maxSkew = skew
+	return nil
+}
+
+// unix seconds or milliseconds, RFC 3339 or an http date
+func parseDeliveryTime(value string) (time.Time, error) {
+	if number, err := strconv.ParseInt(value, 10, 64); err == nil {
+		// the milliseconds have 13 digits for the years to come
+		if number > 1e11 {
+			return time.Unix(0, number * int64(time.Millisecond)), nil
+		}
+		return time.Unix(number, 0), nil
+	}
+	if parsed, err := time.Parse(time.RFC3339, value); err == nil {
+		return parsed, nil
+	}
+	return http.ParseTime(value)
+}
+
+// when the payload was sent: the timestamp header if configured, the signed timestamp of the payload otherwise
+func (i *JiraInstance) deliveryTime(request *http.Request, event *jiraevent.Event) (time.Time, error) {
+	if i.TimestampHeader != "" {
+		value := strings.TrimSpace(request.Header.Get(i.TimestampHeader))
+		if value == "" {
+			return time.Time{}, fmt.Errorf("no %s header", i.TimestampHeader)
+		}
+		return parseDeliveryTime(value)
+	}
+	if event.Timestamp == 0 {
+		return time.Time{}, fmt.Errorf("no timestamp in the payload")
+	}
+	return time.Unix(0, event.Timestamp * int64(time.Millisecond)), nil
+}
+
+// rejects the signed deliveries sent too long ago or too far in the future, e.g. the replayed captures
+func (i *JiraInstance) CheckSkew(request *http.Request, event *jiraevent.Event) error {
+	if i.Secret == "" || i.maxSkew <= 0 {
+		return nil
+	}
+
+	sent, err := i.deliveryTime(request, event)
+	if err != nil {
+		return err
+	}
+	skew := time.Since(sent)
+	if skew < 0 {
+		skew = -skew
+	}
+	if skew > i.maxSkew {
+		return fmt.Errorf("delivery time %s is off by %s, more than %s", sent.Format(time.RFC3339), skew.Round(time.Second), i.maxSkew)
+	}
+	return nil
+}
+
+// false if the signature was accepted within the skew window already, the replay is not announced again
+func (h *JiraHandler) FirstDelivery(instance *JiraInstance, request *http.Request) bool {
+	if instance.Secret == "" || instance.maxSkew <= 0 {
+		return true
+	}
+	signature := strings.TrimPrefix(request.Header.Get("X-Hub-Signature"), "sha256=")
+	// a replay with the same signature is rejected by the skew check afterwards
+	return h.Cooldowns.Start("signature/" + instance.Name + "/" + signature, 2 * instance.maxSkew)
+}
@@ -0,0 +1,119 @@
+package main
+
+import "log"
+import "regexp"
+import "strings"
+import "ru/wikimart/dataflow/format"
+
+// rocket.chat incoming webhook, the message is the slack one with the emoji translated
+type RocketChatDestination struct {
+	DestinationBase
+	Url string `json:"url"`
+	// defaults for the rule overrides, the integration settings are used if empty
+	Channel string `json:"channel"`
+	Username string `json:"username"`
+	IconUrl string `json:"iconUrl"`
+	// the issue list and the rest of the message go to an attachment under the first line
+	Attachment bool `json:"attachment"`
+	// attachment color by transition, e.g. {"Rollback": "#d00000"}, "#36a64f" for the rest
+	Colors map[string]string `json:"colors"`
+	// emoji names by the slack ones, e.g. {"slinky": "rocket"} for the custom slack emoji the server does not have
+	EmojiAliases map[string]string `json:"emojiAliases"`
+}
+
+func init() {
+	RegisterDestination("rocketchat", func() Destination { return &RocketChatDestination{} })
+}
+
+type RocketChatAttachment struct {
+	Title string `json:"title"`
+	TitleLink string `json:"title_link,omitempty"`
+	Text string `json:"text,omitempty"`
+	Color string `json:"color,omitempty"`
+}
+
+type RocketChatMessage struct {
+	Text string `json:"text"`
+	Channel string `json:"channel,omitempty"`
+	// the name and the avatar the message is posted with
+	Alias string `json:"alias,omitempty"`
+	Emoji string `json:"emoji,omitempty"`
+	Avatar string `json:"avatar,omitempty"`
+	Attachments []RocketChatAttachment `json:"attachments,omitempty"`
+}
+
+// slack emoji named differently in the emojione set of rocket.chat
+var rocketChatEmojiAliases = map[string]string {
+	"+1": "thumbsup",
+	"-1": "thumbsdown",
+	"slightly_smiling_face": "slight_smile",
+}
+
+// :name::skin-tone-N: of slack, rocket.chat has :name_toneM: with M = N - 1
+var slackSkinTone = regexp.MustCompile(`:([a-z0-9_+-]+)::skin-tone-([2-6]):`)
+var slackEmoji = regexp.MustCompile(`:([a-z0-9_+-]+):`)
+
+func (d *RocketChatDestination) emojiName(name string) string {
+	if alias, ok := d.EmojiAliases[name]; ok {
+		return alias
+	}
+	if alias, ok := rocketChatEmojiAliases[name]; ok {
+		return alias
+	}
+	return name
+}
+
+// translates the slack emoji of the text
+func (d *RocketChatDestination) Emoji(text string) string {
+	text = slackSkinTone.ReplaceAllStringFunc(text, func(emoji string) string {
+		match := slackSkinTone.FindStringSubmatch(emoji)
+		return ":" + d.emojiName(match[1]) + "_tone" + string(match[2][0] - 1) + ":"
+	})
+	return slackEmoji.ReplaceAllStringFunc(text, func(emoji string) string {
+		return ":" + d.emojiName(emoji[1:len(emoji) - 1]) + ":"
+	})
+}
+
+// rocket.chat shows the slack entities as they are, and has its own mentions of everyone
+var slackEntities = strings.NewReplacer("&lt;", "<", "&gt;", ">", "&amp;", "&", "<!here>", "@here", "<!channel>", "@all")
+
+func (d *RocketChatDestination) Send(announcement *format.Announcement) error {
+	message := &RocketChatMessage {
+		// the mentions of everyone written in the issue are text in slack, and so they stay
+		Text: slackEntities.Replace(d.Emoji(format.DisarmMentions(announcement.SlackText(), "@all", "@here"))),
+		Channel: override(announcement.Channel, d.Channel),
+		Alias: override(announcement.Username, d.Username),
+		Avatar: override(announcement.IconUrl, d.IconUrl),
+	}
+	// the avatar replaces the emoji
+	if message.Avatar == "" {
+		message.Emoji = d.Emoji(":slinky:")
+	}
+
+	if d.Attachment {
+		// rocket.chat understands the slack links and the bold and italic markup, so the text is split as is
+		lines := strings.SplitN(message.Text, "\n", 2)
+		message.Text = lines[0]
+		attachment := RocketChatAttachment {
+			Title: announcement.Issue.Key,
+			TitleLink: announcement.Issue.Url,
+			Color: "#36a64f",
+		}
+		if announcement.Issue.Summary != "" {
+			attachment.Title = announcement.Issue.Key + ": " + announcement.Issue.Summary
+		}
+		if color, ok := d.Colors[announcement.Transition]; ok {
+			attachment.Color = color
+		}
+		if len(lines) > 1 {
+			attachment.Text = lines[1]
+		}
+		message.Attachments = []RocketChatAttachment { attachment }
+	}
+
+	if err := JsonRequest("POST", d.Url, d.WithHeaders(nil), message, nil); err != nil {
+		return err
+	}
+	log.Printf("posted %s to rocket.chat\n", announcement.Issue.Key)
+	return nil
+}
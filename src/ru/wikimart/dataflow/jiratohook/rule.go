@@ -0,0 +1,387 @@
+package main
+
+import "fmt"
+import "log"
+import "regexp"
+import "text/template"
+import "time"
+import "ru/wikimart/dataflow/adf"
+import "ru/wikimart/dataflow/format"
+
+// links the matching issue keys to another tracker instead of jira
+type LinkMapping struct {
+	// e.g. "^GH-(\\d+)$"
+	Pattern string `json:"pattern"`
+	// regexp replacement, e.g. "https://github.com/org/repo/issues/$1"
+	Url string `json:"url"`
+
+	pattern *regexp.Regexp
+}
+
+// settings of a rule replaced for one of its projects, the empty ones are not replaced
+type RuleOverride struct {
+	// e.g. ":rocket:" and "shipped" instead of the ones of the transition
+	Emoji string `json:"emoji"`
+	Action string `json:"action"`
+	Destinations []string `json:"destinations"`
+	Channel string `json:"channel"`
+	Username string `json:"username"`
+	IconUrl string `json:"iconUrl"`
+	React string `json:"react"`
+
+	destinations []Destination
+}
+
+// rule selects the announcements and the destinations they go to
+type Rule struct {
+	Name string `json:"name"`
+	// project keys, any project if empty
+	Projects []string `json:"projects"`
+	// transition names, any transition if empty; "/regexp/" or a case-insensitive glob
+	// like "Deploy*" matches the variants such as "Deploy to stage" and "Deploy to prod"
+	Transitions []string `json:"transitions"`
+	// events other than the transitions the rule announces, "attachment_created", "worklog_created",
+	// "sla_breached", "approval_decided" or "ci_deployment"; Jira Server reports the attachments as jira:issue_updated,
+	// they are announced as attachment_created too
+	Events []string `json:"events"`
+	// jira service management request types, e.g. "Get IT help", any request or issue if empty
+	RequestTypes []string `json:"requestTypes"`
+	// environment names, e.g. to send staging deploys to a quieter channel, any environment if empty
+	Environments []string `json:"environments"`
+	// destination names, all destinations if empty
+	Destinations []string `json:"destinations"`
+	// percentages of the issues the destinations get, by destination name, adding up to 100,
+	// e.g. {"teams": 10, "slack": 90} during a migration; an issue goes to one of them, picked by its key,
+	// the destinations without a weight get every issue
+	Weights map[string]int `json:"weights"`
+	// transitions of the same issue within the window are announced once with the final state, e.g. "2m"
+	CoalesceWindow string `json:"coalesceWindow"`
+	// the same transition of an issue is announced once within the cooldown, e.g. "30m",
+	// against the jira automation loops firing it again and again
+	Cooldown string `json:"cooldown"`
+	// the first matching mapping is used for an issue link
+	Links []*LinkMapping `json:"links"`
+	// order of the listed issues: "key", "project" or "priority", the payload order if empty
+	Sort string `json:"sort"`
+	// lists the issues under "project" or "priority" headers if set
+	Group string `json:"group"`
+	// jql of the issues in scope the "N issue(s) in scope" links find, text/template over the announcement,
+	// e.g. issue in linkedIssues("{{.Issue.Key}}", "is released by"); the linked and the mentioned issues if empty
+	ScopeJql string `json:"scopeJql"`
+	// characters of the issue description shown under the issue, not shown if zero
+	Excerpt int `json:"excerpt"`
+	// fields shown under the first line of the message in this order, a line each,
+	// e.g. [{"field": "assignee"}, {"field": "fixVersions", "label": "Release"}]
+	Fields []*MessageField `json:"fields"`
+	// the fields on one line, separated with a dot
+	FieldsInline bool `json:"fieldsInline"`
+	// @here or @channel mentions for the announcements that need attention, the first matching one is used,
+	// e.g. [{"mention": "channel", "transitions": ["Rollback"], "priorities": ["Blocker"]}]
+	Escalations []*Escalation `json:"escalations"`
+	// shows the total time logged on the issue, read from the rest api
+	TimeSpent bool `json:"timeSpent"`
+	// emoji the slack-project-channel destinations react with to the earlier message about the issue
+	// instead of posting a new one, e.g. "white_check_mark" for the transitions to done;
+	// a new message is posted if there is no earlier one, the other destinations always post
+	React string `json:"react"`
+	// slack channel, bot name and icon for the incoming webhooks, their own settings are used if empty;
+	// slack honours the channel for the legacy webhooks only, mattermost for all of them;
+	// the channel is the room id for the webex destinations
+	Channel string `json:"channel"`
+	Username string `json:"username"`
+	IconUrl string `json:"iconUrl"`
+	// new version of a rule validated on the live traffic, see RuleCanary
+	Canary *RuleCanary `json:"canary"`
+	// the announcements are posted to the approvers first, see approval in the config,
+	// and sent when approved, e.g. for the customer-facing release notes
+	Approval bool `json:"approval"`
+	// gets the events no other rule matched, the events other than transitions included,
+	// e.g. to forward them to a debug channel
+	CatchAll bool `json:"catchAll"`
+	// the rules are evaluated from the highest priority down, in the config order within one priority; 0 by default
+	Priority int `json:"priority"`
+	// no rule after this one is evaluated if it matches, whatever the ruleMatching of the config
+	Final bool `json:"final"`
+	// the matching announcements the rule skips, e.g. {"labels": ["no-announce"], "creators": ["automation"]}
+	Exclude *RuleExclusion `json:"exclude"`
+	// settings replaced for the projects, by project key, e.g. one rule for all the teams with their own channels
+	Overrides map[string]*RuleOverride `json:"overrides"`
+
+	destinations []Destination
+	coalesceWindow time.Duration
+	cooldown time.Duration
+	transitions []*regexp.Regexp
+	scope *template.Template
+	// the canary rule replacing this one
+	replacedBy *Rule
+	// names of the weighted destinations, sorted
+	weighted []string
+}
+
+// the events the rules may announce besides the transitions
+var ruleEvents = map[string]bool {
+	ATTACHMENT_EVENT: true,
+	WORKLOG_EVENT: true,
+	SLA_BREACHED_EVENT: true,
+	APPROVAL_EVENT: true,
+	CI_DEPLOYMENT_EVENT: true,
+}
+
+// announces QA releases, deploys and rollbacks everywhere, used when the config has no rules
+func DefaultRule() *Rule {
+	return &Rule {
+		Name: "default",
+		Projects: []string { "QA" },
+		Transitions: []string { "Release", "Deploy", "Rollback" },
+	}
+}
+
+// the destinations with the given names, all of them if there are no names
+func findDestinations(names []string, destinations []Destination) ([]Destination, error) {
+	if len(names) == 0 {
+		return destinations, nil
+	}
+
+	var found []Destination
+	for _, name := range names {
+		ok := false
+		for _, destination := range destinations {
+			if destination.Name() == name {
+				found = append(found, destination)
+				ok = true
+			}
+		}
+		if !ok {
+			return nil, fmt.Errorf("unknown destination %q", name)
+		}
+	}
+	return found, nil
+}
+
+// resolves the destination names and parses the settings
+func (r *Rule) Init(destinations []Destination) error {
+	var err error
+	if r.destinations, err = findDestinations(r.Destinations, destinations); err != nil {
+		return fmt.Errorf("rule %s: %s", r.Name, err.Error())
+	}
+
+	if err := r.initWeights(); err != nil {
+		return fmt.Errorf("rule %s: weights: %s", r.Name, err.Error())
+	}
+
+	if r.Canary != nil {
+		if err := r.Canary.Init(destinations); err != nil {
+			return fmt.Errorf("rule %s: canary: %s", r.Name, err.Error())
+		}
+	}
+
+	for project, override := range r.Overrides {
+		if override == nil {
+			continue
+		}
+		if len(r.Projects) > 0 && !containsString(r.Projects, project) {
+			return fmt.Errorf("rule %s: overrides: project %s is not in the projects of the rule", r.Name, project)
+		}
+		override.destinations = r.destinations
+		if len(override.Destinations) > 0 {
+			if override.destinations, err = findDestinations(override.Destinations, destinations); err != nil {
+				return fmt.Errorf("rule %s: overrides: %s: %s", r.Name, project, err.Error())
+			}
+		}
+	}
+
+	if r.CoalesceWindow != "" {
+		window, err := time.ParseDuration(r.CoalesceWindow)
+		if err != nil {
+			return fmt.Errorf("rule %s: coalesceWindow: %s", r.Name, err.Error())
+		}
+		r.coalesceWindow = window
+	}
+
+	transitions, err := compileTransitions(r.Transitions)
+	if err != nil {
+		return fmt.Errorf("rule %s: transitions: %s", r.Name, err.Error())
+	}
+	r.transitions = transitions
+
+	if r.Exclude != nil {
+		if err := r.Exclude.Init(); err != nil {
+			return fmt.Errorf("rule %s: exclude: %s", r.Name, err.Error())
+		}
+	}
+
+	if r.Cooldown != "" {
+		cooldown, err := time.ParseDuration(r.Cooldown)
+		if err != nil {
+			return fmt.Errorf("rule %s: cooldown: %s", r.Name, err.Error())
+		}
+		r.cooldown = cooldown
+	}
+
+	for _, event := range r.Events {
+		if !ruleEvents[event] {
+			return fmt.Errorf("rule %s: events: unsupported event %q", r.Name, event)
+		}
+	}
+
+	if err := validIssueOrder(r.Sort); err != nil {
+		return fmt.Errorf("rule %s: sort: %s", r.Name, err.Error())
+	}
+	if err := validIssueGroup(r.Group); err != nil {
+		return fmt.Errorf("rule %s: group: %s", r.Name, err.Error())
+	}
+
+	for _, escalation := range r.Escalations {
+		if err := escalation.Init(); err != nil {
+			return fmt.Errorf("rule %s: escalations: %s", r.Name, err.Error())
+		}
+	}
+
+	for _, field := range r.Fields {
+		if err := field.Init(); err != nil {
+			return fmt.Errorf("rule %s: fields: %s", r.Name, err.Error())
+		}
+	}
+
+	if r.ScopeJql != "" {
+		if r.scope, err = template.New("scopeJql").Parse(r.ScopeJql); err != nil {
+			return fmt.Errorf("rule %s: scopeJql: %s", r.Name, err.Error())
+		}
+	}
+
+	for _, link := range r.Links {
+		pattern, err := regexp.Compile(link.Pattern)
+		if err != nil {
+			return fmt.Errorf("rule %s: links: %s", r.Name, err.Error())
+		}
+		link.pattern = pattern
+	}
+
+	return nil
+}
+
+func (r *Rule) mapLink(issue *format.Issue) {
+	for _, link := range r.Links {
+		if link.pattern.MatchString(issue.Key) {
+			issue.Url = link.pattern.ReplaceAllString(issue.Key, link.Url)
+			return
+		}
+	}
+}
+
+// the announcement as this rule sends it, the given one is shared between rules and is not changed
+func (r *Rule) Apply(announcement *format.Announcement) *format.Announcement {
+	// the time spent read for the other rules, the worklog announcements always show it
+	hideTimeSpent := !r.TimeSpent && announcement.TimeSpent != "" && announcement.Event != WORKLOG_EVENT
+	override := r.Overrides[announcement.Project]
+	relist := r.Exclude != nil && len(r.Exclude.LinkTypes) > 0 && announcement.Relist != nil
+	if !relist && len(r.Links) == 0 && r.Sort == "" && r.Group == "" && r.Channel == "" && r.Username == "" && r.IconUrl == "" && r.Excerpt == 0 && r.React == "" && r.scope == nil && len(r.Fields) == 0 && !hideTimeSpent && override == nil {
+		return announcement
+	}
+
+	applied := *announcement
+	applied.Channel = r.Channel
+	applied.Username = r.Username
+	applied.IconUrl = r.IconUrl
+	applied.Reaction = r.React
+	if override != nil {
+		override.apply(&applied)
+	}
+	if hideTimeSpent {
+		applied.TimeSpent = ""
+	}
+	if r.Excerpt > 0 && announcement.Document != nil {
+		// the document is cut, not the markup, so that the markup stays valid
+		document := adf.Truncate(announcement.Document, r.Excerpt)
+		applied.Excerpt = adf.Plain(document)
+		applied.ExcerptSlack = adf.Slack(document)
+	} else if r.Excerpt > 0 {
+		applied.Excerpt = format.TruncateRunes(announcement.Description, r.Excerpt)
+	}
+	applied.Fields = announcementFields(r.Fields, announcement)
+	applied.FieldsInline = r.FieldsInline
+	r.mapLink(&applied.Issue)
+	if relist {
+		// the links of the skipped types are dropped from the list and the scope, the rest is announced
+		applied.Issues, applied.More = announcement.Relist(r.Exclude.LinkTypes)
+	} else {
+		applied.Issues = append([]format.Issue(nil), announcement.Issues...)
+	}
+	for i := range applied.Issues {
+		r.mapLink(&applied.Issues[i])
+	}
+	SortIssues(applied.Issues, r.Sort, r.Group)
+	if r.scope != nil && applied.More != nil && applied.More.SearchUrl != "" {
+		applied.More = r.scopeMore(&applied)
+	}
+	return &applied
+}
+
+// the summary line of the listed issues linking to the ones the scope jql of the rule finds
+func (r *Rule) scopeMore(announcement *format.Announcement) *format.More {
+	jql, err := executeTemplate(r.scope, announcement)
+	if err != nil {
+		log.Printf("rule %s: scopeJql: %s\n", r.Name, err)
+		return announcement.More
+	}
+
+	more := *announcement.More
+	more.Url = jqlUrl(more.SearchUrl, fmt.Sprintf("(%s) AND project != MD", jql))
+	more.Projects = append([]format.Project(nil), more.Projects...)
+	for i := range more.Projects {
+		more.Projects[i].Url = jqlUrl(more.SearchUrl, fmt.Sprintf("(%s) AND project = %s", jql, more.Projects[i].Project))
+	}
+	return &more
+}
+
+func (o *RuleOverride) apply(announcement *format.Announcement) {
+	replace := func(value *string, with string) {
+		if with != "" {
+			*value = with
+		}
+	}
+	replace(&announcement.Emoji, o.Emoji)
+	replace(&announcement.Action, o.Action)
+	replace(&announcement.Channel, o.Channel)
+	replace(&announcement.Username, o.Username)
+	replace(&announcement.IconUrl, o.IconUrl)
+	replace(&announcement.Reaction, o.React)
+}
+
+// the destinations of the announcement, the shadow ones during the canary period
+func (r *Rule) destinationsFor(announcement *format.Announcement) []Destination {
+	if r.InCanary() {
+		return r.Canary.destinations
+	}
+	if override := r.Overrides[announcement.Project]; override != nil {
+		return r.split(override.destinations, announcement.Issue.Key)
+	}
+	return r.split(r.destinations, announcement.Issue.Key)
+}
+
+func (r *Rule) Matches(announcement *format.Announcement) bool {
+	if r.Retired() {
+		return false
+	}
+	if len(r.Projects) > 0 && !containsString(r.Projects, announcement.Project) {
+		return false
+	}
+	if announcement.Event != "" {
+		// the catch-all rules get everything no other rule matched
+		if !r.CatchAll && !containsString(r.Events, announcement.Event) {
+			return false
+		}
+	} else if len(r.transitions) > 0 && !matchesAny(r.transitions, announcement.Transition) {
+		return false
+	}
+	if len(r.Environments) > 0 && !containsString(r.Environments, announcement.Environment) {
+		return false
+	}
+	if len(r.RequestTypes) > 0 && !containsString(r.RequestTypes, announcement.RequestType) {
+		return false
+	}
+	if r.Exclude != nil && r.Exclude.Matches(announcement) {
+		return false
+	}
+	return true
+}
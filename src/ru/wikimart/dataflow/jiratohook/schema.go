@@ -0,0 +1,193 @@
+package main
+
+import "encoding/json"
+import "fmt"
+import "net/http"
+import "sort"
+
+// version of the payload schema below, bumped on incompatible changes
+const SCHEMA_VERSION = "1"
+
+// description of an incoming payload field, the same structure is served at /schema
+type SchemaField struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+	Required bool `json:"required,omitempty"`
+	// no other fields are expected in the object
+	Closed bool `json:"closed,omitempty"`
+	Description string `json:"description,omitempty"`
+	Fields []SchemaField `json:"fields,omitempty"`
+}
+
+type SchemaCompatibility struct {
+	Product string `json:"product"`
+	Versions string `json:"versions"`
+	Notes string `json:"notes"`
+}
+
+type Schema struct {
+	Version string `json:"version"`
+	Compatibility []SchemaCompatibility `json:"compatibility"`
+	Fields []SchemaField `json:"fields"`
+}
+
+type SchemaDiagnostic struct {
+	Path string `json:"path"`
+	// "missing", "unexpected" or "type"
+	Problem string `json:"problem"`
+	// errors make the payload unusable, warnings do not
+	Error bool `json:"error"`
+	Message string `json:"message"`
+}
+
+var linkedIssueSchema = []SchemaField {
+	{ Name: "key", Type: "string", Required: true },
+	{ Name: "fields", Type: "object", Fields: []SchemaField {
+		{ Name: "summary", Type: "string", Description: "missing when the summary field is hidden by the field configuration" },
+	} },
+}
+
+var PayloadSchema = Schema {
+	Version: SCHEMA_VERSION,
+	Compatibility: []SchemaCompatibility {
+		{
+			Product: "Jira Server / Data Center",
+			Versions: "7.0 - 9.x",
+			Notes: "transition announcements need the \"Trigger a Webhook\" workflow post function, which adds the transition block",
+		},
+		{
+			Product: "Jira Cloud",
+			Versions: "current",
+			Notes: "workflow post function webhooks are supported; plain issue_updated webhooks carry no transition block and are logged only",
+		},
+	},
+	Fields: []SchemaField {
+		{ Name: "webhookEvent", Type: "string", Required: true, Description: "e.g. jira:issue_updated" },
+		{ Name: "timestamp", Type: "number", Description: "milliseconds since epoch, sent since Jira 7.0" },
+		{ Name: "transition", Type: "object", Closed: true, Description: "sent by workflow post function webhooks only", Fields: []SchemaField {
+			{ Name: "workflowId", Type: "number" },
+			{ Name: "workflowName", Type: "string" },
+			{ Name: "transitionId", Type: "number" },
+			{ Name: "transitionName", Type: "string", Required: true },
+			{ Name: "from_status", Type: "string" },
+			{ Name: "to_status", Type: "string" },
+		} },
+		{ Name: "property", Type: "object", Description: "sent with issue_property_set events", Fields: []SchemaField {
+			{ Name: "key", Type: "string", Required: true },
+		} },
+		{ Name: "comment", Type: "object", Description: "sent with comment events and the transitions with a comment, the body is wiki markup or an Atlassian Document Format document" },
+		{ Name: "attachment", Type: "object", Description: "sent with attachment_created events by Jira Cloud", Fields: []SchemaField {
+			{ Name: "filename", Type: "string", Required: true },
+			{ Name: "size", Type: "number" },
+			{ Name: "content", Type: "string", Description: "download link of the file" },
+		} },
+		{ Name: "worklog", Type: "object", Description: "sent with worklog_* events, the issue is read from the rest api by the issueId", Fields: []SchemaField {
+			{ Name: "issueId", Type: "string", Required: true },
+			{ Name: "timeSpent", Type: "string" },
+		} },
+		{ Name: "changelog", Type: "object", Description: "sent with jira:issue_updated events, Jira Server reports the added attachments in it" },
+		{ Name: "issue", Type: "object", Description: "sent with jira:issue_* and issue_property_* events", Fields: []SchemaField {
+			{ Name: "key", Type: "string", Required: true },
+			{ Name: "fields", Type: "object", Fields: []SchemaField {
+				{ Name: "summary", Type: "string", Description: "missing when the summary field is hidden by the field configuration" },
+				{ Name: "issuelinks", Type: "array", Description: "missing when issue linking is disabled", Fields: []SchemaField {
+					{ Name: "type", Type: "object", Fields: []SchemaField { { Name: "name", Type: "string" } } },
+					{ Name: "outwardIssue", Type: "object", Fields: linkedIssueSchema },
+					{ Name: "inwardIssue", Type: "object", Fields: linkedIssueSchema },
+				} },
+			} },
+		} },
+	},
+}
+
+func jsonType(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case string:
+		return "string"
+	case float64:
+		return "number"
+	case bool:
+		return "boolean"
+	case []interface{}:
+		return "array"
+	}
+	return "object"
+}
+
+func validateObject(path string, object map[string]interface{}, fields []SchemaField, closed bool, diagnostics []SchemaDiagnostic) []SchemaDiagnostic {
+	known := map[string]bool{}
+
+	for _, field := range fields {
+		known[field.Name] = true
+		fieldPath := path + field.Name
+
+		value, present := object[field.Name]
+		if !present || value == nil {
+			if field.Required {
+				diagnostics = append(diagnostics, SchemaDiagnostic { Path: fieldPath, Problem: "missing", Error: true, Message: "required field is missing" })
+			}
+			continue
+		}
+
+		actual := jsonType(value)
+		if actual != field.Type {
+			diagnostics = append(diagnostics, SchemaDiagnostic { Path: fieldPath, Problem: "type", Error: true, Message: fmt.Sprintf("expected %s, got %s", field.Type, actual) })
+			continue
+		}
+
+		if field.Type == "object" {
+			diagnostics = validateObject(fieldPath + ".", value.(map[string]interface{}), field.Fields, field.Closed, diagnostics)
+		} else if field.Type == "array" && len(field.Fields) > 0 {
+			for i, item := range value.([]interface{}) {
+				itemPath := fmt.Sprintf("%s[%d]", fieldPath, i)
+				if itemObject, ok := item.(map[string]interface{}); ok {
+					diagnostics = validateObject(itemPath + ".", itemObject, field.Fields, field.Closed, diagnostics)
+				} else {
+					diagnostics = append(diagnostics, SchemaDiagnostic { Path: itemPath, Problem: "type", Error: true, Message: fmt.Sprintf("expected object, got %s", jsonType(item)) })
+				}
+			}
+		}
+	}
+
+	if closed {
+		unexpected := []string{}
+		for name := range object {
+			if !known[name] {
+				unexpected = append(unexpected, name)
+			}
+		}
+		sort.Strings(unexpected)
+		for _, name := range unexpected {
+			diagnostics = append(diagnostics, SchemaDiagnostic { Path: path + name, Problem: "unexpected", Message: "field is not known for any supported Jira version" })
+		}
+	}
+
+	return diagnostics
+}
+
+// validates a raw payload against the schema
+func ValidatePayload(body []byte) []SchemaDiagnostic {
+	var object map[string]interface{}
+	if err := json.Unmarshal(body, &object); err != nil {
+		return []SchemaDiagnostic { { Path: "", Problem: "type", Error: true, Message: "payload is not a json object: " + err.Error() } }
+	}
+
+	// the top level of the payload carries many event-specific fields, so it is not closed
+	return validateObject("", object, PayloadSchema.Fields, false, nil)
+}
+
+func HasSchemaErrors(diagnostics []SchemaDiagnostic) bool {
+	for _, diagnostic := range diagnostics {
+		if diagnostic.Error {
+			return true
+		}
+	}
+	return false
+}
+
+func ServeSchema(response http.ResponseWriter, request *http.Request) {
+	response.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(response).Encode(&PayloadSchema)
+}
@@ -0,0 +1,226 @@
+package main
+
+import "encoding/json"
+import "fmt"
+import "io"
+import "net/url"
+import "os"
+import "strings"
+import "sync"
+
+type redactedSecret struct {
+	secret string
+	replacement string
+}
+
+// replaces the known secrets in everything written through it, used as the log output
+type Redactor struct {
+	mutex sync.RWMutex
+	secrets []redactedSecret
+	out io.Writer
+	// for local debugging only
+	Disabled bool
+}
+
+var redactor = &Redactor { out: os.Stderr }
+
+func (r *Redactor) add(secret string, replacement string) {
+	// too short values would garble the logs
+	if len(secret) < 4 {
+		return
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.secrets = append(r.secrets, redactedSecret { secret: secret, replacement: replacement })
+}
+
+func (r *Redactor) Add(secret string) {
+	r.add(secret, "[redacted]")
+}
+
+// webhook urls are credentials themselves, only their scheme and host are kept
+func (r *Redactor) AddUrl(address string) {
+	parsed, err := url.Parse(address)
+	if err != nil || parsed.Host == "" {
+		r.Add(address)
+		return
+	}
+	if parsed.Path == "" && parsed.RawQuery == "" && parsed.User == nil {
+		return
+	}
+	r.add(address, parsed.Scheme + "://" + parsed.Host + "/[redacted]")
+}
+
+func (r *Redactor) Redact(text string) string {
+	if r.Disabled {
+		return text
+	}
+
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	for _, secret := range r.secrets {
+		text = strings.Replace(text, secret.secret, secret.replacement, -1)
+	}
+	return text
+}
+
+// fields of the destination configs, which are redacted
+func isSecretField(name string) bool {
+	name = strings.ToLower(name)
+	for _, part := range []string { "token", "secret", "password", "apikey" } {
+		if strings.HasSuffix(name, part) {
+			return true
+		}
+	}
+	return false
+}
+
+func isUrlField(name string) bool {
+	return strings.HasSuffix(strings.ToLower(name), "url")
+}
+
+// registers the urls and the tokens of a json config object for the redaction
+func (r *Redactor) AddConfig(data []byte) {
+	var object map[string]interface{}
+	if err := json.Unmarshal(data, &object); err != nil {
+		return
+	}
+
+	for name, value := range object {
+		text, ok := value.(string)
+		if !ok {
+			continue
+		}
+		if isUrlField(name) {
+			r.AddUrl(text)
+		} else if isSecretField(name) {
+			r.Add(text)
+		}
+	}
+}
+
+func (r *Redactor) Write(data []byte) (int, error) {
+	if _, err := io.WriteString(r.out, r.Redact(string(data))); err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
+
+type vaultResponse struct {
+	Data map[string]interface{} `json:"data"`
+}
+
+// reads a key from vault, the path is e.g. secret/data/jiratohook#slackUrl,
+// the address and the token are taken from VAULT_ADDR and VAULT_TOKEN
+func readVaultSecret(reference string) (string, error) {
+	path := reference
+	key := ""
+	if i := strings.LastIndex(reference, "#"); i >= 0 {
+		path = reference[:i]
+		key = reference[i + 1:]
+	}
+
+	address := strings.TrimRight(os.Getenv("VAULT_ADDR"), "/")
+	if address == "" {
+		return "", fmt.Errorf("VAULT_ADDR is not set")
+	}
+
+	var response vaultResponse
+	headers := map[string]string { "X-Vault-Token": os.Getenv("VAULT_TOKEN") }
+	if err := JsonRequest("GET", address + "/v1/" + path, headers, nil, &response); err != nil {
+		return "", err
+	}
+
+	// kv version 2 nests the values into one more data object
+	data := response.Data
+	if nested, ok := data["data"].(map[string]interface{}); ok {
+		data = nested
+	}
+
+	value, ok := data[key].(string)
+	if !ok {
+		return "", fmt.Errorf("no string %q in %s", key, path)
+	}
+	return value, nil
+}
+
+// resolves file:/path, env:NAME and vault:path#key references, other values are returned as is;
+// the resolved values are redacted from the logs
+func ResolveSecret(value string) (string, error) {
+	var resolved string
+
+	switch {
+	case strings.HasPrefix(value, "file:"):
+		data, err := os.ReadFile(strings.TrimPrefix(value, "file:"))
+		if err != nil {
+			return "", err
+		}
+		resolved = strings.TrimSpace(string(data))
+	case strings.HasPrefix(value, "env:"):
+		name := strings.TrimPrefix(value, "env:")
+		var ok bool
+		if resolved, ok = os.LookupEnv(name); !ok {
+			return "", fmt.Errorf("environment variable %s is not set", name)
+		}
+	case strings.HasPrefix(value, "vault:"):
+		var err error
+		if resolved, err = readVaultSecret(strings.TrimPrefix(value, "vault:")); err != nil {
+			return "", fmt.Errorf("vault %s: %s", strings.TrimPrefix(value, "vault:"), err.Error())
+		}
+	default:
+		return value, nil
+	}
+
+	redactor.Add(resolved)
+	return resolved, nil
+}
+
+// the fields the config command masks, the urls, the tokens and the rest of the credentials
+func isCredentialField(name string) bool {
+	return isSecretField(name) || isUrlField(name) || maskedConfigFields[strings.ToLower(name)]
+}
+
+// resolves the secret references in the credential fields of a decoded json value, every string
+// under them, e.g. the header values, is resolved; the other strings are kept as they are
+func resolveSecrets(value interface{}, secret bool) (interface{}, error) {
+	switch v := value.(type) {
+	case string:
+		if !secret {
+			return v, nil
+		}
+		return ResolveSecret(v)
+	case []interface{}:
+		for i := range v {
+			resolved, err := resolveSecrets(v[i], secret)
+			if err != nil {
+				return nil, err
+			}
+			v[i] = resolved
+		}
+	case map[string]interface{}:
+		for key := range v {
+			resolved, err := resolveSecrets(v[key], secret || isCredentialField(key))
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s", key, err.Error())
+			}
+			v[key] = resolved
+		}
+	}
+	return value, nil
+}
+
+// resolves the secret references in the credential fields of a json document
+func ResolveSecretsJson(data []byte) ([]byte, error) {
+	var document interface{}
+	if err := json.Unmarshal(data, &document); err != nil {
+		return nil, err
+	}
+
+	resolved, err := resolveSecrets(document, false)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(resolved)
+}
@@ -0,0 +1,79 @@
+package main
+
+import "log"
+import "strings"
+
+type JiraWebhook struct {
+	Name string `json:"name"`
+	Url string `json:"url"`
+	Events []string `json:"events"`
+	Filters map[string]string `json:"filters"`
+	Enabled bool `json:"enabled"`
+	Self string `json:"self,omitempty"`
+}
+
+// registered webhooks of the instance pointing to the public url of the service
+func (i *JiraInstance) FindWebhooks(publicUrl string) ([]JiraWebhook, error) {
+	var webhooks []JiraWebhook
+	if err := i.Request("GET", "/rest/webhooks/1.0/webhook", nil, &webhooks); err != nil {
+		return nil, err
+	}
+
+	prefix := strings.TrimRight(publicUrl, "/")
+	var found []JiraWebhook
+	for _, webhook := range webhooks {
+		if strings.HasPrefix(webhook.Url, prefix) {
+			found = append(found, webhook)
+		}
+	}
+	return found, nil
+}
+
+// checks the webhook registration in jira, logs the problems and returns their number
+func (i *JiraInstance) SelfCheck(publicUrl string) int {
+	if i.Url == "" {
+		log.Printf("self-check %s: the jira address is derived from the payloads, skipping\n", i.Name)
+		return 0
+	}
+
+	webhooks, err := i.FindWebhooks(i.WebhookUrl(publicUrl))
+	if err != nil {
+		log.Printf("self-check %s: WARNING: cannot list the webhooks of %s, check the credentials and the admin permission: %s\n", i.Name, i.Url, err)
+		return 1
+	}
+
+	if len(webhooks) == 0 {
+		log.Printf("self-check %s: WARNING: no webhook in %s points to %s, register one in the jira webhook administration or run jiratohook register\n", i.Name, i.Url, publicUrl)
+		return 1
+	}
+
+	problems := 0
+	for _, webhook := range webhooks {
+		reported := problems
+		if !webhook.Enabled {
+			log.Printf("self-check %s: WARNING: webhook %q is disabled, enable it in jira\n", i.Name, webhook.Name)
+			problems++
+		}
+
+		for _, event := range i.WebhookEvents {
+			if !containsString(webhook.Events, event) {
+				log.Printf("self-check %s: WARNING: webhook %q does not send %s events\n", i.Name, webhook.Name, event)
+				problems++
+			}
+		}
+
+		if i.WebhookJql != "" {
+			jql := webhook.Filters["issue-related-events-section"]
+			if strings.TrimSpace(jql) != strings.TrimSpace(i.WebhookJql) {
+				log.Printf("self-check %s: WARNING: webhook %q filters by %q instead of %q\n", i.Name, webhook.Name, jql, i.WebhookJql)
+				problems++
+			}
+		}
+
+		if problems == reported {
+			log.Printf("self-check %s: webhook %q is registered\n", i.Name, webhook.Name)
+		}
+	}
+
+	return problems
+}
@@ -0,0 +1,76 @@
+package main
+
+import "fmt"
+import "strings"
+import "time"
+import "ru/wikimart/dataflow/format"
+import "ru/wikimart/dataflow/jiraevent"
+
+// jira service management events, found in the fields of the updated requests
+const (
+	SLA_BREACHED_EVENT = "sla_breached"
+	APPROVAL_EVENT = "approval_decided"
+)
+
+// a breach or a decision is announced once within this time, the later updates of the request carry it too
+const SERVICE_EVENT_TTL = 30 * 24 * time.Hour
+
+// builds an announcement for a breached sla or a decided approval of the updated service request,
+// returns nil if there is none or it is announced already
+func (h *JiraHandler) BuildServiceEvent(event *jiraevent.Event, instance *JiraInstance) *format.Announcement {
+	if event.WebhookEvent != "jira:issue_updated" || event.Issue == nil {
+		return nil
+	}
+	request := event.Issue.Fields.ServiceRequest()
+	if request == nil {
+		return nil
+	}
+
+	announcement := &format.Announcement {
+		Received: time.Now(),
+		Instance: instance.Name,
+		Issue: NewAnnouncementIssue(instance, &event.Issue.IssueBase),
+		Project: format.IssueProject(event.Issue.Key),
+		RequestType: request.RequestType,
+	}
+
+	for _, sla := range request.Slas {
+		if !sla.Breached() || !h.Cooldowns.Start(fmt.Sprintf("sla/%s/%s/%s", instance.Name, event.Issue.Key, sla.Field), SERVICE_EVENT_TTL) {
+			continue
+		}
+		announcement.Event = SLA_BREACHED_EVENT
+		announcement.Emoji = ":rotating_light:"
+		announcement.Action = fmt.Sprintf("%s breached", sla.Name)
+		if sla.OngoingCycle != nil && sla.OngoingCycle.RemainingTime != nil {
+			announcement.Action = fmt.Sprintf("%s breached (%s)", sla.Name, sla.OngoingCycle.RemainingTime.Friendly)
+		}
+		return announcement
+	}
+
+	for _, approval := range request.Approvals {
+		if approval.FinalDecision == "" || approval.FinalDecision == "pending" {
+			continue
+		}
+		if !h.Cooldowns.Start(fmt.Sprintf("approval/%s/%s/%s", instance.Name, event.Issue.Key, approval.Id), SERVICE_EVENT_TTL) {
+			continue
+		}
+		announcement.Event = APPROVAL_EVENT
+		announcement.Emoji = ":white_check_mark:"
+		if approval.FinalDecision != "approved" {
+			announcement.Emoji = ":no_entry:"
+		}
+		announcement.Action = fmt.Sprintf("%s %s", approval.Name, approval.FinalDecision)
+
+		// the approvers who made the decision
+		var deciders []string
+		for _, approver := range approval.Approvers {
+			if approver.ApproverDecision == approval.FinalDecision && approver.Approver != nil {
+				deciders = append(deciders, approver.Approver.DisplayName)
+			}
+		}
+		announcement.Actor = strings.Join(deciders, ", ")
+		return announcement
+	}
+
+	return nil
+}
@@ -0,0 +1,242 @@
+package main
+
+import "crypto/sha256"
+import "encoding/hex"
+import "encoding/json"
+import "fmt"
+import "log"
+import "strconv"
+import "strings"
+import "sync"
+import "time"
+import "ru/wikimart/dataflow/format"
+
+// payloads seen again within this time are not announced again, e.g. the jira retries
+const DEDUP_TTL = 10 * time.Minute
+
+// state shared by the replicas behind a load balancer
+type SharedConfig struct {
+	// e.g. redis://:password@redis:6379/0
+	Redis string `json:"redis"`
+	// key prefix, "jiratohook" by default
+	Prefix string `json:"prefix"`
+}
+
+// dedup cache, rate limits and delivery queue in redis
+type Shared struct {
+	prefix string
+	redis *RedisClient
+	// blocking pops take a connection of their own
+	queue *RedisClient
+}
+
+func NewShared(config *SharedConfig) *Shared {
+	prefix := config.Prefix
+	if prefix == "" {
+		prefix = "jiratohook"
+	}
+	return &Shared {
+		prefix: prefix + ":",
+		redis: &RedisClient { Url: config.Redis },
+		queue: &RedisClient { Url: config.Redis },
+	}
+}
+
+// tells whether the payload was seen recently
+type Deduplicator interface {
+	Seen(payload []byte) bool
+}
+
+func payloadKey(payload []byte) string {
+	sum := sha256.Sum256(payload)
+	return hex.EncodeToString(sum[:])
+}
+
+// dedup cache of a single instance
+type LocalDedup struct {
+	mutex sync.Mutex
+	seen map[string]time.Time
+}
+
+func NewLocalDedup() *LocalDedup {
+	return &LocalDedup { seen: map[string]time.Time{} }
+}
+
+func (d *LocalDedup) Seen(payload []byte) bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	now := time.Now()
+	for key, expires := range d.seen {
+		if now.After(expires) {
+			delete(d.seen, key)
+		}
+	}
+
+	key := payloadKey(payload)
+	if _, ok := d.seen[key]; ok {
+		return true
+	}
+	d.seen[key] = now.Add(DEDUP_TTL)
+	return false
+}
+
+func (s *Shared) Seen(payload []byte) bool {
+	reply, err := s.redis.Do("SET", s.prefix + "dedup:" + payloadKey(payload), "1", "NX", "PX", strconv.FormatInt(int64(DEDUP_TTL / time.Millisecond), 10))
+	if err != nil {
+		// better twice than never
+		log.Printf("shared dedup: %s\n", err)
+		return false
+	}
+	return reply == nil
+}
+
+func (s *Shared) Start(key string, cooldown time.Duration) bool {
+	reply, err := s.redis.Do("SET", s.prefix + "cooldown:" + key, "1", "NX", "PX", strconv.FormatInt(int64(cooldown / time.Millisecond), 10))
+	if err != nil {
+		log.Printf("shared cooldown of %s: %s\n", key, err)
+		return true
+	}
+	return reply != nil
+}
+
+// makes the destination unavailable to all the replicas until the given time
+func (s *Shared) Block(destination string, until time.Time) {
+	milliseconds := int64(time.Until(until) / time.Millisecond)
+	if milliseconds <= 0 {
+		return
+	}
+	_, err := s.redis.Do("SET", s.prefix + "blocked:" + destination, strconv.FormatInt(until.UnixNano(), 10), "PX", strconv.FormatInt(milliseconds, 10))
+	if err != nil {
+		log.Printf("shared block of %s: %s\n", destination, err)
+	}
+}
+
+func (s *Shared) BlockedUntil(destination string) time.Time {
+	reply, err := s.redis.Do("GET", s.prefix + "blocked:" + destination)
+	if err != nil {
+		log.Printf("shared block of %s: %s\n", destination, err)
+		return time.Time{}
+	}
+	text, _ := reply.(string)
+	nanoseconds, err := strconv.ParseInt(text, 10, 64)
+	if err != nil {
+		return time.Time{}
+	}
+	return time.Unix(0, nanoseconds)
+}
+
+// takes the destination's next slot of the min interval, returns the wait if it is taken by another replica
+func (s *Shared) TakeInterval(destination string, interval time.Duration) (bool, time.Duration) {
+	key := s.prefix + "interval:" + destination
+	reply, err := s.redis.Do("SET", key, "1", "NX", "PX", strconv.FormatInt(int64(interval / time.Millisecond), 10))
+	if err != nil {
+		log.Printf("shared interval of %s: %s\n", destination, err)
+		return true, 0
+	}
+	if reply != nil {
+		return true, 0
+	}
+
+	remaining, err := s.redis.Do("PTTL", key)
+	if milliseconds, ok := remaining.(int64); err == nil && ok && milliseconds > 0 {
+		return false, time.Duration(milliseconds) * time.Millisecond
+	}
+	return false, interval
+}
+
+// keeps a value of a destination for all the replicas, e.g. the message or the incident of an issue;
+// kept until forgotten if the ttl is zero
+func (s *Shared) Remember(name string, value string, ttl time.Duration) {
+	args := []string { "SET", s.prefix + name, value }
+	if ttl > 0 {
+		args = append(args, "PX", strconv.FormatInt(int64(ttl / time.Millisecond), 10))
+	}
+	if _, err := s.redis.Do(args...); err != nil {
+		log.Printf("shared %s: %s\n", name, err)
+	}
+}
+
+// the value remembered, empty if there is none
+func (s *Shared) Recall(name string) string {
+	reply, err := s.redis.Do("GET", s.prefix + name)
+	if err != nil {
+		log.Printf("shared %s: %s\n", name, err)
+		return ""
+	}
+	text, _ := reply.(string)
+	return text
+}
+
+func (s *Shared) Forget(name string) {
+	if _, err := s.redis.Do("DEL", s.prefix + name); err != nil {
+		log.Printf("shared %s: %s\n", name, err)
+	}
+}
+
+// remembers the message announcing the issue to the destination, for the reactions of all the replicas
+func (s *Shared) RememberMessage(destination string, key string, channel string, ts string, ttl time.Duration) {
+	s.Remember("message:" + destination + ":" + key, channel + " " + ts, ttl)
+}
+
+// the channel and the ts of the message announcing the issue to the destination, empty if there is none
+func (s *Shared) Message(destination string, key string) (string, string) {
+	channel, ts, _ := strings.Cut(s.Recall("message:" + destination + ":" + key), " ")
+	return channel, ts
+}
+
+// delivery as stored in the shared queue, the destination is referred to by name
+type sharedDelivery struct {
+	Destination string `json:"destination"`
+	Priority int `json:"priority"`
+	Attempts int `json:"attempts"`
+	Announcement *format.Announcement `json:"announcement"`
+}
+
+func (s *Shared) lane(priority int) string {
+	return fmt.Sprintf("%squeue:%d", s.prefix, priority)
+}
+
+func (s *Shared) Push(delivery *Delivery) error {
+	// the outbox of this replica is released once the delivery is in redis
+	announcement := *delivery.Announcement
+	announcement.OutboxIds = nil
+
+	data, err := json.Marshal(&sharedDelivery {
+		Destination: delivery.Destination.Name(),
+		Priority: delivery.Priority,
+		Attempts: delivery.Attempts,
+		Announcement: &announcement,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = s.redis.Do("RPUSH", s.lane(delivery.Priority), string(data))
+	return err
+}
+
+// takes the most urgent delivery of any replica, nil if there is none within the timeout
+func (s *Shared) Pop(timeout time.Duration) (*sharedDelivery, error) {
+	args := []string { "BLPOP" }
+	for priority := 0; priority < PRIORITY_COUNT; priority++ {
+		args = append(args, s.lane(priority))
+	}
+	args = append(args, strconv.Itoa(int(timeout / time.Second)))
+
+	reply, err := s.queue.DoBlocking(timeout, args...)
+	if err != nil || reply == nil {
+		return nil, err
+	}
+
+	items, ok := reply.([]interface{})
+	if !ok || len(items) != 2 {
+		return nil, fmt.Errorf("redis: unexpected BLPOP reply")
+	}
+	data, _ := items[1].(string)
+
+	var delivery sharedDelivery
+	if err := json.Unmarshal([]byte(data), &delivery); err != nil {
+		return nil, err
+	}
+	return &delivery, nil
+}
@@ -0,0 +1,115 @@
+package main
+
+import "crypto/hmac"
+import "crypto/sha256"
+import "encoding/hex"
+import "net/http"
+import "net/url"
+import "os"
+import "sort"
+import "strings"
+import "time"
+
+// aws access key, the environment ones are used if the config has none
+type AwsCredentials struct {
+	AccessKeyId string `json:"accessKeyId"`
+	SecretAccessKey string `json:"secretAccessKey"`
+	SessionToken string `json:"sessionToken"`
+}
+
+func (c *AwsCredentials) fromEnvironment() {
+	if c.AccessKeyId == "" {
+		c.AccessKeyId = os.Getenv("AWS_ACCESS_KEY_ID")
+		c.SecretAccessKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+		c.SessionToken = os.Getenv("AWS_SESSION_TOKEN")
+	}
+}
+
+func hmacSha256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// uri encoding of the signature, every byte but the unreserved ones
+func awsEscape(text string) string {
+	return strings.Replace(url.QueryEscape(text), "+", "%20", -1)
+}
+
+// signs the request with aws signature version 4
+func SignAws(request *http.Request, body []byte, service string, region string, credentials *AwsCredentials, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	payloadHash := sha256Hex(body)
+
+	request.Header.Set("X-Amz-Date", amzDate)
+	request.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if credentials.SessionToken != "" {
+		request.Header.Set("X-Amz-Security-Token", credentials.SessionToken)
+	}
+
+	// the host and the x-amz headers are signed
+	headers := map[string]string { "host": request.URL.Host }
+	for name, values := range request.Header {
+		lower := strings.ToLower(name)
+		if strings.HasPrefix(lower, "x-amz-") || lower == "content-type" {
+			headers[lower] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	query := request.URL.Query()
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	parameters := []string{}
+	for _, key := range keys {
+		values := query[key]
+		sort.Strings(values)
+		for _, value := range values {
+			parameters = append(parameters, awsEscape(key) + "=" + awsEscape(value))
+		}
+	}
+
+	path := request.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	canonicalRequest := strings.Join([]string {
+		request.Method,
+		path,
+		strings.Join(parameters, "&"),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+
+	key := hmacSha256([]byte("AWS4" + credentials.SecretAccessKey), date)
+	key = hmacSha256(key, region)
+	key = hmacSha256(key, service)
+	key = hmacSha256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSha256(key, stringToSign))
+
+	request.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential=" + credentials.AccessKeyId + "/" + scope +
+		", SignedHeaders=" + signedHeaders + ", Signature=" + signature)
+}
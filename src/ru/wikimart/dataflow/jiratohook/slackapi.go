@@ -0,0 +1,108 @@
+package main
+
+import "encoding/json"
+import "fmt"
+import "net/url"
+import "strings"
+
+// slack web api client for the features incoming webhooks do not support
+type SlackApi struct {
+	Token string
+	// https://slack.com/api by default
+	Url string
+	// extra headers, e.g. for a proxy
+	Headers map[string]string
+}
+
+type slackApiResponse struct {
+	Ok bool `json:"ok"`
+	Error string `json:"error"`
+}
+
+func (s *SlackApi) methodUrl(method string) string {
+	base := s.Url
+	if base == "" {
+		base = "https://slack.com/api"
+	}
+	return base + "/" + method
+}
+
+func (s *SlackApi) headers() map[string]string {
+	headers := map[string]string { "Authorization": "Bearer " + s.Token }
+	for name, value := range s.Headers {
+		headers[name] = value
+	}
+	return headers
+}
+
+// checks the ok flag of the raw response and decodes it into result
+func (s *SlackApi) decode(method string, raw json.RawMessage, result interface{}) error {
+	var status slackApiResponse
+	if err := json.Unmarshal(raw, &status); err != nil {
+		return err
+	}
+	if !status.Ok {
+		// slack reports the errors with 200 responses, they are not retried
+		return &DeliveryError { Status: 200, Body: fmt.Sprintf("%s: %s", method, status.Error), Retryable: status.Error == "internal_error" }
+	}
+	if result != nil {
+		return json.Unmarshal(raw, result)
+	}
+	return nil
+}
+
+// calls a method accepting json, e.g. chat.postMessage
+func (s *SlackApi) Call(method string, body interface{}, result interface{}) error {
+	var raw json.RawMessage
+	if err := JsonRequest("POST", s.methodUrl(method), s.headers(), body, &raw); err != nil {
+		return err
+	}
+	return s.decode(method, raw, result)
+}
+
+// calls a method taking query arguments, e.g. users.lookupByEmail
+func (s *SlackApi) Get(method string, arguments url.Values, result interface{}) error {
+	var raw json.RawMessage
+	if err := JsonRequest("GET", s.methodUrl(method) + "?" + arguments.Encode(), s.headers(), nil, &raw); err != nil {
+		return err
+	}
+	return s.decode(method, raw, result)
+}
+
+type SlackPostMessage struct {
+	Channel string `json:"channel"`
+	Text string `json:"text"`
+	IconEmoji string `json:"icon_emoji,omitempty"`
+	ThreadTs string `json:"thread_ts,omitempty"`
+	// block kit layout, the text is the notification fallback then
+	Blocks interface{} `json:"blocks,omitempty"`
+}
+
+type SlackPostMessageResponse struct {
+	Channel string `json:"channel"`
+	Ts string `json:"ts"`
+}
+
+func (s *SlackApi) PostMessage(message *SlackPostMessage) (*SlackPostMessageResponse, error) {
+	var response SlackPostMessageResponse
+	if err := s.Call("chat.postMessage", message, &response); err != nil {
+		return nil, err
+	}
+	return &response, nil
+}
+
+type SlackReaction struct {
+	Channel string `json:"channel"`
+	Timestamp string `json:"timestamp"`
+	// emoji name without the colons, e.g. white_check_mark
+	Name string `json:"name"`
+}
+
+// adds a reaction to a message, reacting twice is not an error
+func (s *SlackApi) AddReaction(reaction *SlackReaction) error {
+	err := s.Call("reactions.add", reaction, nil)
+	if deliveryError, ok := err.(*DeliveryError); ok && strings.HasSuffix(deliveryError.Body, ": already_reacted") {
+		return nil
+	}
+	return err
+}
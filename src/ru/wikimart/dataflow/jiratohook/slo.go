@@ -0,0 +1,175 @@
+package main
+
+import "fmt"
+import "log"
+import "sort"
+import "sync"
+import "time"
+
+type SloConfig struct {
+	// rolling window the percentiles and the failure rate are computed over, "15m" by default
+	Window string `json:"window"`
+	// the alert fires when the p99 latency from the webhook receipt to the delivery exceeds this, e.g. "30s"
+	P99 string `json:"p99"`
+	// the alert fires when the share of the given up deliveries exceeds this, e.g. 0.05
+	FailureRate float64 `json:"failureRate"`
+	// no alerts with fewer deliveries in the window
+	MinSamples int `json:"minSamples"`
+	// slack-compatible webhook the alerts are posted to
+	AlertUrl string `json:"alertUrl"`
+}
+
+type sloSample struct {
+	time time.Time
+	latency time.Duration
+	ok bool
+}
+
+type SloStats struct {
+	Samples int `json:"samples"`
+	P50 string `json:"p50"`
+	P95 string `json:"p95"`
+	P99 string `json:"p99"`
+	FailureRate float64 `json:"failureRate"`
+}
+
+// tracks the end-to-end delivery latency and the failures
+type SloTracker struct {
+	mutex sync.Mutex
+	samples []sloSample
+	window time.Duration
+	p99 time.Duration
+	failureRate float64
+	minSamples int
+	alertUrl string
+	// the alert is sent once when breached and once when recovered
+	alerting bool
+
+	// only the leader posts the alerts when replicated
+	Leader *Leadership
+}
+
+func NewSloTracker(config *SloConfig) (*SloTracker, error) {
+	tracker := &SloTracker {
+		window: 15 * time.Minute,
+		failureRate: config.FailureRate,
+		minSamples: config.MinSamples,
+		alertUrl: config.AlertUrl,
+	}
+
+	var err error
+	if config.Window != "" {
+		if tracker.window, err = time.ParseDuration(config.Window); err != nil {
+			return nil, fmt.Errorf("slo window: %s", err.Error())
+		}
+	}
+	if config.P99 != "" {
+		if tracker.p99, err = time.ParseDuration(config.P99); err != nil {
+			return nil, fmt.Errorf("slo p99: %s", err.Error())
+		}
+	}
+	return tracker, nil
+}
+
+func (t *SloTracker) Record(latency time.Duration, ok bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.samples = append(t.samples, sloSample { time: time.Now(), latency: latency, ok: ok })
+}
+
+// drops the samples out of the window, must be called with the mutex locked
+func (t *SloTracker) expire() {
+	cutoff := time.Now().Add(-t.window)
+	i := 0
+	for i < len(t.samples) && t.samples[i].time.Before(cutoff) {
+		i++
+	}
+	t.samples = t.samples[i:]
+}
+
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(float64(len(sorted)) * p)
+	if i >= len(sorted) {
+		i = len(sorted) - 1
+	}
+	return sorted[i]
+}
+
+func (t *SloTracker) stats() (SloStats, time.Duration) {
+	t.expire()
+
+	latencies := []time.Duration{}
+	failed := 0
+	for _, sample := range t.samples {
+		if sample.ok {
+			latencies = append(latencies, sample.latency)
+		} else {
+			failed++
+		}
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+
+	stats := SloStats {
+		Samples: len(t.samples),
+		P50: percentile(latencies, 0.50).String(),
+		P95: percentile(latencies, 0.95).String(),
+		P99: percentile(latencies, 0.99).String(),
+	}
+	if len(t.samples) > 0 {
+		stats.FailureRate = float64(failed) / float64(len(t.samples))
+	}
+	return stats, percentile(latencies, 0.99)
+}
+
+func (t *SloTracker) Stats() SloStats {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	stats, _ := t.stats()
+	return stats
+}
+
+// checks the thresholds, returns the alert text if the state has changed
+func (t *SloTracker) check() string {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	stats, p99 := t.stats()
+	if stats.Samples < t.minSamples {
+		return ""
+	}
+
+	breached := (t.p99 > 0 && p99 > t.p99) || (t.failureRate > 0 && stats.FailureRate > t.failureRate)
+	if breached == t.alerting {
+		return ""
+	}
+	t.alerting = breached
+
+	if breached {
+		return fmt.Sprintf(":rotating_light: jiratohook delivery slo breached: p99 %s (threshold %s), failure rate %.1f%% (threshold %.1f%%) over %d deliveries in %s", stats.P99, t.p99, stats.FailureRate * 100, t.failureRate * 100, stats.Samples, t.window)
+	}
+	return fmt.Sprintf(":white_check_mark: jiratohook delivery slo recovered: p99 %s, failure rate %.1f%%", stats.P99, stats.FailureRate * 100)
+}
+
+// checks the thresholds every minute and posts the alerts
+func (t *SloTracker) Watch() {
+	for range time.Tick(time.Minute) {
+		text := t.check()
+		if text == "" {
+			continue
+		}
+
+		log.Printf("%s\n", text)
+		if t.alertUrl == "" || !t.Leader.IsLeader() {
+			continue
+		}
+
+		if err := PostWebhookText(t.alertUrl, text); err != nil {
+			log.Printf("error when posting the slo alert: %s\n", err)
+		}
+	}
+}
@@ -0,0 +1,319 @@
+package main
+
+import "bytes"
+import "encoding/json"
+import "flag"
+import "fmt"
+import "io"
+import "log"
+import "net/http"
+import "net/url"
+import "os"
+import "strings"
+import "sync"
+import "time"
+
+// announcements of the issue, or of the issues the jql finds, are suppressed until the time
+type Snooze struct {
+	Id string `json:"id"`
+	Key string `json:"key,omitempty"`
+	Jql string `json:"jql,omitempty"`
+	// instance name, any instance if empty
+	Instance string `json:"instance,omitempty"`
+	Until time.Time `json:"until"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// body of POST /admin/snoozes
+type SnoozeRequest struct {
+	Key string `json:"key"`
+	Jql string `json:"jql"`
+	Instance string `json:"instance"`
+	// e.g. "2h"
+	For string `json:"for"`
+	Reason string `json:"reason"`
+}
+
+// snoozed issues, kept in a json file so they survive a restart
+type Snoozes struct {
+	path string
+	mutex sync.Mutex
+	sequence int
+	snoozes []*Snooze
+	// whether the jql of a snooze finds the issue, by snooze id, then by instance and key
+	jqlResults map[string]map[string]bool
+}
+
+func OpenSnoozes(path string) (*Snoozes, error) {
+	s := &Snoozes { path: path, jqlResults: map[string]map[string]bool{} }
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &s.snoozes); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// drops the expired snoozes, must be called with the mutex locked
+func (s *Snoozes) expire() {
+	active := s.snoozes[:0]
+	for _, snooze := range s.snoozes {
+		if time.Now().Before(snooze.Until) {
+			active = append(active, snooze)
+		} else {
+			delete(s.jqlResults, snooze.Id)
+		}
+	}
+	s.snoozes = active
+}
+
+// writes the file aside and renames it, must be called with the mutex locked
+func (s *Snoozes) save() error {
+	data, err := json.MarshalIndent(s.snoozes, "", "  ")
+	if err != nil {
+		return err
+	}
+	temporary := s.path + ".tmp"
+	if err := os.WriteFile(temporary, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(temporary, s.path)
+}
+
+func (s *Snoozes) List() []*Snooze {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.expire()
+	return append([]*Snooze{}, s.snoozes...)
+}
+
+func (s *Snoozes) Add(request *SnoozeRequest) (*Snooze, error) {
+	if (request.Key == "") == (request.Jql == "") {
+		return nil, fmt.Errorf("either key or jql is required")
+	}
+	duration, err := time.ParseDuration(request.For)
+	if err != nil || duration <= 0 {
+		return nil, fmt.Errorf("for should be a positive duration, e.g. 2h")
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.sequence++
+	snooze := &Snooze {
+		Id: fmt.Sprintf("%d-%06d", time.Now().UnixNano(), s.sequence),
+		Key: request.Key,
+		Jql: request.Jql,
+		Instance: request.Instance,
+		Until: time.Now().Add(duration),
+		Reason: request.Reason,
+	}
+	s.expire()
+	s.snoozes = append(s.snoozes, snooze)
+	return snooze, s.save()
+}
+
+// false if there is no such snooze
+func (s *Snoozes) Delete(id string) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for i, snooze := range s.snoozes {
+		if snooze.Id == id {
+			s.snoozes = append(s.snoozes[:i], s.snoozes[i + 1:]...)
+			delete(s.jqlResults, id)
+			return true, s.save()
+		}
+	}
+	return false, nil
+}
+
+// the issues the jql finds among the keys, each issue is asked once per snooze, the ones not asked yet in one search
+func (s *Snoozes) jqlMatches(snooze *Snooze, instance *JiraInstance, keys []string) map[string]bool {
+	matches := map[string]bool{}
+	var unknown []string
+	s.mutex.Lock()
+	for _, key := range keys {
+		matched, ok := s.jqlResults[snooze.Id][instance.Name + "/" + key]
+		if !ok {
+			unknown = append(unknown, key)
+		}
+		matches[key] = matched
+	}
+	s.mutex.Unlock()
+	if len(unknown) == 0 {
+		return matches
+	}
+
+	quoted := make([]string, len(unknown))
+	for i, key := range unknown {
+		quoted[i] = jqlString(key)
+	}
+	var search struct {
+		Issues []struct {
+			Key string `json:"key"`
+		} `json:"issues"`
+	}
+	query := url.Values {
+		"jql": []string { fmt.Sprintf("key in (%s) AND (%s)", strings.Join(quoted, ", "), snooze.Jql) },
+		"fields": []string { "key" },
+		"maxResults": []string { fmt.Sprintf("%d", len(unknown)) },
+	}
+	if err := instance.Request("GET", "/rest/api/2/search?" + query.Encode(), nil, &search); err != nil {
+		// better announced than lost
+		log.Printf("snooze %s: %s\n", snooze.Id, err)
+		return matches
+	}
+	for _, issue := range search.Issues {
+		matches[issue.Key] = true
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	// the snooze may have expired or been deleted meanwhile
+	for _, active := range s.snoozes {
+		if active != snooze {
+			continue
+		}
+		if s.jqlResults[snooze.Id] == nil {
+			s.jqlResults[snooze.Id] = map[string]bool{}
+		}
+		for _, key := range unknown {
+			s.jqlResults[snooze.Id][instance.Name + "/" + key] = matches[key]
+		}
+	}
+	return matches
+}
+
+// the snoozes suppressing the announcements of the issues by key, the keys not snoozed are missing
+func (s *Snoozes) FindAll(instance *JiraInstance, keys []string) map[string]*Snooze {
+	found := map[string]*Snooze{}
+	if s == nil {
+		return found
+	}
+
+	for _, snooze := range s.List() {
+		if snooze.Instance != "" && snooze.Instance != instance.Name {
+			continue
+		}
+		var rest []string
+		for _, key := range keys {
+			if key == "" || found[key] != nil {
+				continue
+			}
+			if snooze.Key == key {
+				found[key] = snooze
+			} else if snooze.Jql != "" {
+				rest = append(rest, key)
+			}
+		}
+		if len(rest) == 0 {
+			continue
+		}
+		for key, matched := range s.jqlMatches(snooze, instance, rest) {
+			if matched {
+				found[key] = snooze
+			}
+		}
+	}
+	return found
+}
+
+// the snooze suppressing the announcements of the issue, nil if there is none
+func (s *Snoozes) Find(instance *JiraInstance, key string) *Snooze {
+	return s.FindAll(instance, []string { key })[key]
+}
+
+// GET lists the snoozes, POST adds one, DELETE ?id= removes one
+func (a *AdminHandler) ServeSnoozes(response http.ResponseWriter, request *http.Request) {
+	switch request.Method {
+	case "GET":
+		writeJson(response, a.Snoozes.List())
+	case "POST":
+		var snoozeRequest SnoozeRequest
+		if err := json.NewDecoder(request.Body).Decode(&snoozeRequest); err != nil {
+			WriteProblem(response, request, http.StatusBadRequest, PROBLEM_INVALID_PAYLOAD, err.Error())
+			return
+		}
+		snooze, err := a.Snoozes.Add(&snoozeRequest)
+		if snooze == nil {
+			WriteProblem(response, request, http.StatusBadRequest, PROBLEM_INVALID_PARAMETER, err.Error())
+			return
+		}
+		if err != nil {
+			log.Printf("error when saving the snoozes: %s\n", err)
+		}
+		log.Printf("snoozed %s%s until %s: %s\n", snooze.Key, snooze.Jql, snooze.Until.Format(time.RFC3339), snooze.Reason)
+		writeJson(response, snooze)
+	case "DELETE":
+		id := request.URL.Query().Get("id")
+		found, err := a.Snoozes.Delete(id)
+		if !found {
+			WriteProblem(response, request, http.StatusNotFound, PROBLEM_INVALID_PARAMETER, fmt.Sprintf("no snooze %q", id))
+			return
+		}
+		if err != nil {
+			log.Printf("error when saving the snoozes: %s\n", err)
+		}
+		log.Printf("snooze %s deleted\n", id)
+		writeJson(response, a.Snoozes.List())
+	default:
+		WriteProblem(response, request, http.StatusMethodNotAllowed, PROBLEM_METHOD_NOT_ALLOWED, "GET, POST or DELETE expected")
+	}
+}
+
+// jiratohook snooze -url http://jiratohook:8080 -admin-token t (-key QA-1 | -jql '...') -for 2h | -list | -delete id
+func SnoozeCommand(arguments []string) {
+	flags := flag.NewFlagSet("snooze", flag.ExitOnError)
+	serviceUrl := flags.String("url", "http://localhost:8080", "address of the running jiratohook")
+	adminToken := flags.String("admin-token", "", "admin token of the service, can be a file:, env: or vault: reference")
+	key := flags.String("key", "", "issue key to snooze")
+	jql := flags.String("jql", "", "jql of the issues to snooze")
+	instance := flags.String("instance", "", "jira instance of the issues, any if empty")
+	duration := flags.String("for", "1h", "how long the announcements are suppressed")
+	reason := flags.String("reason", "", "why, shown in the list")
+	list := flags.Bool("list", false, "list the snoozes")
+	deleteId := flags.String("delete", "", "id of the snooze to delete")
+	flags.Parse(arguments)
+
+	token, err := ResolveSecret(*adminToken)
+	if err != nil {
+		log.Fatalf("error when resolving the admin token: %s\n", err)
+	}
+
+	method := "POST"
+	address := joinUrl(*serviceUrl, "admin", "snoozes")
+	var body []byte
+	switch {
+	case *list:
+		method = "GET"
+	case *deleteId != "":
+		method = "DELETE"
+		address = address + "?id=" + url.QueryEscape(*deleteId)
+	default:
+		body, _ = json.Marshal(&SnoozeRequest { Key: *key, Jql: *jql, Instance: *instance, For: *duration, Reason: *reason })
+	}
+
+	request, err := http.NewRequest(method, address, bytes.NewReader(body))
+	if err != nil {
+		log.Fatalf("%s\n", err)
+	}
+	request.Header.Set("Authorization", "Bearer " + token)
+	request.Header.Set("Content-Type", "application/json")
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		log.Fatalf("%s\n", err)
+	}
+	defer response.Body.Close()
+
+	io.Copy(os.Stdout, response.Body)
+	if response.StatusCode >= 300 {
+		os.Exit(1)
+	}
+}
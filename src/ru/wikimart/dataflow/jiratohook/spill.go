@@ -0,0 +1,169 @@
+package main
+
+import "encoding/json"
+import "fmt"
+import "log"
+import "os"
+import "path/filepath"
+import "sort"
+import "strings"
+import "sync"
+import "time"
+
+// deliveries moved out of the memory while the queue is over its memory limit, e.g. during a slack outage;
+// the spill is not kept over a restart, the outbox is. Like the queue, it has a lane per priority,
+// a rollback spilled after a backlog of low priority deliveries is taken back before them
+type Spill struct {
+	Dir string
+	// the service answers 503 when the spilled deliveries take more, unlimited if zero
+	MaxBytes int64
+
+	mutex sync.Mutex
+	sequence int
+	// file names in the order they were written, by priority
+	lanes [PRIORITY_COUNT][]string
+	bytes int64
+	destinations map[string]Destination
+}
+
+// clears the directory of the spill left by the previous run
+func OpenSpill(dir string, maxBytes int64, destinations []Destination) (*Spill, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	old, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range old {
+		os.Remove(path)
+	}
+
+	spill := &Spill { Dir: dir, MaxBytes: maxBytes, destinations: map[string]Destination{} }
+	for _, destination := range destinations {
+		spill.destinations[destination.Name()] = destination
+	}
+	return spill, nil
+}
+
+func (s *Spill) Write(delivery *Delivery) error {
+	data, err := json.Marshal(&sharedDelivery {
+		Destination: delivery.Destination.Name(),
+		Priority: delivery.Priority,
+		Attempts: delivery.Attempts,
+		Announcement: delivery.Announcement,
+	})
+	if err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.sequence++
+	name := fmt.Sprintf("%d-%06d.json", time.Now().UnixNano(), s.sequence)
+	if err := os.WriteFile(filepath.Join(s.Dir, name), data, 0600); err != nil {
+		return err
+	}
+	s.lanes[delivery.Priority] = append(s.lanes[delivery.Priority], name)
+	s.bytes += int64(len(data))
+	return nil
+}
+
+// takes the oldest spilled delivery of the highest priority back, nil if there is none
+func (s *Spill) Read() *Delivery {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for {
+		priority := 0
+		for priority < PRIORITY_COUNT && len(s.lanes[priority]) == 0 {
+			priority++
+		}
+		if priority == PRIORITY_COUNT {
+			return nil
+		}
+		path := filepath.Join(s.Dir, s.lanes[priority][0])
+		s.lanes[priority] = s.lanes[priority][1:]
+		data, err := os.ReadFile(path)
+		os.Remove(path)
+		if err != nil {
+			log.Printf("spill: %s\n", err)
+			continue
+		}
+		s.bytes -= int64(len(data))
+
+		var spilled sharedDelivery
+		if err := json.Unmarshal(data, &spilled); err != nil {
+			log.Printf("spill: %s: %s\n", path, err)
+			continue
+		}
+		destination, ok := s.destinations[spilled.Destination]
+		if !ok {
+			log.Printf("spill: dropping a delivery to unknown destination %s\n", spilled.Destination)
+			continue
+		}
+		return &Delivery {
+			Destination: destination,
+			Announcement: spilled.Announcement,
+			Priority: spilled.Priority,
+			Attempts: spilled.Attempts,
+		}
+	}
+}
+
+func (s *Spill) Len() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	count := 0
+	for _, lane := range s.lanes {
+		count += len(lane)
+	}
+	return count
+}
+
+// the spilled deliveries of the priority
+func (s *Spill) LaneLen(priority int) int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return len(s.lanes[priority])
+}
+
+// whether the spill took all the disk it may
+func (s *Spill) Full() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.MaxBytes > 0 && s.bytes >= s.MaxBytes
+}
+
+// the size of the delivery in the memory, roughly, by its json
+func deliverySize(delivery *Delivery) int64 {
+	data, _ := json.Marshal(delivery.Announcement)
+	return int64(len(data))
+}
+
+// parses "64MB", "1GB" or a number of bytes
+func ParseByteSize(text string) (int64, error) {
+	units := map[string]int64 { "KB": 1 << 10, "MB": 1 << 20, "GB": 1 << 30, "B": 1 }
+	suffixes := make([]string, 0, len(units))
+	for suffix := range units {
+		suffixes = append(suffixes, suffix)
+	}
+	// the longer suffixes first, "MB" before "B"
+	sort.Slice(suffixes, func(i, j int) bool { return len(suffixes[i]) > len(suffixes[j]) })
+
+	upper := strings.ToUpper(strings.TrimSpace(text))
+	multiplier := int64(1)
+	for _, suffix := range suffixes {
+		if strings.HasSuffix(upper, suffix) {
+			multiplier = units[suffix]
+			upper = strings.TrimSpace(strings.TrimSuffix(upper, suffix))
+			break
+		}
+	}
+	var value int64
+	if _, err := fmt.Sscanf(upper, "%d", &value); err != nil || value < 0 || fmt.Sprint(value) != upper {
+		return 0, fmt.Errorf("invalid size %q, e.g. 64MB expected", text)
+	}
+	return value * multiplier, nil
+}
@@ -0,0 +1,49 @@
+package main
+
+import "testing"
+import "ru/wikimart/dataflow/format"
+
+func TestSpillReadsByPriority(t *testing.T) {
+	slack := &SlackDestination { DestinationBase: DestinationBase { DestinationName: "slack" } }
+	spill, err := OpenSpill(t.TempDir(), 0, []Destination { slack })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		key string
+		priority int
+	}{
+		{ "LOW-1", PRIORITY_LOW },
+		{ "NORMAL-1", PRIORITY_NORMAL },
+		{ "LOW-2", PRIORITY_LOW },
+		{ "HIGH-1", PRIORITY_HIGH },
+		{ "HIGH-2", PRIORITY_HIGH },
+	} {
+		delivery := &Delivery {
+			Destination: slack,
+			Announcement: &format.Announcement { Issue: format.Issue { Key: c.key } },
+			Priority: c.priority,
+		}
+		if err := spill.Write(delivery); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if spill.Len() != 5 || spill.LaneLen(PRIORITY_LOW) != 2 {
+		t.Errorf("spilled %d, %d of low priority, want 5 and 2", spill.Len(), spill.LaneLen(PRIORITY_LOW))
+	}
+
+	// the priorities first, the order they were spilled in within a priority
+	for _, want := range []string { "HIGH-1", "HIGH-2", "NORMAL-1", "LOW-1", "LOW-2" } {
+		delivery := spill.Read()
+		if delivery == nil {
+			t.Fatalf("nothing read, want %s", want)
+		}
+		if delivery.Announcement.Issue.Key != want || delivery.Destination != slack {
+			t.Errorf("read %s to %s, want %s", delivery.Announcement.Issue.Key, delivery.Destination.Name(), want)
+		}
+	}
+	if delivery := spill.Read(); delivery != nil {
+		t.Errorf("read %s from an empty spill", delivery.Announcement.Issue.Key)
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import "fmt"
+import "hash/fnv"
+import "sort"
+
+// checks the weights of the rule, they are percentages of the rule destinations adding up to 100
+func (r *Rule) initWeights() error {
+	if len(r.Weights) == 0 {
+		return nil
+	}
+
+	total := 0
+	for name, weight := range r.Weights {
+		found := false
+		for _, destination := range r.destinations {
+			if destination.Name() == name {
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("destination %s is not a destination of the rule", name)
+		}
+		if weight < 0 {
+			return fmt.Errorf("%s: negative weight", name)
+		}
+		total += weight
+	}
+	if total != 100 {
+		return fmt.Errorf("weights add up to %d instead of 100", total)
+	}
+
+	r.weighted = make([]string, 0, len(r.Weights))
+	for name := range r.Weights {
+		r.weighted = append(r.weighted, name)
+	}
+	sort.Strings(r.weighted)
+	return nil
+}
+
+// the weighted destination the issue goes to, the same one for every announcement of the issue
+func (r *Rule) pickWeighted(key string) string {
+	hash := fnv.New32a()
+	hash.Write([]byte(key))
+	point := int(hash.Sum32() % 100)
+	for _, name := range r.weighted {
+		point -= r.Weights[name]
+		if point < 0 {
+			return name
+		}
+	}
+	return ""
+}
+
+// the destinations without the weighted ones the issue does not go to
+func (r *Rule) split(destinations []Destination, key string) []Destination {
+	if len(r.weighted) == 0 {
+		return destinations
+	}
+
+	picked := r.pickWeighted(key)
+	var split []Destination
+	for _, destination := range destinations {
+		if _, weighted := r.Weights[destination.Name()]; !weighted || destination.Name() == picked {
+			split = append(split, destination)
+		}
+	}
+	return split
+}
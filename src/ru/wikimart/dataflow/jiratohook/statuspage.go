@@ -0,0 +1,286 @@
+package main
+
+import "bytes"
+import "encoding/json"
+import "fmt"
+import "log"
+import "os"
+import "strings"
+import "sync"
+import "text/template"
+import "ru/wikimart/dataflow/format"
+
+// statuspage.io or instatus incident, opened on rollbacks of the configured projects
+// and resolved by the next deploy of the same issue
+type StatuspageDestination struct {
+	DestinationBase
+	// "statuspage" (default) or "instatus"
+	Provider string `json:"provider"`
+	Url string `json:"url"`
+	ApiKey string `json:"apiKey"`
+	PageId string `json:"pageId"`
+	ComponentIds []string `json:"componentIds"`
+	Projects []string `json:"projects"`
+	// transitions opening or updating the incident, Rollback by default
+	Transitions []string `json:"transitions"`
+	// transitions resolving the incident, Deploy by default
+	ResolveTransitions []string `json:"resolveTransitions"`
+	// text/template over the announcement
+	TitleTemplate string `json:"titleTemplate"`
+	BodyTemplate string `json:"bodyTemplate"`
+	// json file the open incidents are kept in across the restarts, unless the replicas share redis
+	StateFile string `json:"stateFile"`
+
+	title *template.Template
+	body *template.Template
+	// keeps the open incidents for all the replicas if set
+	shared *Shared
+
+	mutex sync.Mutex
+	// open incident ids by issue key, unless shared
+	incidents map[string]string
+}
+
+func init() {
+	RegisterDestination("statuspage", func() Destination { return &StatuspageDestination{} })
+}
+
+type StatuspageIncident struct {
+	Id string `json:"id,omitempty"`
+	Name string `json:"name,omitempty"`
+	Status string `json:"status"`
+	Body string `json:"body,omitempty"`
+	ComponentIds []string `json:"component_ids,omitempty"`
+}
+
+type StatuspageIncidentRequest struct {
+	Incident StatuspageIncident `json:"incident"`
+}
+
+type InstatusIncident struct {
+	Id string `json:"id,omitempty"`
+	Name string `json:"name,omitempty"`
+	Message string `json:"message"`
+	Status string `json:"status"`
+	Components []string `json:"components,omitempty"`
+	Started string `json:"started,omitempty"`
+	Notify bool `json:"notify"`
+}
+
+func (d *StatuspageDestination) Init() error {
+	if d.Provider == "" {
+		d.Provider = "statuspage"
+	}
+	if d.Provider != "statuspage" && d.Provider != "instatus" {
+		return fmt.Errorf("unknown provider %q", d.Provider)
+	}
+	if d.Url == "" {
+		if d.Provider == "statuspage" {
+			d.Url = "https://api.statuspage.io/v1"
+		} else {
+			d.Url = "https://api.instatus.com/v1"
+		}
+	}
+	if len(d.Transitions) == 0 {
+		d.Transitions = []string { "Rollback" }
+	}
+	if len(d.ResolveTransitions) == 0 {
+		d.ResolveTransitions = []string { "Deploy" }
+	}
+	if d.TitleTemplate == "" {
+		d.TitleTemplate = "Rollback of {{.Issue.Key}}"
+	}
+	if d.BodyTemplate == "" {
+		d.BodyTemplate = "{{.Issue.Summary}} has been rolled back, we are investigating."
+	}
+
+	var err error
+	if d.title, err = template.New("title").Parse(d.TitleTemplate); err != nil {
+		return err
+	}
+	if d.body, err = template.New("body").Parse(d.BodyTemplate); err != nil {
+		return err
+	}
+
+	d.incidents = map[string]string{}
+	if d.StateFile != "" {
+		data, err := os.ReadFile(d.StateFile)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err == nil {
+			if err := json.Unmarshal(data, &d.incidents); err != nil {
+				return fmt.Errorf("stateFile: %s", err.Error())
+			}
+		}
+	}
+	return nil
+}
+
+func (d *StatuspageDestination) SetContext(context *DestinationContext) {
+	d.shared = context.Shared
+}
+
+// the open incident of the issue, must be called with the mutex locked
+func (d *StatuspageDestination) incident(key string) (string, bool) {
+	if d.shared != nil {
+		id := d.shared.Recall("incident:" + d.Name() + ":" + key)
+		return id, id != ""
+	}
+	id, ok := d.incidents[key]
+	return id, ok
+}
+
+// remembers the open incident of the issue, or forgets it if the id is empty; must be called with the mutex locked
+func (d *StatuspageDestination) setIncident(key string, id string) {
+	if d.shared != nil {
+		if id == "" {
+			d.shared.Forget("incident:" + d.Name() + ":" + key)
+		} else {
+			d.shared.Remember("incident:" + d.Name() + ":" + key, id, 0)
+		}
+		return
+	}
+
+	if id == "" {
+		delete(d.incidents, key)
+	} else {
+		d.incidents[key] = id
+	}
+	if d.StateFile == "" {
+		return
+	}
+	// written aside and renamed, as the snoozes are
+	data, err := json.MarshalIndent(d.incidents, "", "  ")
+	if err == nil {
+		temporary := d.StateFile + ".tmp"
+		if err = os.WriteFile(temporary, data, 0600); err == nil {
+			err = os.Rename(temporary, d.StateFile)
+		}
+	}
+	if err != nil {
+		log.Printf("error when saving the incidents to %s: %s\n", d.StateFile, err)
+	}
+}
+
+func containsString(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+func executeTemplate(t *template.Template, data interface{}) (string, error) {
+	var buffer bytes.Buffer
+	if err := t.Execute(&buffer, data); err != nil {
+		return "", err
+	}
+	return buffer.String(), nil
+}
+
+func (d *StatuspageDestination) headers() map[string]string {
+	if d.Provider == "instatus" {
+		return d.WithHeaders(map[string]string { "Authorization": "Bearer " + d.ApiKey })
+	}
+	return d.WithHeaders(map[string]string { "Authorization": "OAuth " + d.ApiKey })
+}
+
+func (d *StatuspageDestination) Send(announcement *format.Announcement) error {
+	if len(d.Projects) > 0 && !containsString(d.Projects, announcement.Project) {
+		return nil
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	incidentId, open := d.incident(announcement.Issue.Key)
+	base := strings.TrimRight(d.Url, "/")
+
+	if containsString(d.ResolveTransitions, announcement.Transition) {
+		if !open {
+			return nil
+		}
+
+		log.Printf("resolving %s incident %s for %s\n", d.Provider, incidentId, announcement.Issue.Key)
+		var err error
+		if d.Provider == "instatus" {
+			err = JsonRequest("PUT", fmt.Sprintf("%s/%s/incidents/%s", base, d.PageId, incidentId), d.headers(), &InstatusIncident {
+				Message: fmt.Sprintf("%s has been deployed again.", announcement.Issue.Key),
+				Status: "RESOLVED",
+				Components: d.ComponentIds,
+			}, nil)
+		} else {
+			err = JsonRequest("PATCH", fmt.Sprintf("%s/pages/%s/incidents/%s", base, d.PageId, incidentId), d.headers(), &StatuspageIncidentRequest {
+				Incident: StatuspageIncident {
+					Status: "resolved",
+					Body: fmt.Sprintf("%s has been deployed again.", announcement.Issue.Key),
+				},
+			}, nil)
+		}
+		if err != nil {
+			return err
+		}
+		d.setIncident(announcement.Issue.Key, "")
+		return nil
+	}
+
+	if !containsString(d.Transitions, announcement.Transition) {
+		return nil
+	}
+
+	title, err := executeTemplate(d.title, announcement)
+	if err != nil {
+		return err
+	}
+	body, err := executeTemplate(d.body, announcement)
+	if err != nil {
+		return err
+	}
+
+	if d.Provider == "instatus" {
+		incident := &InstatusIncident {
+			Name: title,
+			Message: body,
+			Status: "INVESTIGATING",
+			Components: d.ComponentIds,
+			Notify: true,
+		}
+
+		if open {
+			log.Printf("updating instatus incident %s for %s\n", incidentId, announcement.Issue.Key)
+			return JsonRequest("PUT", fmt.Sprintf("%s/%s/incidents/%s", base, d.PageId, incidentId), d.headers(), incident, nil)
+		}
+
+		var created InstatusIncident
+		if err := JsonRequest("POST", fmt.Sprintf("%s/%s/incidents", base, d.PageId), d.headers(), incident, &created); err != nil {
+			return err
+		}
+		log.Printf("created instatus incident %s for %s\n", created.Id, announcement.Issue.Key)
+		d.setIncident(announcement.Issue.Key, created.Id)
+		return nil
+	}
+
+	request := &StatuspageIncidentRequest {
+		Incident: StatuspageIncident {
+			Name: title,
+			Status: "investigating",
+			Body: body,
+			ComponentIds: d.ComponentIds,
+		},
+	}
+
+	if open {
+		log.Printf("updating statuspage incident %s for %s\n", incidentId, announcement.Issue.Key)
+		return JsonRequest("PATCH", fmt.Sprintf("%s/pages/%s/incidents/%s", base, d.PageId, incidentId), d.headers(), request, nil)
+	}
+
+	var created StatuspageIncident
+	if err := JsonRequest("POST", fmt.Sprintf("%s/pages/%s/incidents", base, d.PageId), d.headers(), request, &created); err != nil {
+		return err
+	}
+	log.Printf("created statuspage incident %s for %s\n", created.Id, announcement.Issue.Key)
+	d.setIncident(announcement.Issue.Key, created.Id)
+	return nil
+}
@@ -0,0 +1,169 @@
+package main
+
+import "crypto/tls"
+import "fmt"
+import "log"
+import "net"
+import "net/url"
+import "os"
+import "strings"
+import "time"
+import "ru/wikimart/dataflow/format"
+
+// the structured data id of the announcements, 32473 is the example enterprise number of rfc 5424
+const SYSLOG_SD_ID = "jira@32473"
+
+var syslogFacilities = map[string]int {
+	"user": 1,
+	"daemon": 3,
+	"auth": 4,
+	"local0": 16,
+	"local1": 17,
+	"local2": 18,
+	"local3": 19,
+	"local4": 20,
+	"local5": 21,
+	"local6": 22,
+	"local7": 23,
+}
+
+// syslog collector, e.g. of a siem, the announcement is an rfc 5424 message with the structured data;
+// tcp and tls use the octet counting framing of rfc 6587
+type SyslogDestination struct {
+	DestinationBase
+	// udp://host:514, tcp://host:601 or tls://host:6514
+	Address string `json:"address"`
+	// local0 by default
+	Facility string `json:"facility"`
+	// severity of the transitions, e.g. {"Rollback": "warning"}, notice for the rest
+	Severities map[string]string `json:"severities"`
+	AppName string `json:"appName"`
+
+	network string
+	host string
+	facility int
+	hostname string
+}
+
+func init() {
+	RegisterDestination("syslog", func() Destination { return &SyslogDestination{} })
+}
+
+var syslogSeverities = map[string]int {
+	"emergency": 0,
+	"alert": 1,
+	"critical": 2,
+	"error": 3,
+	"warning": 4,
+	"notice": 5,
+	"info": 6,
+	"debug": 7,
+}
+
+func (d *SyslogDestination) Init() error {
+	address, err := url.Parse(d.Address)
+	if err != nil {
+		return fmt.Errorf("address: %s", err.Error())
+	}
+	switch address.Scheme {
+	case "udp":
+		d.host = withDefaultPort(address.Host, "514")
+	case "tcp":
+		d.host = withDefaultPort(address.Host, "601")
+	case "tls":
+		d.host = withDefaultPort(address.Host, "6514")
+	default:
+		return fmt.Errorf("address should be udp://, tcp:// or tls://, not %q", d.Address)
+	}
+	d.network = address.Scheme
+
+	if d.Facility == "" {
+		d.Facility = "local0"
+	}
+	facility, ok := syslogFacilities[d.Facility]
+	if !ok {
+		return fmt.Errorf("unknown facility %q", d.Facility)
+	}
+	d.facility = facility
+	for transition, severity := range d.Severities {
+		if _, ok := syslogSeverities[severity]; !ok {
+			return fmt.Errorf("transition %s: unknown severity %q", transition, severity)
+		}
+	}
+	if d.AppName == "" {
+		d.AppName = "jiratohook"
+	}
+	if d.hostname, err = os.Hostname(); err != nil || d.hostname == "" {
+		d.hostname = "-"
+	}
+	return nil
+}
+
+var syslogParamEscaper = strings.NewReplacer("\\", "\\\\", "\"", "\\\"", "]", "\\]")
+
+// rfc 5424 message of the announcement
+func (d *SyslogDestination) message(announcement *format.Announcement, now time.Time) string {
+	severity := syslogSeverities["notice"]
+	if name, ok := d.Severities[announcement.Transition]; ok {
+		severity = syslogSeverities[name]
+	}
+
+	var data strings.Builder
+	data.WriteString("[" + SYSLOG_SD_ID)
+	parameters := [][2]string {
+		{ "event", announcement.Event },
+		{ "transition", announcement.Transition },
+		{ "status", announcement.Status },
+		{ "instance", announcement.Instance },
+		{ "project", announcement.Project },
+		{ "issue", announcement.Issue.Key },
+		{ "url", announcement.Issue.Url },
+		{ "environment", announcement.Environment },
+		{ "actor", announcement.Actor },
+	}
+	for _, issue := range announcement.Issues {
+		// a parameter may be repeated
+		parameters = append(parameters, [2]string { "scope", issue.Key })
+	}
+	for _, parameter := range parameters {
+		if parameter[1] != "" {
+			fmt.Fprintf(&data, " %s=\"%s\"", parameter[0], syslogParamEscaper.Replace(parameter[1]))
+		}
+	}
+	data.WriteString("]")
+
+	text := strings.Replace(announcement.PlainText(), "\n", " ", -1)
+	msgId := "transition"
+	if announcement.Event != "" {
+		msgId = announcement.Event
+	}
+	return fmt.Sprintf("<%d>1 %s %s %s %d %s %s %s", d.facility * 8 + severity, now.UTC().Format("2006-01-02T15:04:05.000000Z"),
+		d.hostname, d.AppName, os.Getpid(), format.TruncateRunes(msgId, 32), data.String(), text)
+}
+
+func (d *SyslogDestination) Send(announcement *format.Announcement) error {
+	message := d.message(announcement, time.Now())
+
+	network := d.network
+	var tlsConfig *tls.Config
+	if d.network == "tls" {
+		host, _, _ := net.SplitHostPort(d.host)
+		network, tlsConfig = "tcp", &tls.Config { ServerName: host }
+	}
+	connection, err := DialOutbound(network, d.host, 10 * time.Second, tlsConfig)
+	if err != nil {
+		return err
+	}
+	defer connection.Close()
+	connection.SetDeadline(time.Now().Add(10 * time.Second))
+
+	if d.network != "udp" {
+		message = fmt.Sprintf("%d %s", len(message), message)
+	}
+	if _, err := connection.Write([]byte(message)); err != nil {
+		return err
+	}
+
+	log.Printf("sent %s to syslog %s\n", announcement.Issue.Key, d.host)
+	return nil
+}
@@ -0,0 +1,41 @@
+package main
+
+import "fmt"
+import "regexp"
+import "strings"
+
+// transition name pattern of a rule: "/regexp/", a case-insensitive glob with * and ?, or the exact name
+func compileTransition(pattern string) (*regexp.Regexp, error) {
+	if len(pattern) > 1 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/") {
+		return regexp.Compile(pattern[1 : len(pattern) - 1])
+	}
+	if !strings.ContainsAny(pattern, "*?") {
+		return regexp.Compile("^" + regexp.QuoteMeta(pattern) + "$")
+	}
+
+	glob := regexp.QuoteMeta(pattern)
+	glob = strings.Replace(glob, `\*`, ".*", -1)
+	glob = strings.Replace(glob, `\?`, ".", -1)
+	return regexp.Compile("(?i)^" + glob + "$")
+}
+
+func compileTransitions(patterns []string) ([]*regexp.Regexp, error) {
+	compiled := make([]*regexp.Regexp, 0, len(patterns))
+	for _, pattern := range patterns {
+		transition, err := compileTransition(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("%q: %s", pattern, err.Error())
+		}
+		compiled = append(compiled, transition)
+	}
+	return compiled, nil
+}
+
+func matchesAny(patterns []*regexp.Regexp, value string) bool {
+	for _, pattern := range patterns {
+		if pattern.MatchString(value) {
+			return true
+		}
+	}
+	return false
+}
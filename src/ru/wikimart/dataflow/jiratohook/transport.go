@@ -0,0 +1,48 @@
+package main
+
+import "crypto/tls"
+import "fmt"
+import "net/http"
+import "time"
+
+// connection reuse of the outbound requests, the go defaults are used for the unset fields;
+// the default of two idle connections per host makes the busy workers reconnect all the time
+type TransportConfig struct {
+	MaxIdleConns int `json:"maxIdleConns"`
+	MaxIdleConnsPerHost int `json:"maxIdleConnsPerHost"`
+	MaxConnsPerHost int `json:"maxConnsPerHost"`
+	// e.g. "90s"
+	IdleConnTimeout string `json:"idleConnTimeout"`
+	// false to stay with http/1.1, on by default
+	Http2 *bool `json:"http2"`
+}
+
+func (c *TransportConfig) Apply() error {
+	transport, ok := http.DefaultTransport.(*http.Transport)
+	if !ok {
+		return fmt.Errorf("default transport is replaced")
+	}
+
+	if c.MaxIdleConns > 0 {
+		transport.MaxIdleConns = c.MaxIdleConns
+	}
+	if c.MaxIdleConnsPerHost > 0 {
+		transport.MaxIdleConnsPerHost = c.MaxIdleConnsPerHost
+	}
+	if c.MaxConnsPerHost > 0 {
+		transport.MaxConnsPerHost = c.MaxConnsPerHost
+	}
+	if c.IdleConnTimeout != "" {
+		timeout, err := time.ParseDuration(c.IdleConnTimeout)
+		if err != nil {
+			return fmt.Errorf("idleConnTimeout: %s", err.Error())
+		}
+		transport.IdleConnTimeout = timeout
+	}
+	if c.Http2 != nil && !*c.Http2 {
+		// an empty map turns the http/2 upgrade off
+		transport.ForceAttemptHTTP2 = false
+		transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+	return nil
+}
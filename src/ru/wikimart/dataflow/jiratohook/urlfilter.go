@@ -0,0 +1,65 @@
+package main
+
+import "fmt"
+import "net/url"
+import "regexp"
+import "strings"
+import "ru/wikimart/dataflow/format"
+import "ru/wikimart/dataflow/jiraevent"
+
+// pre-filter given in the webhook url on the jira side, e.g. /hook?project=QA&transition=Release,Deploy*;
+// the values are repeated or comma-separated, the other query parameters are ignored
+type UrlFilter struct {
+	projects []string
+	// patterns like the ones of the rules, the events without a transition do not pass
+	transitions []*regexp.Regexp
+	// webhook events, e.g. jira:issue_updated
+	events []string
+}
+
+// the values of the parameter, repeated or comma-separated
+func queryList(query url.Values, name string) []string {
+	var values []string
+	for _, value := range query[name] {
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				values = append(values, item)
+			}
+		}
+	}
+	return values
+}
+
+// nil if the url has no filter
+func ParseUrlFilter(query url.Values) (*UrlFilter, error) {
+	filter := &UrlFilter {
+		projects: queryList(query, "project"),
+		events: queryList(query, "event"),
+	}
+	transitions, err := compileTransitions(queryList(query, "transition"))
+	if err != nil {
+		return nil, fmt.Errorf("transition: %s", err.Error())
+	}
+	filter.transitions = transitions
+
+	if len(filter.projects) == 0 && len(filter.transitions) == 0 && len(filter.events) == 0 {
+		return nil, nil
+	}
+	return filter, nil
+}
+
+func (f *UrlFilter) Matches(event *jiraevent.Event) bool {
+	if f == nil {
+		return true
+	}
+	if len(f.events) > 0 && !containsString(f.events, event.WebhookEvent) {
+		return false
+	}
+	if len(f.projects) > 0 && (event.Issue == nil || !containsString(f.projects, format.IssueProject(event.Issue.Key))) {
+		return false
+	}
+	if len(f.transitions) > 0 && (event.Transition == nil || !matchesAny(f.transitions, event.Transition.Name)) {
+		return false
+	}
+	return true
+}
@@ -0,0 +1,74 @@
+package main
+
+import "log"
+import "net/url"
+import "strings"
+import "sync"
+import "ru/wikimart/dataflow/jiraevent"
+
+// jira users to slack user ids
+type UserMap struct {
+	mutex sync.Mutex
+	// by jira user name, account id or email
+	users map[string]string
+	// by lowercase email, replaced by the user sync; the users above win
+	synced map[string]string
+	// looks up the unmapped users by their email if set
+	Slack *SlackApi
+}
+
+func NewUserMap(users map[string]string) *UserMap {
+	userMap := &UserMap { users: map[string]string{} }
+	for jiraUser, slackUser := range users {
+		userMap.users[jiraUser] = slackUser
+	}
+	return userMap
+}
+
+type slackLookupByEmailResponse struct {
+	User struct {
+		Id string `json:"id"`
+	} `json:"user"`
+}
+
+// slack user id of the jira user, empty if unknown
+func (m *UserMap) Lookup(user *jiraevent.User) string {
+	if user == nil {
+		return ""
+	}
+
+	m.mutex.Lock()
+	for _, key := range []string { user.Name, user.AccountId, user.EmailAddress } {
+		if slackUser, ok := m.users[key]; ok && key != "" {
+			m.mutex.Unlock()
+			return slackUser
+		}
+	}
+	if slackUser, ok := m.synced[strings.ToLower(user.EmailAddress)]; ok && user.EmailAddress != "" {
+		m.mutex.Unlock()
+		return slackUser
+	}
+	m.mutex.Unlock()
+
+	if m.Slack == nil || user.EmailAddress == "" {
+		return ""
+	}
+
+	var response slackLookupByEmailResponse
+	if err := m.Slack.Get("users.lookupByEmail", url.Values { "email": { user.EmailAddress } }, &response); err != nil {
+		log.Printf("error when looking up slack user %s: %s\n", user.EmailAddress, err)
+		return ""
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.users[user.EmailAddress] = response.User.Id
+	return response.User.Id
+}
+
+// replaces the users found by the user sync
+func (m *UserMap) SetSynced(synced map[string]string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.synced = synced
+}
@@ -0,0 +1,159 @@
+package main
+
+import "fmt"
+import "log"
+import "net/url"
+import "strconv"
+import "strings"
+import "time"
+
+// how often the users are synced if the config does not say
+const DEFAULT_USER_SYNC_INTERVAL = time.Hour
+
+// slack users.list and scim return at most this many users per page
+const USER_SYNC_PAGE = 200
+
+// the jira users are mapped to the slack users with the same email, synced from the slack workspace
+// in the background; the users of the config win. LDAP directories are synced through the slack scim
+// provisioning of the identity provider, the same users are read from slack then
+type UserSyncConfig struct {
+	// "users.list" with a bot token having users:read.email, or "scim" with an admin token of a plan with scim
+	Source string `json:"source"`
+	Token string `json:"token"`
+	// e.g. "30m", 1h by default
+	Interval string `json:"interval"`
+	// https://slack.com/api for users.list, https://api.slack.com/scim/v1 for scim by default, e.g. of a proxy
+	Url string `json:"url"`
+
+	interval time.Duration
+}
+
+func (c *UserSyncConfig) Init() error {
+	switch c.Source {
+	case "users.list":
+		if c.Url == "" {
+			c.Url = "https://slack.com/api"
+		}
+	case "scim":
+		if c.Url == "" {
+			c.Url = "https://api.slack.com/scim/v1"
+		}
+	default:
+		return fmt.Errorf("userSync: source should be users.list or scim, not %q", c.Source)
+	}
+	if c.Token == "" {
+		return fmt.Errorf("userSync: token is required")
+	}
+	c.interval = DEFAULT_USER_SYNC_INTERVAL
+	if c.Interval != "" {
+		var err error
+		if c.interval, err = time.ParseDuration(c.Interval); err != nil {
+			return fmt.Errorf("userSync: interval: %s", err.Error())
+		}
+	}
+	return nil
+}
+
+type slackUsersListResponse struct {
+	Members []struct {
+		Id string `json:"id"`
+		Deleted bool `json:"deleted"`
+		IsBot bool `json:"is_bot"`
+		Profile struct {
+			Email string `json:"email"`
+		} `json:"profile"`
+	} `json:"members"`
+	ResponseMetadata struct {
+		NextCursor string `json:"next_cursor"`
+	} `json:"response_metadata"`
+}
+
+type scimUsersResponse struct {
+	TotalResults int `json:"totalResults"`
+	Resources []struct {
+		Id string `json:"id"`
+		Active bool `json:"active"`
+		Emails []struct {
+			Value string `json:"value"`
+			Primary bool `json:"primary"`
+		} `json:"emails"`
+	} `json:"Resources"`
+}
+
+// slack user ids by lowercase email, the deleted users and the bots left out
+func (c *UserSyncConfig) fetchUsersList() (map[string]string, error) {
+	slack := &SlackApi { Token: c.Token, Url: c.Url }
+	users := map[string]string{}
+	cursor := ""
+	for {
+		var page slackUsersListResponse
+		arguments := url.Values { "limit": { strconv.Itoa(USER_SYNC_PAGE) } }
+		if cursor != "" {
+			arguments.Set("cursor", cursor)
+		}
+		if err := slack.Get("users.list", arguments, &page); err != nil {
+			return nil, err
+		}
+		for _, member := range page.Members {
+			if !member.Deleted && !member.IsBot && member.Profile.Email != "" {
+				users[strings.ToLower(member.Profile.Email)] = member.Id
+			}
+		}
+		if cursor = page.ResponseMetadata.NextCursor; cursor == "" {
+			return users, nil
+		}
+	}
+}
+
+func (c *UserSyncConfig) fetchScim() (map[string]string, error) {
+	headers := map[string]string { "Authorization": "Bearer " + c.Token }
+	users := map[string]string{}
+	// the scim pages are 1-based
+	for start := 1; ; start += USER_SYNC_PAGE {
+		var page scimUsersResponse
+		address := strings.TrimRight(c.Url, "/") + "/Users?" + url.Values { "startIndex": { strconv.Itoa(start) }, "count": { strconv.Itoa(USER_SYNC_PAGE) } }.Encode()
+		if err := JsonRequest("GET", address, headers, nil, &page); err != nil {
+			return nil, err
+		}
+		for _, resource := range page.Resources {
+			if !resource.Active {
+				continue
+			}
+			for _, email := range resource.Emails {
+				if email.Value != "" {
+					users[strings.ToLower(email.Value)] = resource.Id
+				}
+			}
+		}
+		if len(page.Resources) == 0 || start + len(page.Resources) > page.TotalResults {
+			return users, nil
+		}
+	}
+}
+
+// replaces the synced users of the map, a failed sync keeps the previous ones
+func (c *UserSyncConfig) Sync(users *UserMap) error {
+	var synced map[string]string
+	var err error
+	if c.Source == "scim" {
+		synced, err = c.fetchScim()
+	} else {
+		synced, err = c.fetchUsersList()
+	}
+	if err != nil {
+		return err
+	}
+	users.SetSynced(synced)
+	log.Printf("synced %d slack users from %s\n", len(synced), c.Source)
+	return nil
+}
+
+// syncs the users now and then every interval
+func (c *UserSyncConfig) Watch(users *UserMap) {
+	for {
+		if err := c.Sync(users); err != nil {
+			log.Printf("error when syncing the slack users from %s: %s\n", c.Source, err)
+		}
+		time.Sleep(c.interval)
+	}
+}
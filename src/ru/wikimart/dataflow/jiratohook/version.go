@@ -0,0 +1,55 @@
+package main
+
+import "encoding/json"
+import "fmt"
+import "net/http"
+import "runtime"
+
+// set at build time, e.g. go build -ldflags "-X main.Version=1.2.0 -X main.Commit=abc1234", see the Makefile
+var Version = "dev"
+var Commit = "unknown"
+var BuildDate = "unknown"
+
+type VersionInfo struct {
+	Version string `json:"version"`
+	Commit string `json:"commit"`
+	BuildDate string `json:"buildDate"`
+	Go string `json:"go"`
+	// version of the payload schema served at /schema
+	Schema string `json:"schema"`
+}
+
+func CurrentVersion() *VersionInfo {
+	return &VersionInfo {
+		Version: Version,
+		Commit: Commit,
+		BuildDate: BuildDate,
+		Go: runtime.Version(),
+		Schema: SCHEMA_VERSION,
+	}
+}
+
+func (v *VersionInfo) String() string {
+	return fmt.Sprintf("jiratohook %s (commit %s, built %s with %s, payload schema %s)", v.Version, v.Commit, v.BuildDate, v.Go, v.Schema)
+}
+
+func ServeVersion(response http.ResponseWriter, request *http.Request) {
+	response.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(response).Encode(CurrentVersion())
+}
+
+// sent with the outbound requests, see -user-agent
+var userAgent = "jiratohook/" + Version
+
+// sets the user agent of the requests which do not have one
+type userAgentTransport struct {
+	http.RoundTripper
+}
+
+func (t userAgentTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	if request.Header.Get("User-Agent") == "" {
+		request = request.Clone(request.Context())
+		request.Header.Set("User-Agent", userAgent)
+	}
+	return t.RoundTripper.RoundTrip(request)
+}
@@ -0,0 +1,81 @@
+package main
+
+import "fmt"
+import "log"
+import "net/url"
+import "ru/wikimart/dataflow/format"
+import "ru/wikimart/dataflow/jiraevent"
+
+type JiraWatchers struct {
+	Watchers []jiraevent.User `json:"watchers"`
+}
+
+// direct messages to the slack users watching the announced issue
+type SlackWatchersDestination struct {
+	DestinationBase
+	// bot token with chat:write and users:read.email
+	Token string `json:"token"`
+
+	slack *SlackApi
+	instances []*JiraInstance
+	users *UserMap
+}
+
+func init() {
+	RegisterDestination("slack-watchers", func() Destination { return &SlackWatchersDestination{} })
+}
+
+func (d *SlackWatchersDestination) Init() error {
+	if d.Token == "" {
+		return fmt.Errorf("token is required")
+	}
+	d.slack = &SlackApi { Token: d.Token, Headers: d.Headers }
+	return nil
+}
+
+func (d *SlackWatchersDestination) SetContext(context *DestinationContext) {
+	d.instances = context.Instances
+	d.users = context.Users
+
+	// the users are looked up with the bot token if they are not mapped in the config
+	if d.users.Slack == nil {
+		d.users.Slack = d.slack
+	}
+}
+
+func (d *SlackWatchersDestination) Send(announcement *format.Announcement) error {
+	var watchers JiraWatchers
+	path := fmt.Sprintf("/rest/api/2/issue/%s/watchers", url.PathEscape(announcement.Issue.Key))
+	if err := FindInstance(d.instances, announcement.Instance).Request("GET", path, nil, &watchers); err != nil {
+		return err
+	}
+
+	text := announcement.SlackText()
+	sent := 0
+	// a failed message is logged and the rest of the watchers are notified still, a retry would message them again;
+	// the delivery fails only if nobody was reached
+	failed := 0
+	var lastErr error
+	for i := range watchers.Watchers {
+		slackUser := d.users.Lookup(&watchers.Watchers[i])
+		if slackUser == "" {
+			log.Printf("watcher %s of %s is not a known slack user\n", watchers.Watchers[i].DisplayName, announcement.Issue.Key)
+			continue
+		}
+
+		// posting to a user id opens the direct message with the bot
+		if _, err := d.slack.PostMessage(&SlackPostMessage { Channel: slackUser, Text: text, IconEmoji: announcement.Emoji }); err != nil {
+			log.Printf("error when notifying watcher %s of %s: %s\n", watchers.Watchers[i].DisplayName, announcement.Issue.Key, err)
+			failed++
+			lastErr = err
+			continue
+		}
+		sent++
+	}
+
+	if sent == 0 && failed > 0 {
+		return fmt.Errorf("none of %d watcher(s) of %s notified: %s", failed, announcement.Issue.Key, lastErr.Error())
+	}
+	log.Printf("notified %d of %d watcher(s) of %s, %d failed\n", sent, len(watchers.Watchers), announcement.Issue.Key, failed)
+	return nil
+}
@@ -0,0 +1,60 @@
+package main
+
+import "fmt"
+import "log"
+import "strings"
+import "ru/wikimart/dataflow/format"
+
+// cisco webex room, posted to by a bot; the rules choose the room with their channel
+type WebexDestination struct {
+	DestinationBase
+	Url string `json:"url"`
+	// access token of the bot
+	Token string `json:"token"`
+	// the room of the rules without a channel
+	RoomId string `json:"roomId"`
+}
+
+func init() {
+	RegisterDestination("webex", func() Destination { return &WebexDestination{} })
+}
+
+type WebexMessage struct {
+	RoomId string `json:"roomId"`
+	Markdown string `json:"markdown"`
+	// shown by the clients which do not render markdown
+	Text string `json:"text"`
+}
+
+type WebexMessageResponse struct {
+	Id string `json:"id"`
+}
+
+func (d *WebexDestination) Init() error {
+	if d.Token == "" {
+		return fmt.Errorf("token is required")
+	}
+	if d.Url == "" {
+		d.Url = "https://webexapis.com/v1/messages"
+	}
+	return nil
+}
+
+func (d *WebexDestination) Send(announcement *format.Announcement) error {
+	message := &WebexMessage {
+		RoomId: override(announcement.Channel, d.RoomId),
+		// webex shows the emoji shortcodes as they are
+		Markdown: mentionText(announcement, "<@all>") + strings.TrimPrefix(announcement.MarkdownText(), announcement.Emoji + " "),
+		Text: announcement.PlainText(),
+	}
+	if message.RoomId == "" {
+		return &DeliveryError { Body: fmt.Sprintf("no webex room for %s, set the roomId of the destination or the channel of the rule", announcement.Issue.Key) }
+	}
+
+	var posted WebexMessageResponse
+	if err := JsonRequest("POST", d.Url, d.WithHeaders(map[string]string { "Authorization": "Bearer " + d.Token }), message, &posted); err != nil {
+		return err
+	}
+	log.Printf("posted %s to webex room %s as %s\n", announcement.Issue.Key, message.RoomId, posted.Id)
+	return nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import "fmt"
+import "log"
+import "sort"
+import "strings"
+import "ru/wikimart/dataflow/format"
+
+// slack workflow builder webhook trigger, the announcement is sent as flat string variables,
+// so the workflow decides how to post it
+type SlackWorkflowDestination struct {
+	DestinationBase
+	Url string `json:"url"`
+	// workflow variable by announcement variable, e.g. {"key": "issue_key"}; every variable is sent with its own name if empty
+	Variables map[string]string `json:"variables"`
+}
+
+func init() {
+	RegisterDestination("slack-workflow", func() Destination { return &SlackWorkflowDestination{} })
+}
+
+// the announcement as the variables of a workflow, the deployment metadata as metadata_<name>
+func workflowVariables(announcement *format.Announcement) map[string]string {
+	variables := map[string]string {
+		"text": announcement.PlainText(),
+		"event": announcement.Event,
+		"transition": announcement.Transition,
+		"status": announcement.Status,
+		"action": announcement.Action,
+		"instance": announcement.Instance,
+		"project": announcement.Project,
+		"key": announcement.Issue.Key,
+		"summary": announcement.Issue.Summary,
+		"url": announcement.Issue.Url,
+		"priority": announcement.Issue.Priority,
+		"request_type": announcement.RequestType,
+		"description": announcement.Excerpt,
+		"actor": announcement.Actor,
+		"time": announcement.Time,
+		"environment": announcement.Environment,
+	}
+
+	keys := make([]string, 0, len(announcement.Issues))
+	for _, issue := range announcement.Issues {
+		keys = append(keys, issue.Key)
+	}
+	variables["issues"] = strings.Join(keys, ", ")
+
+	for name, value := range announcement.Metadata {
+		variables["metadata_" + name] = value
+	}
+	return variables
+}
+
+func (d *SlackWorkflowDestination) Init() error {
+	known := workflowVariables(&format.Announcement{})
+	names := make([]string, 0, len(d.Variables))
+	for name := range d.Variables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if _, ok := known[name]; !ok && !strings.HasPrefix(name, "metadata_") {
+			return fmt.Errorf("unknown variable %q", name)
+		}
+	}
+	return nil
+}
+
+func (d *SlackWorkflowDestination) Send(announcement *format.Announcement) error {
+	variables := workflowVariables(announcement)
+	if len(d.Variables) > 0 {
+		renamed := map[string]string{}
+		for name, workflowName := range d.Variables {
+			// the workflow fails on a missing variable, so the absent metadata is sent empty
+			renamed[workflowName] = variables[name]
+		}
+		variables = renamed
+	}
+
+	if err := JsonRequest("POST", d.Url, d.WithHeaders(nil), variables, nil); err != nil {
+		return err
+	}
+	log.Printf("triggered slack workflow for %s\n", announcement.Issue.Key)
+	return nil
+}
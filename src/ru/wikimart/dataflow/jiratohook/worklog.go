@@ -0,0 +1,91 @@
+package main
+
+import "fmt"
+import "log"
+import "net/url"
+import "time"
+import "ru/wikimart/dataflow/format"
+import "ru/wikimart/dataflow/jiraevent"
+
+const WORKLOG_EVENT = "worklog_created"
+
+type worklogIssue struct {
+	Key string `json:"key"`
+	Fields struct {
+		Summary string `json:"summary"`
+		// seconds, the subtasks included
+		AggregateTimeSpent int64 `json:"aggregatetimespent"`
+	} `json:"fields"`
+}
+
+// reads the issue key, the summary and the time spent from the rest api
+func fetchWorklogIssue(instance *JiraInstance, issue string) (*worklogIssue, error) {
+	var result worklogIssue
+	path := fmt.Sprintf("/rest/api/2/issue/%s?fields=summary,aggregatetimespent", url.PathEscape(issue))
+	if err := instance.Request("GET", path, nil, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// builds an announcement for the logged work, returns nil if the event is not a new worklog;
+// the worklog events tell the issue id only, the issue is read from the rest api
+func (h *JiraHandler) BuildWorklog(event *jiraevent.Event, instance *JiraInstance) *format.Announcement {
+	if event.WebhookEvent != WORKLOG_EVENT || event.Worklog == nil {
+		return nil
+	}
+
+	issueId := event.Worklog.IssueId.String()
+	if event.Issue != nil {
+		issueId = event.Issue.Key
+	}
+	issue, err := fetchWorklogIssue(instance, issueId)
+	if err != nil {
+		log.Printf("error when reading the issue %s of the worklog: %s\n", issueId, err)
+		return nil
+	}
+
+	announcement := &format.Announcement {
+		Event: WORKLOG_EVENT,
+		Received: time.Now(),
+		Instance: instance.Name,
+		Emoji: ":stopwatch:",
+		Action: fmt.Sprintf("%s of work logged", event.Worklog.TimeSpent),
+		Issue: format.Issue { Key: issue.Key, Url: instance.IssueUrl(issue.Key), Summary: issue.Fields.Summary },
+		Project: format.IssueProject(issue.Key),
+		TimeSpent: format.Hours(issue.Fields.AggregateTimeSpent),
+	}
+	if author := event.Worklog.Author; author != nil {
+		announcement.Actor = author.DisplayName
+		if announcement.Actor == "" {
+			announcement.Actor = author.Name
+		}
+		announcement.ActorMention = h.Users.Lookup(author)
+	}
+
+	return announcement
+}
+
+// adds the total time spent on the issue for the rules showing it
+func (h *JiraHandler) AddTimeSpent(announcement *format.Announcement, instance *JiraInstance) {
+	if announcement.TimeSpent != "" {
+		return
+	}
+
+	wanted := false
+	for _, rule := range h.CurrentRules() {
+		if rule.TimeSpent && !rule.CatchAll && rule.Matches(announcement) {
+			wanted = true
+		}
+	}
+	if !wanted {
+		return
+	}
+
+	issue, err := fetchWorklogIssue(instance, announcement.Issue.Key)
+	if err != nil {
+		log.Printf("error when reading the time spent on %s: %s\n", announcement.Issue.Key, err)
+		return
+	}
+	announcement.TimeSpent = format.Hours(issue.Fields.AggregateTimeSpent)
+}
@@ -0,0 +1,97 @@
+package main
+
+import "fmt"
+import "log"
+import "net/http"
+import "net/url"
+import "strings"
+import "text/template"
+import "ru/wikimart/dataflow/format"
+
+// most characters of a zulip topic
+const ZULIP_TOPIC_LENGTH = 60
+
+// zulip stream message, the stream and the topic are templates over the announcement,
+// so the messages about one issue are grouped in its own topic
+type ZulipDestination struct {
+	DestinationBase
+	// e.g. https://example.zulipchat.com
+	Url string `json:"url"`
+	// the bot email and its api key
+	Email string `json:"email"`
+	ApiKey string `json:"apiKey"`
+	// text/template over the announcement, e.g. "releases-{{.Project}}"
+	StreamTemplate string `json:"stream"`
+	// text/template over the announcement, the issue key by default
+	TopicTemplate string `json:"topic"`
+
+	stream *template.Template
+	topic *template.Template
+}
+
+func init() {
+	RegisterDestination("zulip", func() Destination { return &ZulipDestination{} })
+}
+
+func (d *ZulipDestination) Init() error {
+	if d.Url == "" || d.Email == "" || d.ApiKey == "" {
+		return fmt.Errorf("url, email and apiKey are required")
+	}
+	if d.StreamTemplate == "" {
+		return fmt.Errorf("stream is required")
+	}
+	if d.TopicTemplate == "" {
+		d.TopicTemplate = "{{.Issue.Key}}"
+	}
+
+	var err error
+	if d.stream, err = template.New("stream").Parse(d.StreamTemplate); err != nil {
+		return err
+	}
+	if d.topic, err = template.New("topic").Parse(d.TopicTemplate); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (d *ZulipDestination) Send(announcement *format.Announcement) error {
+	stream, err := executeTemplate(d.stream, announcement)
+	if err != nil {
+		return fmt.Errorf("stream template: %s", err.Error())
+	}
+	topic, err := executeTemplate(d.topic, announcement)
+	if err != nil {
+		return fmt.Errorf("topic template: %s", err.Error())
+	}
+	topic = strings.TrimSpace(topic)
+	if topic == "" {
+		topic = "(no topic)"
+	}
+
+	form := url.Values {
+		"type": { "stream" },
+		"to": { strings.TrimSpace(stream) },
+		"topic": { format.TruncateRunes(topic, ZULIP_TOPIC_LENGTH) },
+		"content": { mentionText(announcement, "@**all**") + announcement.MarkdownText() },
+	}
+	request, err := http.NewRequest("POST", strings.TrimRight(d.Url, "/") + "/api/v1/messages", strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	for name, value := range d.WithHeaders(map[string]string { "Content-Type": "application/x-www-form-urlencoded" }) {
+		request.Header.Set(name, value)
+	}
+	request.SetBasicAuth(d.Email, d.ApiKey)
+
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if err := CheckResponse(response); err != nil {
+		return err
+	}
+
+	log.Printf("posted %s to zulip stream %s, topic %s\n", announcement.Issue.Key, stream, topic)
+	return nil
+}